@@ -0,0 +1,56 @@
+package cbpfc
+
+import (
+	"golang.org/x/net/bpf"
+)
+
+// PacketAccessInfo describes the packet bytes a filter can read.
+type PacketAccessInfo struct {
+	// MaxAbsolute is the largest offset + size of any absolute packet load (LoadAbsolute or LoadMemShift).
+	// The filter never reads past this many bytes with absolute loads.
+	MaxAbsolute uint32
+
+	// Indirect is true IFF the filter has indirect packet loads (relative to RegX).
+	Indirect bool
+
+	// MaxIndirect is the largest offset + size of any indirect packet load, relative to RegX.
+	MaxIndirect uint32
+}
+
+// PacketAccess reports which packet bytes a cBPF filter can read.
+//
+// Only reachable instructions are considered.
+func PacketAccess(insns []bpf.Instruction) (PacketAccessInfo, error) {
+	blocks, err := compile(insns, CompileOpts{})
+	if err != nil {
+		return PacketAccessInfo{}, err
+	}
+
+	return packetAccess(blocks), nil
+}
+
+// packetAccess derives the packet accesses of compiled blocks from their packet guards.
+// A load is always covered by a guard at least as big as it, and guards are only as big as
+// the biggest load they cover, so the biggest guard is the biggest access.
+func packetAccess(blocks []*block) PacketAccessInfo {
+	info := PacketAccessInfo{}
+
+	for _, block := range blocks {
+		for _, insn := range block.insns {
+			switch i := insn.Instruction.(type) {
+			case packetGuardAbsolute:
+				if i.Len > info.MaxAbsolute {
+					info.MaxAbsolute = i.Len
+				}
+			case packetGuardIndirect:
+				info.Indirect = true
+
+				if i.Len > info.MaxIndirect {
+					info.MaxIndirect = i.Len
+				}
+			}
+		}
+	}
+
+	return info
+}
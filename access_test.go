@@ -0,0 +1,63 @@
+package cbpfc
+
+import (
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestPacketAccess(t *testing.T) {
+	info, err := PacketAccess([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 12}, // 14
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 1},
+
+		// block 1
+		/* 2 */ bpf.RetConstant{Val: 0},
+
+		// block 2
+		/* 3 */ bpf.LoadMemShift{Off: 14}, // 15
+		/* 4 */ bpf.LoadIndirect{Size: 2, Off: 16}, // x + 18
+		/* 5 */ bpf.LoadIndirect{Size: 1, Off: 14}, // x + 15
+		/* 6 */ bpf.LoadAbsolute{Size: 4, Off: 26}, // 30
+		/* 7 */ bpf.RetA{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := PacketAccessInfo{
+		MaxAbsolute: 30,
+		Indirect:    true,
+		MaxIndirect: 18,
+	}
+
+	if info != expected {
+		t.Fatalf("expected %+v, got %+v", expected, info)
+	}
+}
+
+func TestPacketAccessAbsolute(t *testing.T) {
+	info, err := PacketAccess([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 23},
+		bpf.RetA{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := PacketAccessInfo{
+		MaxAbsolute: 24,
+	}
+
+	if info != expected {
+		t.Fatalf("expected %+v, got %+v", expected, info)
+	}
+}
+
+func TestPacketAccessInvalid(t *testing.T) {
+	_, err := PacketAccess([]bpf.Instruction{})
+	if err == nil {
+		t.Fatal("invalid filter accepted")
+	}
+}
@@ -10,12 +10,66 @@ import (
 	"golang.org/x/net/bpf"
 )
 
-const funcTemplate = `
+const funcTemplate = `{{.Accessors}}{{if .Segmented}}
+#ifndef CBPFC_SEGMENTS
+#define CBPFC_SEGMENTS
+// Contiguous part of a packet
+struct cbpfc_segment {
+	const uint8_t *data;
+	uint32_t len;
+};
+
+// Length of a packet made of segments
+static inline
+uint64_t cbpfc_segments_len(const struct cbpfc_segment *segs, uint32_t nsegs) {
+	uint64_t len = 0;
+	for (uint32_t i = 0; i < nsegs; i++) {
+		len += segs[i].len;
+	}
+	return len;
+}
+
+// Load size bytes at off of a packet made of segments, in network byte order.
+// The packet has to be at least off + size bytes.
+static inline
+uint32_t cbpfc_segments_load(const struct cbpfc_segment *segs, uint64_t off, uint32_t size) {
+	uint32_t val = 0;
+	for (uint32_t i = 0; i < size; i++, off++) {
+		while (off >= segs->len) {
+			off -= segs->len;
+			segs++;
+		}
+		val = (val << 8) | segs->data[off];
+	}
+	return val;
+}
+#endif
+{{end}}{{template "defines" .}}
 // True if packet matches, false otherwise
 static inline
-uint32_t {{.Name}}(const uint8_t *const data, const uint8_t *const data_end) {
+uint32_t {{.Name}}({{.Params}}) {
 	__attribute__((unused))
 	uint32_t a, x, m[16];
+{{- if .Segmented}}
+
+	__attribute__((unused))
+	const uint64_t len = cbpfc_segments_len(segs, nsegs);
+{{- end}}
+{{- if .Context}}
+
+	__attribute__((unused))
+	const uint8_t *const data = (const uint8_t *) (long) ctx->{{.ContextData}};
+	__attribute__((unused))
+	const uint8_t *const data_end = (const uint8_t *) (long) ctx->{{.ContextDataEnd}};
+{{- end}}
+{{- if .EpilogueLabel}}
+
+	uint32_t result;
+{{- end}}
+{{- if .Prologue}}
+
+{{.Prologue}}
+{{- end}}
 
 {{range $i, $b := .Blocks}}
 {{if $b.IsTarget}}{{$b.Label}}:{{end}}
@@ -23,11 +77,112 @@ uint32_t {{.Name}}(const uint8_t *const data, const uint8_t *const data_end) {
 	{{$s}}
 {{- end}}
 {{end}}
+{{- if .EpilogueLabel}}
+{{.EpilogueLabel}}:
+{{.Epilogue}}
+	return result;
+{{- end}}
 }`
 
+// definesTemplate is the DefinePrefix defines, before the function or macro.
+const definesTemplate = `{{if .DefinePrefix}}
+// Biggest absolute packet guard of {{.Name}}
+#define {{.DefinePrefix}}_MIN_PACKET_LEN {{.MinPacketLen}}
+{{if .Access.Indirect}}// {{.Name}} has indirect packet loads, up to x + {{.Access.MaxIndirect}}
+{{else}}// {{.Name}} has no indirect packet loads
+{{end}}{{end}}`
+
+// macroTemplate is the body of the macro, every line but the last is continued by macroToC.
+const macroTemplate = `#define {{.Name}}(packet, len, result) do {
+	const uint8_t *const cbpfc_packet = (const uint8_t *) (packet);
+	const uint8_t *const cbpfc_packet_end = cbpfc_packet + (len);
+	uint32_t *const cbpfc_result = &(result);
+
+	__attribute__((unused))
+	uint32_t a, x, m[16];
+	__attribute__((unused))
+	const uint8_t *const data = cbpfc_packet;
+	__attribute__((unused))
+	const uint8_t *const data_end = cbpfc_packet_end;
+{{range $i, $b := .Blocks}}
+{{if $b.IsTarget}}{{$b.Label}}:{{end}}
+{{- range $i, $s := $b.Statements}}
+	{{$s}}
+{{- end}}
+{{end}}
+} while (0)`
+
+// cAccessors read from the packet for ReadAccessors, checking the read is in the packet.
+const cAccessors = `
+#ifndef CBPFC_READ
+#define CBPFC_READ
+// Length of a packet from a signed PacketLength, negative lengths are empty.
+static inline
+uint64_t cbpfc_len(const int64_t len) {
+	return len < 0 ? 0 : (uint64_t) len;
+}
+
+// Read 1, 2 or 4 bytes at off of a packet of len bytes into val, in network byte order.
+// Return 0 if the packet is too short, and 1 otherwise.
+static inline
+int cbpfc_read_u8(const uint8_t *const packet, const uint64_t len, const uint64_t off, uint32_t *const val) {
+	if (off + 1 > len) {
+		return 0;
+	}
+	*val = packet[off];
+	return 1;
+}
+
+static inline
+int cbpfc_read_u16(const uint8_t *const packet, const uint64_t len, const uint64_t off, uint32_t *const val) {
+	if (off + 2 > len) {
+		return 0;
+	}
+	*val = (uint32_t) packet[off] << 8 | packet[off + 1];
+	return 1;
+}
+
+static inline
+int cbpfc_read_u32(const uint8_t *const packet, const uint64_t len, const uint64_t off, uint32_t *const val) {
+	if (off + 4 > len) {
+		return 0;
+	}
+	*val = (uint32_t) packet[off] << 24 | (uint32_t) packet[off + 1] << 16 | (uint32_t) packet[off + 2] << 8 | packet[off + 3];
+	return 1;
+}
+#endif
+`
+
+// cMacroLabel pastes the line a macro is expanded on to labels, so they're unique to each expansion.
+const cMacroLabel = `
+#ifndef CBPFC_MACRO_LABEL
+#define CBPFC_MACRO_LABEL_(name, line) name##_##line
+#define CBPFC_MACRO_LABEL__(name, line) CBPFC_MACRO_LABEL_(name, line)
+#define CBPFC_MACRO_LABEL(name) CBPFC_MACRO_LABEL__(name, __LINE__)
+#endif
+`
+
 type cFunction struct {
 	Name   string
+	Params string
 	Blocks []cBlock
+
+	Segmented bool
+
+	// Context, ContextData and ContextDataEnd are set if data and data_end are read from fields of ctx
+	Context, ContextData, ContextDataEnd string
+
+	DefinePrefix string
+	Access       PacketAccessInfo
+
+	// MinPacketLen is the biggest absolute packet guard, including the trailer
+	MinPacketLen uint64
+
+	// Prologue and Epilogue are indented, EpilogueLabel is set if there is an Epilogue
+	Prologue, Epilogue, EpilogueLabel string
+
+	// Accessors are the definitions of the ReadAccessors, if used
+	Accessors string
 }
 
 // cBPF reg to C symbol
@@ -68,40 +223,391 @@ var funcNameRegex = regexp.MustCompile(`^[A-Za-z_][0-9A-Za-z_]*$`)
 type cBlock struct {
 	*block
 
+	// Label of the block, with the prefix
+	Label string
+
 	Statements []string
 }
 
 type COpts struct {
-	// FunctionName is the symbol to use as the generated C function. Must match regex:
+	CompileOpts
+
+	// FunctionName is the symbol to use as the generated C function, Name if not set. Must match regex:
 	//     [A-Za-z_][0-9A-Za-z_]*
 	FunctionName string
+
+	// LabelPrefix is the prefix to prepend to labels used internally, if set.
+	// Must match the same regex as FunctionName.
+	LabelPrefix string
+
+	// DefinePrefix, if set, emits a DefinePrefix_MIN_PACKET_LEN define before the function,
+	// the length of the biggest absolute packet guard, and a comment saying if the filter has indirect packet loads.
+	// With SingleGuard and no indirect packet loads, shorter packets never match.
+	// Must match the same regex as FunctionName.
+	DefinePrefix string
+
+	// PacketLength, if set, is a C expression of the length of the packet that packet guards compare against,
+	// instead of comparing pointers to data_end. eg (int64_t) ctx_len(ctx) - ETH_HLEN.
+	// It is compared as a signed 64 bit integer, so a negative length fails every guard.
+	// Unsigned arithmetic wraps instead of going negative: convert to a signed type before subtracting.
+	// It is evaluated in the generated function, so it can use data, data_end, globals and macros.
+	// Must be a single expression: parentheses must balance, and it can't contain ; { } , # quotes, backslashes or comments.
+	PacketLength string
+
+	// BasePointer generates a function that reads the packet from len bytes at base, with a signature of:
+	//
+	//     uint32_t opts.FunctionName(const void *const base, const uint32_t len)
+	//
+	// Loads are from offsets of base, and use __builtin_bswap16 / __builtin_bswap32 for network byte order:
+	// the host has to be little endian unless HostByteOrder is set.
+	// Guards compare against len, so PacketLength can't be set.
+	BasePointer bool
+
+	// Segmented generates a function that reads the packet from nsegs segments, with a signature of:
+	//
+	//     uint32_t opts.FunctionName(const struct cbpfc_segment *const segs, const uint32_t nsegs)
+	//
+	// Where struct cbpfc_segment, defined before the function, is a pointer to part of the packet and its length:
+	//
+	//     struct cbpfc_segment {
+	//         const uint8_t *data;
+	//         uint32_t len;
+	//     };
+	//
+	// Guards compare against the total length of the segments, and loads can span segments.
+	// It's only for userspace: loads loop over the segments.
+	// BasePointer, PacketLength and HostByteOrder can't be set.
+	Segmented bool
+
+	// Context generates a function that reads the packet from the data and data_end fields of a context struct,
+	// eg "struct xdp_md" or "struct __sk_buff", with a signature of:
+	//
+	//     uint32_t opts.FunctionName(opts.Context *const ctx)
+	//
+	// The fields are cast to pointers once, at the start of the function: guards and loads are the same as the default signature.
+	// Must be a type name, optionally prefixed by struct or union.
+	// BasePointer and Segmented can't be set.
+	Context string
+
+	// ContextData and ContextDataEnd are the fields of Context that point to the start and end of the packet,
+	// "data" and "data_end" if not set. Only used with Context.
+	// Must be member accesses, eg "data" or "hdr.data".
+	ContextData, ContextDataEnd string
+
+	// Prologue is C spliced into the generated function before the filter, after a, x, m[] and any locals are declared.
+	// Epilogue is C spliced at the end of the function: returns set the uint32_t result to the return value,
+	// and goto the Epilogue, which then returns result. It can read and modify result.
+	//
+	// Labels in them can't be the filter's labels (block_N and epilogue, prefixed by LabelPrefix if set).
+	Prologue, Epilogue string
+
+	// Macro generates a statement-like macro instead of a function, to inline the filter in a bigger function:
+	//
+	//     #define opts.FunctionName(packet, len, result) do { ... } while (0)
+	//
+	// packet is a pointer to len bytes of packet, and the uint32_t variable result is set to the filter's return value.
+	// Returns break out of the loop. Every argument is evaluated once, before the filter runs.
+	// Labels have the line the macro is expanded on appended, so it can only be expanded once per line.
+	// Comments can't contain */. BasePointer, Segmented, Context, Metadata, Prologue and Epilogue can't be set.
+	Macro bool
+
+	// ReadAccessors reads the packet only through accessors that check every read is in the packet,
+	// defined before the function:
+	//
+	//     int cbpfc_read_u8(const uint8_t *const packet, const uint64_t len, const uint64_t off, uint32_t *const val)
+	//
+	// And cbpfc_read_u16 and cbpfc_read_u32 for 2 and 4 bytes.
+	// A read past the end of the packet returns GuardFailureValue, like a failed guard: packet guards aren't emitted.
+	// It's a single read path that's easy to audit, but slower, and the eBPF verifier doesn't accept it.
+	// Segmented, HostByteOrder, Trailer, SingleGuard and HoistGuards can't be set.
+	ReadAccessors bool
+}
+
+// cContextRegex and cMemberRegex match the type of Context, and the members of ContextData and ContextDataEnd.
+var (
+	cContextRegex = regexp.MustCompile(`^((struct|union) )?[A-Za-z_][0-9A-Za-z_]*$`)
+	cMemberRegex  = regexp.MustCompile(`^[A-Za-z_][0-9A-Za-z_]*(\.[A-Za-z_][0-9A-Za-z_]*)*$`)
+)
+
+// contextFields are the ContextData and ContextDataEnd fields, with their defaults.
+func (c COpts) contextFields() (string, string, error) {
+	data, dataEnd := c.ContextData, c.ContextDataEnd
+	if data == "" {
+		data = "data"
+	}
+	if dataEnd == "" {
+		dataEnd = "data_end"
+	}
+
+	for _, field := range []string{data, dataEnd} {
+		if !cMemberRegex.MatchString(field) {
+			return "", "", errors.Errorf("invalid context field %s", field)
+		}
+	}
+
+	return data, dataEnd, nil
+}
+
+// cDataParams, cBaseParams and cSegsParams are the parameters of the generated function, cMetaParams are added with Metadata.
+const (
+	cDataParams = "const uint8_t *const data, const uint8_t *const data_end"
+	cBaseParams = "const void *const base, const uint32_t len"
+	cSegsParams = "const struct cbpfc_segment *const segs, const uint32_t nsegs"
+	cMetaParams = "const uint8_t *const meta, const uint8_t *const meta_end"
+)
+
+// packetPtr is a C uint8_t pointer to offset bytes into the packet.
+func (c COpts) packetPtr(offset string) string {
+	if c.BasePointer {
+		return "(const uint8_t *) base + " + offset
+	}
+
+	return "data + " + offset
+}
+
+// cExpressionInvalid are strings C expressions can't contain, to prevent them from ending the expression.
+var cExpressionInvalid = []string{";", "{", "}", ",", "#", "\"", "'", "\\", "//", "/*", "\n", "\r"}
+
+// validateCExpression checks expr is a single C expression.
+func validateCExpression(expr string) error {
+	if strings.TrimSpace(expr) == "" {
+		return errors.New("empty expression")
+	}
+
+	for _, invalid := range cExpressionInvalid {
+		if strings.Contains(expr, invalid) {
+			return errors.Errorf("expression %s contains %q", expr, invalid)
+		}
+	}
+
+	depth := 0
+	for _, c := range expr {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+
+		if depth < 0 {
+			return errors.Errorf("expression %s has unbalanced parentheses", expr)
+		}
+	}
+
+	if depth != 0 {
+		return errors.Errorf("expression %s has unbalanced parentheses", expr)
+	}
+
+	return nil
+}
+
+// ret returns val from the filter, through the Epilogue if there is one.
+func (c COpts) ret(val interface{}) string {
+	if c.Macro {
+		return fmt.Sprintf("{ *cbpfc_result = %v; break; }", val)
+	}
+
+	if c.Epilogue == "" {
+		return fmt.Sprintf("return %v;", val)
+	}
+
+	return fmt.Sprintf("{ result = %v; goto %s; }", val, c.label(epilogueLabel))
+}
+
+// indentC indents every line of C by a tab.
+func indentC(c string) string {
+	lines := strings.Split(strings.TrimRight(c, "\n"), "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = "\t" + line
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (c COpts) label(name string) string {
+	if c.LabelPrefix != "" {
+		name = fmt.Sprintf("%s_%s", c.LabelPrefix, name)
+	}
+
+	if c.Macro {
+		return fmt.Sprintf("CBPFC_MACRO_LABEL(%s)", name)
+	}
+
+	return name
+}
+
+// cComment is a comment at the end of a line of C.
+// Line comments would swallow the continuation of macro lines.
+func (c COpts) cComment(comment string) string {
+	if c.Macro {
+		return " /* " + comment + " */"
+	}
+
+	return " // " + comment
 }
 
 // ToC compiles a cBPF filter to a C function with a signature of:
 //
 //     uint32_t opts.FunctionName(const uint8_t *const data, const uint8_t *const data_end)
 //
+// Or, with opts.BasePointer:
+//
+//     uint32_t opts.FunctionName(const void *const base, const uint32_t len)
+//
+// Or, with opts.Segmented:
+//
+//     uint32_t opts.FunctionName(const struct cbpfc_segment *const segs, const uint32_t nsegs)
+//
+// Or, with opts.Context:
+//
+//     uint32_t opts.FunctionName(opts.Context *const ctx)
+//
+// With a Metadata region, the function has two more parameters, the start and end of the metadata buffer:
+//
+//     uint32_t opts.FunctionName(..., const uint8_t *const meta, const uint8_t *const meta_end)
+//
+// Metadata isn't supported with BasePointer or Segmented.
+//
 // The function returns the filter's return value:
 // 0 if the packet does not match the cBPF filter,
 // non 0 if the packet does match.
+// Like ToEBPF, the value is the one the filter returns unchanged, eg a snap length,
+// and packets too short for a load return GuardFailureValue.
 func ToC(filter []bpf.Instruction, opts COpts) (string, error) {
-	if !funcNameRegex.MatchString(opts.FunctionName) {
-		return "", errors.Errorf("invalid FunctioName %s", opts.FunctionName)
+	name, err := opts.symbol(opts.FunctionName, "FunctionName")
+	if err != nil {
+		return "", err
+	}
+
+	if opts.LabelPrefix != "" && !funcNameRegex.MatchString(opts.LabelPrefix) {
+		return "", errors.Errorf("invalid LabelPrefix %s", opts.LabelPrefix)
+	}
+
+	if opts.DefinePrefix != "" && !funcNameRegex.MatchString(opts.DefinePrefix) {
+		return "", errors.Errorf("invalid DefinePrefix %s", opts.DefinePrefix)
+	}
+
+	if opts.BasePointer && opts.PacketLength != "" {
+		return "", errors.New("BasePointer and PacketLength are exclusive")
+	}
+
+	if opts.Segmented && (opts.BasePointer || opts.PacketLength != "" || opts.HostByteOrder) {
+		return "", errors.New("Segmented can't be used with BasePointer, PacketLength or HostByteOrder")
+	}
+
+	if opts.Context != "" {
+		if opts.BasePointer || opts.Segmented {
+			return "", errors.New("Context can't be used with BasePointer or Segmented")
+		}
+
+		if !cContextRegex.MatchString(opts.Context) || opts.Context == "struct" || opts.Context == "union" {
+			return "", errors.Errorf("invalid Context %s", opts.Context)
+		}
+	} else if opts.ContextData != "" || opts.ContextDataEnd != "" {
+		return "", errors.New("ContextData and ContextDataEnd need Context")
+	}
+
+	if opts.Metadata.Len != 0 && (opts.BasePointer || opts.Segmented) {
+		return "", errors.New("Metadata can't be used with BasePointer or Segmented")
+	}
+
+	if opts.Macro {
+		if opts.BasePointer || opts.Segmented || opts.Context != "" || opts.Metadata.Len != 0 || opts.Prologue != "" || opts.Epilogue != "" {
+			return "", errors.New("Macro can't be used with BasePointer, Segmented, Context, Metadata, Prologue or Epilogue")
+		}
+
+		for pc, comment := range opts.Comments {
+			if strings.Contains(comment, "*/") {
+				return "", errors.Errorf("comment of instruction %d contains */", pc)
+			}
+		}
+	}
+
+	if opts.ReadAccessors && (opts.Segmented || opts.HostByteOrder || opts.Trailer != 0 || opts.SingleGuard || opts.HoistGuards) {
+		return "", errors.New("ReadAccessors can't be used with Segmented, HostByteOrder, Trailer, SingleGuard or HoistGuards")
 	}
 
-	blocks, err := compile(filter)
+	if opts.PacketLength != "" {
+		if err := validateCExpression(opts.PacketLength); err != nil {
+			return "", errors.Wrap(err, "invalid PacketLength")
+		}
+	}
+
+	// a, x and m[] are local to the generated function, callers can't initialize them
+	if len(opts.InitializedRegs) != 0 || len(opts.InitializedScratch) != 0 {
+		return "", errors.New("InitializedRegs and InitializedScratch not supported")
+	}
+
+	blocks, err := compile(filter, opts.CompileOpts)
 	if err != nil {
 		return "", err
 	}
 
+	// Accessors check every read instead
+	if opts.ReadAccessors {
+		removePacketGuards(blocks)
+	}
+
+	// Range checks are a single condition, and switch chains a single switch.
+	// Their inner blocks don't need to be emitted.
+	ranges := rangeChecks(blocks)
+	chains := switchChains(blocks)
+
+	emitted := make([]*block, 0, len(blocks))
+	for _, block := range blocks {
+		if !isInnerBlock(ranges, block) && !isSwitchInnerBlock(chains, block) {
+			emitted = append(emitted, block)
+		}
+	}
+
 	fun := cFunction{
-		Name:   opts.FunctionName,
-		Blocks: make([]cBlock, len(blocks)),
+		Name:   name,
+		Params: cDataParams,
+		Blocks: make([]cBlock, len(emitted)),
+
+		DefinePrefix: opts.DefinePrefix,
+		Access:       packetAccess(blocks),
+	}
+	fun.MinPacketLen = opts.guardLen(fun.Access.MaxAbsolute)
+
+	if opts.ReadAccessors {
+		fun.Accessors = cAccessors
+	}
+
+	if opts.BasePointer {
+		fun.Params = cBaseParams
+	}
+
+	if opts.Segmented {
+		fun.Params = cSegsParams
+		fun.Segmented = true
+	}
+
+	if opts.Context != "" {
+		fun.Params = fmt.Sprintf("%s *const ctx", opts.Context)
+		fun.Context = opts.Context
+
+		fun.ContextData, fun.ContextDataEnd, err = opts.contextFields()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	fun.Prologue = indentC(opts.Prologue)
+	if opts.Epilogue != "" {
+		fun.Epilogue = indentC(opts.Epilogue)
+		fun.EpilogueLabel = opts.label(epilogueLabel)
+	}
+
+	if opts.Metadata.Len != 0 {
+		fun.Params += ", " + cMetaParams
 	}
 
 	// Compile blocks to C
-	for i, block := range blocks {
-		fun.Blocks[i], err = blockToC(block)
+	for i, block := range emitted {
+		fun.Blocks[i], err = blockToC(block, nextBlock(emitted, i), ranges[block], chains[block], opts)
 		if err != nil {
 			return "", err
 		}
@@ -109,10 +615,20 @@ func ToC(filter []bpf.Instruction, opts COpts) (string, error) {
 
 	// Fill in the template
 	tmpl, err := template.New("cbfp_func").Parse(funcTemplate)
+	if err == nil {
+		_, err = tmpl.New("defines").Parse(definesTemplate)
+	}
+	if err == nil {
+		_, err = tmpl.New("macro").Parse(macroTemplate)
+	}
 	if err != nil {
 		return "", errors.Wrapf(err, "unable to parse func template")
 	}
 
+	if opts.Macro {
+		return macroToC(tmpl, fun)
+	}
+
 	c := strings.Builder{}
 
 	if err := tmpl.Execute(&c, fun); err != nil {
@@ -122,27 +638,94 @@ func ToC(filter []bpf.Instruction, opts COpts) (string, error) {
 	return c.String(), nil
 }
 
+// macroToC fills in the macro template, continuing every line of the macro.
+func macroToC(tmpl *template.Template, fun cFunction) (string, error) {
+	c := strings.Builder{}
+	c.WriteString(fun.Accessors)
+	c.WriteString(cMacroLabel)
+
+	if err := tmpl.ExecuteTemplate(&c, "defines", fun); err != nil {
+		return "", errors.Wrapf(err, "unable to execute defines template")
+	}
+
+	body := strings.Builder{}
+	if err := tmpl.ExecuteTemplate(&body, "macro", fun); err != nil {
+		return "", errors.Wrapf(err, "unable to execute macro template")
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(body.String(), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	c.WriteString("\n// Sets result to the filter's return value: 0 if the packet doesn't match, non 0 if it does\n")
+	c.WriteString(strings.Join(lines, " \\\n"))
+
+	return c.String(), nil
+}
+
 // blockToC compiles a block to C.
-func blockToC(blk *block) (cBlock, error) {
+// next is the block laid out after blk, nil if blk is the last block.
+// rng is the range check blk is the outer block of, nil if none.
+// chain is the switch chain blk is the head of, nil if none.
+func blockToC(blk *block, next *block, rng *rangeCheck, chain *switchChain, opts COpts) (cBlock, error) {
 	cBlk := cBlock{
 		block:      blk,
+		Label:      opts.label(blk.Label()),
 		Statements: make([]string, len(blk.insns)),
 	}
 
 	for i, insn := range blk.insns {
-		stat, err := insnToC(insn, blk)
+		// Last instruction is the first test of the range
+		if rng != nil && i == len(blk.insns)-1 {
+			stat := rangeToC(opts, rng, next)
+
+			// Both tests are emitted as a single statement
+			comments := []string{}
+			for _, test := range []instruction{insn, rng.inner.last()} {
+				if comment, ok := opts.comment(test); ok {
+					comments = append(comments, comment)
+				}
+			}
+
+			if len(comments) != 0 {
+				stat += opts.cComment(strings.Join(comments, "; "))
+			}
+
+			cBlk.Statements[i] = stat
+			continue
+		}
+
+		// Last instruction is the first test of the chain
+		if chain != nil && i == len(blk.insns)-1 {
+			cBlk.Statements[i] = switchToC(opts, chain, next)
+			continue
+		}
+
+		stat, err := insnToC(insn, blk, next, opts)
 		if err != nil {
 			return cBlk, errors.Wrapf(err, "unable to compile %v", insn)
 		}
 
+		if comment, ok := opts.comment(insn); ok {
+			stat += opts.cComment(comment)
+		}
+
 		cBlk.Statements[i] = stat
 	}
 
+	// Block isn't laid out before the block it falls through to
+	if ft := blk.fallthroughBlock(); ft != nil && ft != next {
+		cBlk.Statements = append(cBlk.Statements, fmt.Sprintf("goto %s;", opts.label(ft.jumpTarget().Label())))
+	}
+
 	return cBlk, nil
 }
 
 // insnToC compiles an instruction to a single C line / statement.
-func insnToC(insn instruction, blk *block) (string, error) {
+func insnToC(insn instruction, blk *block, next *block, opts COpts) (string, error) {
 	switch i := insn.Instruction.(type) {
 
 	case bpf.LoadConstant:
@@ -150,78 +733,214 @@ func insnToC(insn instruction, blk *block) (string, error) {
 	case bpf.LoadScratch:
 		return stat("%s = m[%d];", regToCSym[i.Dst], i.N)
 	case bpf.LoadAbsolute:
-		return packetLoadToC(i.Size, "data + %d", i.Off)
+		if opts.Segmented {
+			return stat("a = cbpfc_segments_load(segs, %d, %d);", i.Off, i.Size)
+		}
+		if opts.ReadAccessors {
+			return opts.readToC("a", i.Size, fmt.Sprintf("%d", i.Off))
+		}
+		return packetLoadToC(opts, i.Size, opts.packetPtr(fmt.Sprintf("%d", i.Off)))
+	case loadMetadata:
+		return packetLoadToC(opts, i.Size, fmt.Sprintf("meta + %d", i.Off))
 	case bpf.LoadIndirect:
-		return packetLoadToC(i.Size, "data + x + %d", i.Off)
+		if opts.Segmented {
+			return stat("a = cbpfc_segments_load(segs, (uint64_t) x + %d, %d);", i.Off, i.Size)
+		}
+		if opts.ReadAccessors {
+			return opts.readToC("a", i.Size, fmt.Sprintf("(uint64_t) x + %d", i.Off))
+		}
+		return packetLoadToC(opts, i.Size, opts.packetPtr(fmt.Sprintf("x + %d", i.Off)))
+	case bpf.LoadExtension:
+		switch {
+		case opts.BasePointer || opts.Segmented:
+			return stat("a = (uint32_t) len;")
+		case opts.PacketLength != "":
+			return stat("a = (uint32_t) (%s);", opts.PacketLength)
+		}
+		return stat("a = (uint32_t) (data_end - data);")
 	case bpf.LoadMemShift:
-		return stat("x = 4*(*(data + %d) & 0xf);", i.Off)
+		if opts.Segmented {
+			return stat("x = 4*(cbpfc_segments_load(segs, %d, 1) & 0xf);", i.Off)
+		}
+		if opts.ReadAccessors {
+			read, err := opts.readToC("x", 1, fmt.Sprintf("%d", i.Off))
+			return read + "\n\tx = 4*(x & 0xf);", err
+		}
+		return stat("x = 4*(*(%s) & 0xf);", opts.packetPtr(fmt.Sprintf("%d", i.Off)))
 
 	case bpf.StoreScratch:
 		return stat("m[%d] = %s;", i.N, regToCSym[i.Src])
 
+	// C shifts of 32 or more are undefined, cBPF's are 0
 	case bpf.ALUOpConstant:
-		return stat("a %s= %d;", aluToCOp[i.Op], i.Val)
+		op, ok := aluToCOp[i.Op]
+		if !ok {
+			return "", errors.Errorf("unsupported instruction %v", insn)
+		}
+		if isShift(i.Op) && i.Val >= 32 {
+			return stat("a = 0;")
+		}
+		return stat("a %s= %d;", op, i.Val)
 	case bpf.ALUOpX:
-		return stat("a %s= x;", aluToCOp[i.Op])
+		op, ok := aluToCOp[i.Op]
+		if !ok {
+			return "", errors.Errorf("unsupported instruction %v", insn)
+		}
+		if isShift(i.Op) {
+			return stat("a = x < 32 ? a %s x : 0;", op)
+		}
+		return stat("a %s= x;", op)
 	case bpf.NegateA:
 		return stat("a = -a;")
 
 	case bpf.Jump:
-		return stat("goto %s;", blk.skipToBlock(skip(i.Skip)).Label())
+		return stat("goto %s;", opts.label(blk.skipToBlock(skip(i.Skip)).jumpTarget().Label()))
 	case bpf.JumpIf:
-		return condToC(skip(i.SkipTrue), skip(i.SkipFalse), blk, condToCFmt[i.Cond], i.Val)
+		return condToC(opts, skip(i.SkipTrue), skip(i.SkipFalse), blk, next, condToCFmt[i.Cond], i.Val)
 	case bpf.JumpIfX:
-		return condToC(skip(i.SkipTrue), skip(i.SkipFalse), blk, condToCFmt[i.Cond], "x")
+		return condToC(opts, skip(i.SkipTrue), skip(i.SkipFalse), blk, next, condToCFmt[i.Cond], "x")
 
 	case bpf.RetA:
-		return stat("return a;")
+		return stat("%s", opts.ret("a"))
 	case bpf.RetConstant:
-		return stat("return %d;", i.Val)
+		return stat("%s", opts.ret(i.Val))
 
 	case bpf.TXA:
 		return stat("a = x;")
 	case bpf.TAX:
 		return stat("x = a;")
 
+	// The eBPF verifier doesn't allow arithmetic on data_end, so guards compare pointers unless PacketLength is set.
+	// Pointer arithmetic is 64 bits, like the casts, x + Len can't overflow.
 	case packetGuardAbsolute:
-		return stat("if (data + %d > data_end) return 0;", i.Len)
+		if opts.BasePointer || opts.Segmented {
+			return stat("if (len < %d) %s", opts.guardLen(i.Len), opts.ret(opts.GuardFailureValue))
+		}
+		if opts.PacketLength != "" {
+			return stat("if ((int64_t) (%s) < %d) %s", opts.PacketLength, opts.guardLen(i.Len), opts.ret(opts.GuardFailureValue))
+		}
+		return stat("if (data + %d > data_end) %s", opts.guardLen(i.Len), opts.ret(opts.GuardFailureValue))
 	case packetGuardIndirect:
-		return stat("if (data + x + %d > data_end) return 0;", i.Len)
+		if opts.BasePointer || opts.Segmented {
+			return stat("if (len < (uint64_t) x + %d) %s", opts.guardLen(i.Len), opts.ret(opts.GuardFailureValue))
+		}
+		if opts.PacketLength != "" {
+			return stat("if ((int64_t) (%s) < (int64_t) x + %d) %s", opts.PacketLength, opts.guardLen(i.Len), opts.ret(opts.GuardFailureValue))
+		}
+		// Bounding x lets the verifier learn the range of data + x, packets can't be longer than maxPacketOffset anyways
+		if opts.guardLen(i.Len) > maxPacketOffset {
+			return "", errors.Errorf("packet guard of x + %d bytes too big", opts.guardLen(i.Len))
+		}
+		return stat("if (x > %d || data + x + %d > data_end) %s", maxPacketOffset-opts.guardLen(i.Len), opts.guardLen(i.Len), opts.ret(opts.GuardFailureValue))
 
+	case metadataGuard:
+		return stat("if (meta + %d > meta_end) %s", i.Len, opts.ret(opts.GuardFailureValue))
+
+	case initializeRegister:
+		return stat("%s = 0;", regToCSym[i.Reg])
 	case initializeScratch:
 		return stat("m[%d] = 0;", i.N)
 
 	case checkXNotZero:
-		return stat("if (x == 0) return 0;")
+		return stat("if (x == 0) %s", opts.ret(0))
 
 	default:
 		return "", errors.Errorf("unsupported instruction %v", insn)
 	}
 }
 
-func packetLoadToC(size int, offsetFmt string, offsetArgs ...interface{}) (string, error) {
-	offset := fmt.Sprintf(offsetFmt, offsetArgs...)
+// readToC reads size bytes at offset of the packet into reg with the ReadAccessors.
+func (c COpts) readToC(reg string, size int, offset string) (string, error) {
+	packet, length := "data", "(uint64_t) (data_end - data)"
+	switch {
+	case c.BasePointer:
+		packet, length = "(const uint8_t *) base", "len"
+	case c.PacketLength != "":
+		length = fmt.Sprintf("cbpfc_len(%s)", c.PacketLength)
+	}
+
+	return stat("if (!cbpfc_read_u%d(%s, %s, %s, &%s)) %s", 8*size, packet, length, offset, reg, c.ret(c.GuardFailureValue))
+}
+
+// packetLoadToC loads size bytes from ptr, a uint8_t pointer into the packet, into a.
+func packetLoadToC(opts COpts, size int, ptr string) (string, error) {
+	ntohs, ntohl := "ntohs", "ntohl"
+	if opts.BasePointer {
+		ntohs, ntohl = "__builtin_bswap16", "__builtin_bswap32"
+	}
+	if opts.HostByteOrder {
+		ntohs, ntohl = "", ""
+	}
+
+	// base is const, the pointers need to be too
+	qualifier := ""
+	if opts.BasePointer {
+		qualifier = "const "
+	}
 
 	switch size {
 	case 1:
-		return stat("a = *(%s);", offset)
+		return stat("a = *(%s);", ptr)
 	case 2:
-		return stat("a = ntohs(*((uint16_t *) (%s)));", offset)
+		return stat("a = %s(*((%suint16_t *) (%s)));", ntohs, qualifier, ptr)
 	case 4:
-		return stat("a = ntohl(*((uint32_t *) (%s)));", offset)
+		return stat("a = %s(*((%suint32_t *) (%s)));", ntohl, qualifier, ptr)
 	}
 
 	return "", errors.Errorf("unsupported load size %d", size)
 }
 
-func condToC(skipTrue, skipFalse skip, blk *block, condFmt string, condArgs ...interface{}) (string, error) {
+func condToC(opts COpts, skipTrue, skipFalse skip, blk *block, next *block, condFmt string, condArgs ...interface{}) (string, error) {
 	cond := fmt.Sprintf(condFmt, condArgs...)
 
-	if skipFalse == 0 {
-		return stat("if (%s) goto %s;", cond, blk.skipToBlock(skipTrue).Label())
+	trueBlk := blk.skipToBlock(skipTrue).jumpTarget()
+	falseBlk := blk.skipToBlock(skipFalse)
+
+	// false falls through to the next block
+	if skipFalse == 0 && falseBlk == next {
+		return stat("if (%s) goto %s;", cond, opts.label(trueBlk.Label()))
 	}
 
-	return stat("if (%s) goto %s; else goto %s;", cond, blk.skipToBlock(skipTrue).Label(), blk.skipToBlock(skipFalse).Label())
+	return stat("if (%s) goto %s; else goto %s;", cond, opts.label(trueBlk.Label()), opts.label(falseBlk.jumpTarget().Label()))
+}
+
+// rangeToC compiles both tests of a range check to a single condition.
+func rangeToC(opts COpts, rng *rangeCheck, next *block) string {
+	cond := fmt.Sprintf(condToCFmt[rng.lower.Cond]+" && "+condToCFmt[rng.upper.Cond], rng.lower.Val, rng.upper.Val)
+
+	trueLabel := opts.label(rng.trueBlk.jumpTarget().Label())
+
+	// false falls through to the next block
+	if rng.falseBlk == next {
+		return fmt.Sprintf("if (%s) goto %s;", cond, trueLabel)
+	}
+
+	return fmt.Sprintf("if (%s) goto %s; else goto %s;", cond, trueLabel, opts.label(rng.falseBlk.jumpTarget().Label()))
+}
+
+// switchToC compiles all the tests of a switch chain to a single switch statement.
+// Comments of the tests are on their cases.
+func switchToC(opts COpts, chain *switchChain, next *block) string {
+	lines := []string{"switch (a) {"}
+
+	for _, c := range chain.cases {
+		line := fmt.Sprintf("case %d: goto %s;", c.val, opts.label(c.target.jumpTarget().Label()))
+
+		if comment, ok := opts.comment(c.test); ok {
+			line += opts.cComment(comment)
+		}
+
+		lines = append(lines, line)
+	}
+
+	// default falls through to the next block
+	if chain.defaultBlk != next {
+		lines = append(lines, fmt.Sprintf("default: goto %s;", opts.label(chain.defaultBlk.jumpTarget().Label())))
+	}
+
+	lines = append(lines, "}")
+
+	return strings.Join(lines, "\n\t")
 }
 
 func stat(format string, a ...interface{}) (string, error) {
@@ -108,15 +108,9 @@ func buildC(filter []bpf.Instruction, programName string) ([]byte, error) {
 		return nil, errors.Wrap(err, "executing template with C filter")
 	}
 
-	// lookup clang binary to use
-	clangBin, ok := os.LookupEnv("CLANG")
-	if !ok {
-		clangBin = "/usr/bin/clang"
-	}
-
 	// compile C program
 	elf, err := clang.Compile(c.Bytes(), entryPoint, clang.Opts{
-		Clang: clangBin,
+		Clang: clangBin(),
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "compiling C")
@@ -124,3 +118,13 @@ func buildC(filter []bpf.Instruction, programName string) ([]byte, error) {
 
 	return elf, nil
 }
+
+// clangBin is the clang binary to use, $CLANG or /usr/bin/clang.
+func clangBin() string {
+	bin, ok := os.LookupEnv("CLANG")
+	if !ok {
+		return "/usr/bin/clang"
+	}
+
+	return bin
+}
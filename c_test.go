@@ -2,8 +2,19 @@ package cbpfc
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/cloudflare/cbpfc/clang"
 	"github.com/newtools/ebpf"
 	"golang.org/x/net/bpf"
 )
@@ -50,3 +61,1075 @@ func loadC(tb testing.TB, insns []bpf.Instruction) *ebpf.ProgramSpec {
 
 	return spec.Programs[entryPoint]
 }
+
+func TestSingleInstructionC(t *testing.T) {
+	check := func(t *testing.T, insn bpf.Instruction, expected string) {
+		t.Helper()
+
+		c, err := ToC([]bpf.Instruction{insn}, COpts{
+			FunctionName: "filter",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(c, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, c)
+		}
+	}
+
+	check(t, bpf.RetConstant{Val: 0}, "\treturn 0;\n")
+	check(t, bpf.RetConstant{Val: 1}, "\treturn 1;\n")
+	check(t, bpf.RetA{}, "\ta = 0;\n\treturn a;\n")
+
+	_, err := ToC([]bpf.Instruction{bpf.LoadAbsolute{Size: 1, Off: 0}}, COpts{
+		FunctionName: "filter",
+	})
+	if err == nil {
+		t.Fatal("single load compiled")
+	}
+}
+
+func TestInitializedC(t *testing.T) {
+	_, err := ToC([]bpf.Instruction{bpf.RetA{}}, COpts{
+		CompileOpts: CompileOpts{
+			InitializedRegs: []bpf.Register{bpf.RegA},
+		},
+		FunctionName: "filter",
+	})
+	if err == nil {
+		t.Fatal("initialized registers accepted")
+	}
+}
+
+func TestLabelPrefixC(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1, SkipFalse: 0},
+		bpf.Jump{Skip: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	}
+
+	labelRegex := regexp.MustCompile(`(?m)^(\w+):$`)
+	gotoRegex := regexp.MustCompile(`goto (\w+);`)
+
+	labels := map[string]bool{}
+	source := ""
+
+	for _, prefix := range []string{"foo", "bar"} {
+		c, err := ToC(filter, COpts{
+			FunctionName: prefix + "_filter",
+			LabelPrefix:  prefix,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		source += c
+
+		for _, match := range labelRegex.FindAllStringSubmatch(c, -1) {
+			if !strings.HasPrefix(match[1], prefix+"_") {
+				t.Fatalf("label %s not prefixed with %s", match[1], prefix)
+			}
+
+			if labels[match[1]] {
+				t.Fatalf("duplicate label %s", match[1])
+			}
+			labels[match[1]] = true
+		}
+	}
+
+	if len(labels) == 0 {
+		t.Fatalf("no labels in:\n%s", source)
+	}
+
+	for _, match := range gotoRegex.FindAllStringSubmatch(source, -1) {
+		if !labels[match[1]] {
+			t.Fatalf("goto undefined label %s in:\n%s", match[1], source)
+		}
+	}
+
+	_, err := ToC(filter, COpts{
+		FunctionName: "filter",
+		LabelPrefix:  "0foo",
+	})
+	if err == nil {
+		t.Fatal("invalid label prefix accepted")
+	}
+}
+
+func TestRangeC(t *testing.T) {
+	c, err := ToC([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 2},
+		bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 80, SkipTrue: 0, SkipFalse: 2},
+		bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 443, SkipTrue: 1, SkipFalse: 0},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	}, COpts{
+		FunctionName: "filter",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "if (a >= 80 && a <= 443) goto block_3; else goto block_4;"
+	if !strings.Contains(c, expected) {
+		t.Fatalf("expected %q in:\n%s", expected, c)
+	}
+
+	if strings.Count(c, "if (a") != 1 {
+		t.Fatalf("expected single condition on a in:\n%s", c)
+	}
+}
+
+func TestDefinePrefixC(t *testing.T) {
+	check := func(t *testing.T, filter []bpf.Instruction, expected ...string) {
+		t.Helper()
+
+		c, err := ToC(filter, COpts{
+			CompileOpts:  CompileOpts{SingleGuard: true},
+			FunctionName: "filter",
+			DefinePrefix: "FILTER",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range expected {
+			if !strings.Contains(c, e) {
+				t.Fatalf("expected %q in:\n%s", e, c)
+			}
+		}
+	}
+
+	absolute := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 0, SkipFalse: 2},
+		bpf.LoadAbsolute{Size: 1, Off: 23},
+		bpf.RetA{},
+		bpf.LoadAbsolute{Size: 4, Off: 30},
+		bpf.RetA{},
+	}
+
+	// Define matches the single guard
+	blocks, err := compile(absolute, CompileOpts{SingleGuard: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	biggestLen := blocks[0].insns[0].Instruction.(packetGuardAbsolute).Len
+
+	check(t, absolute,
+		fmt.Sprintf("#define FILTER_MIN_PACKET_LEN %d\n", biggestLen),
+		"// filter has no indirect packet loads\n",
+	)
+
+	check(t, []bpf.Instruction{
+		bpf.LoadMemShift{Off: 14},
+		bpf.LoadIndirect{Size: 4, Off: 14},
+		bpf.RetA{},
+	},
+		"#define FILTER_MIN_PACKET_LEN 15\n",
+		"// filter has indirect packet loads, up to x + 18\n",
+	)
+}
+
+func TestNoDefinePrefixC(t *testing.T) {
+	c, err := ToC([]bpf.Instruction{bpf.RetA{}}, COpts{
+		FunctionName: "filter",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(c, "#define") {
+		t.Fatalf("unexpected define in:\n%s", c)
+	}
+
+	_, err = ToC([]bpf.Instruction{bpf.RetA{}}, COpts{
+		FunctionName: "filter",
+		DefinePrefix: "0FILTER",
+	})
+	if err == nil {
+		t.Fatal("invalid define prefix accepted")
+	}
+}
+
+func TestHostByteOrderC(t *testing.T) {
+	c, err := ToC([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 4, Off: 0},
+		bpf.RetA{},
+	}, COpts{
+		CompileOpts:  CompileOpts{HostByteOrder: true},
+		FunctionName: "filter",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "a = (*((uint32_t *) (data + 0)));"
+	if !strings.Contains(c, expected) {
+		t.Fatalf("expected %q in:\n%s", expected, c)
+	}
+}
+
+func TestCommentsC(t *testing.T) {
+	c, err := ToC([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 9},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	}, COpts{
+		CompileOpts: CompileOpts{
+			Comments: map[int]string{
+				0: "ip proto",
+				1: "tcp?",
+				3: "no match",
+			},
+		},
+		FunctionName: "filter",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"a = *(data + 9); // ip proto",
+		"if (a != 6) goto block_3; // tcp?",
+		"return 0; // no match",
+	} {
+		if !strings.Contains(c, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, c)
+		}
+	}
+
+	// Packet guards are synthetic, and never have comments
+	if !strings.Contains(c, "if (data + 10 > data_end) return 0;\n") {
+		t.Fatalf("unexpected comments in:\n%s", c)
+	}
+}
+
+func TestCommentsInvalid(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.RetConstant{Val: 0},
+	}
+
+	for _, comments := range []map[int]string{
+		{1: "out of range"},
+		{-1: "negative"},
+		{0: "multiple\nlines"},
+		{0: "continued \\"},
+		{0: "continued \\ "},
+	} {
+		_, err := ToC(filter, COpts{
+			CompileOpts:  CompileOpts{Comments: comments},
+			FunctionName: "filter",
+		})
+		if err == nil {
+			t.Fatalf("comments %v accepted", comments)
+		}
+	}
+}
+
+func TestPacketLengthC(t *testing.T) {
+	c, err := ToC([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.TAX{},
+		bpf.LoadIndirect{Size: 1, Off: 3},
+		bpf.RetA{},
+	}, COpts{
+		FunctionName: "filter",
+		PacketLength: "ctx_len(ctx) - (ETH_HLEN + 2)",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"if ((int64_t) (ctx_len(ctx) - (ETH_HLEN + 2)) < 14) return 0;",
+		"if ((int64_t) (ctx_len(ctx) - (ETH_HLEN + 2)) < (int64_t) x + 4) return 0;",
+	} {
+		if !strings.Contains(c, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, c)
+		}
+	}
+
+	if strings.Contains(c, "> data_end") {
+		t.Fatalf("guard compares to data_end:\n%s", c)
+	}
+}
+
+// A negative length fails every guard, instead of wrapping to a long packet
+func TestPacketLengthNegativeC(t *testing.T) {
+	pkt := make([]byte, 14+20+4)
+	pkt[12], pkt[13] = 0x08, 0x00
+	pkt[14] = 0x45
+	pkt[14+20+3] = 80
+
+	// The packet is followed by 4 bytes PacketLength excludes, only the whole packet is long enough
+	padded := append(append([]byte{}, pkt...), 0, 0, 0, 0)
+
+	packets := [][]byte{padded[:0], padded[:2], padded[:4], padded[:13+4], padded}
+	expected := []uint32{7, 7, 7, 7, 1}
+
+	for _, opts := range []COpts{{}, {ReadAccessors: true}} {
+		opts.PacketLength = "len - 4"
+		opts.GuardFailureValue = 7
+
+		checkCResults(t, cPortFilter, opts, expected, packets...)
+	}
+}
+
+func TestPacketLengthInvalidC(t *testing.T) {
+	for _, expr := range []string{
+		" ",
+		"len; return 1",
+		"len) + (1",
+		"(len",
+		"len /* comment */",
+		"f(a, b)",
+		"len }",
+	} {
+		_, err := ToC([]bpf.Instruction{bpf.RetConstant{Val: 0}}, COpts{
+			FunctionName: "filter",
+			PacketLength: expr,
+		})
+		if err == nil {
+			t.Fatalf("PacketLength %q accepted", expr)
+		}
+	}
+}
+
+// C shifts of 32 or more are undefined
+func TestShiftC(t *testing.T) {
+	c, err := ToC([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 40},
+		bpf.TAX{},
+		bpf.ALUOpX{Op: bpf.ALUOpShiftRight},
+		bpf.RetA{},
+	}, COpts{FunctionName: "filter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"a = 0;",
+		"a = x < 32 ? a >> x : 0;",
+	} {
+		if !strings.Contains(c, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, c)
+		}
+	}
+}
+
+func TestTrailerC(t *testing.T) {
+	opts := COpts{
+		FunctionName: "filter",
+		DefinePrefix: "FILTER",
+	}
+	opts.Trailer = 4
+
+	c, err := ToC([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.TAX{},
+		bpf.LoadIndirect{Size: 1, Off: 3},
+		bpf.RetA{},
+	}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"#define FILTER_MIN_PACKET_LEN 18\n",
+		"if (data + 18 > data_end) return 0;",
+		"if (x > 65527 || data + x + 8 > data_end) return 0;",
+	} {
+		if !strings.Contains(c, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, c)
+		}
+	}
+}
+
+// cShim defines everything generated C filters need, for filters compiled on their own
+const cShim = `
+typedef unsigned long long uint64_t;
+typedef unsigned int uint32_t;
+typedef unsigned short uint16_t;
+typedef unsigned char uint8_t;
+
+#define ntohs __builtin_bswap16
+#define ntohl __builtin_bswap32
+`
+
+// cPortFilter matches IPv4 packets to port 80, skipping IP options
+var cPortFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Size: 2, Off: 12},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 4},
+	bpf.LoadMemShift{Off: 14},
+	bpf.LoadIndirect{Size: 2, Off: 14 + 2},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipFalse: 1},
+	bpf.RetConstant{Val: 1},
+	bpf.RetConstant{Val: 0},
+}
+
+func TestBasePointerGoldenC(t *testing.T) {
+	for _, test := range []struct {
+		golden      string
+		basePointer bool
+	}{
+		{"c_data", false},
+		{"c_base", true},
+	} {
+		opts := COpts{
+			FunctionName: "filter",
+			BasePointer:  test.basePointer,
+		}
+
+		checkGolden(t, test.golden, cPortFilter, opts)
+
+		c, err := ToC(cPortFilter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = clang.Compile([]byte(cShim+c), "filter", clang.Opts{
+			Clang: clangBin(),
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", test.golden, err)
+		}
+	}
+}
+
+func TestBasePointerPacketLengthC(t *testing.T) {
+	_, err := ToC(cPortFilter, COpts{
+		FunctionName: "filter",
+		BasePointer:  true,
+		PacketLength: "len",
+	})
+	if err == nil {
+		t.Fatal("BasePointer and PacketLength accepted")
+	}
+}
+
+// runC compiles C with the host compiler ($CC or cc), and runs it, returning its output.
+func runC(tb testing.TB, source string) string {
+	tb.Helper()
+
+	cc, ok := os.LookupEnv("CC")
+	if !ok {
+		cc = "cc"
+	}
+
+	if _, err := exec.LookPath(cc); err != nil {
+		tb.Skipf("%s not available", cc)
+	}
+
+	dir, err := ioutil.TempDir("", "cbpfc-c")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, bin := filepath.Join(dir, "main.c"), filepath.Join(dir, "main")
+	if err := ioutil.WriteFile(src, []byte(source), 0644); err != nil {
+		tb.Fatal(err)
+	}
+
+	if out, err := exec.Command(cc, "-Wall", "-Werror", "-o", bin, src).CombinedOutput(); err != nil {
+		tb.Fatalf("unable to compile C: %v\n%s", err, out)
+	}
+
+	out, err := exec.Command(bin).Output()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return string(out)
+}
+
+// runCFilter runs source, the C of a filter and any declarations it needs, and returns the result of call for every packet.
+// call is a format of a pointer to the packet, and its length.
+func runCFilter(tb testing.TB, source, call string, packets ...[]byte) []uint32 {
+	tb.Helper()
+
+	main := strings.Builder{}
+	main.WriteString("#include <stdint.h>\n#include <stdio.h>\n#include <arpa/inet.h>\n")
+	main.WriteString(source)
+	main.WriteString("\n\nint main(void) {\n")
+
+	for i, pkt := range packets {
+		bytes := []string{"0"} // arrays can't be empty
+		for _, b := range pkt {
+			bytes = append(bytes, fmt.Sprint(b))
+		}
+
+		fmt.Fprintf(&main, "\tstatic const uint8_t p%d[] = {%s};\n", i, strings.Join(bytes, ", "))
+		fmt.Fprintf(&main, "\tprintf(\"%%u\\n\", "+call+");\n", fmt.Sprintf("(p%d + 1)", i), len(pkt))
+	}
+
+	main.WriteString("\treturn 0;\n}\n")
+
+	results := []uint32{}
+	for _, line := range strings.Fields(runC(tb, main.String())) {
+		res, err := strconv.ParseUint(line, 10, 32)
+		if err != nil {
+			tb.Fatalf("%v\n%s", err, main.String())
+		}
+		results = append(results, uint32(res))
+	}
+
+	return results
+}
+
+// vmResults runs filter against every packet with the x/net/bpf VM.
+func vmResults(tb testing.TB, filter []bpf.Instruction, packets ...[]byte) []uint32 {
+	tb.Helper()
+
+	vm, err := bpf.NewVM(filter)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	results := []uint32{}
+	for _, pkt := range packets {
+		res, err := vm.Run(pkt)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		results = append(results, uint32(res))
+	}
+
+	return results
+}
+
+// checkC compiles filter to C with opts, and checks it returns the same results as the x/net/bpf VM for every packet.
+func checkC(tb testing.TB, filter []bpf.Instruction, opts COpts, packets ...[]byte) {
+	tb.Helper()
+
+	checkCResults(tb, filter, opts, vmResults(tb, filter, packets...), packets...)
+}
+
+// checkCResults compiles filter to C with opts, and checks it returns expected[i] for packets[i].
+// The function is called like the opts generate it, PacketLength can only use a len parameter that is the length of the packet.
+func checkCResults(tb testing.TB, filter []bpf.Instruction, opts COpts, expected []uint32, packets ...[]byte) {
+	tb.Helper()
+
+	opts.FunctionName = "filter"
+
+	c, err := ToC(filter, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	call := "filter(%[1]s, %[1]s + %[2]d)"
+	switch {
+	case opts.BasePointer:
+		call = "filter(%[1]s, %[2]d)"
+	case opts.Segmented:
+		call = "filter(&(struct cbpfc_segment){%[1]s, %[2]d}, 1)"
+	case opts.PacketLength != "":
+		// PacketLength is an expression, make len a parameter
+		c = strings.Replace(c, "const uint8_t *const data_end)", "const uint8_t *const data_end, const int64_t len)", 1)
+		call = "filter(%[1]s, %[1]s + %[2]d, %[2]d)"
+	}
+
+	if results := runCFilter(tb, c, call, packets...); !reflect.DeepEqual(results, expected) {
+		tb.Fatalf("%+v: expected %v, got %v\n%s", opts, expected, results, c)
+	}
+}
+
+func TestSegmentedC(t *testing.T) {
+	c, err := ToC(cPortFilter, COpts{
+		FunctionName: "filter",
+		Segmented:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt := make([]byte, 14+20+4)
+	pkt[12], pkt[13] = 0x08, 0x00
+	pkt[14] = 0x45
+	pkt[14+20+2], pkt[14+20+3] = 0, 80
+
+	other := append([]byte{}, pkt...)
+	other[14+20+3] = 81
+
+	// Segment boundaries, as offsets in the packet
+	tests := []struct {
+		pkt    []byte
+		splits []int
+	}{
+		{pkt, nil},
+		// load of the ethertype spans segments
+		{pkt, []int{13}},
+		// load of the port spans segments
+		{pkt, []int{14 + 20 + 3}},
+		// empty segments
+		{pkt, []int{0, 13, 13, 14 + 20 + 3, len(pkt)}},
+		{other, []int{13, 14 + 20 + 3}},
+		// too short for the port
+		{pkt[:len(pkt)-1], []int{13, 14 + 20 + 2}},
+		{pkt[:20], []int{13}},
+	}
+
+	main := strings.Builder{}
+	main.WriteString("#include <stdint.h>\n#include <stdio.h>\n")
+	main.WriteString(c)
+	main.WriteString("\n\nint main(void) {\n")
+
+	vm, err := bpf.NewVM(cPortFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Builder{}
+
+	for i, test := range tests {
+		segs := []string{}
+
+		start := 0
+		for _, end := range append(test.splits, len(test.pkt)) {
+			bytes := []string{"0"} // arrays can't be empty
+			for _, b := range test.pkt[start:end] {
+				bytes = append(bytes, fmt.Sprint(b))
+			}
+
+			fmt.Fprintf(&main, "\tstatic const uint8_t p%d_%d[] = {%s};\n", i, len(segs), strings.Join(bytes, ", "))
+			segs = append(segs, fmt.Sprintf("{p%d_%d + 1, %d}", i, len(segs), end-start))
+			start = end
+		}
+
+		fmt.Fprintf(&main, "\tstruct cbpfc_segment s%d[] = {%s};\n", i, strings.Join(segs, ", "))
+		fmt.Fprintf(&main, "\tprintf(\"%%u\\n\", filter(s%d, %d));\n", i, len(segs))
+
+		res, err := vm.Run(test.pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&expected, "%d\n", res)
+	}
+
+	main.WriteString("\treturn 0;\n}\n")
+
+	if out := runC(t, main.String()); out != expected.String() {
+		t.Fatalf("expected:\n%s\ngot:\n%s\n%s", expected.String(), out, main.String())
+	}
+}
+
+func TestSegmentedExclusiveC(t *testing.T) {
+	for name, opts := range map[string]COpts{
+		"base pointer":    {BasePointer: true},
+		"packet length":   {PacketLength: "len"},
+		"host byte order": {CompileOpts: CompileOpts{HostByteOrder: true}},
+	} {
+		opts.FunctionName = "filter"
+		opts.Segmented = true
+
+		if _, err := ToC(cPortFilter, opts); err == nil {
+			t.Fatalf("Segmented and %s accepted", name)
+		}
+	}
+}
+
+func TestLoadLenC(t *testing.T) {
+	for expected, opts := range map[string]COpts{
+		"a = (uint32_t) (data_end - data);": {},
+		"a = (uint32_t) (ctx_len(ctx));":    {PacketLength: "ctx_len(ctx)"},
+		"a = (uint32_t) len;":               {BasePointer: true},
+	} {
+		opts.FunctionName = "filter"
+
+		c, err := ToC(lenFilter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(c, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, c)
+		}
+	}
+}
+
+func TestNarrowLoadsC(t *testing.T) {
+	for _, opts := range []COpts{{}, {BasePointer: true}, {Segmented: true}} {
+		checkC(t, narrowFilter, opts, narrowPackets...)
+	}
+}
+
+func TestGuardFailureValueC(t *testing.T) {
+	tcp := make([]byte, 24)
+	tcp[12], tcp[13], tcp[23] = 0x08, 0x00, 6
+
+	udp := append([]byte{}, tcp...)
+	udp[23] = 17
+
+	for _, opts := range []COpts{{}, {PacketLength: "len"}, {BasePointer: true}} {
+		opts.GuardFailureValue = math.MaxUint32
+
+		checkCResults(t, ipv4TCPFilter, opts, []uint32{math.MaxUint32, math.MaxUint32, 1, 0}, nil, tcp[:14], tcp, udp)
+	}
+}
+
+func TestSwitchC(t *testing.T) {
+	ports := []uint32{22, 25, 53, 80, 110, 143, 443, 993, 995, 8080}
+
+	// Match TCP destination port of any of ports
+	filter := []bpf.Instruction{bpf.LoadAbsolute{Size: 2, Off: 2}}
+	for i, port := range ports {
+		filter = append(filter, bpf.JumpIf{Cond: bpf.JumpEqual, Val: port, SkipTrue: uint8(len(ports) - i)})
+	}
+	filter = append(filter, bpf.RetConstant{Val: 0}, bpf.RetConstant{Val: 1})
+
+	c, err := ToC(filter, COpts{
+		FunctionName: "filter",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(c, "switch (a) {") {
+		t.Fatalf("expected switch in:\n%s", c)
+	}
+
+	if strings.Contains(c, "if (a") {
+		t.Fatalf("unexpected condition on a in:\n%s", c)
+	}
+
+	for _, port := range ports {
+		if expected := fmt.Sprintf("case %d: goto block_12;", port); !strings.Contains(c, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, c)
+		}
+	}
+
+	// Every port, and the ports around them
+	packets := [][]byte{}
+	for _, port := range ports {
+		for _, p := range []uint32{port - 1, port, port + 1} {
+			packets = append(packets, []byte{0, 0, byte(p >> 8), byte(p)})
+		}
+	}
+
+	checkC(t, filter, COpts{}, packets...)
+}
+
+func TestContextC(t *testing.T) {
+	c, err := ToC(cPortFilter, COpts{
+		FunctionName:   "filter",
+		Context:        "struct pkt_ctx",
+		ContextData:    "pkt.start",
+		ContextDataEnd: "pkt.end",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"uint32_t filter(struct pkt_ctx *const ctx) {",
+		"const uint8_t *const data = (const uint8_t *) (long) ctx->pkt.start;",
+		"const uint8_t *const data_end = (const uint8_t *) (long) ctx->pkt.end;",
+	} {
+		if !strings.Contains(c, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, c)
+		}
+	}
+
+	pkt := make([]byte, 14+20+4)
+	pkt[12], pkt[13] = 0x08, 0x00
+	pkt[14] = 0x45
+	pkt[14+20+3] = 80
+
+	packets := [][]byte{}
+	for _, length := range []int{0, 13, 15, len(pkt) - 1, len(pkt)} {
+		packets = append(packets, pkt[:length])
+	}
+
+	source := "struct pkt_ctx { int other; struct { long start, end; } pkt; };\n" + c
+	results := runCFilter(t, source, "filter(&(struct pkt_ctx){0, {(long) %[1]s, (long) (%[1]s + %[2]d)}})", packets...)
+
+	if expected := vmResults(t, cPortFilter, packets...); !reflect.DeepEqual(results, expected) {
+		t.Fatalf("expected %v, got %v\n%s", expected, results, c)
+	}
+}
+
+// The fields of struct xdp_md are 32 bits, like the kernel's
+func TestContextXDPC(t *testing.T) {
+	c, err := ToC(cPortFilter, COpts{
+		FunctionName: "filter",
+		Context:      "struct xdp_md",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(c, "ctx->data_end;") {
+		t.Fatalf("expected default data_end field in:\n%s", c)
+	}
+
+	shim := cShim + "struct xdp_md { uint32_t data; uint32_t data_end; };\n"
+
+	_, err = clang.Compile([]byte(shim+c), "filter", clang.Opts{
+		Clang: clangBin(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContextInvalidC(t *testing.T) {
+	for _, opts := range []COpts{
+		{Context: "struct"},
+		{Context: "struct xdp_md *"},
+		{Context: "struct xdp_md; int"},
+		{Context: "struct xdp_md", ContextData: "data)"},
+		{Context: "struct xdp_md", ContextData: "data->x"},
+		{Context: "struct xdp_md", ContextDataEnd: "data_end + 1"},
+		{Context: "struct xdp_md", ContextDataEnd: ".data_end"},
+		{Context: "struct xdp_md", BasePointer: true},
+		{Context: "struct xdp_md", Segmented: true},
+		{ContextData: "data"},
+	} {
+		opts.FunctionName = "filter"
+
+		if _, err := ToC(cPortFilter, opts); err == nil {
+			t.Fatalf("%+v accepted", opts)
+		}
+	}
+
+	for _, context := range []string{"xdp_md_t", "union ctx", "struct __sk_buff"} {
+		if _, err := ToC(cPortFilter, COpts{FunctionName: "filter", Context: context}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPrologueEpilogueC(t *testing.T) {
+	c, err := ToC(snippetFilter, COpts{
+		CompileOpts: CompileOpts{
+			GuardFailureValue: 7,
+		},
+		FunctionName: "filter",
+		LabelPrefix:  "filter",
+		Prologue:     "const uint32_t base = 1000;\nprologues++;",
+		Epilogue:     "result += base;\nepilogues++;",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The Prologue runs once before the filter, and the Epilogue once after whichever return it takes
+	source := "static int prologues, epilogues;\n" + c + `
+static uint32_t counted(const uint8_t *const data, const uint8_t *const data_end) {
+	const int prologue = prologues, epilogue = epilogues;
+	const uint32_t result = filter(data, data_end);
+	return prologues == prologue + 1 && epilogues == epilogue + 1 ? result : 0xdead;
+}`
+
+	packets, expected := [][]byte{}, []uint32{}
+	for _, p := range snippetPackets {
+		packets = append(packets, p.pkt)
+		expected = append(expected, p.result+1000)
+	}
+
+	if results := runCFilter(t, source, "counted(%[1]s, %[1]s + %[2]d)", packets...); !reflect.DeepEqual(results, expected) {
+		t.Fatalf("expected %v, got %v\n%s", expected, results, c)
+	}
+}
+
+func TestMetadataC(t *testing.T) {
+	c, err := ToC(metadataFilter, COpts{
+		CompileOpts: CompileOpts{
+			Metadata:          metadataRegion,
+			GuardFailureValue: 7,
+		},
+		FunctionName: "filter",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := c + "\nstatic const uint8_t meta[] = {0, 0, 0, 3};\n"
+	ipv4 := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x08, 0x00}
+
+	for _, test := range []struct {
+		metaLen  int
+		packets  [][]byte
+		expected []uint32
+	}{
+		// Packet guard fails for the short packet
+		{4, [][]byte{ipv4, ipv4[:13]}, []uint32{1, 7}},
+		// Metadata guard fails
+		{3, [][]byte{ipv4}, []uint32{7}},
+	} {
+		call := fmt.Sprintf("filter(%%[1]s, %%[1]s + %%[2]d, meta, meta + %d)", test.metaLen)
+
+		if results := runCFilter(t, source, call, test.packets...); !reflect.DeepEqual(results, test.expected) {
+			t.Fatalf("metadata length %d: expected %v, got %v\n%s", test.metaLen, test.expected, results, c)
+		}
+	}
+
+	for _, opts := range []COpts{{BasePointer: true}, {Segmented: true}} {
+		opts.FunctionName = "filter"
+		opts.Metadata = metadataRegion
+
+		if _, err := ToC(metadataFilter, opts); err == nil {
+			t.Fatalf("%+v accepted", opts)
+		}
+	}
+}
+
+func TestMacroC(t *testing.T) {
+	c, err := ToC(cPortFilter, COpts{
+		CompileOpts: CompileOpts{
+			Comments: map[int]string{0: "EtherType"},
+		},
+		FunctionName: "FILTER",
+		LabelPrefix:  "filter",
+		Macro:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(c, "#define FILTER(packet, len, result) do {") || !strings.Contains(c, "/* EtherType */") {
+		t.Fatalf("unexpected macro:\n%s", c)
+	}
+
+	pkt := make([]byte, 14+20+4)
+	pkt[12], pkt[13] = 0x08, 0x00
+	pkt[14] = 0x45
+	pkt[14+20+3] = 80
+
+	// The caller's variables have the same names as the filter's
+	source := c + `
+
+static uint32_t host(const uint8_t *data, uint32_t x) {
+	uint32_t a = 0, b = 0;
+	FILTER(data, x, a);
+	FILTER(data, x - 1, b);
+	return a << 1 | b;
+}`
+
+	// The VM can't run the filter against 14 bytes
+	packets, expected := [][]byte{}, []uint32{}
+	for _, length := range []int{13, 16, len(pkt) - 1, len(pkt)} {
+		packets = append(packets, pkt[:length])
+
+		res := vmResults(t, cPortFilter, pkt[:length], pkt[:length-1])
+		expected = append(expected, res[0]<<1|res[1])
+	}
+
+	if results := runCFilter(t, source, "host(%[1]s, %[2]d)", packets...); !reflect.DeepEqual(results, expected) {
+		t.Fatalf("expected %v, got %v\n%s", expected, results, c)
+	}
+}
+
+func TestMacroInvalidC(t *testing.T) {
+	for _, opts := range []COpts{
+		{BasePointer: true},
+		{Segmented: true},
+		{Context: "struct xdp_md"},
+		{Epilogue: "result++;"},
+		{CompileOpts: CompileOpts{Metadata: metadataRegion}},
+		{CompileOpts: CompileOpts{Comments: map[int]string{0: "*/ oops"}}},
+	} {
+		opts.FunctionName = "FILTER"
+		opts.Macro = true
+
+		if _, err := ToC(cPortFilter, opts); err == nil {
+			t.Fatalf("%+v accepted", opts)
+		}
+	}
+}
+
+func TestIndirectLenC(t *testing.T) {
+	pkt := make([]byte, 64)
+	pkt[0], pkt[1], pkt[2] = 1, 2, 3
+
+	// The load is past the end of every packet
+	checkCResults(t, []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.TAX{},
+		bpf.LoadIndirect{Size: 1, Off: 0},
+		bpf.RetConstant{Val: 1},
+	}, COpts{}, []uint32{0, 0, 0}, pkt[:0], pkt[:1], pkt)
+}
+
+func TestReadAccessorsC(t *testing.T) {
+	filter := append([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 4, Off: 0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x01020304, SkipTrue: 1},
+	}, cPortFilter...)
+
+	for _, opts := range []COpts{{}, {BasePointer: true}, {PacketLength: "data_end - data"}} {
+		opts.FunctionName = "filter"
+		opts.ReadAccessors = true
+
+		c, err := ToC(filter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the accessors dereference the packet
+		fun := c[strings.Index(c, "#endif"):]
+		for _, deref := range []string{"*((", "*(data", "data +", "base +", "data["} {
+			if strings.Contains(fun, deref) {
+				t.Fatalf("%+v: unexpected %q in:\n%s", opts, deref, fun)
+			}
+		}
+	}
+
+	pkt := make([]byte, 14+20+4)
+	pkt[12], pkt[13] = 0x08, 0x00
+	pkt[14] = 0x45
+	pkt[14+20+3] = 80
+
+	packets := [][]byte{}
+	for _, length := range []int{0, 3, 13, 15, len(pkt) - 1, len(pkt)} {
+		packets = append(packets, pkt[:length])
+	}
+
+	// The VM returns 0 for reads past the end of the packet
+	expected := vmResults(t, filter, packets...)
+	for i := range packets[:len(packets)-1] {
+		expected[i] = 7
+	}
+
+	checkCResults(t, filter, COpts{ReadAccessors: true, CompileOpts: CompileOpts{GuardFailureValue: 7}}, expected, packets...)
+
+	for _, opts := range []COpts{
+		{Segmented: true},
+		{CompileOpts: CompileOpts{HostByteOrder: true}},
+		{CompileOpts: CompileOpts{Trailer: 4}},
+		{CompileOpts: CompileOpts{SingleGuard: true}},
+		{CompileOpts: CompileOpts{HoistGuards: true}},
+	} {
+		opts.FunctionName = "filter"
+		opts.ReadAccessors = true
+
+		if _, err := ToC(filter, opts); err == nil {
+			t.Fatalf("%+v accepted", opts)
+		}
+	}
+}
+
+func TestSnapLenC(t *testing.T) {
+	packets, expected := [][]byte{}, []uint32{}
+	for _, test := range snapLenPackets {
+		packets = append(packets, test.pkt)
+
+		if test.short {
+			expected = append(expected, 1500)
+		} else {
+			expected = append(expected, test.len)
+		}
+	}
+
+	checkCResults(t, snapLenFilter, COpts{CompileOpts: CompileOpts{GuardFailureValue: 1500}}, expected, packets...)
+}
+
+func TestReuseportHashC(t *testing.T) {
+	checkC(t, reuseportHashFilter, COpts{}, reuseportHashPackets...)
+}
@@ -0,0 +1,177 @@
+package cbpfc
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// OptimizeCBPF applies the optimizations cbpfc makes that don't need instructions cBPF doesn't have,
+// and returns the result as a cBPF filter that can still be attached to a socket unchanged
+// (eg with SO_ATTACH_FILTER or SO_ATTACH_REUSEPORT_CBPF):
+//   - Unreachable instructions are removed
+//   - ALU operations that never change RegA are removed
+//   - Absolute packet loads masked by an and are narrowed to the bytes kept
+//   - Stores to scratch memory that is never read are removed
+//   - TAX and TXA whose destination register is never read are removed
+//
+// Packet guards, zero initialization and division by zero checks are never inserted,
+// the kernel already does them for cBPF. Jumps are recomputed to match the new positions of instructions.
+// The optimized filter returns the same value as the original for every packet.
+func OptimizeCBPF(filter []bpf.Instruction) ([]bpf.Instruction, error) {
+	if err := Validate(filter); err != nil {
+		return nil, err
+	}
+
+	// Jumps aren't normalized, so conditions are unchanged
+	blocks, err := splitBlocks(toInstructions(filter))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to compute blocks")
+	}
+
+	removeNoOps(blocks)
+	narrowLoads(blocks, nil)
+	removeDeadStores(blocks, nil)
+	removeDeadTransfers(blocks)
+
+	return blocksToCBPF(blocks)
+}
+
+// laidOut is an instruction of a block laid out as a flat list of instructions.
+type laidOut struct {
+	instruction
+
+	// Blocks the instruction jumps to: the target of Jump, the true and false targets of conditional jumps
+	jt, jf *block
+
+	// fallthroughOf is the block an inserted Jump to the block it falls through to follows, nil otherwise
+	fallthroughOf *block
+}
+
+// cbpfLayout lays blocks out as a flat list of instructions, in order,
+// along with the position of the first instruction of every block.
+// Blocks that aren't laid out before the block they fall through to are followed by a Jump to it.
+func cbpfLayout(blocks []*block) ([]laidOut, map[*block]int) {
+	start := make(map[*block]int, len(blocks))
+	layout := []laidOut{}
+
+	for i, block := range blocks {
+		start[block] = len(layout)
+
+		for _, insn := range block.insns {
+			out := laidOut{instruction: insn}
+
+			switch in := insn.Instruction.(type) {
+			case bpf.Jump:
+				out.jt = block.skipToBlock(skip(in.Skip))
+			case bpf.JumpIf:
+				out.jt, out.jf = block.skipToBlock(skip(in.SkipTrue)), block.skipToBlock(skip(in.SkipFalse))
+			case bpf.JumpIfX:
+				out.jt, out.jf = block.skipToBlock(skip(in.SkipTrue)), block.skipToBlock(skip(in.SkipFalse))
+			}
+
+			layout = append(layout, out)
+		}
+
+		if ft := block.fallthroughBlock(); ft != nil && ft != nextBlock(blocks, i) {
+			layout = append(layout, laidOut{
+				instruction:   instruction{Instruction: bpf.Jump{}},
+				jt:            ft,
+				fallthroughOf: block,
+			})
+		}
+	}
+
+	return layout, start
+}
+
+// blocksToCBPF lays blocks out as a cBPF filter, in order, see cbpfLayout.
+// Blocks can only contain cBPF instructions.
+func blocksToCBPF(blocks []*block) ([]bpf.Instruction, error) {
+	layout, start := cbpfLayout(blocks)
+
+	filter := make([]bpf.Instruction, 0, len(layout))
+
+	// target is the skip from the current instruction to blk
+	target := func(blk *block) (uint32, error) {
+		s := start[blk] - (len(filter) + 1)
+		if s < 0 {
+			return 0, errors.Errorf("%s jumps backwards", blk.Label())
+		}
+
+		return uint32(s), nil
+	}
+
+	// condTarget is a target for a conditional jump, which only has 8 bits
+	condTarget := func(blk *block) (uint8, error) {
+		s, err := target(blk)
+		if err != nil {
+			return 0, err
+		}
+
+		if s > math.MaxUint8 {
+			return 0, errors.Errorf("jump to %s skips %d instructions", blk.Label(), s)
+		}
+
+		return uint8(s), nil
+	}
+
+	for _, out := range layout {
+		var err error
+		insn := out.instruction
+
+		switch in := insn.Instruction.(type) {
+		case bpf.Jump:
+			in.Skip, err = target(out.jt)
+			insn.Instruction = in
+
+		case bpf.JumpIf:
+			if in.SkipTrue, err = condTarget(out.jt); err == nil {
+				in.SkipFalse, err = condTarget(out.jf)
+			}
+			insn.Instruction = in
+
+		case bpf.JumpIfX:
+			if in.SkipTrue, err = condTarget(out.jt); err == nil {
+				in.SkipFalse, err = condTarget(out.jf)
+			}
+			insn.Instruction = in
+
+		default:
+			if isSynthetic(in) {
+				err = errors.New("no cBPF equivalent")
+			}
+		}
+
+		if err != nil && out.fallthroughOf != nil {
+			return nil, errors.Wrapf(err, "unable to lay out %s", out.fallthroughOf.Label())
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to lay out %v", insn)
+		}
+
+		filter = append(filter, insn.Instruction)
+	}
+
+	return filter, nil
+}
+
+// ToRawCBPF is OptimizeCBPF assembled to the kernel's struct sock_filter layout, like tcpdump -dd,
+// ready to attach with SO_ATTACH_FILTER.
+func ToRawCBPF(filter []bpf.Instruction) ([]bpf.RawInstruction, error) {
+	optimized, err := OptimizeCBPF(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]bpf.RawInstruction, len(optimized))
+	for pc, insn := range optimized {
+		raw[pc], err = insn.Assemble()
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to assemble instruction %d: %v", pc, insn)
+		}
+	}
+
+	return raw, nil
+}
@@ -0,0 +1,170 @@
+//go:build linux && cbpfc_integration
+
+package cbpfc
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+)
+
+// Not in package syscall
+const (
+	soReuseport           = 15
+	soAttachReuseportCBPF = 51
+)
+
+// udpFilter matches UDP packets with a payload starting with 'a'.
+// Socket filters see packets from the UDP header.
+var udpFilter = []bpf.Instruction{
+	/* 0 */ bpf.LoadConstant{Dst: bpf.RegX, Val: 8},
+	/* 1 */ bpf.StoreScratch{Src: bpf.RegX, N: 1}, // dead store
+	/* 2 */ bpf.LoadIndirect{Size: 1, Off: 0},
+	/* 3 */ bpf.ALUOpConstant{Op: bpf.ALUOpOr, Val: 0}, // no op
+	/* 4 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 'a', SkipFalse: 2},
+	/* 5 */ bpf.RetConstant{Val: 0xFFFF},
+	/* 6 */ bpf.RetConstant{Val: 1}, // unreachable
+	/* 7 */ bpf.RetConstant{Val: 0},
+}
+
+// attachCBPF attaches filter to conn with setsockopt opt.
+func attachCBPF(tb testing.TB, conn *net.UDPConn, opt int, filter []bpf.Instruction) {
+	tb.Helper()
+
+	raw, err := bpf.Assemble(filter)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	attachRawCBPF(tb, conn, opt, raw)
+}
+
+// attachRawCBPF attaches an assembled filter to conn with setsockopt opt.
+func attachRawCBPF(tb testing.TB, conn *net.UDPConn, opt int, raw []bpf.RawInstruction) {
+	tb.Helper()
+
+	prog := syscall.SockFprog{
+		Len:    uint16(len(raw)),
+		Filter: (*syscall.SockFilter)(unsafe.Pointer(&raw[0])),
+	}
+
+	sc, err := conn.SyscallConn()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var sockErr syscall.Errno
+	err = sc.Control(func(fd uintptr) {
+		_, _, sockErr = syscall.Syscall6(syscall.SYS_SETSOCKOPT, fd, syscall.SOL_SOCKET, uintptr(opt), uintptr(unsafe.Pointer(&prog)), unsafe.Sizeof(prog), 0)
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if sockErr != 0 {
+		tb.Fatalf("kernel rejected filter: %v", sockErr)
+	}
+}
+
+// checkUDPFilter checks conn, with udpFilter attached, only receives the packet starting with 'a'.
+func checkUDPFilter(tb testing.TB, conn *net.UDPConn) {
+	tb.Helper()
+
+	sender, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer sender.Close()
+
+	for _, payload := range []string{"b", "a"} {
+		if _, err := sender.Write([]byte(payload)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	// Only the second packet matches
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		tb.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if string(buf[:n]) != "a" {
+		tb.Fatalf("expected a, got %q", buf[:n])
+	}
+}
+
+func TestOptimizeCBPFSocket(t *testing.T) {
+	optimized, err := OptimizeCBPF(udpFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(optimized) >= len(udpFilter) {
+		t.Fatalf("filter not optimized: %v", optimized)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	attachCBPF(t, conn, syscall.SO_ATTACH_FILTER, optimized)
+	checkUDPFilter(t, conn)
+}
+
+// Reuseport filters return the index of the socket to use, only check the kernel accepts the filter.
+func TestOptimizeCBPFReuseport(t *testing.T) {
+	optimized, err := OptimizeCBPF(udpFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reuseport group is created when the socket is bound
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReuseport, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	attachCBPF(t, conn.(*net.UDPConn), soAttachReuseportCBPF, optimized)
+}
+
+func TestToRawCBPFSocket(t *testing.T) {
+	raw, err := ToRawCBPF(udpFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	attachRawCBPF(t, conn, syscall.SO_ATTACH_FILTER, raw)
+	checkUDPFilter(t, conn)
+}
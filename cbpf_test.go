@@ -0,0 +1,187 @@
+package cbpfc
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+// checkOptimizeCBPF checks filter optimizes to expected, and both give the same results for packets.
+func checkOptimizeCBPF(tb testing.TB, filter, expected []bpf.Instruction, packets ...[]byte) {
+	tb.Helper()
+
+	optimized, err := OptimizeCBPF(filter)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(optimized, expected) {
+		tb.Fatalf("expected:\n%v\ngot:\n%v", expected, optimized)
+	}
+
+	// Optimized filters have to assemble, like the original
+	if _, err := bpf.Assemble(optimized); err != nil {
+		tb.Fatal(err)
+	}
+
+	vm, err := bpf.NewVM(filter)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	optimizedVM, err := bpf.NewVM(optimized)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	for _, pkt := range packets {
+		res, err := vm.Run(pkt)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		optimizedRes, err := optimizedVM.Run(pkt)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if res != optimizedRes {
+			tb.Fatalf("packet %v: expected %d, got %d", pkt, res, optimizedRes)
+		}
+	}
+}
+
+func TestOptimizeCBPF(t *testing.T) {
+	checkOptimizeCBPF(t, []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 0},
+		/* 2 */ bpf.StoreScratch{Src: bpf.RegA, N: 3},
+		/* 3 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 3},
+		/* 4 */ bpf.Jump{Skip: 3},
+		/* 5 */ bpf.RetConstant{Val: 4}, // unreachable
+		/* 6 */ bpf.RetConstant{Val: 5}, // unreachable
+		/* 7 */ bpf.RetConstant{Val: 1},
+		/* 8 */ bpf.RetConstant{Val: 0},
+	}, []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+		/* 2 */ bpf.Jump{Skip: 1},
+		/* 3 */ bpf.RetConstant{Val: 1},
+		/* 4 */ bpf.RetConstant{Val: 0},
+	}, []byte{0}, []byte{1}, []byte{2})
+}
+
+func TestOptimizeCBPFUnchanged(t *testing.T) {
+	checkOptimizeCBPF(t, cPortFilter, cPortFilter, nil, make([]byte, 15), make([]byte, 40))
+}
+
+// Packet loads, scratch reads and divisions by X are left to the kernel
+func TestOptimizeCBPFNoSynthetic(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadScratch{Dst: bpf.RegX, N: 2},
+		bpf.LoadIndirect{Size: 4, Off: 10},
+		bpf.ALUOpX{Op: bpf.ALUOpDiv},
+		bpf.RetA{},
+	}
+
+	checkOptimizeCBPF(t, filter, filter, make([]byte, 14))
+}
+
+// Removed instructions shorten jumps
+func TestOptimizeCBPFLongJump(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 255},
+	}
+	for i := 0; i < 254; i++ {
+		filter = append(filter, bpf.ALUOpConstant{Op: bpf.ALUOpOr, Val: 0})
+	}
+	filter = append(filter, bpf.RetConstant{Val: 0}, bpf.RetConstant{Val: 1})
+
+	checkOptimizeCBPF(t, filter, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 1},
+	}, []byte{0}, []byte{1})
+}
+
+func TestOptimizeCBPFInvalid(t *testing.T) {
+	if _, err := OptimizeCBPF([]bpf.Instruction{bpf.LoadScratch{Dst: bpf.RegA, N: 16}}); err == nil {
+		t.Fatal("invalid filter accepted")
+	}
+}
+
+func TestToRawCBPF(t *testing.T) {
+	raw, err := ToRawCBPF([]bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 2},
+		/* 2 */ bpf.RetConstant{Val: 0},
+		/* 3 */ bpf.RetConstant{Val: 2}, // unreachable
+		/* 4 */ bpf.RetConstant{Val: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Jump recomputed over the removed instruction
+	expected := []bpf.RawInstruction{
+		{Op: 0x30, K: 0},
+		{Op: 0x15, Jt: 1, Jf: 0, K: 1},
+		{Op: 0x06, K: 0},
+		{Op: 0x06, K: 1},
+	}
+	if !reflect.DeepEqual(raw, expected) {
+		t.Fatalf("expected %v, got %v", expected, raw)
+	}
+}
+
+func TestToRawCBPFInvalid(t *testing.T) {
+	if _, err := ToRawCBPF([]bpf.Instruction{bpf.LoadScratch{Dst: bpf.RegA, N: 16}}); err == nil {
+		t.Fatal("invalid filter accepted")
+	}
+}
+
+// Blocks that don't fall through to the next block laid out jump to it
+func TestCBPFLayout(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+
+		// block 1
+		/* 2 */ bpf.LoadAbsolute{Size: 1, Off: 1},
+		// fall through to block 2
+
+		// block 2
+		/* 3 */ bpf.RetA{},
+	})
+
+	blocks := mustSplitBlocks(t, 3, insns)
+
+	// block 2 is laid out before block 1
+	layout, start := cbpfLayout([]*block{blocks[0], blocks[2], blocks[1]})
+
+	expected := map[*block]int{blocks[0]: 0, blocks[2]: 2, blocks[1]: 3}
+	if !reflect.DeepEqual(start, expected) {
+		t.Fatalf("expected starts %v, got %v", expected, start)
+	}
+
+	if len(layout) != 5 {
+		t.Fatalf("expected 5 instructions, got %d", len(layout))
+	}
+
+	if jump := layout[1]; jump.jt != blocks[2] || jump.jf != blocks[1] {
+		t.Fatalf("wrong targets %v %v", jump.jt, jump.jf)
+	}
+
+	if ft := layout[4]; ft.Instruction != (bpf.Jump{}) || ft.jt != blocks[2] || ft.fallthroughOf != blocks[1] {
+		t.Fatalf("expected jump from block 1 to block 2, got %+v", ft)
+	}
+
+	// cBPF can't jump backwards
+	if _, err := blocksToCBPF([]*block{blocks[0], blocks[2], blocks[1]}); err == nil {
+		t.Fatal("backwards jump laid out")
+	}
+}
@@ -4,6 +4,7 @@
 // cbpfc can compile cBPF filters to:
 //   - C, which can be compiled to eBPF with Clang
 //   - eBPF
+//   - Rust, for userspace packet processing
 //
 // Both the C and eBPF output are intended to be accepted by the kernel verifier:
 //   - All packet loads are guarded with runtime packet length checks
@@ -14,8 +15,11 @@
 package cbpfc
 
 import (
+	"container/heap"
 	"fmt"
+	"math"
 	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 	"golang.org/x/net/bpf"
@@ -46,6 +50,18 @@ type instruction struct {
 	id pos
 }
 
+// regName returns the cBPF name of a register
+func regName(reg bpf.Register) string {
+	switch reg {
+	case bpf.RegA:
+		return "a"
+	case bpf.RegX:
+		return "x"
+	default:
+		return fmt.Sprintf("r%d", reg)
+	}
+}
+
 func (i instruction) String() string {
 	return fmt.Sprintf("%d: %v", i.id, i.Instruction)
 }
@@ -67,10 +83,11 @@ type block struct {
 
 	// id of the instruction that started this block
 	// Unique, but not guaranteed to match insns[0].id after blocks are modified
+	// Labels are derived from it, so they're stable across runs and can be traced back to the filter.
 	id pos
 
 	// True IFF another block jumps to this block as a target
-	// A block falling-through to this one does not count
+	// A block falling-through to this one does not count, unless a backend has to jump to it explicitly
 	IsTarget bool
 }
 
@@ -108,6 +125,44 @@ func (b *block) last() instruction {
 	return b.insns[len(b.insns)-1]
 }
 
+// nextBlock returns the block laid out after blocks[i], nil if it is the last block.
+func nextBlock(blocks []*block, i int) *block {
+	if i+1 < len(blocks) {
+		return blocks[i+1]
+	}
+
+	return nil
+}
+
+// jumpTarget marks the block as explicitly jumped to, and returns it.
+// Used by backends that have to jump to blocks that are fallen through to.
+func (b *block) jumpTarget() *block {
+	b.IsTarget = true
+	return b
+}
+
+// fallthroughBlock returns the block this block falls through to,
+// or nil if the block ends in a jump or return.
+func (b *block) fallthroughBlock() *block {
+	if isTerminator(b.last().Instruction) {
+		return nil
+	}
+
+	// Blocks that fall through only have one target.
+	// Don't use skipToBlock(0), the instruction the block originally ended with could have been removed.
+	for _, target := range b.jumps {
+		return target
+	}
+
+	return nil
+}
+
+// isNoMatch checks if a block always returns no match
+func (b *block) isNoMatch() bool {
+	ret, ok := b.last().Instruction.(bpf.RetConstant)
+	return ok && ret.Val == 0
+}
+
 // packetGuardAbsolute is a "fake" instruction
 // that checks the length of the packet for absolute packet loads
 type packetGuardAbsolute struct {
@@ -120,6 +175,10 @@ func (p packetGuardAbsolute) Assemble() (bpf.RawInstruction, error) {
 	return bpf.RawInstruction{}, errors.Errorf("unsupported")
 }
 
+func (p packetGuardAbsolute) String() string {
+	return fmt.Sprintf("guard len >= %d", p.Len)
+}
+
 // packetGuardIndirect is a "fake" instruction
 // that checks the length of the packet for indirect packet loads
 type packetGuardIndirect struct {
@@ -132,6 +191,26 @@ func (p packetGuardIndirect) Assemble() (bpf.RawInstruction, error) {
 	return bpf.RawInstruction{}, errors.Errorf("unsupported")
 }
 
+func (p packetGuardIndirect) String() string {
+	return fmt.Sprintf("guard len >= x + %d", p.Len)
+}
+
+// initializeRegister is a "fake" instruction
+// that zero initializes a register
+type initializeRegister struct {
+	// Register that needs to be initialized
+	Reg bpf.Register
+}
+
+// Assemble implements the Instruction Assemble method.
+func (i initializeRegister) Assemble() (bpf.RawInstruction, error) {
+	return bpf.RawInstruction{}, errors.Errorf("unsupported")
+}
+
+func (i initializeRegister) String() string {
+	return fmt.Sprintf("init %s", regName(i.Reg))
+}
+
 // initializeScratch is a "fake" instruction
 // that zero initializes a scratch position
 type initializeScratch struct {
@@ -144,6 +223,10 @@ func (i initializeScratch) Assemble() (bpf.RawInstruction, error) {
 	return bpf.RawInstruction{}, errors.Errorf("unsupported")
 }
 
+func (i initializeScratch) String() string {
+	return fmt.Sprintf("init M[%d]", i.N)
+}
+
 // checksXNotZero is a "fake" instruction
 // that returns no match if X is 0
 type checkXNotZero struct {
@@ -154,37 +237,641 @@ func (c checkXNotZero) Assemble() (bpf.RawInstruction, error) {
 	return bpf.RawInstruction{}, errors.Errorf("unsupported")
 }
 
+func (c checkXNotZero) String() string {
+	return "check x != 0"
+}
+
+// loadMetadata is a "fake" instruction
+// that loads from the metadata buffer into A, like LoadAbsolute from the packet
+type loadMetadata struct {
+	// Offset in the metadata buffer
+	Off  uint32
+	Size int
+}
+
+// Assemble implements the Instruction Assemble method.
+func (l loadMetadata) Assemble() (bpf.RawInstruction, error) {
+	return bpf.RawInstruction{}, errors.Errorf("unsupported")
+}
+
+func (l loadMetadata) String() string {
+	return fmt.Sprintf("ld%s meta[%d]", sizeSuffix[l.Size], l.Off)
+}
+
+// metadataGuard is a "fake" instruction
+// that checks the length of the metadata buffer for metadata loads
+type metadataGuard struct {
+	// Length the guard checks. offset + size
+	Len uint32
+}
+
+// Assemble implements the Instruction Assemble method.
+func (m metadataGuard) Assemble() (bpf.RawInstruction, error) {
+	return bpf.RawInstruction{}, errors.Errorf("unsupported")
+}
+
+func (m metadataGuard) String() string {
+	return fmt.Sprintf("guard meta len >= %d", m.Len)
+}
+
+// sizeSuffix is the suffix of loads of a size, like x/net/bpf
+var sizeSuffix = map[int]string{
+	1: "b",
+	2: "h",
+	4: "",
+}
+
+// MetadataRegion is a range of offsets that absolute loads read from a metadata buffer provided by the caller,
+// instead of the packet. eg the ingress interface or a timestamp, alongside the packet.
+type MetadataRegion struct {
+	// Base is the offset of the first byte of the metadata buffer.
+	Base uint32
+
+	// Len is the number of offsets in the region, 0 if there is no metadata.
+	Len uint32
+}
+
+// contains checks if an absolute load of size bytes at off is in the region.
+// Loads that are partly in it are an error.
+func (m MetadataRegion) contains(off uint32, size int) (bool, error) {
+	end := loadEnd(off, 0, size)
+	base, regionEnd := uint64(m.Base), uint64(m.Base)+uint64(m.Len)
+
+	switch {
+	case m.Len == 0 || end <= base || uint64(off) >= regionEnd:
+		return false, nil
+	case uint64(off) >= base && end <= regionEnd:
+		return true, nil
+	default:
+		return false, errors.Errorf("load of %d bytes at %d is partly in the metadata region", size, off)
+	}
+}
+
+// mapMetadataLoads replaces absolute loads in the metadata region with loads from the metadata buffer.
+func mapMetadataLoads(insns []instruction, region MetadataRegion) error {
+	for pc := range insns {
+		load, ok := insns[pc].Instruction.(bpf.LoadAbsolute)
+		if !ok {
+			continue
+		}
+
+		meta, err := region.contains(load.Off, load.Size)
+		if err != nil {
+			return errors.Wrapf(err, "instruction %v", insns[pc])
+		}
+
+		if meta {
+			insns[pc].Instruction = loadMetadata{Off: load.Off - region.Base, Size: load.Size}
+		}
+	}
+
+	return nil
+}
+
+// removePacketGuards removes the absolute and indirect packet guards from blocks, for backends that check every load.
+// Guards are always followed by the load they guard, blocks are never empty.
+func removePacketGuards(blocks []*block) {
+	for _, block := range blocks {
+		insns := block.insns[:0]
+
+		for _, insn := range block.insns {
+			switch insn.Instruction.(type) {
+			case packetGuardAbsolute, packetGuardIndirect:
+				continue
+			}
+
+			insns = append(insns, insn)
+		}
+
+		block.insns = insns
+	}
+}
+
+// addMetadataGuards adds a guard to the start of every block with metadata loads,
+// checking the metadata buffer is long enough for all of them.
+func addMetadataGuards(blocks []*block) {
+	for _, block := range blocks {
+		guard := uint32(0)
+
+		for _, insn := range block.insns {
+			if load, ok := insn.Instruction.(loadMetadata); ok && load.Off+uint32(load.Size) > guard {
+				guard = load.Off + uint32(load.Size)
+			}
+		}
+
+		if guard != 0 {
+			block.insert(0, instruction{Instruction: metadataGuard{Len: guard}})
+		}
+	}
+}
+
+// BlockOrder is the order the blocks of a filter are laid out in by backends.
+type BlockOrder int
+
+const (
+	// SourceOrder lays blocks out in the order of the cBPF instructions they start with.
+	SourceOrder BlockOrder = iota
+
+	// FallthroughFirst lays blocks that always return no match out last,
+	// so the path through the filter to a match is laid out contiguously.
+	FallthroughFirst
+)
+
+// CompileOpts control how a cBPF filter is analyzed and transformed,
+// independently of the backend it is compiled to.
+type CompileOpts struct {
+	// Name of the filter, the symbol backends generate if their own name isn't set:
+	// the C, Rust and WebAssembly FunctionName, the object ProgramName, and the eBPF LabelPrefix.
+	// Must match regex:
+	//     [A-Za-z_][0-9A-Za-z_]*
+	Name string
+
+	// SingleGuard replaces all the absolute packet guards with a single
+	// guard at the start of the filter, checking the packet is long enough
+	// for every load the filter can do.
+	// Only used if the filter has no indirect packet loads or LoadMemShift,
+	// as their offsets are only known at runtime.
+	//
+	// Packets that are too short for any load are no longer matched,
+	// even if the path they take through the filter wouldn't have loaded
+	// past the end of the packet.
+	// They return GuardFailureValue, even if they would have divided by zero first.
+	SingleGuard bool
+
+	// HoistGuards moves absolute packet guards up to the blocks that jump to them,
+	// if every path from a block needs at least that much of the packet.
+	// Blocks that jump to many blocks loading the packet get a single guard, instead of one in each of them.
+	// The result of the filter is unchanged: packets that are too short fail earlier, but they fail on every path.
+	// Guards aren't hoisted past divisions by X (with GuardFailureValue) or stores to ScratchMaps,
+	// so a short packet still returns 0 if X is 0, and still updates the maps.
+	// SingleGuard takes precedence if the filter is eligible for it.
+	HoistGuards bool
+
+	// BlockOrder is the order blocks are laid out in. Defaults to SourceOrder.
+	// Only changes the layout of the generated code, not the result of the filter.
+	// The eBPF backend inverts conditional jumps so they fall through to the block laid out next, if it can.
+	BlockOrder BlockOrder
+
+	// InitializedRegs are registers the caller guarantees are initialized
+	// before the filter runs (eg by a preceding filter).
+	// They are not zero initialized, even if the filter reads them before writing to them.
+	//
+	// Only supported by backends where the caller can initialize the filter's memory (eBPF).
+	InitializedRegs []bpf.Register
+
+	// InitializedScratch are the scratch positions (M[]) the caller guarantees
+	// are initialized before the filter runs, see InitializedRegs.
+	InitializedScratch []int
+
+	// StrictUninitialized rejects filters that read registers or scratch memory before writing to them,
+	// on any path, instead of zero initializing them (eg a filter returning A without setting it).
+	// Memory the caller initializes (InitializedRegs and InitializedScratch) can always be read.
+	StrictUninitialized bool
+
+	// HardenNoIndirect rejects filters with any LoadIndirect, LoadMemShift or ALUOpX instruction, even unreachable ones,
+	// to only allow filters that load the packet at constant offsets and compute with constants.
+	HardenNoIndirect bool
+
+	// HostByteOrder makes packet loads of 2 and 4 bytes (LoadAbsolute and LoadIndirect) read
+	// values in the byte order of the host running the filter, instead of network byte order (big endian) like cBPF.
+	// Useful if the filter is applied to data that is already in host order (eg a parsed struct).
+	HostByteOrder bool
+
+	// OffsetBase is added to the offset of every absolute packet load (LoadAbsolute and LoadMemShift),
+	// so a filter can be applied to data starting OffsetBase bytes into the packet.
+	// Indirect loads are unchanged, they remain relative to X.
+	OffsetBase uint32
+
+	// Trailer is the length of a region at the end of the packet that isn't part of it, eg an Ethernet FCS,
+	// that loads never read. Packet guards check offset + size + Trailer <= packet length.
+	Trailer uint32
+
+	// GuardFailureValue is returned when a packet guard fails, because the packet is too short for a load,
+	// instead of 0 (no match) like cBPF. Lets callers tell packets that are too short apart from packets that don't match.
+	// Division by zero still returns 0, unless SingleGuard fails first:
+	// blocks are split after divisions by X, so packet guards of later loads are checked after X is.
+	GuardFailureValue uint32
+
+	// MaxPacketOffset, if not 0, rejects filters with packet loads that need more than MaxPacketOffset bytes of packet:
+	// offset + size of absolute loads (including OffsetBase), and the constant offset + size of indirect loads.
+	// Only reachable loads are checked.
+	MaxPacketOffset uint32
+
+	// MaxBlocks, if not 0, rejects filters with more than MaxBlocks reachable blocks.
+	// Blocks are counted as they're found, so the check fails before the filter is fully split or any other pass runs:
+	// it bounds the time and memory spent compiling untrusted filters.
+	MaxBlocks int
+
+	// Selectivity are estimates of the fraction of packets conditional jumps with a constant (JumpIf) continue
+	// a chain of comparisons for, instead of jumping to the block every comparison of the chain fails to,
+	// keyed by the position of the jump in the filter.
+	// Chains of independent comparisons with a hint for each one are reordered to test the least likely to pass first,
+	// so packets that don't match fail sooner. Only the order comparisons are tested in changes, not the result of the filter.
+	Selectivity map[int]float64
+
+	// Metadata maps absolute packet loads (LoadAbsolute) at offsets in the region to loads from a metadata buffer,
+	// at offset - Metadata.Base, checked against the length of the buffer by their own guards.
+	// OffsetBase isn't added to them, and loads can't be partly in the region. Only supported by the eBPF and C backends.
+	Metadata MetadataRegion
+
+	// Comments are emitted by the C, Rust and WebAssembly backends, and ToEBPFAsm, alongside the code
+	// an instruction compiles to, keyed by the position of the instruction in the filter.
+	// Comments can't span multiple lines, or end in a backslash: it would continue a C line comment.
+	Comments map[int]string
+
+	// Profile, if set, is called with the time and memory spent in each phase of compiling the filter, once per phase.
+	// Measuring allocations is expensive, only for profiling.
+	Profile func(PhaseStats)
+
+	// Log, if set, is called with every change the compile passes make to the filter:
+	// removing instructions, narrowing loads, reordering comparisons, inserting guards and initialization, and moving blocks.
+	Log func(OptEvent)
+
+	// Rewrite, if set, is called with every instruction of the filter and its position before it is compiled.
+	// It returns the instruction to compile instead, which is validated like the original,
+	// or an error to reject the filter. The filter passed to the backend isn't modified.
+	Rewrite func(pc int, insn bpf.Instruction) (bpf.Instruction, error)
+
+	// liveScratch are the scratch positions read after the filter returns, stores to them are never removed.
+	liveScratch []int
+
+	// checkedLoads are packet loads that check the packet is long enough themselves, packet guards aren't added.
+	checkedLoads bool
+}
+
+// initialized returns the memory the caller guarantees is initialized
+func (c CompileOpts) initialized() (memStatus, error) {
+	status := memStatus{}
+
+	for _, reg := range c.InitializedRegs {
+		if reg != bpf.RegA && reg != bpf.RegX {
+			return status, errors.Errorf("invalid initialized register %v", reg)
+		}
+
+		status.regs[reg] = true
+	}
+
+	for _, n := range c.InitializedScratch {
+		if n < 0 || n >= len(status.scratch) {
+			return status, errors.Errorf("invalid initialized scratch position %d", n)
+		}
+
+		status.scratch[n] = true
+	}
+
+	return status, nil
+}
+
+// validateComments checks the comments are for instructions of a filter of length insns, and are single lines.
+func (c CompileOpts) validateComments(insns int) error {
+	for pc, comment := range c.Comments {
+		if pc < 0 || pc >= insns {
+			return errors.Errorf("comment for invalid instruction %d", pc)
+		}
+
+		if strings.ContainsAny(comment, "\r\n") {
+			return errors.Errorf("comment for instruction %d spans multiple lines", pc)
+		}
+
+		// Compilers continue lines ending in a backslash followed by whitespace too
+		if strings.HasSuffix(strings.TrimRight(comment, " \t"), "\\") {
+			return errors.Errorf("comment for instruction %d ends in a backslash", pc)
+		}
+	}
+
+	return nil
+}
+
+// symbol is the name of the symbol a backend generates: specific, the backend's own name option, if set, Name otherwise.
+// field is the name of the backend's option.
+func (c CompileOpts) symbol(specific, field string) (string, error) {
+	name := specific
+	if name == "" {
+		name = c.Name
+	}
+
+	if !funcNameRegex.MatchString(name) {
+		return "", errors.Errorf("invalid %s %s", field, name)
+	}
+
+	return name, nil
+}
+
+// guardLen is the packet length a packet guard of Len checks for, including the Trailer.
+func (c CompileOpts) guardLen(len uint32) uint64 {
+	return uint64(len) + uint64(c.Trailer)
+}
+
+// rewrite applies Rewrite to every instruction of a filter.
+func (c CompileOpts) rewrite(insns []bpf.Instruction) ([]bpf.Instruction, error) {
+	if c.Rewrite == nil {
+		return insns, nil
+	}
+
+	rewritten := make([]bpf.Instruction, len(insns))
+
+	for pc, insn := range insns {
+		var err error
+
+		rewritten[pc], err = c.Rewrite(pc, insn)
+		if err != nil {
+			return nil, errors.Wrapf(err, "instruction %d: %v rejected", pc, insn)
+		}
+
+		if rewritten[pc] == nil {
+			return nil, errors.Errorf("instruction %d: %v rewritten to nil", pc, insn)
+		}
+	}
+
+	return rewritten, nil
+}
+
+// barrier checks if the packet guards of the instructions after insn have to be checked after it:
+// stores to liveScratch outlive the filter, so have to happen even if a later load is past the end of the packet,
+// and divisions by X return 0 if X is 0, before a later guard could return GuardFailureValue.
+func (c CompileOpts) barrier(insn bpf.Instruction) bool {
+	switch i := insn.(type) {
+	case bpf.StoreScratch:
+		for _, n := range c.liveScratch {
+			if i.N == n {
+				return true
+			}
+		}
+	case bpf.ALUOpX:
+		return c.GuardFailureValue != 0 && isDivision(i.Op)
+	}
+
+	return false
+}
+
+// comment returns the comment of insn, if it has one.
+// Synthetic instructions never have comments.
+func (c CompileOpts) comment(insn instruction) (string, bool) {
+	if isSynthetic(insn.Instruction) {
+		return "", false
+	}
+
+	comment, ok := c.Comments[int(insn.id)]
+	return comment, ok
+}
+
+// isTerminator checks if an instruction always ends a block: a jump or a return.
+// Other instructions fall through to the next instruction.
+func isTerminator(insn bpf.Instruction) bool {
+	switch insn.(type) {
+	case bpf.Jump, bpf.JumpIf, bpf.JumpIfX, bpf.RetA, bpf.RetConstant:
+		return true
+	}
+
+	return false
+}
+
+// isSynthetic checks if an instruction is a "fake" instruction inserted by cbpfc
+func isSynthetic(insn bpf.Instruction) bool {
+	switch insn.(type) {
+	case packetGuardAbsolute, packetGuardIndirect, metadataGuard, initializeRegister, initializeScratch, checkXNotZero:
+		return true
+	}
+
+	return false
+}
+
+// Validate checks a cBPF filter can be compiled, without generating any code.
+// The first problem found is returned:
+// unsupported or invalid instructions, jumps or flow past the last instruction, divisions by a constant 0.
+//
+// The only extension supported is ld #len (bpf.LoadExtension of bpf.ExtLen), the length of the whole packet:
+// OffsetBase and Trailer don't change it.
+func Validate(insns []bpf.Instruction) error {
+	err := validateInstructions(insns)
+	if err != nil {
+		return err
+	}
+
+	instructions := toInstructions(insns)
+
+	normalizeJumps(instructions)
+
+	blocks, err := splitBlocks(instructions)
+	if err != nil {
+		return errors.Wrapf(err, "unable to compute blocks")
+	}
+
+	// Guards are thrown away, only the static checks matter
+	return addDivideByZeroGuards(blocks)
+}
+
 // compile compiles a cBPF program to an ordered slice of blocks, with:
 // - Registers zero initialized as required
 // - Required packet access guards added
 // - JumpIf and JumpIfX instructions normalized (see normalizeJumps)
-func compile(insns []bpf.Instruction) ([]*block, error) {
-	err := validateInstructions(insns)
+func compile(insns []bpf.Instruction, opts CompileOpts) ([]*block, error) {
+	return (&buffers{}).compile(insns, opts)
+}
+
+// buffers are scratch buffers that can be reused across compilations, to reduce allocations.
+// Nothing returned by a compilation references them.
+// The zero value is ready to use.
+type buffers struct {
+	instructions []instruction
+
+	// used by splitBlocks
+	targets        map[pos][]targetBlock
+	pendingTargets targetHeap
+
+	// used by addPacketGuards
+	absoluteGuards map[*block][]packetGuardAbsolute
+	indirectGuards map[*block][]packetGuardIndirect
+}
+
+// compile is compile(), using the buffers.
+func (b *buffers) compile(insns []bpf.Instruction, opts CompileOpts) ([]*block, error) {
+	var initialized memStatus
+	var features filterFeatures
+
+	err := opts.phase(PhaseValidate, func() error {
+		var err error
+
+		insns, err = opts.rewrite(insns)
+		if err != nil {
+			return err
+		}
+
+		err = validateInstructions(insns)
+		if err != nil {
+			return err
+		}
+
+		features = scanFeatures(insns)
+
+		if opts.HardenNoIndirect {
+			if err := checkNoIndirect(insns, features); err != nil {
+				return err
+			}
+		}
+
+		if opts.MaxBlocks < 0 {
+			return errors.Errorf("invalid MaxBlocks %d", opts.MaxBlocks)
+		}
+
+		if err := validateSelectivity(insns, opts.Selectivity); err != nil {
+			return err
+		}
+
+		initialized, err = opts.initialized()
+		if err != nil {
+			return err
+		}
+
+		return opts.validateComments(len(insns))
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	instructions := toInstructions(insns)
+	var blocks []*block
 
-	normalizeJumps(instructions)
+	err = opts.phase(PhaseSplitBlocks, func() error {
+		instructions := b.toInstructions(insns)
 
-	// Split into blocks
-	blocks, err := splitBlocks(instructions)
+		normalizeJumps(instructions)
+
+		// Before OffsetBase, it doesn't apply to metadata
+		err := mapMetadataLoads(instructions, opts.Metadata)
+		if err != nil {
+			return err
+		}
+
+		err = offsetAbsoluteLoads(instructions, opts.OffsetBase)
+		if err != nil {
+			return err
+		}
+
+		// Split into blocks
+		blocks, err = b.splitBlocks(instructions, opts.MaxBlocks)
+		if err != nil {
+			return errors.Wrapf(err, "unable to compute blocks")
+		}
+
+		opts.logUnreachable(blocks, len(instructions))
+
+		// Remove instructions that do nothing
+		opts.logRemovals("no ops", "no op ALU operation", blocks, func() {
+			removeNoOps(blocks)
+		})
+
+		// Load only the bytes of the packet that are used.
+		// The bytes kept depend on the byte order of the load, which isn't known for HostByteOrder.
+		if !opts.HostByteOrder {
+			narrowLoads(blocks, func(blk *block, from, to bpf.LoadAbsolute) {
+				opts.log("narrow loads", []*block{blk}, "narrowed %v to %v", from, to)
+			})
+		}
+
+		opts.logRemovals("dead stores", "dead store", blocks, func() {
+			removeDeadStores(blocks, opts.liveScratch)
+		})
+
+		// After dead stores, they can be the only reads of a register
+		opts.logRemovals("dead transfers", "dead register transfer", blocks, func() {
+			removeDeadTransfers(blocks)
+		})
+
+		// Once comparisons are as small as they get
+		reorderComparisons(blocks, opts.Selectivity, opts.GuardFailureValue, func(chain []*block, pcs []int) {
+			opts.log("selectivity", chain, "reordered comparisons to test instructions %v in order", pcs)
+		})
+
+		// Blocks are only split once they aren't modified anymore, splitting them doesn't make the filter faster
+		blocks = splitAfter(blocks, opts.barrier)
+
+		return nil
+	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to compute blocks")
+		return nil, err
 	}
 
-	// Initialize registers
-	initializeMemory(blocks)
+	err = opts.phase(PhaseInitializeMemory, func() error {
+		if opts.StrictUninitialized {
+			if _, insn, reads := uninitializedReads(blocks, initialized); insn != nil {
+				return errors.Errorf("instruction %v reads uninitialized %s", *insn, strings.Join(reads.names(), ", "))
+			}
+		}
+
+		// Initialize registers
+		return opts.logInsertions("initialize memory", blocks, func() error {
+			initializeMemory(blocks, initialized)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	// Check we don't divide by zero
-	err = addDivideByZeroGuards(blocks)
+	err = opts.phase(PhaseDivideByZeroGuards, func() error {
+		return opts.logInsertions("divide by zero guards", blocks, func() error {
+			return addDivideByZeroGuardsFeatures(blocks, features)
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	// Guard packet loads
-	addPacketGuards(blocks)
+	err = opts.phase(PhasePacketGuards, func() error {
+		if opts.MaxPacketOffset != 0 {
+			if err := checkMaxPacketOffset(blocks, opts.MaxPacketOffset); err != nil {
+				return err
+			}
+		}
+
+		return opts.logInsertions("packet guards", blocks, func() error {
+			switch {
+			case opts.checkedLoads:
+				// Nothing to guard
+			case opts.SingleGuard && onlyAbsolutePacketLoads(blocks):
+				addSinglePacketGuard(blocks)
+			default:
+				var hoisted map[*block]uint32
+				if opts.HoistGuards {
+					hoisted = hoistedGuards(blocks, opts.barrier)
+				}
+
+				b.addPacketGuards(blocks, features, hoisted)
+			}
+
+			addMetadataGuards(blocks)
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = opts.phase(PhaseBlockOrder, func() error {
+		switch opts.BlockOrder {
+		case SourceOrder:
+		case FallthroughFirst:
+			ordered := orderFallthroughFirst(blocks)
+			opts.logOrder(blocks, ordered)
+			blocks = ordered
+		default:
+			return errors.Errorf("unknown block order %d", opts.BlockOrder)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if debug {
+		if err := verifyGuards(blocks); err != nil {
+			return nil, errors.Wrap(err, "invalid packet guards")
+		}
+	}
 
 	return blocks, nil
 }
@@ -203,9 +890,34 @@ func validateInstructions(insns []bpf.Instruction) error {
 			return errors.Errorf("can't assemble insnstruction %d: %v", pc, insn)
 		}
 
-		switch insn.(type) {
-		case bpf.LoadExtension, bpf.RawInstruction:
+		switch i := insn.(type) {
+		// ld #len is the only extension that doesn't need a socket buffer
+		case bpf.LoadExtension:
+			if i.Num != bpf.ExtLen {
+				return errors.Errorf("unsupported instruction %d: %v", pc, insn)
+			}
+		case bpf.RawInstruction:
 			return errors.Errorf("unsupported instruction %d: %v", pc, insn)
+
+		// Assemble encodes any op, backends only know these
+		case bpf.ALUOpConstant:
+			if !isALUOp(i.Op) {
+				return errors.Errorf("instruction %d: unknown ALU op %#x", pc, uint16(i.Op))
+			}
+		case bpf.ALUOpX:
+			if !isALUOp(i.Op) {
+				return errors.Errorf("instruction %d: unknown ALU op %#x", pc, uint16(i.Op))
+			}
+
+		// Packet guards cover Off + Size, relative to X for indirect loads
+		case bpf.LoadAbsolute:
+			if loadEnd(i.Off, 0, i.Size) > math.MaxUint32 {
+				return errors.Errorf("instruction %d: %v overflows", pc, insn)
+			}
+		case bpf.LoadIndirect:
+			if loadEnd(i.Off, 0, i.Size) > math.MaxUint32 {
+				return errors.Errorf("instruction %d: %v overflows", pc, insn)
+			}
 		}
 	}
 
@@ -213,7 +925,17 @@ func validateInstructions(insns []bpf.Instruction) error {
 }
 
 func toInstructions(insns []bpf.Instruction) []instruction {
-	instructions := make([]instruction, len(insns))
+	return (&buffers{}).toInstructions(insns)
+}
+
+// toInstructions is toInstructions(), reusing the instructions buffer.
+// The instructions are only valid until the next call.
+func (b *buffers) toInstructions(insns []bpf.Instruction) []instruction {
+	if cap(b.instructions) < len(insns) {
+		b.instructions = make([]instruction, len(insns))
+	}
+
+	instructions := b.instructions[:len(insns)]
 
 	for pc, insn := range insns {
 		instructions[pc] = instruction{
@@ -249,6 +971,41 @@ func normalizeJumps(insns []instruction) {
 	}
 }
 
+// loadEnd is the end of a packet load of size bytes at off + base, which can exceed math.MaxUint32.
+func loadEnd(off, base uint32, size int) uint64 {
+	return uint64(off) + uint64(base) + uint64(size)
+}
+
+// offsetAbsoluteLoads adds base to the offset of every absolute packet load.
+func offsetAbsoluteLoads(insns []instruction, base uint32) error {
+	offset := func(off uint32, size int) (uint32, error) {
+		if loadEnd(off, base, size) > math.MaxUint32 {
+			return 0, errors.Errorf("offset %d overflows with base %d", off, base)
+		}
+
+		return off + base, nil
+	}
+
+	for pc := range insns {
+		var err error
+
+		switch i := insns[pc].Instruction.(type) {
+		case bpf.LoadAbsolute:
+			i.Off, err = offset(i.Off, i.Size)
+			insns[pc].Instruction = i
+		case bpf.LoadMemShift:
+			i.Off, err = offset(i.Off, 1)
+			insns[pc].Instruction = i
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "instruction %v", insns[pc])
+		}
+	}
+
+	return nil
+}
+
 // Check if a conditional jump should be inverted
 func shouldInvert(skipTrue, skipFalse uint8) bool {
 	return skipTrue == 0 && skipFalse != 0
@@ -277,107 +1034,482 @@ func visitBlock(insns []instruction, target pos) (*block, []skip) {
 			continue
 		}
 
-		// every insn including this one
-		return newBlock(insns[:pc+1]), skips
+		// every insn including this one
+		return newBlock(insns[:pc+1]), skips
+	}
+
+	// Try to fall through to next block
+	return newBlock(insns), []skip{0}
+}
+
+// targetBlock is a block that targets (ie jumps) to another block
+// used internally by splitBlocks()
+type targetBlock struct {
+	*block
+	// True IFF the block falls through to the other block (skip == 0)
+	isFallthrough bool
+}
+
+// splitBlocks splits the cBPF into an ordered list of blocks.
+//
+// The blocks are preserved in the order they are found as this guarantees that
+// a block only targets later blocks (cBPF jumps are positive, relative offsets).
+// This also mimics the layout of the original cBPF, which is good for debugging.
+func splitBlocks(instructions []instruction) ([]*block, error) {
+	return (&buffers{}).splitBlocks(instructions, 0)
+}
+
+// splitBlocks is splitBlocks(), reusing the targets buffers.
+// maxBlocks, if not 0, is the most blocks allowed: splitting stops with an error as soon as there are more.
+func (b *buffers) splitBlocks(instructions []instruction, maxBlocks int) ([]*block, error) {
+	// Blocks we've visited already
+	blocks := []*block{}
+
+	// map of targets to blocks that target them
+	if b.targets == nil {
+		b.targets = make(map[pos][]targetBlock)
+	}
+	targets := b.targets
+
+	// targets that haven't been visited yet, lowest first
+	pending := &b.pendingTargets
+	*pending = (*pending)[:0]
+
+	// Don't leak blocks of this compilation into the next one (on error)
+	defer func() {
+		for target := range targets {
+			delete(targets, target)
+		}
+	}()
+
+	// target 0 is for the base case
+	targets[0] = nil
+	heap.Push(pending, pos(0))
+
+	// As long as we have un visited targets
+	for pending.Len() > 0 {
+		// Get the first one (not really breadth first, but close enough!)
+		target := heap.Pop(pending).(pos)
+
+		end := len(instructions)
+		// If there's a next target, ensure we stop before it
+		if pending.Len() > 0 {
+			end = int((*pending)[0])
+		}
+
+		next, nextSkips := visitBlock(instructions[target:end], target)
+
+		// Add skips to our list of things to visit
+		for _, s := range nextSkips {
+			// Convert relative skip to absolute pos
+			t := next.skipToPos(s)
+
+			// The last instruction is a valid target, anything after it isn't.
+			// A block that doesn't end in a jump or return falls through to the next instruction (s == 0),
+			// which can be past the last instruction if the block is the last one.
+			if t >= pos(len(instructions)) {
+				if !isTerminator(next.last().Instruction) {
+					return nil, errors.Errorf("instruction %v flows past last instruction: the last reachable instruction has to return or jump", next.last())
+				}
+
+				return nil, errors.Errorf("instruction %v flows past last instruction", next.last())
+			}
+
+			if _, ok := targets[t]; !ok {
+				heap.Push(pending, t)
+			}
+
+			targets[t] = append(targets[t], targetBlock{next, s == 0})
+		}
+
+		jmpBlocks := targets[target]
+
+		// Mark all the blocks that jump to the block we've just visited as doing so
+		for _, jmpBlock := range jmpBlocks {
+			jmpBlock.jumps[target] = next
+
+			// Not a fallthrough, the block we've just visited is explicitly jumped to
+			if !jmpBlock.isFallthrough {
+				next.IsTarget = true
+			}
+		}
+
+		blocks = append(blocks, next)
+		if maxBlocks != 0 && len(blocks) > maxBlocks {
+			return nil, errors.Errorf("more than %d blocks", maxBlocks)
+		}
+
+		// Target is now a block!
+		delete(targets, target)
+	}
+
+	return blocks, nil
+}
+
+// orderFallthroughFirst moves the blocks that always return no match after all the other blocks.
+//
+// Blocks that return only have predecessors, so the blocks are still topologically sorted:
+// a block only targets later blocks.
+// Backends have to jump explicitly to blocks that are no longer laid out after a block that falls through to them.
+func orderFallthroughFirst(blocks []*block) []*block {
+	ordered := make([]*block, 0, len(blocks))
+	noMatch := []*block{}
+
+	for i, block := range blocks {
+		// The first block is the entry point, it can't be moved
+		if i != 0 && block.isNoMatch() {
+			noMatch = append(noMatch, block)
+			continue
+		}
+
+		ordered = append(ordered, block)
+	}
+
+	return append(ordered, noMatch...)
+}
+
+// targetHeap is a min heap of targets, implementing heap.Interface.
+type targetHeap []pos
+
+func (t targetHeap) Len() int           { return len(t) }
+func (t targetHeap) Less(i, j int) bool { return t[i] < t[j] }
+func (t targetHeap) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+func (t *targetHeap) Push(x interface{}) {
+	*t = append(*t, x.(pos))
+}
+
+func (t *targetHeap) Pop() interface{} {
+	old := *t
+	x := old[len(old)-1]
+	*t = old[:len(old)-1]
+	return x
+}
+
+// splitAfter splits blocks after every instruction barrier is true for, unless it's the last of its block:
+// the rest of the block becomes a new block it falls through to, laid out right after it.
+// Packet guards are checked at the start of blocks, so they can't fail before a barrier runs.
+func splitAfter(blocks []*block, barrier func(bpf.Instruction) bool) []*block {
+	var split []*block
+
+	for i, blk := range blocks {
+		for {
+			at := -1
+			for pc, insn := range blk.insns[:len(blk.insns)-1] {
+				if barrier(insn.Instruction) {
+					at = pc
+					break
+				}
+			}
+
+			if at == -1 {
+				break
+			}
+
+			if split == nil {
+				split = append(make([]*block, 0, len(blocks)+1), blocks[:i]...)
+			}
+
+			next := &block{
+				insns: blk.insns[at+1:],
+				jumps: blk.jumps,
+				id:    blk.insns[at+1].id,
+			}
+
+			blk.insns = blk.insns[: at+1 : at+1]
+			blk.jumps = map[pos]*block{next.id: next}
+
+			split = append(split, blk)
+			blk = next
+		}
+
+		if split != nil {
+			split = append(split, blk)
+		}
+	}
+
+	if split == nil {
+		return blocks
+	}
+
+	return split
+}
+
+// removeNoOps removes ALU operations that never change RegA (eg add #0),
+// unless they are the only instruction in a block so blocks are never empty.
+//
+// Division and modulus are never removed, even by 1, as they are also checked for division by zero.
+func removeNoOps(blocks []*block) {
+	for _, block := range blocks {
+		insns := make([]instruction, 0, len(block.insns))
+
+		for _, insn := range block.insns {
+			if !isNoOp(insn.Instruction) {
+				insns = append(insns, insn)
+			}
+		}
+
+		if len(insns) == 0 {
+			continue
+		}
+
+		block.insns = insns
+	}
+}
+
+// removeDeadStores removes StoreScratch instructions whose scratch position is never read afterwards, on any path,
+// unless they are the only instruction in a block so blocks are never empty.
+// liveOut are the scratch positions read after the filter returns.
+//
+// Blocks are topologically sorted, so the scratch positions live at the start of every block
+// are known once the blocks after it have been visited.
+func removeDeadStores(blocks []*block, liveOut []int) {
+	liveIn := make(map[*block][16]bool, len(blocks))
+
+	var exit [16]bool
+	for _, n := range liveOut {
+		exit[n] = true
+	}
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+
+		// Positions live at the end of the block are the ones live at the start of any successor, or after the filter
+		live := exit
+		for _, target := range block.jumps {
+			for n, l := range liveIn[target] {
+				live[n] = live[n] || l
+			}
+		}
+
+		keep := make([]bool, len(block.insns))
+		kept := 0
+
+		for pc := len(block.insns) - 1; pc >= 0; pc-- {
+			insn := block.insns[pc].Instruction
+
+			if store, ok := insn.(bpf.StoreScratch); ok && !live[store.N] {
+				continue
+			}
+
+			keep[pc] = true
+			kept++
+
+			writes, reads := memWrites(insn), memReads(insn)
+			for n := range live {
+				live[n] = (live[n] && !writes.scratch[n]) || reads.scratch[n]
+			}
+		}
+
+		liveIn[block] = live
+
+		if kept == len(block.insns) {
+			continue
+		}
+
+		// Only dead stores, keep the first one
+		if kept == 0 {
+			keep[0] = true
+			kept++
+		}
+
+		insns := make([]instruction, 0, kept)
+		for pc, insn := range block.insns {
+			if keep[pc] {
+				insns = append(insns, insn)
+			}
+		}
+
+		block.insns = insns
+	}
+}
+
+// removeDeadTransfers removes TAX and TXA instructions whose destination register is never read before it's written again,
+// on any path, unless they are the only instruction in a block so blocks are never empty.
+// Registers aren't read after the filter returns, RetA reads A.
+//
+// Like removeDeadStores, blocks are visited in reverse topological order.
+func removeDeadTransfers(blocks []*block) {
+	liveIn := make(map[*block]memStatus, len(blocks))
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+
+		// Registers live at the end of the block are the ones live at the start of any successor
+		live := memStatus{}
+		for _, target := range block.jumps {
+			live = live.or(liveIn[target])
+		}
+
+		keep := make([]bool, len(block.insns))
+		kept := 0
+
+		for pc := len(block.insns) - 1; pc >= 0; pc-- {
+			insn := block.insns[pc].Instruction
+
+			switch insn.(type) {
+			case bpf.TAX:
+				if !live.regs[bpf.RegX] {
+					continue
+				}
+			case bpf.TXA:
+				if !live.regs[bpf.RegA] {
+					continue
+				}
+			}
+
+			keep[pc] = true
+			kept++
+
+			writes, reads := memWrites(insn), memReads(insn)
+			for r := range live.regs {
+				live.regs[r] = (live.regs[r] && !writes.regs[r]) || reads.regs[r]
+			}
+		}
+
+		liveIn[block] = live
+
+		if kept == len(block.insns) {
+			continue
+		}
+
+		// Only dead transfers, keep the first one
+		if kept == 0 {
+			keep[0] = true
+			kept++
+		}
+
+		insns := make([]instruction, 0, kept)
+		for pc, insn := range block.insns {
+			if keep[pc] {
+				insns = append(insns, insn)
+			}
+		}
+
+		block.insns = insns
 	}
+}
 
-	// Try to fall through to next block
-	return newBlock(insns), []skip{0}
+// isALUOp checks if op is one of the ALU operations cBPF has
+func isALUOp(op bpf.ALUOp) bool {
+	switch op {
+	case bpf.ALUOpAdd, bpf.ALUOpSub, bpf.ALUOpMul, bpf.ALUOpDiv, bpf.ALUOpOr, bpf.ALUOpAnd,
+		bpf.ALUOpShiftLeft, bpf.ALUOpShiftRight, bpf.ALUOpMod, bpf.ALUOpXor:
+		return true
+	default:
+		return false
+	}
 }
 
-// targetBlock is a block that targets (ie jumps) to another block
-// used internally by splitBlocks()
-type targetBlock struct {
-	*block
-	// True IFF the block falls through to the other block (skip == 0)
-	isFallthrough bool
+// isShift checks if op is a shift
+func isShift(op bpf.ALUOp) bool {
+	return op == bpf.ALUOpShiftLeft || op == bpf.ALUOpShiftRight
 }
 
-// splitBlocks splits the cBPF into an ordered list of blocks.
-//
-// The blocks are preserved in the order they are found as this guarantees that
-// a block only targets later blocks (cBPF jumps are positive, relative offsets).
-// This also mimics the layout of the original cBPF, which is good for debugging.
-func splitBlocks(instructions []instruction) ([]*block, error) {
-	// Blocks we've visited already
-	blocks := []*block{}
+// isNoOp checks if an instruction is an ALU operation that never changes RegA
+func isNoOp(insn bpf.Instruction) bool {
+	i, ok := insn.(bpf.ALUOpConstant)
+	if !ok {
+		return false
+	}
 
-	// map of targets to blocks that target them
-	// target 0 is for the base case
-	targets := map[pos][]targetBlock{
-		0: nil,
+	switch i.Op {
+	case bpf.ALUOpAdd, bpf.ALUOpSub, bpf.ALUOpOr, bpf.ALUOpXor, bpf.ALUOpShiftLeft, bpf.ALUOpShiftRight:
+		return i.Val == 0
+	case bpf.ALUOpMul:
+		return i.Val == 1
+	case bpf.ALUOpAnd:
+		return i.Val == 0xFFFFFFFF
 	}
 
-	// As long as we have un visited targets
-	for len(targets) > 0 {
-		sortedTargets := sortTargets(targets)
+	return false
+}
 
-		// Get the first one (not really breadth first, but close enough!)
-		target := sortedTargets[0]
+// filterFeatures are the features of a filter that require extra passes.
+// Filters without them, like most header filters that only have absolute packet loads, skip the passes.
+type filterFeatures struct {
+	// LoadIndirect
+	indirectLoads bool
 
-		end := len(instructions)
-		// If there's a next target, ensure we stop before it
-		if len(sortedTargets) > 1 {
-			end = int(sortedTargets[1])
-		}
+	// ALUOpX division or modulus
+	divisionsByX bool
 
-		next, nextSkips := visitBlock(instructions[target:end], target)
+	// LoadIndirect, LoadMemShift or ALUOpX, at position usesXPC for the first one
+	usesX   bool
+	usesXPC int
+}
 
-		// Add skips to our list of things to visit
-		for _, s := range nextSkips {
-			// Convert relative skip to absolute pos
-			t := next.skipToPos(s)
+// allFeatures doesn't skip any passes.
+var allFeatures = filterFeatures{indirectLoads: true, divisionsByX: true}
 
-			if t >= pos(len(instructions)) {
-				return nil, errors.Errorf("instruction %v flows past last instruction", next.last())
-			}
+// scanFeatures finds the features a filter uses.
+func scanFeatures(insns []bpf.Instruction) filterFeatures {
+	features := filterFeatures{}
 
-			targets[t] = append(targets[t], targetBlock{next, s == 0})
+	usesX := func(pc int) {
+		if !features.usesX {
+			features.usesX, features.usesXPC = true, pc
 		}
+	}
 
-		jmpBlocks := targets[target]
-
-		// Mark all the blocks that jump to the block we've just visited as doing so
-		for _, jmpBlock := range jmpBlocks {
-			jmpBlock.jumps[target] = next
-
-			// Not a fallthrough, the block we've just visited is explicitly jumped to
-			if !jmpBlock.isFallthrough {
-				next.IsTarget = true
+	for pc, insn := range insns {
+		switch i := insn.(type) {
+		case bpf.LoadIndirect:
+			features.indirectLoads = true
+			usesX(pc)
+		case bpf.LoadMemShift:
+			usesX(pc)
+		case bpf.ALUOpX:
+			if isDivision(i.Op) {
+				features.divisionsByX = true
 			}
+			usesX(pc)
 		}
-
-		blocks = append(blocks, next)
-
-		// Target is now a block!
-		delete(targets, target)
 	}
 
-	return blocks, nil
+	return features
 }
 
-// sortTargets sorts the target positions (keys), lowest first
-func sortTargets(targets map[pos][]targetBlock) []pos {
-	keys := make([]pos, len(targets))
-
-	i := 0
-	for k := range targets {
-		keys[i] = k
-		i++
+// checkNoIndirect checks a filter has no instructions HardenNoIndirect rejects, using the features scanned from it.
+func checkNoIndirect(insns []bpf.Instruction, features filterFeatures) error {
+	if !features.usesX {
+		return nil
 	}
 
-	sort.Slice(keys, func(i, j int) bool {
-		return keys[i] < keys[j]
-	})
+	pc := features.usesXPC
+	switch insn := insns[pc]; insn.(type) {
+	case bpf.LoadIndirect:
+		return errors.Errorf("instruction %d: %v loads relative to x, rejected by HardenNoIndirect", pc, insn)
+	case bpf.LoadMemShift:
+		return errors.Errorf("instruction %d: %v loads into x, rejected by HardenNoIndirect", pc, insn)
+	default:
+		return errors.Errorf("instruction %d: %v operates on x, rejected by HardenNoIndirect", pc, insn)
+	}
+}
 
-	return keys
+// isDivision checks if op is a division or modulus, that can divide by 0
+func isDivision(op bpf.ALUOp) bool {
+	return op == bpf.ALUOpDiv || op == bpf.ALUOpMod
 }
 
 // addDivideByZeroGuards adds runtime guards / checks to ensure
 // the program returns no match when it would otherwise divide by zero.
 func addDivideByZeroGuards(blocks []*block) error {
-	isDivision := func(op bpf.ALUOp) bool {
-		return op == bpf.ALUOpDiv || op == bpf.ALUOpMod
+	return addDivideByZeroGuardsFeatures(blocks, allFeatures)
+}
+
+// addDivideByZeroGuardsFeatures is addDivideByZeroGuards(), only checking X if the filter divides by it.
+func addDivideByZeroGuardsFeatures(blocks []*block, features filterFeatures) error {
+	if !features.divisionsByX {
+		for _, block := range blocks {
+			for _, insn := range block.insns {
+				if i, ok := insn.Instruction.(bpf.ALUOpConstant); ok && isDivision(i.Op) && i.Val == 0 {
+					return errors.Errorf("instruction %v divides by 0", insn)
+				}
+			}
+		}
+
+		return nil
 	}
 
 	// Is RegX known to be none 0 at the start of each block
@@ -432,21 +1564,49 @@ func addDivideByZeroGuards(blocks []*block) error {
 // We can check if the block requires a longer / bigger guard than
 // the shortest / least existing guard.
 func addPacketGuards(blocks []*block) {
+	(&buffers{}).addPacketGuards(blocks, allFeatures, nil)
+}
+
+// addPacketGuards is addPacketGuards(), reusing the guard buffers.
+// Indirect guards are only added if the filter has indirect loads.
+// hoisted are the absolute guards hoisted to each block, from hoistedGuards(). nil to not hoist guards.
+func (b *buffers) addPacketGuards(blocks []*block, features filterFeatures, hoisted map[*block]uint32) {
 	if len(blocks) == 0 {
 		return
 	}
 
-	// Guards in effect at the start of each block
+	if !features.indirectLoads {
+		b.addAbsolutePacketGuards(blocks, hoisted)
+		return
+	}
+
+	if b.absoluteGuards == nil {
+		b.absoluteGuards = make(map[*block][]packetGuardAbsolute)
+		b.indirectGuards = make(map[*block][]packetGuardIndirect)
+	}
+
+	// Guards in effect at the end of the predecessors of each block
+	// The least of them is in effect at the start of the block, as it's the only one guaranteed on every path.
 	// Can't jump backwards so we only need to traverse blocks once
-	absoluteGuards := make(map[*block][]packetGuardAbsolute)
-	indirectGuards := make(map[*block][]packetGuardIndirect)
+	absoluteGuards := b.absoluteGuards
+	indirectGuards := b.indirectGuards
+
+	// Don't keep the blocks alive
+	defer func() {
+		for block := range absoluteGuards {
+			delete(absoluteGuards, block)
+		}
+		for block := range indirectGuards {
+			delete(indirectGuards, block)
+		}
+	}()
 
 	// first block starts with no guards
 	absoluteGuards[blocks[0]] = []packetGuardAbsolute{{Len: 0}}
 	indirectGuards[blocks[0]] = []packetGuardIndirect{{Len: 0}}
 
 	for _, block := range blocks {
-		absolute := addAbsolutePacketGuard(block, leastAbsoluteGuard(absoluteGuards[block]))
+		absolute := addAbsolutePacketGuard(block, leastAbsoluteGuard(absoluteGuards[block]), hoisted[block])
 		indirect := addIndirectPacketGuard(block, leastIndirectGuard(indirectGuards[block]))
 
 		for _, target := range block.jumps {
@@ -456,6 +1616,104 @@ func addPacketGuards(blocks []*block) {
 	}
 }
 
+// addAbsolutePacketGuards is addPacketGuards() for filters without indirect packet loads.
+func (b *buffers) addAbsolutePacketGuards(blocks []*block, hoisted map[*block]uint32) {
+	if b.absoluteGuards == nil {
+		b.absoluteGuards = make(map[*block][]packetGuardAbsolute)
+		b.indirectGuards = make(map[*block][]packetGuardIndirect)
+	}
+
+	absoluteGuards := b.absoluteGuards
+	defer func() {
+		for block := range absoluteGuards {
+			delete(absoluteGuards, block)
+		}
+	}()
+
+	absoluteGuards[blocks[0]] = []packetGuardAbsolute{{Len: 0}}
+
+	for _, block := range blocks {
+		absolute := addAbsolutePacketGuard(block, leastAbsoluteGuard(absoluteGuards[block]), hoisted[block])
+
+		for _, target := range block.jumps {
+			absoluteGuards[target] = append(absoluteGuards[target], absolute)
+		}
+	}
+}
+
+// hoistedGuards computes the length of packet every path from each block needs, so absolute guards can be hoisted to it.
+// A packet shorter than that fails a guard on every path, and can fail before the block jumps anywhere:
+// the result of the filter is the same, but blocks that jump to many blocks that load the packet
+// need a single guard instead of one in each target.
+// Indirect guards aren't hoisted, the offset of indirect loads depends on X.
+// Guards aren't hoisted to blocks that end in a barrier, the guards can't fail before it.
+func hoistedGuards(blocks []*block, barrier func(bpf.Instruction) bool) map[*block]uint32 {
+	needs := make(map[*block]uint32, len(blocks))
+
+	// Blocks only jump forwards, the targets of a block are always visited before it
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+
+		// Least length needed by the targets, 0 if the block returns or ends in a barrier
+		var least uint32
+		first := true
+		for _, target := range block.jumps {
+			if barrier(block.last().Instruction) {
+				break
+			}
+
+			if first || needs[target] < least {
+				least = needs[target]
+				first = false
+			}
+		}
+
+		need := absoluteLoadsLen(block)
+		if least > need {
+			need = least
+		}
+
+		needs[block] = need
+	}
+
+	return needs
+}
+
+// onlyAbsolutePacketLoads checks if the only packet loads the blocks have are LoadAbsolute.
+func onlyAbsolutePacketLoads(blocks []*block) bool {
+	for _, block := range blocks {
+		for _, insn := range block.insns {
+			switch insn.Instruction.(type) {
+			case bpf.LoadIndirect, bpf.LoadMemShift:
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// addSinglePacketGuard adds a single absolute packet guard to the first block,
+// covering every absolute packet load of every block.
+// Only valid if the blocks have no other packet loads (see onlyAbsolutePacketLoads).
+func addSinglePacketGuard(blocks []*block) {
+	if len(blocks) == 0 {
+		return
+	}
+
+	var biggestLen uint32
+
+	for _, block := range blocks {
+		if a := absoluteLoadsLen(block); a > biggestLen {
+			biggestLen = a
+		}
+	}
+
+	if biggestLen > 0 {
+		blocks[0].insert(0, instruction{Instruction: packetGuardAbsolute{Len: biggestLen}})
+	}
+}
+
 // leastAbsoluteGuard gets the packet guard with least Len / lowest range
 func leastAbsoluteGuard(guards []packetGuardAbsolute) packetGuardAbsolute {
 	sort.Slice(guards, func(i, j int) bool {
@@ -476,20 +1734,11 @@ func leastIndirectGuard(guards []packetGuardIndirect) packetGuardIndirect {
 
 // addAbsolutePacketGuard adds required packet guards to a block knowing the least guard in effect at the start of block.
 // The guard in effect at the end of the block is returned (may be nil).
-func addAbsolutePacketGuard(block *block, guard packetGuardAbsolute) packetGuardAbsolute {
-	var biggestLen uint32
-
-	for _, insn := range block.insns {
-		switch i := insn.Instruction.(type) {
-		case bpf.LoadAbsolute:
-			if a := i.Off + uint32(i.Size); a > biggestLen {
-				biggestLen = a
-			}
-		case bpf.LoadMemShift:
-			if a := i.Off + 1; a > biggestLen {
-				biggestLen = a
-			}
-		}
+// hoisted is the length of packet the block needs to guard, even if it doesn't load it itself.
+func addAbsolutePacketGuard(block *block, guard packetGuardAbsolute, hoisted uint32) packetGuardAbsolute {
+	biggestLen := absoluteLoadsLen(block)
+	if hoisted > biggestLen {
+		biggestLen = hoisted
 	}
 
 	if biggestLen > guard.Len {
@@ -502,6 +1751,58 @@ func addAbsolutePacketGuard(block *block, guard packetGuardAbsolute) packetGuard
 	return guard
 }
 
+// absoluteLoadsLen is the length of packet the absolute loads of a block need.
+func absoluteLoadsLen(block *block) uint32 {
+	var biggestLen uint32
+
+	for _, insn := range block.insns {
+		if a, ok := absoluteLoadLen(insn.Instruction); ok && a > biggestLen {
+			biggestLen = a
+		}
+	}
+
+	return biggestLen
+}
+
+// absoluteLoadLen is the length of packet an absolute packet load needs, offset + size.
+func absoluteLoadLen(insn bpf.Instruction) (uint32, bool) {
+	switch i := insn.(type) {
+	case bpf.LoadAbsolute:
+		return i.Off + uint32(i.Size), true
+	case bpf.LoadMemShift:
+		return i.Off + 1, true
+	}
+
+	return 0, false
+}
+
+// indirectLoadLen is the length of packet after X an indirect packet load needs, offset + size.
+func indirectLoadLen(insn bpf.Instruction) (uint32, bool) {
+	if i, ok := insn.(bpf.LoadIndirect); ok {
+		return i.Off + uint32(i.Size), true
+	}
+
+	return 0, false
+}
+
+// checkMaxPacketOffset checks no packet load of the blocks needs more than max bytes of packet,
+// ignoring X for indirect loads.
+func checkMaxPacketOffset(blocks []*block, max uint32) error {
+	for _, block := range blocks {
+		for _, insn := range block.insns {
+			if a, ok := absoluteLoadLen(insn.Instruction); ok && a > max {
+				return errors.Errorf("instruction %v needs %d bytes of packet, more than MaxPacketOffset %d", insn, a, max)
+			}
+
+			if a, ok := indirectLoadLen(insn.Instruction); ok && a > max {
+				return errors.Errorf("instruction %v needs x + %d bytes of packet, more than MaxPacketOffset %d", insn, a, max)
+			}
+		}
+	}
+
+	return nil
+}
+
 // addIndirectPacketGuard adds required packet guards to a block knowing the least guard in effect at the start of block.
 // The guard in effect at the end of the block is returned (may be nil).
 func addIndirectPacketGuard(block *block, guard packetGuardIndirect) packetGuardIndirect {
@@ -510,14 +1811,12 @@ func addIndirectPacketGuard(block *block, guard packetGuardIndirect) packetGuard
 	for pc := 0; pc < len(block.insns); pc++ {
 		insn := block.insns[pc]
 
-		switch i := insn.Instruction.(type) {
-		case bpf.LoadIndirect:
-			if a := i.Off + uint32(i.Size); a > biggestLen {
-				biggestLen = a
-			}
+		if a, ok := indirectLoadLen(insn.Instruction); ok && a > biggestLen {
+			biggestLen = a
 		}
 
 		// Check if we clobbered x - this invalidates the guard
+		// LoadMemShift is also an absolute packet load, but that's covered by addAbsolutePacketGuard
 		clobbered := memWrites(insn.Instruction).regs[bpf.RegX]
 
 		// End of block or x clobbered -> create guard for previous instructions
@@ -579,18 +1878,157 @@ func (r memStatus) or(other memStatus) memStatus {
 }
 
 // initializeMemory zero initializes all the memory (regs & scratch) that the BPF program reads from before writing to.
-func initializeMemory(blocks []*block) {
+// Memory in initialized is guaranteed to be initialized by the caller, and never zero initialized.
+//
+// Memory is initialized in the latest block that dominates (is on every path to) all the blocks that read it uninitialized,
+// so paths that never read it don't initialize it.
+// The block can't be reachable from a block that writes the memory, as initializing it would clobber the write.
+func initializeMemory(blocks []*block, initialized memStatus) {
+	reads, _, _ := uninitializedReads(blocks, initialized)
+
+	doms := newDominators(blocks)
+	written := mayBeWritten(blocks)
+
+	// initBlock finds the block to initialize memory in, given the blocks that read it uninitialized
+	initBlock := func(read func(memStatus) bool) *block {
+		var dom *block
+
+		for _, block := range blocks {
+			if read(reads[block]) {
+				dom = doms.common(dom, block)
+			}
+		}
+
+		for dom != nil && read(written[dom]) {
+			dom = doms.idoms[dom]
+		}
+
+		return dom
+	}
+
+	for reg := range (memStatus{}).regs {
+		dom := initBlock(func(status memStatus) bool { return status.regs[reg] })
+		if dom == nil {
+			continue
+		}
+
+		dom.insert(0, instruction{
+			Instruction: initializeRegister{
+				Reg: bpf.Register(reg),
+			},
+		})
+	}
+
+	for scratch := range (memStatus{}).scratch {
+		dom := initBlock(func(status memStatus) bool { return status.scratch[scratch] })
+		if dom == nil {
+			continue
+		}
+
+		dom.insert(0, instruction{
+			Instruction: initializeScratch{
+				N: scratch,
+			},
+		})
+	}
+}
+
+// dominators are the immediate dominators of blocks: the latest block that is on every path to a block.
+// The first block has no dominator.
+type dominators struct {
+	idoms map[*block]*block
+
+	// position of each block, blocks are always laid out after their dominators
+	index map[*block]int
+}
+
+// newDominators computes the dominators of blocks.
+// Blocks are topologically sorted, so the dominator of a block is known once all its predecessors have been visited.
+func newDominators(blocks []*block) dominators {
+	doms := dominators{
+		idoms: make(map[*block]*block),
+		index: make(map[*block]int),
+	}
+
+	for i, block := range blocks {
+		doms.index[block] = i
+	}
+
+	for _, block := range blocks {
+		for _, target := range block.jumps {
+			doms.idoms[target] = doms.common(doms.idoms[target], block)
+		}
+	}
+
+	return doms
+}
+
+// common returns the latest block that dominates (or is) both a and b.
+// nil is dominated by every block.
+func (d dominators) common(a, b *block) *block {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+
+	for a != b {
+		for d.index[a] > d.index[b] {
+			a = d.idoms[a]
+		}
+		for d.index[b] > d.index[a] {
+			b = d.idoms[b]
+		}
+	}
+
+	return a
+}
+
+// mayBeWritten returns the memory that may have been written on at least one path to the start of every block.
+func mayBeWritten(blocks []*block) map[*block]memStatus {
+	statuses := make(map[*block]memStatus)
+
+	for _, block := range blocks {
+		status := statuses[block]
+
+		for _, insn := range block.insns {
+			status = status.or(memWrites(insn.Instruction))
+		}
+
+		for _, target := range block.jumps {
+			statuses[target] = statuses[target].or(status)
+		}
+	}
+
+	return statuses
+}
+
+// uninitializedReads returns the memory each block reads before it is initialized on at least one path,
+// and the first instruction that does so (nil if none do) along with the uninitialized memory it reads.
+func uninitializedReads(blocks []*block, initialized memStatus) (map[*block]memStatus, *instruction, memStatus) {
 	// memory initialized at the start of each block
 	statuses := make(map[*block]memStatus)
 
-	// uninitialized memory used so far
-	uninitialized := memStatus{}
+	// the first block starts with the caller initialized memory
+	statuses[blocks[0]] = initialized
+
+	// uninitialized memory used by each block
+	uninitialized := make(map[*block]memStatus)
+	var first *instruction
+	var firstReads memStatus
 
 	for _, block := range blocks {
 		status := statuses[block]
 
-		for _, insn := range block.insns {
-			uninitialized = uninitialized.or(memUninitializedReads(insn.Instruction, status))
+		for i, insn := range block.insns {
+			reads := memUninitializedReads(insn.Instruction, status)
+			if first == nil && reads != (memStatus{}) {
+				first = &block.insns[i]
+				firstReads = reads
+			}
+
+			uninitialized[block] = uninitialized[block].or(reads)
 			status = status.or(memWrites(insn.Instruction))
 		}
 
@@ -607,30 +2045,26 @@ func initializeMemory(blocks []*block) {
 		}
 	}
 
-	for reg, uninit := range uninitialized.regs {
-		if !uninit {
-			continue
-		}
+	return uninitialized, first, firstReads
+}
 
-		blocks[0].insert(0, instruction{
-			Instruction: bpf.LoadConstant{
-				Dst: bpf.Register(reg),
-				Val: 0,
-			},
-		})
-	}
+// names returns the cBPF names of the memory set in the status
+func (r memStatus) names() []string {
+	names := []string{}
 
-	for scratch, uninit := range uninitialized.scratch {
-		if !uninit {
-			continue
+	for reg, set := range r.regs {
+		if set {
+			names = append(names, regName(bpf.Register(reg)))
 		}
+	}
 
-		blocks[0].insert(0, instruction{
-			Instruction: initializeScratch{
-				N: scratch,
-			},
-		})
+	for n, set := range r.scratch {
+		if set {
+			names = append(names, fmt.Sprintf("M[%d]", n))
+		}
 	}
+
+	return names
 }
 
 // memUninitializedReads returns the memory read by insn that has not yet been initialized according to initialized.
@@ -692,10 +2126,14 @@ func memWrites(insn bpf.Instruction) memStatus {
 
 	case bpf.LoadAbsolute:
 		write.regs[bpf.RegA] = true
+	case loadMetadata:
+		write.regs[bpf.RegA] = true
 	case bpf.LoadConstant:
 		write.regs[i.Dst] = true
 	case bpf.LoadIndirect:
 		write.regs[bpf.RegA] = true
+	case bpf.LoadExtension:
+		write.regs[bpf.RegA] = true
 	case bpf.LoadMemShift:
 		write.regs[bpf.RegX] = true
 	case bpf.LoadScratch:
@@ -711,6 +2149,11 @@ func memWrites(insn bpf.Instruction) memStatus {
 		write.regs[bpf.RegX] = true
 	case bpf.TXA:
 		write.regs[bpf.RegA] = true
+
+	case initializeRegister:
+		write.regs[i.Reg] = true
+	case initializeScratch:
+		write.scratch[i.N] = true
 	}
 
 	return write
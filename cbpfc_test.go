@@ -1,15 +1,23 @@
 package cbpfc
 
 import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/newtools/ebpf"
+	"github.com/pkg/errors"
 	"golang.org/x/net/bpf"
 )
 
 // Make sure we bail out with 0 instructions
 func TestZero(t *testing.T) {
-	_, err := compile([]bpf.Instruction{})
+	_, err := compile([]bpf.Instruction{}, CompileOpts{})
 
 	if err == nil {
 		t.Fatal("zero length instructions compiled", err)
@@ -19,7 +27,7 @@ func TestZero(t *testing.T) {
 func TestRaw(t *testing.T) {
 	_, err := compile([]bpf.Instruction{
 		bpf.RawInstruction{},
-	})
+	}, CompileOpts{})
 
 	if err == nil {
 		t.Fatal("raw instruction accepted", err)
@@ -29,7 +37,7 @@ func TestRaw(t *testing.T) {
 func TestExtension(t *testing.T) {
 	_, err := compile([]bpf.Instruction{
 		bpf.LoadExtension{},
-	})
+	}, CompileOpts{})
 
 	if err == nil {
 		t.Fatal("load extension accepted", err)
@@ -41,7 +49,7 @@ func TestJumpOut(t *testing.T) {
 	_, err := compile([]bpf.Instruction{
 		bpf.LoadConstant{Dst: bpf.RegX, Val: 0},
 		bpf.Jump{Skip: 0},
-	})
+	}, CompileOpts{})
 
 	if err == nil {
 		t.Fatal("out of bounds skip compiled")
@@ -52,7 +60,7 @@ func TestJumpIfOut(t *testing.T) {
 	_, err := compile([]bpf.Instruction{
 		bpf.LoadConstant{Dst: bpf.RegA, Val: 0},
 		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 2, SkipTrue: 0, SkipFalse: 1},
-	})
+	}, CompileOpts{})
 
 	if err == nil {
 		t.Fatal("out of bounds skip compiled")
@@ -64,7 +72,7 @@ func TestJumpIfXOut(t *testing.T) {
 		bpf.LoadConstant{Dst: bpf.RegA, Val: 0},
 		bpf.LoadConstant{Dst: bpf.RegX, Val: 3},
 		bpf.JumpIfX{Cond: bpf.JumpEqual, SkipTrue: 1, SkipFalse: 0},
-	})
+	}, CompileOpts{})
 
 	if err == nil {
 		t.Fatal("out of bounds skip compiled")
@@ -75,13 +83,80 @@ func TestJumpIfXOut(t *testing.T) {
 func TestFallthroughOut(t *testing.T) {
 	_, err := compile([]bpf.Instruction{
 		bpf.LoadConstant{Dst: bpf.RegA, Val: 0},
-	})
+	}, CompileOpts{})
 
 	if err == nil {
 		t.Fatal("out of bounds fall through compiled")
 	}
 }
 
+// Check instructions can be replaced before they're compiled
+func TestRewrite(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 1000},
+		bpf.RetA{},
+	}
+
+	blocks, err := compile(filter, CompileOpts{
+		Rewrite: func(pc int, insn bpf.Instruction) (bpf.Instruction, error) {
+			// Cap offsets
+			if load, ok := insn.(bpf.LoadAbsolute); ok && load.Off > 100 {
+				return bpf.LoadConstant{Dst: bpf.RegA, Val: 0}, nil
+			}
+
+			return insn, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []instruction{
+		{Instruction: bpf.LoadConstant{Dst: bpf.RegA, Val: 0}, id: 0},
+		{Instruction: bpf.RetA{}, id: 1},
+	}
+
+	if len(blocks) != 1 || !reflect.DeepEqual(blocks[0].insns, expected) {
+		t.Fatalf("expected instructions %v, got %v", expected, blocks[0].insns)
+	}
+
+	// The filter isn't modified
+	if filter[0] != (bpf.LoadAbsolute{Size: 2, Off: 1000}) {
+		t.Fatalf("filter modified to %v", filter)
+	}
+}
+
+// Check rewrites can reject instructions, and are validated
+func TestRewriteReject(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadIndirect{Size: 1, Off: 0},
+		bpf.RetA{},
+	}
+
+	for name, rewrite := range map[string]func(int, bpf.Instruction) (bpf.Instruction, error){
+		"rejected": func(pc int, insn bpf.Instruction) (bpf.Instruction, error) {
+			if _, ok := insn.(bpf.LoadIndirect); ok {
+				return nil, errors.New("indirect loads not allowed")
+			}
+			return insn, nil
+		},
+		"nil": func(pc int, insn bpf.Instruction) (bpf.Instruction, error) {
+			return nil, nil
+		},
+		"invalid": func(pc int, insn bpf.Instruction) (bpf.Instruction, error) {
+			return bpf.LoadExtension{Num: bpf.ExtLen}, nil
+		},
+		"out of bounds": func(pc int, insn bpf.Instruction) (bpf.Instruction, error) {
+			return bpf.Jump{Skip: 10}, nil
+		},
+	} {
+		_, err := compile(filter, CompileOpts{Rewrite: rewrite})
+		if err == nil {
+			t.Fatalf("%s rewrite accepted", name)
+		}
+	}
+}
+
 // Jump normalization
 func TestNormalizeJumps(t *testing.T) {
 	insns := func(skipTrue, skipFalse uint8) []instruction {
@@ -159,6 +234,143 @@ func TestNormalizeJumps(t *testing.T) {
 	check(t, insns(0, 3), invertedInsns(3, 0))
 }
 
+// randomFilter generates a valid filter of n instructions, with jumps of every size that fits.
+func randomFilter(rng *rand.Rand, n int) []bpf.Instruction {
+	conds := []bpf.JumpTest{
+		bpf.JumpEqual, bpf.JumpNotEqual, bpf.JumpGreaterThan, bpf.JumpLessThan,
+		bpf.JumpGreaterOrEqual, bpf.JumpLessOrEqual, bpf.JumpBitsSet, bpf.JumpBitsNotSet,
+	}
+
+	filter := make([]bpf.Instruction, n)
+
+	for pc := 0; pc < n-1; pc++ {
+		// Jump to any instruction after this one
+		maxSkip := n - 2 - pc
+		if maxSkip > math.MaxUint8 {
+			maxSkip = math.MaxUint8
+		}
+		skip := func() uint8 {
+			return uint8(rng.Intn(maxSkip + 1))
+		}
+
+		switch rng.Intn(6) {
+		case 0:
+			filter[pc] = bpf.LoadAbsolute{Size: 1, Off: uint32(rng.Intn(4))}
+		case 1:
+			filter[pc] = bpf.LoadConstant{Dst: bpf.RegX, Val: uint32(rng.Intn(4))}
+		case 2:
+			filter[pc] = bpf.JumpIf{Cond: conds[rng.Intn(len(conds))], Val: uint32(rng.Intn(4)), SkipTrue: skip(), SkipFalse: skip()}
+		case 3:
+			filter[pc] = bpf.JumpIfX{Cond: conds[rng.Intn(len(conds))], SkipTrue: skip(), SkipFalse: skip()}
+		case 4:
+			filter[pc] = bpf.Jump{Skip: uint32(skip())}
+		case 5:
+			filter[pc] = bpf.RetA{}
+		}
+	}
+
+	filter[n-1] = bpf.RetA{}
+
+	return filter
+}
+
+// jumpTaken gives the position a conditional jump at pc goes to, for values of A and X.
+func jumpTaken(t *testing.T, pc int, insn bpf.Instruction, a, x uint32) int {
+	var cond bpf.JumpTest
+	var val uint32
+	var skipTrue, skipFalse uint8
+
+	switch i := insn.(type) {
+	case bpf.JumpIf:
+		cond, val, skipTrue, skipFalse = i.Cond, i.Val, i.SkipTrue, i.SkipFalse
+	case bpf.JumpIfX:
+		cond, val, skipTrue, skipFalse = i.Cond, x, i.SkipTrue, i.SkipFalse
+	default:
+		t.Fatalf("%v isn't a conditional jump", insn)
+	}
+
+	taken := map[bpf.JumpTest]bool{
+		bpf.JumpEqual:          a == val,
+		bpf.JumpNotEqual:       a != val,
+		bpf.JumpGreaterThan:    a > val,
+		bpf.JumpLessThan:       a < val,
+		bpf.JumpGreaterOrEqual: a >= val,
+		bpf.JumpLessOrEqual:    a <= val,
+		bpf.JumpBitsSet:        a&val != 0,
+		bpf.JumpBitsNotSet:     a&val == 0,
+	}[cond]
+
+	if taken {
+		return pc + 1 + int(skipTrue)
+	}
+	return pc + 1 + int(skipFalse)
+}
+
+// Check normalizing jumps of random filters never changes where they go
+func TestNormalizeJumpsRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	for n := 0; n < 500; n++ {
+		filter := randomFilter(rng, 2+rng.Intn(300))
+
+		insns := toInstructions(filter)
+		normalizeJumps(insns)
+
+		normalized := make([]bpf.Instruction, len(insns))
+		for pc, insn := range insns {
+			normalized[pc] = insn.Instruction
+
+			switch insn.Instruction.(type) {
+			case bpf.JumpIf, bpf.JumpIfX:
+			default:
+				if insn.Instruction != filter[pc] {
+					t.Fatalf("instruction %d: %v changed to %v", pc, filter[pc], insn.Instruction)
+				}
+				continue
+			}
+
+			for _, a := range []uint32{0, 1, 2, 3, 4, math.MaxUint32} {
+				for _, x := range []uint32{0, 1, 3} {
+					if expected, got := jumpTaken(t, pc, filter[pc], a, x), jumpTaken(t, pc, insn.Instruction, a, x); expected != got {
+						t.Fatalf("instruction %d: %v goes to %d, %v to %d with a %d x %d", pc, filter[pc], expected, insn.Instruction, got, a, x)
+					}
+				}
+			}
+		}
+
+		// Blocks are split from the normalized jumps
+		if _, err := compile(filter, CompileOpts{}); err != nil {
+			t.Fatalf("%v\n%v", err, filter)
+		}
+
+		vm, err := bpf.NewVM(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		normalizedVM, err := bpf.NewVM(normalized)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, pkt := range [][]byte{{}, {0, 1, 2, 3}, {3, 2, 1, 0}, {1, 1, 1, 1}} {
+			expected, err := vm.Run(pkt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := normalizedVM.Run(pkt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected != got {
+				t.Fatalf("packet %x: expected %d, got %d\n%v\n%v", pkt, expected, got, filter, normalized)
+			}
+		}
+	}
+}
+
 // instruction read / writes
 func TestInstructionReadsRegA(t *testing.T) {
 	checkMemoryStatus(t, map[bpf.Instruction]bool{
@@ -372,7 +584,7 @@ func TestUninitializedScratch(t *testing.T) {
 
 	blocks := mustSplitBlocks(t, 1, insns)
 
-	initializeMemory(blocks)
+	initializeMemory(blocks, memStatus{})
 
 	matchBlock(t, blocks[0], append([]instruction{{Instruction: initializeScratch{N: 2}}}, insns...), nil)
 }
@@ -395,13 +607,230 @@ func TestPartiallyUninitializedScratch(t *testing.T) {
 
 	blocks := mustSplitBlocks(t, 3, insns)
 
-	initializeMemory(blocks)
+	initializeMemory(blocks, memStatus{})
 
 	matchBlock(t, blocks[0], append([]instruction{{Instruction: initializeScratch{N: 5}}}, insns[:2]...), nil)
 	matchBlock(t, blocks[1], insns[2:3], nil)
 	matchBlock(t, blocks[2], insns[3:], nil)
 }
 
+// scratch only read in one branch is initialized in that branch
+func TestSunkScratch(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 3, SkipTrue: 0, SkipFalse: 2}, // jump to block 1 or 3
+
+		// block 1
+		/* 2 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 4, SkipTrue: 0, SkipFalse: 1}, // jump to block 2 or 3
+
+		// block 2
+		/* 3 */ bpf.LoadScratch{Dst: bpf.RegX, N: 7},
+		// fall through to block 3
+
+		// block 3
+		/* 4 */ bpf.RetA{},
+	})
+
+	blocks := mustSplitBlocks(t, 4, insns)
+
+	initializeMemory(blocks, memStatus{})
+
+	matchBlock(t, blocks[0], insns[:2], nil)
+	matchBlock(t, blocks[1], insns[2:3], nil)
+	matchBlock(t, blocks[2], append([]instruction{{Instruction: initializeScratch{N: 7}}}, insns[3:4]...), nil)
+	matchBlock(t, blocks[3], insns[4:], nil)
+}
+
+// Stores that are overwritten before they're read, or never read, are removed
+func TestDeadStores(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.StoreScratch{Src: bpf.RegA, N: 0}, // overwritten by 5
+		/* 2 */ bpf.StoreScratch{Src: bpf.RegA, N: 1}, // only read by block 1
+		/* 3 */ bpf.StoreScratch{Src: bpf.RegA, N: 2}, // never read
+		/* 4 */ bpf.LoadConstant{Dst: bpf.RegA, Val: 7},
+		/* 5 */ bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		/* 6 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 7, SkipTrue: 0, SkipFalse: 2}, // jump to block 1 or 2
+
+		// block 1
+		/* 7 */ bpf.LoadScratch{Dst: bpf.RegA, N: 1},
+		/* 8 */ bpf.RetA{},
+
+		// block 2
+		/* 9 */ bpf.LoadScratch{Dst: bpf.RegA, N: 0},
+		/* 10 */ bpf.RetA{},
+	})
+
+	blocks := mustSplitBlocks(t, 3, insns)
+
+	removeDeadStores(blocks, nil)
+
+	matchBlock(t, blocks[0], []instruction{insns[0], insns[2], insns[4], insns[5], insns[6]}, nil)
+	matchBlock(t, blocks[1], insns[7:9], nil)
+	matchBlock(t, blocks[2], insns[9:], nil)
+}
+
+// Blocks of only dead stores keep one, so they're never empty
+func TestDeadStoresOnly(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 7, SkipTrue: 0, SkipFalse: 2}, // jump to block 1 or 2
+
+		// block 1
+		/* 2 */ bpf.StoreScratch{Src: bpf.RegA, N: 3},
+		/* 3 */ bpf.StoreScratch{Src: bpf.RegA, N: 4},
+		// fall through to block 2
+
+		// block 2
+		/* 4 */ bpf.RetA{},
+	})
+
+	blocks := mustSplitBlocks(t, 3, insns)
+
+	removeDeadStores(blocks, nil)
+
+	matchBlock(t, blocks[1], insns[2:3], nil)
+}
+
+func TestDeadStoresVM(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		bpf.StoreScratch{Src: bpf.RegA, N: 1},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+		bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 3, SkipTrue: 0, SkipFalse: 2},
+		bpf.LoadScratch{Dst: bpf.RegA, N: 1},
+		bpf.RetA{},
+		bpf.LoadScratch{Dst: bpf.RegA, N: 0},
+		bpf.RetA{},
+	}
+
+	// M[0] is at StackOffset
+	opts := testOpts
+	opts.StackOffset = 4
+
+	checkInterpreter(t, filter, opts, []byte{1}, []byte{2}, []byte{3})
+}
+
+// Transfers whose destination is overwritten before it's read, or never read, are removed
+func TestDeadTransfers(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.TAX{}, // overwritten by 3
+		/* 2 */ bpf.LoadAbsolute{Size: 1, Off: 1},
+		/* 3 */ bpf.TAX{}, // only read by block 1
+		/* 4 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 7, SkipTrue: 0, SkipFalse: 3}, // jump to block 1 or 2
+
+		// block 1
+		/* 5 */ bpf.TXA{}, // read by 6
+		/* 6 */ bpf.ALUOpX{Op: bpf.ALUOpAdd},
+		/* 7 */ bpf.RetA{},
+
+		// block 2
+		/* 8 */ bpf.TXA{}, // never read
+		/* 9 */ bpf.RetConstant{Val: 1},
+	})
+
+	blocks := mustSplitBlocks(t, 3, insns)
+
+	removeDeadTransfers(blocks)
+
+	matchBlock(t, blocks[0], []instruction{insns[0], insns[2], insns[3], insns[4]}, nil)
+	matchBlock(t, blocks[1], insns[5:8], nil)
+	matchBlock(t, blocks[2], insns[9:], nil)
+}
+
+// Transfers only read by dead transfers are dead too
+func TestDeadTransfersChain(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.TAX{},
+		/* 2 */ bpf.TXA{},
+		/* 3 */ bpf.LoadConstant{Dst: bpf.RegA, Val: 2},
+		/* 4 */ bpf.RetA{},
+	})
+
+	blocks := mustSplitBlocks(t, 1, insns)
+
+	removeDeadTransfers(blocks)
+
+	matchBlock(t, blocks[0], []instruction{insns[0], insns[3], insns[4]}, nil)
+}
+
+func TestDeadTransfersVM(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.TAX{},
+		bpf.LoadAbsolute{Size: 1, Off: 1},
+		bpf.TAX{},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 3, SkipTrue: 0, SkipFalse: 2},
+		bpf.TXA{},
+		bpf.RetA{},
+		bpf.TXA{},
+		bpf.LoadConstant{Dst: bpf.RegA, Val: 9},
+		bpf.RetA{},
+	}
+
+	blocks, err := compile(filter, CompileOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transfers := 0
+	for _, blk := range blocks {
+		for _, insn := range blk.insns {
+			switch insn.Instruction.(type) {
+			case bpf.TAX, bpf.TXA:
+				transfers++
+			}
+		}
+	}
+
+	if transfers != 2 {
+		t.Fatalf("expected 2 transfers, got %d", transfers)
+	}
+
+	checkInterpreter(t, filter, testOpts, []byte{1, 3}, []byte{2, 3}, []byte{3, 4})
+}
+
+// scratch read in divergent branches is initialized in the block that dominates both
+func TestSunkScratchCommonDominator(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 3, SkipTrue: 0, SkipFalse: 5}, // jump to block 1 or 4
+
+		// block 1
+		/* 2 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 4, SkipTrue: 0, SkipFalse: 2}, // jump to block 2 or 3
+
+		// block 2
+		/* 3 */ bpf.LoadScratch{Dst: bpf.RegA, N: 7},
+		/* 4 */ bpf.RetA{},
+
+		// block 3
+		/* 5 */ bpf.LoadScratch{Dst: bpf.RegA, N: 7},
+		/* 6 */ bpf.RetA{},
+
+		// block 4
+		/* 7 */ bpf.RetConstant{Val: 0},
+	})
+
+	blocks := mustSplitBlocks(t, 5, insns)
+
+	initializeMemory(blocks, memStatus{})
+
+	matchBlock(t, blocks[0], insns[:2], nil)
+	matchBlock(t, blocks[1], append([]instruction{{Instruction: initializeScratch{N: 7}}}, insns[2:3]...), nil)
+	matchBlock(t, blocks[2], insns[3:5], nil)
+	matchBlock(t, blocks[3], insns[5:7], nil)
+	matchBlock(t, blocks[4], insns[7:], nil)
+}
+
 // Test block splitting
 func TestBlocksJump(t *testing.T) {
 	insns := toInstructions([]bpf.Instruction{
@@ -820,6 +1249,27 @@ func TestIndirectGuardSize(t *testing.T) {
 	matchBlock(t, blocks[0], append([]instruction{{Instruction: packetGuardIndirect{Len: 14}}}, insns...), map[pos]*block{})
 }
 
+// Check loads that can never be in bounds, as their end overflows, are rejected
+func TestGuardOverflow(t *testing.T) {
+	for _, insn := range []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 4, Off: math.MaxUint32 - 3},
+		bpf.LoadIndirect{Size: 2, Off: math.MaxUint32},
+	} {
+		_, err := compile([]bpf.Instruction{insn, bpf.RetA{}}, CompileOpts{})
+		if err == nil {
+			t.Fatalf("%v accepted", insn)
+		}
+	}
+
+	_, err := compile([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 4, Off: 10},
+		bpf.RetA{},
+	}, CompileOpts{OffsetBase: math.MaxUint32 - 12})
+	if err == nil {
+		t.Fatal("overflowing OffsetBase accepted")
+	}
+}
+
 // Check we use parent guards if they're long / big enough
 func TestIndirectGuardParentsOK(t *testing.T) {
 	insns := toInstructions([]bpf.Instruction{
@@ -973,6 +1423,115 @@ func TestIndirectGuardClobberMemShift(t *testing.T) {
 	matchBlock(t, blocks[3], append([]instruction{{Instruction: packetGuardIndirect{Len: 2}}}, insns[6:]...), map[pos]*block{})
 }
 
+// Check the canonical IP options skipping filter gets an absolute guard for LoadMemShift,
+// and an indirect guard that isn't extended across the LoadMemShift
+func TestIndirectGuardMemShiftIPOptions(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 12}, // ethertype, guard 14
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 0, SkipFalse: 5}, // jump to block 1 or 2
+
+		// block 1
+		/* 2 */ bpf.LoadIndirect{Size: 1, Off: 14}, // guard x + 15
+		/* 3 */ bpf.LoadMemShift{Off: 14}, // IP header length, guard 15. clobbers X
+		/* 4 */ bpf.LoadIndirect{Size: 1, Off: 0}, // new guard x + 18
+		/* 5 */ bpf.LoadIndirect{Size: 2, Off: 16},
+		/* 6 */ bpf.RetA{},
+
+		// block 2
+		/* 7 */ bpf.RetConstant{Val: 0},
+	})
+
+	blocks := mustSplitBlocks(t, 3, insns)
+
+	addPacketGuards(blocks)
+
+	matchBlock(t, blocks[0], append([]instruction{{Instruction: packetGuardAbsolute{Len: 14}}}, insns[:2]...), map[pos]*block{2: blocks[1], 7: blocks[2]})
+	matchBlock(t, blocks[1], join(
+		[]instruction{
+			{Instruction: packetGuardIndirect{Len: 15}},
+			{Instruction: packetGuardAbsolute{Len: 15}},
+		},
+		insns[2:4],
+		[]instruction{{Instruction: packetGuardIndirect{Len: 18}}},
+		insns[4:7],
+	), map[pos]*block{})
+	matchBlock(t, blocks[2], insns[7:], map[pos]*block{})
+}
+
+// Check indirect loads following a single LoadMemShift share one guard
+func TestIndirectGuardMemShiftShared(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		/* 0 */ bpf.LoadMemShift{Off: 14}, // guard 15
+		/* 1 */ bpf.LoadIndirect{Size: 1, Off: 0}, // guard x + 1
+		/* 2 */ bpf.LoadIndirect{Size: 1, Off: 3}, // guard x + 4
+		/* 3 */ bpf.LoadIndirect{Size: 2, Off: 6}, // guard x + 8
+		/* 4 */ bpf.RetA{},
+	})
+
+	blocks := mustSplitBlocks(t, 1, insns)
+
+	addPacketGuards(blocks)
+
+	matchBlock(t, blocks[0], join(
+		[]instruction{{Instruction: packetGuardAbsolute{Len: 15}}},
+		insns[0:1],
+		[]instruction{{Instruction: packetGuardIndirect{Len: 8}}},
+		insns[1:],
+	), map[pos]*block{})
+}
+
+// Check the guard in effect at the start of a block is the least guard of all its predecessors
+func TestAbsoluteGuardLeastPredecessor(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 9}, // guard 10
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 0, SkipFalse: 2}, // jump to block 1 or 2
+
+		// block 1
+		/* 2 */ bpf.LoadAbsolute{Size: 1, Off: 39}, // guard 40
+		/* 3 */ bpf.Jump{Skip: 4}, // jump to block 5
+
+		// block 2
+		/* 4 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 2, SkipTrue: 0, SkipFalse: 2}, // jump to block 3 or 4
+
+		// block 3
+		/* 5 */ bpf.LoadAbsolute{Size: 1, Off: 19}, // guard 20
+		/* 6 */ bpf.Jump{Skip: 1}, // jump to block 5
+
+		// block 4
+		/* 7 */ bpf.LoadConstant{Dst: bpf.RegX, Val: 0}, // guard 10 still, fall through to block 5
+
+		// block 5
+		/* 8 */ bpf.LoadAbsolute{Size: 2, Off: 28}, // guard 30
+		/* 9 */ bpf.RetA{},
+	})
+
+	blocks := mustSplitBlocks(t, 6, insns)
+
+	addPacketGuards(blocks)
+
+	matchBlock(t, blocks[0], append([]instruction{{Instruction: packetGuardAbsolute{Len: 10}}}, insns[0:2]...), nil)
+	matchBlock(t, blocks[1], append([]instruction{{Instruction: packetGuardAbsolute{Len: 40}}}, insns[2:4]...), nil)
+	matchBlock(t, blocks[2], insns[4:5], nil)
+	matchBlock(t, blocks[3], append([]instruction{{Instruction: packetGuardAbsolute{Len: 20}}}, insns[5:7]...), nil)
+	matchBlock(t, blocks[4], insns[7:8], nil)
+	// Only guaranteed 10 by block 4, not 20 or 40
+	matchBlock(t, blocks[5], append([]instruction{{Instruction: packetGuardAbsolute{Len: 30}}}, insns[8:]...), nil)
+}
+
+func TestLeastGuard(t *testing.T) {
+	absolute := leastAbsoluteGuard([]packetGuardAbsolute{{Len: 20}, {Len: 10}, {Len: 40}})
+	if absolute.Len != 10 {
+		t.Fatalf("expected least absolute guard 10, got %d", absolute.Len)
+	}
+
+	indirect := leastIndirectGuard([]packetGuardIndirect{{Len: 40}, {Len: 20}, {Len: 10}})
+	if indirect.Len != 10 {
+		t.Fatalf("expected least indirect guard 10, got %d", indirect.Len)
+	}
+}
+
 func join(insns ...[]instruction) []instruction {
 	res := []instruction{}
 
@@ -1008,3 +1567,1496 @@ func mustSplitBlocks(t *testing.T, blockCount int, insns []instruction) []*block
 
 	return blocks
 }
+
+// Check a single guard is used if there are only absolute loads
+func TestSingleGuard(t *testing.T) {
+	blocks, err := compile([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 12}, // guard 14
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 0, SkipFalse: 2}, // jump to block 1 or 2
+
+		// block 1
+		/* 2 */ bpf.LoadAbsolute{Size: 1, Off: 23}, // guard 24
+		/* 3 */ bpf.RetA{},
+
+		// block 2
+		/* 4 */ bpf.LoadAbsolute{Size: 4, Off: 30}, // guard 34
+		/* 5 */ bpf.RetA{},
+	}, CompileOpts{SingleGuard: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blocks) != 3 {
+		t.Fatalf("expected 3 blocks, got %d", len(blocks))
+	}
+
+	matchBlock(t, blocks[0], []instruction{
+		{Instruction: packetGuardAbsolute{Len: 34}},
+		{Instruction: bpf.LoadAbsolute{Size: 2, Off: 12}, id: 0},
+		{Instruction: bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x800, SkipTrue: 2, SkipFalse: 0}, id: 1}, // normalized
+	}, nil)
+	matchBlock(t, blocks[1], []instruction{
+		{Instruction: bpf.LoadAbsolute{Size: 1, Off: 23}, id: 2},
+		{Instruction: bpf.RetA{}, id: 3},
+	}, nil)
+	matchBlock(t, blocks[2], []instruction{
+		{Instruction: bpf.LoadAbsolute{Size: 4, Off: 30}, id: 4},
+		{Instruction: bpf.RetA{}, id: 5},
+	}, nil)
+}
+
+// Check per block guards are still used with indirect loads or LoadMemShift
+func TestSingleGuardIneligible(t *testing.T) {
+	test := func(t *testing.T, insn bpf.Instruction) {
+		t.Helper()
+
+		filter := []bpf.Instruction{
+			// block 0
+			/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 12},
+			/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 0, SkipFalse: 2},
+
+			// block 1
+			/* 2 */ insn,
+			/* 3 */ bpf.RetA{},
+
+			// block 2
+			/* 4 */ bpf.LoadAbsolute{Size: 4, Off: 30},
+			/* 5 */ bpf.RetA{},
+		}
+
+		single, err := compile(filter, CompileOpts{SingleGuard: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected, err := compile(filter, CompileOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(single) != len(expected) {
+			t.Fatalf("expected %d blocks, got %d", len(expected), len(single))
+		}
+
+		for i := range single {
+			matchBlock(t, single[i], expected[i].insns, nil)
+		}
+	}
+
+	test(t, bpf.LoadIndirect{Size: 1, Off: 23})
+	test(t, bpf.LoadMemShift{Off: 14})
+}
+
+// Single instruction programs
+func TestSingleRetConstant(t *testing.T) {
+	blocks, err := compile([]bpf.Instruction{
+		bpf.RetConstant{Val: 1},
+	}, CompileOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blocks) != 1 {
+		t.Fatalf("expected 1 block, got %d", len(blocks))
+	}
+
+	matchBlock(t, blocks[0], toInstructions([]bpf.Instruction{
+		bpf.RetConstant{Val: 1},
+	}), map[pos]*block{})
+}
+
+func TestSingleRetA(t *testing.T) {
+	blocks, err := compile([]bpf.Instruction{
+		bpf.RetA{},
+	}, CompileOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blocks) != 1 {
+		t.Fatalf("expected 1 block, got %d", len(blocks))
+	}
+
+	// A zero initialized before it is returned
+	matchBlock(t, blocks[0], []instruction{
+		{Instruction: initializeRegister{Reg: bpf.RegA}},
+		{Instruction: bpf.RetA{}, id: 0},
+	}, map[pos]*block{})
+}
+
+func TestSingleLoad(t *testing.T) {
+	_, err := compile([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+	}, CompileOpts{})
+	if err == nil {
+		t.Fatal("single load compiled")
+	}
+}
+
+// scratch reg initialized by the caller
+func TestInitializedScratch(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadScratch{Dst: bpf.RegA, N: 3},
+		/* 1 */ bpf.LoadScratch{Dst: bpf.RegX, N: 4},
+		/* 2 */ bpf.RetA{},
+	})
+
+	blocks := mustSplitBlocks(t, 1, insns)
+
+	initializeMemory(blocks, memStatus{scratch: [16]bool{3: true}})
+
+	matchBlock(t, blocks[0], append([]instruction{{Instruction: initializeScratch{N: 4}}}, insns...), nil)
+}
+
+// regs initialized by the caller
+func TestInitializedRegs(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.TXA{},
+		bpf.ALUOpX{Op: bpf.ALUOpAdd},
+		bpf.RetA{},
+	}
+
+	blocks, err := compile(filter, CompileOpts{
+		InitializedRegs: []bpf.Register{bpf.RegX},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchBlock(t, blocks[0], toInstructions(filter), nil)
+
+	_, err = compile(filter, CompileOpts{
+		InitializedRegs: []bpf.Register{bpf.Register(3)},
+	})
+	if err == nil {
+		t.Fatal("invalid initialized register accepted")
+	}
+
+	_, err = compile(filter, CompileOpts{
+		InitializedScratch: []int{16},
+	})
+	if err == nil {
+		t.Fatal("invalid initialized scratch accepted")
+	}
+}
+
+// ALU operations that don't change RegA
+func TestRemoveNoOps(t *testing.T) {
+	for _, test := range []struct {
+		insn bpf.ALUOpConstant
+		noOp bool
+	}{
+		{bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 0}, true},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1}, false},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpSub, Val: 0}, true},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpSub, Val: 1}, false},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpMul, Val: 1}, true},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpMul, Val: 0}, false},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpDiv, Val: 1}, false},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpOr, Val: 0}, true},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpOr, Val: 1}, false},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xFFFFFFFF}, true},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xFFFF}, false},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 0}, true},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 1}, false},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 0}, true},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 1}, false},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpMod, Val: 1}, false},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpXor, Val: 0}, true},
+		{bpf.ALUOpConstant{Op: bpf.ALUOpXor, Val: 1}, false},
+	} {
+		insns := toInstructions([]bpf.Instruction{
+			bpf.LoadAbsolute{Size: 1, Off: 0},
+			test.insn,
+			bpf.RetA{},
+		})
+
+		blocks := mustSplitBlocks(t, 1, insns)
+
+		removeNoOps(blocks)
+
+		expected := insns
+		if test.noOp {
+			// ids preserved
+			expected = join(insns[:1], insns[2:])
+		}
+
+		matchBlock(t, blocks[0], expected, nil)
+	}
+}
+
+// No-ops that are the only instruction of a block are kept
+func TestRemoveNoOpsBlock(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 3, SkipTrue: 1},
+
+		// block 1
+		/* 2 */ bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 0},
+		// fall through to block 2
+
+		// block 2
+		/* 3 */ bpf.RetA{},
+	})
+
+	blocks := mustSplitBlocks(t, 3, insns)
+
+	removeNoOps(blocks)
+
+	matchBlock(t, blocks[0], insns[:2], nil)
+	matchBlock(t, blocks[1], insns[2:3], nil)
+	matchBlock(t, blocks[2], insns[3:], nil)
+}
+
+// No-ops that end a block that falls through are removed, the block still falls through
+func TestRemoveNoOpsLast(t *testing.T) {
+	filter := []bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 3, SkipTrue: 2},
+
+		// block 1
+		/* 2 */ bpf.LoadAbsolute{Size: 1, Off: 1},
+		/* 3 */ bpf.ALUOpConstant{Op: bpf.ALUOpOr, Val: 0},
+		// fall through to block 2
+
+		// block 2
+		/* 4 */ bpf.RetA{},
+	}
+	insns := toInstructions(filter)
+
+	blocks := mustSplitBlocks(t, 3, insns)
+
+	removeNoOps(blocks)
+
+	matchBlock(t, blocks[0], insns[:2], nil)
+	matchBlock(t, blocks[1], insns[2:3], nil)
+	matchBlock(t, blocks[2], insns[4:], nil)
+
+	if ft := blocks[1].fallthroughBlock(); ft != blocks[2] {
+		t.Fatalf("expected block 1 to fall through to block 2, got %v", ft)
+	}
+
+	checkInterpreter(t, filter, testOpts, []byte{}, []byte{3}, []byte{2, 7}, []byte{3, 7})
+}
+
+func TestSplitAfter(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		/* 2 */ bpf.StoreScratch{Src: bpf.RegA, N: 1},
+		/* 3 */ bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		/* 4 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 3, SkipTrue: 1},
+
+		// block 1
+		/* 5 */ bpf.StoreScratch{Src: bpf.RegA, N: 0},
+
+		// block 2
+		/* 6 */ bpf.RetA{},
+	})
+
+	blocks := mustSplitBlocks(t, 3, insns)
+	opts := CompileOpts{liveScratch: []int{0}}
+
+	split := splitAfter(blocks, opts.barrier)
+	if len(split) != 5 {
+		t.Fatalf("expected 5 blocks, got %d", len(split))
+	}
+
+	matchBlock(t, split[0], insns[:2], map[pos]*block{2: split[1]})
+	matchBlock(t, split[1], insns[2:4], map[pos]*block{4: split[2]})
+	matchBlock(t, split[2], insns[4:5], map[pos]*block{5: split[3], 6: split[4]})
+	// A store that ends a block doesn't split it
+	matchBlock(t, split[3], insns[5:6], map[pos]*block{6: split[4]})
+	matchBlock(t, split[4], insns[6:], nil)
+
+	// Nothing to split
+	if split := splitAfter(split[3:], opts.barrier); len(split) != 2 {
+		t.Fatalf("expected 2 blocks, got %d", len(split))
+	}
+}
+
+// Jumps to the last instruction are valid
+func TestJumpLast(t *testing.T) {
+	insns := toInstructions([]bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 3, SkipTrue: 2, SkipFalse: 0}, // jump to last instruction
+		/* 2 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 4, SkipTrue: 0, SkipFalse: 1}, // jump to last instruction
+		/* 3 */ bpf.Jump{Skip: 0}, // fall through to last instruction
+		/* 4 */ bpf.RetA{},
+	})
+
+	normalizeJumps(insns)
+
+	blocks := mustSplitBlocks(t, 4, insns)
+
+	matchBlock(t, blocks[0], insns[0:2], map[pos]*block{2: blocks[1], 4: blocks[3]})
+	matchBlock(t, blocks[1], insns[2:3], map[pos]*block{3: blocks[2], 4: blocks[3]})
+	matchBlock(t, blocks[2], insns[3:4], map[pos]*block{4: blocks[3]})
+	matchBlock(t, blocks[3], insns[4:5], map[pos]*block{})
+}
+
+// Jumps past the last instruction are not
+func TestJumpPastLast(t *testing.T) {
+	test := func(t *testing.T, jump bpf.Instruction) {
+		t.Helper()
+
+		_, err := splitBlocks(toInstructions([]bpf.Instruction{
+			/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+			/* 1 */ jump, // jump to 4
+			/* 2 */ bpf.RetConstant{Val: 0},
+			/* 3 */ bpf.RetA{},
+		}))
+		if err == nil {
+			t.Fatalf("jump past last instruction %v accepted", jump)
+		}
+	}
+
+	test(t, bpf.Jump{Skip: 2})
+	test(t, bpf.JumpIf{Cond: bpf.JumpEqual, SkipTrue: 2, SkipFalse: 0})
+	test(t, bpf.JumpIf{Cond: bpf.JumpEqual, SkipTrue: 1, SkipFalse: 2})
+}
+
+func TestFallthroughFirst(t *testing.T) {
+	blocks, err := compile([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 0, SkipFalse: 1},
+
+		// block 1
+		/* 2 */ bpf.RetConstant{Val: 0},
+
+		// block 2
+		/* 3 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 2, SkipTrue: 1, SkipFalse: 0},
+
+		// block 3
+		/* 4 */ bpf.RetConstant{Val: 0},
+
+		// block 4
+		/* 5 */ bpf.RetConstant{Val: 1},
+	}, CompileOpts{BlockOrder: FallthroughFirst})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := []pos{}
+	for _, block := range blocks {
+		order = append(order, block.id)
+	}
+
+	expected := []pos{0, 3, 5, 2, 4}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected block order %v, got %v", expected, order)
+	}
+}
+
+func TestUnknownBlockOrder(t *testing.T) {
+	_, err := compile([]bpf.Instruction{
+		bpf.RetConstant{Val: 1},
+	}, CompileOpts{BlockOrder: 99})
+	if err == nil {
+		t.Fatal("unknown block order accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	err := Validate([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.ALUOpX{Op: bpf.ALUOpDiv},
+		bpf.RetA{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	for name, insns := range map[string][]bpf.Instruction{
+		"empty":       {},
+		"assemble":    {bpf.LoadAbsolute{Size: 3}, bpf.RetA{}},
+		"extension":   {bpf.LoadExtension{Num: bpf.ExtProto}, bpf.RetA{}},
+		"raw":         {bpf.RawInstruction{Op: 0x06}},
+		"flow past":   {bpf.LoadAbsolute{Size: 1, Off: 0}},
+		"jump past":   {bpf.Jump{Skip: 1}, bpf.RetA{}},
+		"divide zero": {bpf.ALUOpConstant{Op: bpf.ALUOpDiv, Val: 0}, bpf.RetA{}},
+		"modulo zero": {bpf.ALUOpConstant{Op: bpf.ALUOpMod, Val: 0}, bpf.RetA{}},
+		"alu op":      {bpf.ALUOpConstant{Op: 0xb0, Val: 1}, bpf.RetA{}},
+		"alu op x":    {bpf.ALUOpX{Op: 0xb0}, bpf.RetA{}},
+	} {
+		if err := Validate(insns); err == nil {
+			t.Fatalf("%s: invalid filter accepted", name)
+		}
+
+		// Validate agrees with compile
+		if _, err := compile(insns, CompileOpts{}); err == nil {
+			t.Fatalf("%s: invalid filter compiled", name)
+		}
+	}
+}
+
+func TestValidateALUOp(t *testing.T) {
+	err := Validate([]bpf.Instruction{
+		bpf.LoadConstant{Dst: bpf.RegA, Val: 1},
+		bpf.ALUOpConstant{Op: 0xf0, Val: 1},
+		bpf.RetA{},
+	})
+	if err == nil || !strings.Contains(err.Error(), "unknown ALU op 0xf0") {
+		t.Fatalf("expected unknown ALU op error, got %v", err)
+	}
+}
+
+func TestOffsetBase(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.LoadMemShift{Off: 14},
+		bpf.LoadIndirect{Size: 1, Off: 14},
+		bpf.RetA{},
+	}
+
+	test := func(t *testing.T, base uint32) {
+		t.Helper()
+
+		blocks, err := compile(filter, CompileOpts{OffsetBase: base})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matchBlock(t, blocks[0], []instruction{
+			{Instruction: packetGuardAbsolute{Len: 15 + base}},
+			{Instruction: bpf.LoadAbsolute{Size: 2, Off: 12 + base}, id: 0},
+			{Instruction: bpf.LoadMemShift{Off: 14 + base}, id: 1},
+			{Instruction: packetGuardIndirect{Len: 15}},
+			{Instruction: bpf.LoadIndirect{Size: 1, Off: 14}, id: 2},
+			{Instruction: bpf.RetA{}, id: 3},
+		}, nil)
+	}
+
+	test(t, 0)
+	test(t, 14)
+}
+
+func TestOffsetBaseOverflow(t *testing.T) {
+	_, err := compile([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0xFFFFFFF0},
+		bpf.RetA{},
+	}, CompileOpts{OffsetBase: 0x10})
+	if err == nil {
+		t.Fatal("overflowing offset accepted")
+	}
+}
+
+func TestMaxPacketOffset(t *testing.T) {
+	check := func(t *testing.T, max uint32, base uint32, insn bpf.Instruction, ok bool) {
+		t.Helper()
+
+		_, err := compile([]bpf.Instruction{
+			insn,
+			bpf.RetA{},
+		}, CompileOpts{MaxPacketOffset: max, OffsetBase: base})
+
+		switch {
+		case ok && err != nil:
+			t.Fatalf("%v rejected: %v", insn, err)
+		case !ok && err == nil:
+			t.Fatalf("%v accepted", insn)
+		case !ok && base == 0 && !strings.Contains(err.Error(), fmt.Sprint(insn)):
+			t.Fatalf("error %q doesn't name %v", err, insn)
+		}
+	}
+
+	check(t, 128, 0, bpf.LoadAbsolute{Size: 2, Off: 2000}, false)
+	check(t, 0, 0, bpf.LoadAbsolute{Size: 2, Off: 2000}, true)
+
+	// Limit is inclusive
+	check(t, 128, 0, bpf.LoadAbsolute{Size: 2, Off: 126}, true)
+	check(t, 128, 0, bpf.LoadAbsolute{Size: 2, Off: 127}, false)
+	check(t, 128, 0, bpf.LoadMemShift{Off: 127}, true)
+	check(t, 128, 0, bpf.LoadMemShift{Off: 128}, false)
+
+	// Only the constant part of indirect loads
+	check(t, 128, 0, bpf.LoadIndirect{Size: 4, Off: 124}, true)
+	check(t, 128, 0, bpf.LoadIndirect{Size: 4, Off: 125}, false)
+
+	// OffsetBase counts, only for absolute loads
+	check(t, 128, 14, bpf.LoadAbsolute{Size: 2, Off: 112}, true)
+	check(t, 128, 14, bpf.LoadAbsolute{Size: 2, Off: 113}, false)
+	check(t, 128, 14, bpf.LoadIndirect{Size: 4, Off: 124}, true)
+}
+
+func TestHardenNoIndirect(t *testing.T) {
+	absolute := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.TAX{},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+		bpf.JumpIfX{Cond: bpf.JumpEqual, SkipTrue: 1},
+		bpf.RetA{},
+		bpf.RetConstant{Val: 1},
+	}
+
+	if _, err := compile(absolute, CompileOpts{HardenNoIndirect: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		insn  bpf.Instruction
+		error string
+	}{
+		{bpf.LoadIndirect{Size: 1, Off: 2}, "instruction 1: ldb [x + 2] loads relative to x"},
+		{bpf.LoadMemShift{Off: 14}, "instruction 1: ldx 4*([14]&0xf) loads into x"},
+		{bpf.ALUOpX{Op: bpf.ALUOpAdd}, "instruction 1: add x operates on x"},
+	} {
+		filter := []bpf.Instruction{
+			bpf.RetConstant{Val: 0},
+			test.insn,
+			bpf.RetA{},
+		}
+
+		// Accepted without the option, the instruction is unreachable
+		if _, err := compile(filter, CompileOpts{}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := compile(filter, CompileOpts{HardenNoIndirect: true})
+		if err == nil {
+			t.Fatalf("%v accepted", test.insn)
+		}
+
+		if !strings.Contains(err.Error(), test.error) {
+			t.Fatalf("%v: expected error %q, got %q", test.insn, test.error, err)
+		}
+	}
+}
+
+// branchyFilter has blocks + 1 blocks, each ending with a conditional jump
+func branchyFilter(blocks int) []bpf.Instruction {
+	filter := []bpf.Instruction{}
+	for i := 0; i < blocks; i++ {
+		filter = append(filter, bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(i)})
+	}
+
+	return append(filter, bpf.RetA{})
+}
+
+func TestMaxBlocks(t *testing.T) {
+	filter := branchyFilter(1000)
+
+	var phases []Phase
+	_, err := compile(filter, CompileOpts{MaxBlocks: 10, Profile: func(s PhaseStats) {
+		phases = append(phases, s.Phase)
+	}})
+	if err == nil {
+		t.Fatal("filter with too many blocks accepted")
+	}
+
+	// No pass ran after blocks were split
+	if !reflect.DeepEqual(phases, []Phase{PhaseValidate, PhaseSplitBlocks}) {
+		t.Fatalf("expected only validate and split blocks phases, got %v", phases)
+	}
+
+	// Limit is inclusive
+	if _, err := compile(branchyFilter(9), CompileOpts{MaxBlocks: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compile(branchyFilter(10), CompileOpts{MaxBlocks: 10}); err == nil {
+		t.Fatal("11 blocks accepted")
+	}
+
+	if _, err := compile(filter, CompileOpts{MaxBlocks: -1}); err == nil {
+		t.Fatal("negative MaxBlocks accepted")
+	}
+}
+
+// Unreachable loads can't read the packet
+func TestMaxPacketOffsetUnreachable(t *testing.T) {
+	_, err := compile([]bpf.Instruction{
+		bpf.RetConstant{Val: 0},
+		bpf.LoadAbsolute{Size: 2, Off: 2000},
+		bpf.RetA{},
+	}, CompileOpts{MaxPacketOffset: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// X is initialized before an indirect load that reads it, and before the indirect guard
+func TestIndirectLoadInitializesX(t *testing.T) {
+	blocks, err := compile([]bpf.Instruction{
+		bpf.LoadIndirect{Size: 1, Off: 5},
+		bpf.RetA{},
+	}, CompileOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchBlock(t, blocks[0], []instruction{
+		{Instruction: initializeRegister{Reg: bpf.RegX}},
+		{Instruction: packetGuardIndirect{Len: 6}},
+		{Instruction: bpf.LoadIndirect{Size: 1, Off: 5}, id: 0},
+		{Instruction: bpf.RetA{}, id: 1},
+	}, map[pos]*block{})
+}
+
+// ALUOpX reads X
+func TestALUOpXInitializesX(t *testing.T) {
+	blocks, err := compile([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.ALUOpX{Op: bpf.ALUOpAdd},
+		bpf.RetA{},
+	}, CompileOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchBlock(t, blocks[0], []instruction{
+		{Instruction: packetGuardAbsolute{Len: 1}},
+		{Instruction: initializeRegister{Reg: bpf.RegX}},
+		{Instruction: bpf.LoadAbsolute{Size: 1, Off: 0}, id: 0},
+		{Instruction: bpf.ALUOpX{Op: bpf.ALUOpAdd}, id: 1},
+		{Instruction: bpf.RetA{}, id: 2},
+	}, map[pos]*block{})
+}
+
+// X written on only one of the paths to an ALUOpX is initialized on the other
+func TestALUOpXInitializesXPath(t *testing.T) {
+	diamond := func(ldx bpf.Instruction) []bpf.Instruction {
+		return []bpf.Instruction{
+			bpf.LoadAbsolute{Size: 1, Off: 0},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+			ldx,
+			bpf.ALUOpX{Op: bpf.ALUOpAdd},
+			bpf.RetA{},
+		}
+	}
+
+	initializesX := func(blk *block) bool {
+		for _, insn := range blk.insns {
+			if insn.Instruction == (initializeRegister{Reg: bpf.RegX}) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	blocks, err := compile(diamond(bpf.LoadConstant{Dst: bpf.RegX, Val: 5}), CompileOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !initializesX(blocks[0]) {
+		t.Fatalf("X not initialized in first block: %v", blocks[0].insns)
+	}
+
+	_, err = compile(diamond(bpf.LoadConstant{Dst: bpf.RegX, Val: 5}), CompileOpts{StrictUninitialized: true})
+	if err == nil {
+		t.Fatal("uninitialized read accepted")
+	}
+
+	// X is written on both paths
+	filter := append([]bpf.Instruction{bpf.LoadConstant{Dst: bpf.RegX, Val: 3}}, diamond(bpf.LoadConstant{Dst: bpf.RegX, Val: 5})...)
+
+	blocks, err = compile(filter, CompileOpts{StrictUninitialized: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, blk := range blocks {
+		if initializesX(blk) {
+			t.Fatalf("X initialized in %v: %v", blk.Label(), blk.insns)
+		}
+	}
+}
+
+func TestStrictUninitialized(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.RetA{},
+	}
+
+	// lenient by default
+	_, err := compile(filter, CompileOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = compile(filter, CompileOpts{StrictUninitialized: true})
+	if err == nil {
+		t.Fatal("uninitialized read accepted")
+	}
+
+	if !strings.Contains(err.Error(), "0: ret a") || !strings.HasSuffix(err.Error(), "uninitialized a") {
+		t.Fatalf("error doesn't name instruction: %v", err)
+	}
+
+	// caller initialized
+	_, err = compile(filter, CompileOpts{StrictUninitialized: true, InitializedRegs: []bpf.Register{bpf.RegA}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Memory only initialized on some paths is rejected
+func TestStrictUninitializedPath(t *testing.T) {
+	_, err := compile([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+		bpf.StoreScratch{Src: bpf.RegA, N: 2},
+		bpf.LoadScratch{Dst: bpf.RegX, N: 2},
+		bpf.TXA{},
+		bpf.RetA{},
+	}, CompileOpts{StrictUninitialized: true})
+	if err == nil {
+		t.Fatal("uninitialized read accepted")
+	}
+
+	if !strings.Contains(err.Error(), "uninitialized M[2]") {
+		t.Fatalf("error doesn't name scratch: %v", err)
+	}
+}
+
+// largeFilter is a long chain of comparisons, each jumping over the next hundred or so,
+// so many blocks are targeted but not visited yet.
+func largeFilter(n int) []bpf.Instruction {
+	filter := []bpf.Instruction{}
+
+	for i := 0; i < n; i++ {
+		skip := 200
+		if left := n - i - 1; left < skip {
+			skip = left
+		}
+
+		filter = append(filter, bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(i), SkipTrue: uint8(skip)})
+	}
+
+	return append(filter, bpf.RetConstant{Val: 1})
+}
+
+func BenchmarkSplitBlocks(b *testing.B) {
+	insns := toInstructions(largeFilter(5000))
+	bufs := &buffers{}
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := bufs.splitBlocks(insns, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// splitBlocksSorted is splitBlocks, sorting all the targets left to find the next one.
+// Reference implementation.
+func splitBlocksSorted(instructions []instruction) ([]*block, error) {
+	blocks := []*block{}
+	targets := map[pos][]targetBlock{0: nil}
+
+	for len(targets) > 0 {
+		sorted := []pos{}
+		for target := range targets {
+			sorted = append(sorted, target)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i] < sorted[j]
+		})
+
+		target := sorted[0]
+
+		end := len(instructions)
+		if len(sorted) > 1 {
+			end = int(sorted[1])
+		}
+
+		next, nextSkips := visitBlock(instructions[target:end], target)
+
+		for _, s := range nextSkips {
+			t := next.skipToPos(s)
+			if t >= pos(len(instructions)) {
+				return nil, errors.Errorf("instruction %v flows past last instruction", next.last())
+			}
+
+			targets[t] = append(targets[t], targetBlock{next, s == 0})
+		}
+
+		for _, jmpBlock := range targets[target] {
+			jmpBlock.jumps[target] = next
+
+			if !jmpBlock.isFallthrough {
+				next.IsTarget = true
+			}
+		}
+
+		blocks = append(blocks, next)
+		delete(targets, target)
+	}
+
+	return blocks, nil
+}
+
+// Check splitting blocks with a heap of targets gives the same blocks as sorting them
+func TestSplitBlocksSorted(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	filters := [][]bpf.Instruction{largeFilter(1000)}
+	for i := 0; i < 200; i++ {
+		filters = append(filters, randomFilter(rng, 2+rng.Intn(300)))
+	}
+
+	bufs := &buffers{}
+
+	for _, filter := range filters {
+		insns := toInstructions(filter)
+		normalizeJumps(insns)
+
+		expected, err := splitBlocksSorted(insns)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		blocks, err := bufs.splitBlocks(insns, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(blocks, expected) {
+			t.Fatalf("expected blocks %v, got %v", expected, blocks)
+		}
+	}
+}
+
+// Check skipping the passes for features a filter doesn't use doesn't change the guards
+func TestFeatures(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	filters := [][]bpf.Instruction{benchmarkFilter()}
+	for i := 0; i < 200; i++ {
+		filters = append(filters, randomFilter(rng, 2+rng.Intn(100)))
+	}
+
+	guards := func(filter []bpf.Instruction, features filterFeatures) []*block {
+		insns := toInstructions(filter)
+		normalizeJumps(insns)
+
+		blocks, err := splitBlocks(insns)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := addDivideByZeroGuardsFeatures(blocks, features); err != nil {
+			t.Fatal(err)
+		}
+
+		(&buffers{}).addPacketGuards(blocks, features, nil)
+
+		return blocks
+	}
+
+	for _, filter := range filters {
+		expected := guards(filter, allFeatures)
+		blocks := guards(filter, scanFeatures(filter))
+
+		if !reflect.DeepEqual(blocks, expected) {
+			t.Fatalf("expected blocks %v, got %v", expected, blocks)
+		}
+	}
+}
+
+// Compare the passes on an absolute only filter with and without skipping them
+func BenchmarkFeatures(b *testing.B) {
+	insns := toInstructions(largeFilter(200))
+
+	for name, features := range map[string]filterFeatures{
+		"all":     allFeatures,
+		"scanned": scanFeatures(largeFilter(200)),
+	} {
+		b.Run(name, func(b *testing.B) {
+			bufs := &buffers{}
+
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				blocks, err := bufs.splitBlocks(insns, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				if err := addDivideByZeroGuardsFeatures(blocks, features); err != nil {
+					b.Fatal(err)
+				}
+
+				bufs.addPacketGuards(blocks, features, nil)
+			}
+		})
+	}
+}
+
+// ipv6ExtensionFilter walks up to stages IPv6 extension headers, the way libpcap unrolls it,
+// and matches TCP packets to port 80.
+// Each stage advances X past an extension header, by reading its length from the packet.
+func ipv6ExtensionFilter(stages int) []bpf.Instruction {
+	tail := 4 + 12*stages
+	tcp, fail := tail+1, tail+4
+
+	// skip from pc to target
+	to := func(pc, target int) uint8 {
+		return uint8(target - pc - 1)
+	}
+
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: to(1, fail)},
+		bpf.LoadAbsolute{Size: 1, Off: 14 + 6}, // next header
+		bpf.LoadConstant{Dst: bpf.RegX, Val: 14 + 40},
+	}
+
+	for i := 0; i < stages; i++ {
+		pc := len(filter)
+
+		filter = append(filter,
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipTrue: to(pc, tcp)},
+			// hop by hop, routing, destination options
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 43, SkipTrue: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 60, SkipFalse: to(pc+3, fail)},
+			bpf.LoadIndirect{Size: 1, Off: 0},
+			bpf.StoreScratch{Src: bpf.RegA, N: 1},
+			// x += (len + 1) * 8
+			bpf.LoadIndirect{Size: 1, Off: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 3},
+			bpf.ALUOpX{Op: bpf.ALUOpAdd},
+			bpf.TAX{},
+			bpf.LoadScratch{Dst: bpf.RegA, N: 1},
+		)
+	}
+
+	return append(filter,
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: to(tail, fail)},
+		bpf.LoadIndirect{Size: 2, Off: 2}, // destination port
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipFalse: 1},
+		bpf.RetConstant{Val: math.MaxUint32},
+		bpf.RetConstant{Val: 0},
+	)
+}
+
+// Each X advance starts a new indirect guard
+func TestIPv6ExtensionGuards(t *testing.T) {
+	blocks, err := compile(ipv6ExtensionFilter(3), CompileOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyGuards(blocks); err != nil {
+		t.Fatal(err)
+	}
+
+	guards := []uint32{}
+	for _, block := range blocks {
+		for _, insn := range block.insns {
+			if guard, ok := insn.Instruction.(packetGuardIndirect); ok {
+				guards = append(guards, guard.Len)
+			}
+		}
+	}
+
+	// one per stage, and the port
+	expected := []uint32{2, 2, 2, 4}
+	if !reflect.DeepEqual(guards, expected) {
+		t.Fatalf("expected indirect guards %v, got %v", expected, guards)
+	}
+}
+
+// Every backend generates the same output for the same filter, blocks and jumps are never emitted in map order
+func TestDeterministicOutput(t *testing.T) {
+	filter := ipv6ExtensionFilter(3)
+
+	backends := map[string]func() (interface{}, error){
+		"c": func() (interface{}, error) {
+			return ToC(filter, COpts{FunctionName: "filter"})
+		},
+		"ebpf": func() (interface{}, error) {
+			opts := testOpts
+			opts.StackOffset = 4
+			return ToEBPFAsm(filter, opts)
+		},
+		"json": func() (interface{}, error) {
+			out, err := ToJSON(filter)
+			return string(out), err
+		},
+		"rust": func() (interface{}, error) {
+			return ToRust(filter, RustOpts{FunctionName: "filter"})
+		},
+		"wat": func() (interface{}, error) {
+			return ToWAT(filter, WATOpts{FunctionName: "filter"})
+		},
+	}
+
+	for name, backend := range backends {
+		first, err := backend()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		for i := 0; i < 20; i++ {
+			out, err := backend()
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			if out != first {
+				t.Fatalf("%s: output differs between runs:\n%v\n%v", name, first, out)
+			}
+		}
+	}
+}
+
+func TestLastReachableNotTerminator(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+	}
+
+	err := Validate(filter)
+	if err == nil {
+		t.Fatal("filter ending in add accepted")
+	}
+
+	if !strings.Contains(err.Error(), "add #1") || !strings.Contains(err.Error(), "has to return or jump") {
+		t.Fatalf("unclear error: %v", err)
+	}
+
+	// Unreachable instructions are never run
+	if err := Validate(filter[2:]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Name is the symbol of every backend
+func TestName(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.RetConstant{Val: 1},
+	}
+	compileOpts := CompileOpts{Name: "drop_tcp"}
+
+	c, err := ToC(filter, COpts{CompileOpts: compileOpts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(c, "uint32_t drop_tcp(") {
+		t.Fatalf("expected C function drop_tcp:\n%s", c)
+	}
+
+	rust, err := ToRust(filter, RustOpts{CompileOpts: compileOpts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rust, "pub fn drop_tcp(") {
+		t.Fatalf("expected Rust function drop_tcp:\n%s", rust)
+	}
+
+	wat, err := ToWAT(filter, WATOpts{CompileOpts: compileOpts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(wat, `(export "drop_tcp")`) {
+		t.Fatalf("expected WebAssembly export drop_tcp:\n%s", wat)
+	}
+
+	obj, err := ToObject(filter, ObjectOpts{CompileOpts: compileOpts, Type: ebpf.XDP, License: "BSD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(obj))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Programs["drop_tcp"] == nil {
+		t.Fatalf("expected program drop_tcp, got %v", spec.Programs)
+	}
+
+	opts := testOpts
+	opts.CompileOpts = compileOpts
+	opts.LabelPrefix = ""
+	ebpfAsm, err := ToEBPFAsm([]bpf.Instruction{bpf.LoadAbsolute{Size: 1, Off: 0}, bpf.RetA{}}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ebpfAsm, "drop_tcp_nomatch") {
+		t.Fatalf("expected drop_tcp labels:\n%s", ebpfAsm)
+	}
+
+	// Backend's own names take precedence
+	c, err = ToC(filter, COpts{CompileOpts: compileOpts, FunctionName: "filter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(c, "uint32_t filter(") {
+		t.Fatalf("expected C function filter:\n%s", c)
+	}
+
+	_, err = ToC(filter, COpts{CompileOpts: CompileOpts{Name: "drop tcp"}})
+	if err == nil {
+		t.Fatal("invalid Name accepted")
+	}
+}
+
+// fanOutFilter switches on the first byte of the packet, every case loads further into the packet.
+func fanOutFilter(cases int) []bpf.Instruction {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+	}
+
+	for i := 0; i < cases; i++ {
+		filter = append(filter, bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(i), SkipTrue: uint8(cases + 1 + i)})
+	}
+
+	// default case
+	filter = append(filter, bpf.LoadAbsolute{Size: 4, Off: 20}, bpf.RetA{})
+
+	for i := 0; i < cases; i++ {
+		filter = append(filter, bpf.LoadAbsolute{Size: 2, Off: uint32(20 + i)}, bpf.RetA{})
+	}
+
+	return filter
+}
+
+func absoluteGuards(blocks []*block) []uint32 {
+	guards := []uint32{}
+
+	for _, block := range blocks {
+		for _, insn := range block.insns {
+			if guard, ok := insn.Instruction.(packetGuardAbsolute); ok {
+				guards = append(guards, guard.Len)
+			}
+		}
+	}
+
+	return guards
+}
+
+func TestHoistGuards(t *testing.T) {
+	filter := fanOutFilter(3)
+
+	for _, test := range []struct {
+		hoist  bool
+		guards []uint32
+	}{
+		{false, []uint32{1, 24, 22, 23, 24}},
+		// Least of every case, the last case still needs a longer guard
+		{true, []uint32{22, 23, 24}},
+	} {
+		blocks, err := compile(filter, CompileOpts{HoistGuards: test.hoist})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if guards := absoluteGuards(blocks); !reflect.DeepEqual(guards, test.guards) {
+			t.Fatalf("hoist %v: expected guards %v, got %v", test.hoist, test.guards, guards)
+		}
+	}
+}
+
+// Guards aren't hoisted past paths that don't need them
+func TestHoistGuardsReturn(t *testing.T) {
+	blocks, err := compile([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.LoadAbsolute{Size: 4, Off: 20},
+		bpf.RetA{},
+	}, CompileOpts{HoistGuards: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []uint32{1, 24}
+	if guards := absoluteGuards(blocks); !reflect.DeepEqual(guards, expected) {
+		t.Fatalf("expected guards %v, got %v", expected, guards)
+	}
+}
+
+// A guard both arms of a conditional need is only in the block that branches
+func TestHoistGuardsBranch(t *testing.T) {
+	blocks, err := compile([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 2},
+		bpf.LoadAbsolute{Size: 4, Off: 40},
+		bpf.RetA{},
+		bpf.LoadAbsolute{Size: 4, Off: 40},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+		bpf.RetA{},
+	}, CompileOpts{HoistGuards: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blocks) != 3 {
+		t.Fatalf("expected 3 blocks, got %d", len(blocks))
+	}
+
+	if blocks[0].insns[0].Instruction != (packetGuardAbsolute{Len: 44}) {
+		t.Fatalf("expected guard 44 at start of %v", blocks[0])
+	}
+
+	expected := []uint32{44}
+	if guards := absoluteGuards(blocks); !reflect.DeepEqual(guards, expected) {
+		t.Fatalf("expected guards %v, got %v", expected, guards)
+	}
+}
+
+// ld #len sets A, it doesn't need to be initialized
+func TestLoadLenInitializes(t *testing.T) {
+	blocks, err := compile([]bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.RetA{},
+	}, CompileOpts{StrictUninitialized: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, insn := range blocks[0].insns {
+		if isSynthetic(insn.Instruction) {
+			t.Fatalf("unexpected %v", insn)
+		}
+	}
+}
+
+// Nothing can jump to the first instruction, the entry block is never a target
+func TestEntryBlockNotTarget(t *testing.T) {
+	filters := [][]bpf.Instruction{
+		cPortFilter,
+		tcpPortFilter,
+		// Entry only jumps to the next block
+		{
+			bpf.Jump{Skip: 0},
+			bpf.LoadAbsolute{Size: 1, Off: 1},
+			bpf.RetA{},
+		},
+		{
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0},
+			bpf.RetA{},
+		},
+		// Entry is the whole filter
+		{
+			bpf.LoadAbsolute{Size: 1, Off: 1},
+			bpf.RetA{},
+		},
+	}
+
+	for _, filter := range filters {
+		for _, order := range []BlockOrder{SourceOrder, FallthroughFirst} {
+			opts := CompileOpts{BlockOrder: order, HoistGuards: true}
+
+			blocks, err := compile(filter, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if blocks[0].id != 0 || blocks[0].IsTarget {
+				t.Fatalf("%v: entry %s is a target", filter, blocks[0].Label())
+			}
+
+			for _, block := range blocks {
+				for _, target := range block.jumps {
+					if target == blocks[0] {
+						t.Fatalf("%v: %s jumps to entry", filter, block.Label())
+					}
+				}
+			}
+
+			// Backends don't label the entry
+			c, err := ToC(filter, COpts{CompileOpts: opts, FunctionName: "filter"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(c, "block_0:") {
+				t.Fatalf("%v: entry labelled in:\n%s", filter, c)
+			}
+
+			wat, err := ToWAT(filter, WATOpts{CompileOpts: opts, FunctionName: "filter"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(wat, "$block_0") {
+				t.Fatalf("%v: entry labelled in:\n%s", filter, wat)
+			}
+
+			eOpts := testOpts
+			eOpts.CompileOpts = opts
+			insns, err := ToEBPF(filter, eOpts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, insn := range insns {
+				if insn.Symbol == eOpts.LabelPrefix+"_block_0" {
+					t.Fatalf("%v: entry labelled in:\n%v", filter, insns)
+				}
+			}
+		}
+	}
+}
+
+// Memory initialization and guards of the entry block go before the filter's instructions,
+// when the entry block only jumps to the next block
+func TestEntryBlockInsertions(t *testing.T) {
+	filter := []bpf.Instruction{
+		/* 0 */ bpf.TXA{},
+		/* 1 */ bpf.Jump{Skip: 0},
+		// A is read after the jump, so the txa isn't dead
+		/* 2 */ bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+		/* 3 */ bpf.LoadAbsolute{Size: 1, Off: 1},
+		/* 4 */ bpf.RetA{},
+	}
+
+	blocks, err := compile(filter, CompileOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchBlock(t, blocks[0], []instruction{
+		{Instruction: initializeRegister{Reg: bpf.RegX}},
+		{Instruction: bpf.TXA{}, id: 0},
+		{Instruction: bpf.Jump{Skip: 0}, id: 1},
+	}, map[pos]*block{2: blocks[1]})
+
+	matchBlock(t, blocks[1], []instruction{
+		{Instruction: packetGuardAbsolute{Len: 2}},
+		{Instruction: bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1}, id: 2},
+		{Instruction: bpf.LoadAbsolute{Size: 1, Off: 1}, id: 3},
+		{Instruction: bpf.RetA{}, id: 4},
+	}, nil)
+
+	// Guard hoisted into the entry, before the initialization
+	blocks, err = compile(filter, CompileOpts{HoistGuards: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchBlock(t, blocks[0], []instruction{
+		{Instruction: packetGuardAbsolute{Len: 2}},
+		{Instruction: initializeRegister{Reg: bpf.RegX}},
+		{Instruction: bpf.TXA{}, id: 0},
+		{Instruction: bpf.Jump{Skip: 0}, id: 1},
+	}, nil)
+
+	if blocks[0].IsTarget || blocks[1].IsTarget {
+		t.Fatal("blocks only jumped to with skip 0 are targets")
+	}
+
+	checkInterpreter(t, filter, testOpts, []byte{}, []byte{1}, []byte{1, 2})
+}
+
+// Initializations and guards are both inserted at the start of the entry block, before the instructions that need them.
+// The order between them doesn't matter.
+func TestEntryBlockInitializeAndGuard(t *testing.T) {
+	filter := []bpf.Instruction{
+		/* 0 */ bpf.LoadScratch{Dst: bpf.RegA, N: 3},
+		/* 1 */ bpf.ALUOpX{Op: bpf.ALUOpAdd},
+		/* 2 */ bpf.TAX{},
+		/* 3 */ bpf.LoadAbsolute{Size: 2, Off: 2},
+		/* 4 */ bpf.ALUOpX{Op: bpf.ALUOpAdd},
+		/* 5 */ bpf.RetA{},
+	}
+
+	blocks, err := compile(filter, CompileOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blocks) != 1 {
+		t.Fatalf("expected 1 block, got %d", len(blocks))
+	}
+
+	matchBlock(t, blocks[0], []instruction{
+		{Instruction: packetGuardAbsolute{Len: 4}},
+		{Instruction: initializeScratch{N: 3}},
+		{Instruction: initializeRegister{Reg: bpf.RegX}},
+		{Instruction: bpf.LoadScratch{Dst: bpf.RegA, N: 3}, id: 0},
+		{Instruction: bpf.ALUOpX{Op: bpf.ALUOpAdd}, id: 1},
+		{Instruction: bpf.TAX{}, id: 2},
+		{Instruction: bpf.LoadAbsolute{Size: 2, Off: 2}, id: 3},
+		{Instruction: bpf.ALUOpX{Op: bpf.ALUOpAdd}, id: 4},
+		{Instruction: bpf.RetA{}, id: 5},
+	}, nil)
+
+	if err := verifyGuards(blocks); err != nil {
+		t.Fatal(err)
+	}
+
+	checkInterpreter(t, filter, testOpts, []byte{}, []byte{1, 2, 3}, []byte{1, 2, 3, 4})
+}
+
+// metadataFilter checks the ingress interface in a metadata buffer at 0x1000, then the EtherType of the packet
+var metadataFilter = []bpf.Instruction{
+	/* 0 */ bpf.LoadAbsolute{Size: 4, Off: 0x1000},
+	/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 3, SkipFalse: 3},
+	/* 2 */ bpf.LoadAbsolute{Size: 2, Off: 12},
+	/* 3 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+	/* 4 */ bpf.RetConstant{Val: 1},
+	/* 5 */ bpf.RetConstant{Val: 0},
+}
+
+var metadataRegion = MetadataRegion{Base: 0x1000, Len: 16}
+
+// Metadata loads have their own guards, and OffsetBase doesn't apply to them
+func TestMetadata(t *testing.T) {
+	blocks, err := compile(metadataFilter, CompileOpts{Metadata: metadataRegion, OffsetBase: 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchBlock(t, blocks[0], []instruction{
+		{Instruction: metadataGuard{Len: 4}},
+		{Instruction: loadMetadata{Size: 4, Off: 0}, id: 0},
+		{Instruction: bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 3, SkipTrue: 3}, id: 1},
+	}, map[pos]*block{
+		2: blocks[1],
+		5: blocks[3],
+	})
+
+	matchBlock(t, blocks[1], []instruction{
+		{Instruction: packetGuardAbsolute{Len: 28}},
+		{Instruction: bpf.LoadAbsolute{Size: 2, Off: 26}, id: 2},
+		{Instruction: bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 0x800, SkipTrue: 1}, id: 3},
+	}, map[pos]*block{
+		4: blocks[2],
+		5: blocks[3],
+	})
+}
+
+func TestMetadataRegion(t *testing.T) {
+	check := func(t *testing.T, load bpf.LoadAbsolute, meta, ok bool) {
+		t.Helper()
+
+		blocks, err := compile([]bpf.Instruction{load, bpf.RetA{}}, CompileOpts{Metadata: metadataRegion})
+		switch {
+		case ok && err != nil:
+			t.Fatalf("%v rejected: %v", load, err)
+		case !ok && err == nil:
+			t.Fatalf("%v accepted", load)
+		case !ok:
+			return
+		}
+
+		_, isMeta := blocks[0].insns[1].Instruction.(loadMetadata)
+		if isMeta != meta {
+			t.Fatalf("%v: expected metadata load %v, got %v", load, meta, blocks[0].insns[1])
+		}
+	}
+
+	check(t, bpf.LoadAbsolute{Size: 4, Off: 0x1000}, true, true)
+	check(t, bpf.LoadAbsolute{Size: 4, Off: 0x100C}, true, true)
+	check(t, bpf.LoadAbsolute{Size: 1, Off: 0x100F}, true, true)
+	check(t, bpf.LoadAbsolute{Size: 1, Off: 0x1010}, false, true)
+	check(t, bpf.LoadAbsolute{Size: 4, Off: 0x0FFC}, false, true)
+
+	// Partly in the region
+	check(t, bpf.LoadAbsolute{Size: 4, Off: 0x0FFE}, false, false)
+	check(t, bpf.LoadAbsolute{Size: 4, Off: 0x100E}, false, false)
+}
@@ -0,0 +1,183 @@
+package cbpfc
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// DiffResult is the structural difference between two filters.
+type DiffResult struct {
+	// Same is true if the filters compile to the same blocks, with the same control flow between them.
+	// Filters that are the same always have the same result, but filters that aren't can still be equivalent,
+	// eg if independent conditions are reordered.
+	Same bool
+
+	// Difference describes the first difference found, empty if the filters are the same.
+	Difference string
+}
+
+// Diff compiles two filters, and checks if their blocks are isomorphic:
+// the same instructions, jumping to the same blocks.
+//
+// The position of instructions and blocks in the filters, how jumps are laid out
+// (eg inverting a condition and swapping its targets, or jumping through unconditional jumps),
+// and the order of packet guards within a block are ignored.
+func Diff(a, b []bpf.Instruction) (DiffResult, error) {
+	aBlocks, err := compile(a, CompileOpts{})
+	if err != nil {
+		return DiffResult{}, errors.Wrap(err, "unable to compile a")
+	}
+
+	bBlocks, err := compile(b, CompileOpts{})
+	if err != nil {
+		return DiffResult{}, errors.Wrap(err, "unable to compile b")
+	}
+
+	return diffBlocks(skipJumps(aBlocks[0]), skipJumps(bBlocks[0])), nil
+}
+
+// diffBlocks compares the DAGs of blocks starting at a and b.
+// Blocks are paired up as they are reached, a block can only be paired with a single other block.
+func diffBlocks(a, b *block) DiffResult {
+	aToB := map[*block]*block{a: b}
+	bToA := map[*block]*block{b: a}
+
+	pairs := [][2]*block{{a, b}}
+
+	for len(pairs) > 0 {
+		a, b := pairs[0][0], pairs[0][1]
+		pairs = pairs[1:]
+
+		aShape, bShape := newBlockShape(a), newBlockShape(b)
+
+		if diff := aShape.diff(bShape); diff != "" {
+			return DiffResult{Difference: fmt.Sprintf("a %s and b %s: %s", a.Label(), b.Label(), diff)}
+		}
+
+		for i := range aShape.targets {
+			aTarget, bTarget := aShape.targets[i], bShape.targets[i]
+
+			pairedB, aSeen := aToB[aTarget]
+			pairedA, bSeen := bToA[bTarget]
+
+			switch {
+			case !aSeen && !bSeen:
+				aToB[aTarget], bToA[bTarget] = bTarget, aTarget
+				pairs = append(pairs, [2]*block{aTarget, bTarget})
+			case pairedB != bTarget || pairedA != aTarget:
+				return DiffResult{Difference: fmt.Sprintf("a %s and b %s: jump %d goes to a %s and b %s, that aren't the same", a.Label(), b.Label(), i, aTarget.Label(), bTarget.Label())}
+			}
+		}
+	}
+
+	return DiffResult{Same: true}
+}
+
+// blockShape is a block, without anything Diff ignores.
+type blockShape struct {
+	// insns are the instructions of the block, other than packet guards and jumps.
+	// Conditional jumps are canonicalized, and their skips are cleared.
+	insns []bpf.Instruction
+
+	// guards are the packet guards of the block, sorted
+	guards []string
+
+	// targets are the blocks the block jumps to: the true and false targets of a conditional jump,
+	// the target of a jump, or the block fallen through to.
+	targets []*block
+}
+
+func newBlockShape(blk *block) blockShape {
+	shape := blockShape{}
+
+	// Jumps always end blocks
+	for _, insn := range blk.insns {
+		switch ins := insn.Instruction.(type) {
+		case packetGuardAbsolute, packetGuardIndirect, metadataGuard:
+			shape.guards = append(shape.guards, fmt.Sprint(ins))
+
+		case bpf.Jump:
+			shape.targets = []*block{blk.skipToBlock(skip(ins.Skip))}
+
+		case bpf.JumpIf:
+			trueBlk, falseBlk := blk.skipToBlock(skip(ins.SkipTrue)), blk.skipToBlock(skip(ins.SkipFalse))
+			ins.Cond, trueBlk, falseBlk = canonicalCond(ins.Cond, trueBlk, falseBlk)
+			ins.SkipTrue, ins.SkipFalse = 0, 0
+
+			shape.insns = append(shape.insns, ins)
+			shape.targets = []*block{trueBlk, falseBlk}
+
+		case bpf.JumpIfX:
+			trueBlk, falseBlk := blk.skipToBlock(skip(ins.SkipTrue)), blk.skipToBlock(skip(ins.SkipFalse))
+			ins.Cond, trueBlk, falseBlk = canonicalCond(ins.Cond, trueBlk, falseBlk)
+			ins.SkipTrue, ins.SkipFalse = 0, 0
+
+			shape.insns = append(shape.insns, ins)
+			shape.targets = []*block{trueBlk, falseBlk}
+
+		default:
+			shape.insns = append(shape.insns, ins)
+		}
+	}
+
+	if ft := blk.fallthroughBlock(); ft != nil {
+		shape.targets = []*block{ft}
+	}
+
+	for i, target := range shape.targets {
+		shape.targets[i] = skipJumps(target)
+	}
+
+	sort.Strings(shape.guards)
+
+	return shape
+}
+
+// skipJumps follows blocks that are only an unconditional jump, to the first block that isn't.
+func skipJumps(blk *block) *block {
+	for len(blk.insns) == 1 {
+		jump, ok := blk.insns[0].Instruction.(bpf.Jump)
+		if !ok {
+			break
+		}
+
+		blk = blk.skipToBlock(skip(jump.Skip))
+	}
+
+	return blk
+}
+
+// canonicalCond picks one of a condition and its inverse, swapping the targets if it's the inverse.
+func canonicalCond(cond bpf.JumpTest, trueBlk, falseBlk *block) (bpf.JumpTest, *block, *block) {
+	if inverse := condToInverse[cond]; inverse < cond {
+		return inverse, falseBlk, trueBlk
+	}
+
+	return cond, trueBlk, falseBlk
+}
+
+// diff describes the difference between two block shapes, ignoring their targets, empty if there isn't one.
+func (s blockShape) diff(other blockShape) string {
+	if len(s.insns) != len(other.insns) {
+		return fmt.Sprintf("%d instructions and %d instructions", len(s.insns), len(other.insns))
+	}
+
+	for i := range s.insns {
+		if s.insns[i] != other.insns[i] {
+			return fmt.Sprintf("instruction %d is %v and %v", i, s.insns[i], other.insns[i])
+		}
+	}
+
+	if fmt.Sprint(s.guards) != fmt.Sprint(other.guards) {
+		return fmt.Sprintf("packet guards %v and %v", s.guards, other.guards)
+	}
+
+	if len(s.targets) != len(other.targets) {
+		return fmt.Sprintf("%d targets and %d targets", len(s.targets), len(other.targets))
+	}
+
+	return ""
+}
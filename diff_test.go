@@ -0,0 +1,109 @@
+package cbpfc
+
+import (
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func checkDiff(tb testing.TB, a, b []bpf.Instruction, same bool) {
+	tb.Helper()
+
+	// Diff is symmetric
+	for _, filters := range [][2][]bpf.Instruction{{a, b}, {b, a}} {
+		res, err := Diff(filters[0], filters[1])
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if res.Same != same {
+			tb.Fatalf("expected same %v, got %+v", same, res)
+		}
+
+		if !res.Same && res.Difference == "" {
+			tb.Fatal("no difference described")
+		}
+	}
+}
+
+// tcpPortFilter matches IPv4 TCP packets to port 80, without IP options
+var tcpPortFilter = []bpf.Instruction{
+	/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 23},
+	/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 3},
+	/* 2 */ bpf.LoadAbsolute{Size: 2, Off: 36},
+	/* 3 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipFalse: 1},
+	/* 4 */ bpf.RetConstant{Val: 1},
+	/* 5 */ bpf.RetConstant{Val: 0},
+}
+
+func TestDiffSame(t *testing.T) {
+	checkDiff(t, tcpPortFilter, tcpPortFilter, true)
+
+	// Conditions inverted, and returns laid out differently
+	checkDiff(t, tcpPortFilter, []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 23},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 6, SkipTrue: 5},
+		/* 2 */ bpf.LoadAbsolute{Size: 2, Off: 36},
+		/* 3 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 80, SkipFalse: 2},
+		/* 4 */ bpf.Jump{Skip: 2},
+		/* 5 */ bpf.RetConstant{Val: 2},
+		/* 6 */ bpf.RetConstant{Val: 1},
+		/* 7 */ bpf.RetConstant{Val: 0},
+	}, true)
+}
+
+func TestDiffDifferent(t *testing.T) {
+	// Different port
+	checkDiff(t, tcpPortFilter, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 23},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 3},
+		bpf.LoadAbsolute{Size: 2, Off: 36},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 443, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	}, false)
+
+	// Targets swapped
+	checkDiff(t, tcpPortFilter, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 23},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 3},
+		bpf.LoadAbsolute{Size: 2, Off: 36},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipTrue: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	}, false)
+
+	// Both conditions jump to the same no match block, instead of separate ones
+	checkDiff(t, tcpPortFilter, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 23},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 4},
+		bpf.LoadAbsolute{Size: 2, Off: 36},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 0},
+	}, false)
+}
+
+// Reordering independent conditions doesn't change the result of a filter, but it changes its blocks.
+// It is always reported as different.
+func TestDiffReordered(t *testing.T) {
+	reordered := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 36},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipFalse: 3},
+		bpf.LoadAbsolute{Size: 1, Off: 23},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	}
+
+	for i := 0; i < 10; i++ {
+		checkDiff(t, tcpPortFilter, reordered, false)
+	}
+}
+
+func TestDiffInvalid(t *testing.T) {
+	if _, err := Diff(tcpPortFilter, []bpf.Instruction{bpf.LoadScratch{Dst: bpf.RegA, N: 16}}); err == nil {
+		t.Fatal("invalid filter accepted")
+	}
+}
@@ -0,0 +1,66 @@
+package cbpfc
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// jump test to a disassembly mnemonic, jumps that test bits aren't set swap their targets instead
+var condToDisasm = map[bpf.JumpTest]string{
+	bpf.JumpEqual:          "jeq",
+	bpf.JumpNotEqual:       "jne",
+	bpf.JumpGreaterThan:    "jgt",
+	bpf.JumpLessThan:       "jlt",
+	bpf.JumpGreaterOrEqual: "jge",
+	bpf.JumpLessOrEqual:    "jle",
+	bpf.JumpBitsSet:        "jset",
+}
+
+// Disassemble lists a cBPF filter as cbpfc compiles it, one instruction per line, eg:
+//
+//	0: guard len >= 14
+//	1: ldh [12]
+//	2: jne #0x800 jt 5 jf 3
+//
+// Jumps are normalized and optimizations applied, the instructions cbpfc inserts are included.
+// Instructions are numbered by their position in the listing, and jump targets are resolved to those positions.
+func Disassemble(insns []bpf.Instruction) (string, error) {
+	blocks, err := compile(insns, CompileOpts{})
+	if err != nil {
+		return "", err
+	}
+
+	layout, start := cbpfLayout(blocks)
+
+	listing := strings.Builder{}
+
+	for pc, out := range layout {
+		var line string
+
+		switch in := out.Instruction.(type) {
+		case bpf.Jump:
+			line = fmt.Sprintf("ja %d", start[out.jt])
+		case bpf.JumpIf:
+			line = disasmCond(in.Cond, "#"+explainConst(in.Val), start[out.jt], start[out.jf])
+		case bpf.JumpIfX:
+			line = disasmCond(in.Cond, "x", start[out.jt], start[out.jf])
+		default:
+			line = fmt.Sprintf("%v", in)
+		}
+
+		fmt.Fprintf(&listing, "%d: %s\n", pc, line)
+	}
+
+	return listing.String(), nil
+}
+
+// disasmCond is a conditional jump to absolute positions.
+func disasmCond(cond bpf.JumpTest, val string, jt, jf int) string {
+	if cond == bpf.JumpBitsNotSet {
+		cond, jt, jf = bpf.JumpBitsSet, jf, jt
+	}
+
+	return fmt.Sprintf("%s %s jt %d jf %d", condToDisasm[cond], val, jt, jf)
+}
@@ -0,0 +1,43 @@
+package cbpfc
+
+import (
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestDisassemble(t *testing.T) {
+	listing, err := Disassemble([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 4},
+		bpf.LoadAbsolute{Size: 1, Off: 23},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 6, SkipTrue: 1},
+		bpf.TAX{},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Positions include the guards, the jump is normalized
+	expected := "0: guard len >= 14\n" +
+		"1: ldh [12]\n" +
+		"2: jne #0x800 jt 8 jf 3\n" +
+		"3: guard len >= 24\n" +
+		"4: ldb [23]\n" +
+		"5: jset #6 jt 7 jf 6\n" +
+		"6: tax\n" +
+		"7: ret #1\n" +
+		"8: ret #0\n"
+
+	if listing != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, listing)
+	}
+}
+
+func TestDisassembleInvalid(t *testing.T) {
+	if _, err := Disassemble([]bpf.Instruction{bpf.LoadAbsolute{Size: 2, Off: 12}}); err == nil {
+		t.Fatal("filter without return disassembled")
+	}
+}
@@ -3,6 +3,8 @@ package cbpfc
 import (
 	"fmt"
 	"math"
+	"sort"
+	"strings"
 
 	"github.com/newtools/ebpf/asm"
 	"github.com/pkg/errors"
@@ -12,6 +14,15 @@ import (
 // internal label when packet doesn't match
 const noMatchLabel = "nomatch"
 
+// guardFailureLabel returns GuardFailureValue, if it isn't 0 (no match)
+const guardFailureLabel = "guardfailure"
+
+// prologueLabel and epilogueLabel prefix the labels of the Prologue and Epilogue, returns jump to epilogueLabel
+const (
+	prologueLabel = "prologue"
+	epilogueLabel = "epilogue"
+)
+
 // alu operation to eBPF
 var aluToEBPF = map[bpf.ALUOp]asm.ALUOp{
 	bpf.ALUOpAdd:        asm.Add,
@@ -33,8 +44,85 @@ var sizeToEBPF = map[int]asm.Size{
 	4: asm.Word,
 }
 
+// KernelVersion is a Linux kernel version, ie Major.Minor.
+type KernelVersion struct {
+	Major int
+	Minor int
+}
+
+// Kernel versions eBPF features the generated eBPF can use were added in
+var (
+	// Direct packet access
+	kernelPacketAccess = KernelVersion{4, 7}
+	// JLT and JLE jumps
+	kernelJumpLess = KernelVersion{4, 14}
+	// bpf_xdp_load_bytes helper
+	kernelXDPLoadBytes = KernelVersion{5, 18}
+	// bpf_skb_pull_data helper
+	kernelSKBPullData = KernelVersion{4, 9}
+)
+
+// Helpers asm doesn't know about.
+// asm is missing bpf_skb_load_bytes, the helpers it numbers after it are off by one.
+const (
+	// bpf_skb_load_bytes
+	skbLoadBytes = asm.BuiltinFunc(26)
+	// bpf_skb_pull_data
+	skbPullData = asm.BuiltinFunc(39)
+	// bpf_xdp_load_bytes
+	xdpLoadBytes = asm.BuiltinFunc(189)
+)
+
+// Offsets of the fields of struct __sk_buff the generated eBPF reads
+const (
+	skbLenOffset     = 0
+	skbDataOffset    = 76
+	skbDataEndOffset = 80
+)
+
+// SKBMode is how a filter loads from socket buffers (struct __sk_buff) that aren't linear.
+//
+// Direct packet access only reaches the linear part of a socket buffer, between PacketStart and PacketEnd,
+// which can be shorter than the packet, eg for GSO or fraglist packets.
+type SKBMode int
+
+const (
+	// SKBLinear only loads from the linear part of the packet: loads past it fail the packet guards,
+	// even if the packet is long enough. The cBPF packet length is the length of the linear part.
+	SKBLinear SKBMode = iota
+
+	// SKBPullData calls bpf_skb_pull_data at the start of the filter, to make as much of the packet linear
+	// as the absolute loads of the filter need, or all of it if the filter has indirect loads.
+	// PacketStart and PacketEnd are reloaded from SKBContext afterwards, the call invalidates them.
+	SKBPullData
+
+	// SKBLoadBytes loads directly from the linear part of the packet, and with bpf_skb_load_bytes past it.
+	// Loads are checked against the linear part one at a time instead of with packet guards,
+	// the helper checks the packet is long enough: a load past the packet fails the filter like a failed guard.
+	SKBLoadBytes
+)
+
+// supports checks if version k is at least version, the zero value supports everything.
+func (k KernelVersion) supports(version KernelVersion) bool {
+	if k == (KernelVersion{}) {
+		return true
+	}
+
+	if k.Major != version.Major {
+		return k.Major > version.Major
+	}
+
+	return k.Minor >= version.Minor
+}
+
+func (k KernelVersion) String() string {
+	return fmt.Sprintf("%d.%d", k.Major, k.Minor)
+}
+
 // EBPFOpts control how a cBPF filter is converted to eBPF
 type EBPFOpts struct {
+	CompileOpts
+
 	// PacketStart is a register holding a pointer to the start of the packet.
 	// Not modified.
 	PacketStart asm.Register
@@ -55,8 +143,109 @@ type EBPFOpts struct {
 	// StackOffset is the first stack offset that can be used.
 	StackOffset int
 
-	// LabelPrefix is the prefix to prepend to labels used internally.
+	// ScratchAlign, if set, moves the scratch memory (M[0] to M[15], 64 bytes) down the stack
+	// so its lowest address is a multiple of ScratchAlign bytes below the frame pointer.
+	// Must be a power of 2.
+	ScratchAlign int
+
+	// ScratchPadding is a number of bytes reserved, and not used, after the scratch memory.
+	ScratchPadding int
+
+	// LabelPrefix is the prefix to prepend to labels used internally, Name if not set.
 	LabelPrefix string
+
+	// Trace calls bpf_trace_printk at the start of every block with the block's id ("blk <id>"),
+	// and with the filter's return value ("ret <value>"), to show the path packets take through the filter.
+	// trace_printk is slow and rate limited, only for debugging.
+	//
+	// Registers used by the filter are saved and restored around the calls.
+	// Up to 48 bytes of stack following the scratch memory and ScratchPadding are used, aligned to 8 bytes.
+	Trace bool
+
+	// PreserveX makes X (register Working[1]) caller owned: the caller initializes it before the filter runs,
+	// and it is restored to that value before jumping to ResultLabel, even if the filter modifies X.
+	// X is added to InitializedRegs, so it isn't zero initialized if the filter reads it before writing to it.
+	// The full 64 bits of the register are preserved.
+	//
+	// X is saved in the 8 bytes of stack following the 48 used by Trace.
+	// Result must be different to Working[1].
+	PreserveX bool
+
+	// ScratchMaps backs scratch positions (M[]) by BPF maps, so their value persists across runs of the filter.
+	// M[n] is the value of key 0 of the map ScratchMaps[n] is the symbol of: an array of 4 byte values, with 4 byte keys.
+	// The map is referenced by a 64 bit load of its symbol, that has to be rewritten with the map (eg ebpf.Editor.RewriteMap).
+	//
+	// Loads and stores of M[n] call map_lookup_elem and map_update_elem, loads are 0 if the lookup fails.
+	// M[n] is never zero initialized, and stores to it are never removed.
+	// Registers used by the filter are saved and restored around the calls, using the same stack as Trace.
+	//
+	// Blocks are split after stores to M[n], so packet guards (including HoistGuards) can't fail before a store that runs in cBPF.
+	// It can't be used with SingleGuard.
+	ScratchMaps map[int]string
+
+	// MatchOffset outputs the offset in the packet of the last packet load the filter did in register MatchOffsetReg,
+	// along with Result: the offset of the load that decided the result of a classifier.
+	// Offsets of indirect loads include X. MatchOffsetReg is 0xFFFFFFFF if the filter didn't load from the packet.
+	//
+	// MatchOffsetReg must be different to PacketStart, PacketEnd, Result and the Working registers.
+	// With Trace, ScratchMaps, XDPLoadBytes or SKB, it has to be one of R6 - R9 so it isn't clobbered by calls.
+	MatchOffset    bool
+	MatchOffsetReg asm.Register
+
+	// XDPLoadBytes loads from the packet with the bpf_xdp_load_bytes helper, instead of directly,
+	// for XDP programs on kernels that have it (5.18).
+	// The helper checks the packet is long enough for each load, so packet guards aren't emitted:
+	// a load fails the filter like a failed guard. Direct access is faster.
+	//
+	// Bytes are loaded into the first 8 byte slot used by Trace, registers used by the filter are saved and restored
+	// around the calls like Trace.
+	XDPLoadBytes bool
+
+	// XDPContext is a register holding the XDP program's context (struct xdp_md), passed to bpf_xdp_load_bytes.
+	// Not modified. Only used with XDPLoadBytes, must be one of R6 - R9 so it isn't clobbered by calls.
+	XDPContext asm.Register
+
+	// SKB is how loads reach the parts of the packet that aren't linear, for programs with a socket buffer context.
+	// With a mode other than SKBLinear, the cBPF packet length is the length of the whole packet (skb->len).
+	SKB SKBMode
+
+	// SKBContext is a register holding the program's context (struct __sk_buff), passed to the helpers SKB uses.
+	// Not modified. Only used with an SKB mode other than SKBLinear, must be one of R6 - R9 so it isn't clobbered by calls.
+	SKBContext asm.Register
+
+	// MetadataStart and MetadataEnd are registers holding pointers to the start and end of the metadata buffer
+	// absolute loads in CompileOpts.Metadata read from. Not modified. Only used if there is a Metadata region.
+	// They must be different to PacketStart, PacketEnd, Result and the Working registers.
+	// With Trace, ScratchMaps, XDPLoadBytes or SKB, they have to be R6 - R9 so they aren't clobbered by calls.
+	MetadataStart, MetadataEnd asm.Register
+
+	// Assertions re-check at runtime what cbpfc guarantees when compiling, to catch compiler bugs:
+	// packet and metadata loads are checked to be in their buffer, and X not to be 0 before divisions and modulus by X.
+	// Like the checks they mirror, failed load assertions return GuardFailureValue, and failed X assertions don't match.
+	// Every assertion is an extra branch for the verifier.
+	// Loads aren't checked with XDPLoadBytes or SKBLoadBytes, they check themselves.
+	Assertions bool
+
+	// Prologue is spliced before the filter, and falls through to it.
+	// Epilogue is spliced after the filter: returns jump to it with the result in register Result,
+	// and it falls through to ResultLabel, unless it ends with an exit or an unconditional jump.
+	// Registers other than the ones used by the filter can be used to pass state from the Prologue to the Epilogue.
+	// With Trace, ScratchMaps, XDPLoadBytes or SKB, only R6 - R9 can: the filter calls helpers, which clobber R1 - R5.
+	//
+	// Labels defined in them are prefixed with LabelPrefix and "prologue" or "epilogue", along with the references to them
+	// from the same snippet, so they can't collide with the filter's labels. Other references are left unchanged,
+	// eg to ResultLabel or to labels of the surrounding program.
+	Prologue, Epilogue asm.Instructions
+
+	// KernelVersion is the oldest kernel the eBPF has to be loadable on.
+	// Only instructions supported by it are used:
+	//
+	//   < 4.7        unsupported, no direct packet access
+	//   4.7 - 4.13   JLT and JLE are replaced by JGE and JGT, with the jump targets swapped
+	//   >= 4.14      all instructions
+	//
+	// The zero value allows all instructions.
+	KernelVersion KernelVersion
 }
 
 // ebpfOpts is the internal version of EBPFOpts
@@ -86,12 +275,371 @@ func (e ebpfOpts) reg(reg bpf.Register) asm.Register {
 	}
 }
 
+// guardLabel is the label failed packet guards jump to.
+func (e ebpfOpts) guardLabel() string {
+	if e.GuardFailureValue == 0 {
+		return noMatchLabel
+	}
+
+	return guardFailureLabel
+}
+
 func (e ebpfOpts) label(name string) string {
 	return fmt.Sprintf("%s_%s", e.LabelPrefix, name)
 }
 
+// maxStackDepth is the size of the eBPF stack
+const maxStackDepth = 512
+
+// maxPacketOffset is the furthest into the packet the verifier tracks packet pointers, MAX_PACKET_OFF in the kernel.
+const maxPacketOffset = 0xffff
+
 func (e ebpfOpts) stackOffset(n int) int16 {
-	return -int16(e.StackOffset + n*4)
+	return -int16(e.scratchBase() + n*4)
+}
+
+// scratchBase is the depth of M[0] on the stack. M[15] is ScratchAlign aligned.
+func (e ebpfOpts) scratchBase() int {
+	if e.ScratchAlign == 0 {
+		return e.StackOffset
+	}
+
+	last := (e.StackOffset + 15*4 + e.ScratchAlign - 1) &^ (e.ScratchAlign - 1)
+	return last - 15*4
+}
+
+// traceStackOffset is the stack offset of the nth 8 byte slot used by tracing, after the scratch memory.
+func (e ebpfOpts) traceStackOffset(n int) int16 {
+	return -int16(e.traceDepth(n))
+}
+
+func (e ebpfOpts) traceDepth(n int) int {
+	scratchEnd := (e.scratchBase() + 16*4 + e.ScratchPadding + 7) &^ 7
+	return scratchEnd + (n+1)*8
+}
+
+// stackDepth is the depth of the lowest byte of stack used.
+// Stack offsets are int16, it is computed without them so it can't overflow.
+func (e ebpfOpts) stackDepth() int {
+	switch {
+	case e.PreserveX:
+		return e.traceDepth(6)
+	case e.calls():
+		return e.traceDepth(5)
+	default:
+		return e.scratchBase() + 15*4 + e.ScratchPadding
+	}
+}
+
+// preserveXStackOffset is the stack offset X is saved at, after the stack used by tracing.
+func (e ebpfOpts) preserveXStackOffset() int16 {
+	return e.traceStackOffset(6)
+}
+
+// result jumps to ResultLabel, or the Epilogue if there is one, restoring X first if it is preserved.
+func (e ebpfOpts) result() []asm.Instruction {
+	label := e.ResultLabel
+	if len(e.Epilogue) != 0 {
+		label = e.label(epilogueLabel)
+	}
+
+	if !e.PreserveX {
+		return []asm.Instruction{asm.Ja.Label(label)}
+	}
+
+	return []asm.Instruction{
+		asm.LoadMem(e.regX, asm.R10, e.preserveXStackOffset(), asm.DWord),
+		asm.Ja.Label(label),
+	}
+}
+
+// splice copies a Prologue or Epilogue, prefixing the labels it defines and the references to them with name.
+func (e ebpfOpts) splice(name string, snippet asm.Instructions) asm.Instructions {
+	insns := make(asm.Instructions, len(snippet))
+	copy(insns, snippet)
+
+	labels := make(map[string]string)
+	for _, insn := range insns {
+		if insn.Symbol != "" {
+			labels[insn.Symbol] = e.label(fmt.Sprintf("%s_%s", name, insn.Symbol))
+		}
+	}
+
+	for i := range insns {
+		if label, ok := labels[insns[i].Symbol]; ok {
+			insns[i].Symbol = label
+		}
+		if label, ok := labels[insns[i].Reference]; ok {
+			insns[i].Reference = label
+		}
+	}
+
+	return insns
+}
+
+// fallsThrough checks if execution can continue after insn.
+func fallsThrough(insn asm.Instruction) bool {
+	if insn.OpCode.Class() != asm.JumpClass {
+		return true
+	}
+
+	op := insn.OpCode.JumpOp()
+	return op != asm.Ja && op != asm.Exit
+}
+
+// traceFormatLen is the size of trace format strings, including the terminating NUL.
+const traceFormatLen = 8
+
+// trace calls bpf_trace_printk with format, and a single argument set by arg in R3.
+// format must be shorter than traceFormatLen.
+// Registers the helper call clobbers are saved and restored.
+func (e ebpfOpts) trace(format string, arg asm.Instruction) asm.Instructions {
+	insns, restore := e.saveClobbered()
+
+	// Format string, one byte at a time to be endian independent
+	for i := 0; i < traceFormatLen; i++ {
+		var c byte
+		if i < len(format) {
+			c = format[i]
+		}
+
+		insns = append(insns, asm.StoreImm(asm.R10, e.traceStackOffset(0)+int16(i), int64(c), asm.Byte))
+	}
+
+	// Set the arg first, it might be read from R1 or R2
+	insns = append(insns,
+		arg,
+		asm.Mov.Reg(asm.R1, asm.R10),
+		asm.Add.Imm(asm.R1, int32(e.traceStackOffset(0))),
+		asm.Mov.Imm(asm.R2, traceFormatLen),
+		asm.TracePrintk.Call(),
+	)
+
+	return append(insns, restore...)
+}
+
+// calls checks if the filter calls helpers, other than explicitly with bpf_trace_printk.
+func (e ebpfOpts) calls() bool {
+	return e.Trace || len(e.ScratchMaps) != 0 || e.XDPLoadBytes || e.SKB != SKBLinear
+}
+
+// helperLoads checks if packet loads check themselves, with a helper, instead of being guarded.
+func (e ebpfOpts) helperLoads() bool {
+	return e.XDPLoadBytes || e.SKB == SKBLoadBytes
+}
+
+// saveClobbered saves the registers used by the filter that calls clobber (R0 - R5)
+// in the 8 byte slots used by tracing after the first one, and returns the instructions restoring them.
+func (e ebpfOpts) saveClobbered() (save asm.Instructions, restore asm.Instructions) {
+	for _, reg := range []asm.Register{e.PacketStart, e.PacketEnd, e.regA, e.regX, e.regIndirect} {
+		if reg <= asm.R5 {
+			offset := e.traceStackOffset(len(save) + 1)
+
+			save = append(save, asm.StoreMem(asm.R10, offset, reg, asm.DWord))
+			restore = append(restore, asm.LoadMem(reg, asm.R10, offset, asm.DWord))
+		}
+	}
+
+	return save, restore
+}
+
+// loadScratchMap loads M[n] from the map backing it into dst.
+// The key, and the value once it's looked up, are in the first 8 byte slot used by tracing.
+func (e ebpfOpts) loadScratchMap(n int, dst asm.Register) asm.Instructions {
+	insns, restore := e.saveClobbered()
+
+	key := e.traceStackOffset(0)
+
+	// value is 0 if the lookup fails
+	skip := asm.JEq.Imm(asm.R0, 0, "")
+	skip.Offset = 1
+
+	insns = append(insns,
+		asm.StoreImm(asm.R10, key, 0, asm.Word),
+		e.scratchMapPtr(n),
+		asm.Mov.Reg(asm.R2, asm.R10),
+		asm.Add.Imm(asm.R2, int32(key)),
+		asm.MapLookupElement.Call(),
+		asm.Mov.Imm(asm.R1, 0),
+		skip,
+		asm.LoadMem(asm.R1, asm.R0, 0, asm.Word),
+		asm.StoreMem(asm.R10, key, asm.R1, asm.Word),
+	)
+
+	insns = append(insns, restore...)
+
+	return append(insns, asm.LoadMem(dst, asm.R10, key, asm.Word))
+}
+
+// storeScratchMap stores src in M[n], in the map backing it.
+// The key and value are in the first 8 byte slot used by tracing.
+func (e ebpfOpts) storeScratchMap(n int, src asm.Register) asm.Instructions {
+	insns, restore := e.saveClobbered()
+
+	key, value := e.traceStackOffset(0), e.traceStackOffset(0)+4
+
+	insns = append(insns,
+		asm.StoreMem(asm.R10, value, src, asm.Word),
+		asm.StoreImm(asm.R10, key, 0, asm.Word),
+		e.scratchMapPtr(n),
+		asm.Mov.Reg(asm.R2, asm.R10),
+		asm.Add.Imm(asm.R2, int32(key)),
+		asm.Mov.Reg(asm.R3, asm.R10),
+		asm.Add.Imm(asm.R3, int32(value)),
+		asm.Mov.Imm(asm.R4, 0), // BPF_ANY
+		asm.MapUpdateElement.Call(),
+	)
+
+	return append(insns, restore...)
+}
+
+// loadBytes loads size bytes of the packet into dst with bpf_xdp_load_bytes, or bpf_skb_load_bytes with SKBLoadBytes,
+// jumping to the guard failure label if it fails.
+// check is run before the registers are saved, offset sets the offset to load from in R2.
+// Bytes are loaded into the first 8 byte slot used by tracing, followed by the helper's result.
+func (e ebpfOpts) loadBytes(dst asm.Register, size int, check asm.Instructions, offset ...asm.Instruction) (asm.Instructions, error) {
+	save, restore := e.saveClobbered()
+
+	helper, ctx := xdpLoadBytes, e.XDPContext
+	if e.SKB == SKBLoadBytes {
+		helper, ctx = skbLoadBytes, e.SKBContext
+	}
+
+	buf := e.traceStackOffset(0)
+
+	insns := append(asm.Instructions{}, check...)
+	insns = append(insns, save...)
+	// offset can read X, set it before the other arguments
+	insns = append(insns, offset...)
+	insns = append(insns,
+		asm.Mov.Reg(asm.R1, ctx),
+		asm.Mov.Reg(asm.R3, asm.R10),
+		asm.Add.Imm(asm.R3, int32(buf)),
+		asm.Mov.Imm(asm.R4, int32(size)),
+		helper.Call(),
+		asm.StoreMem(asm.R10, buf+4, asm.R0, asm.Word),
+	)
+	insns = append(insns, restore...)
+
+	// Check the result once the registers are restored, PacketStart and PacketEnd are restored on failure too
+	insns = append(insns,
+		asm.LoadMem(e.regTmp, asm.R10, buf+4, asm.Word),
+		asm.JNE.Imm(e.regTmp, 0, e.label(e.guardLabel())),
+	)
+
+	return appendNtoh(e, dst, sizeToEBPF[size], append(insns, asm.LoadMem(dst, asm.R10, buf, sizeToEBPF[size]))...)
+}
+
+// linearLoad loads size bytes at off from the start of the packet, or from x with indirect, into dst
+// directly if they're in the linear part of the packet, and runs slow otherwise.
+// Only SKBLoadBytes loads directly, slow is always run otherwise.
+func (e ebpfOpts) linearLoad(dst asm.Register, size int, off uint32, indirect bool, slow asm.Instructions) (asm.Instructions, error) {
+	// Direct loads need the offset to fit in the instruction
+	if e.SKB != SKBLoadBytes || off > math.MaxInt16-uint32(size) {
+		return slow, nil
+	}
+
+	base := e.PacketStart
+	check := asm.Instructions{}
+
+	if indirect {
+		// Bound x so the verifier learns the range of packet start + x, like indirect packet guards
+		check = append(check,
+			asm.JGT.Imm(e.regX, int32(maxPacketOffset-off-uint32(size)), ""),
+			asm.Mov.Reg(e.regIndirect, e.PacketStart),
+			asm.Add.Reg(e.regIndirect, e.regX),
+		)
+		base = e.regIndirect
+	}
+
+	check = append(check,
+		asm.Mov.Reg(e.regTmp, base),
+		asm.Add.Imm(e.regTmp, int32(off)+int32(size)),
+		asm.JGT.Reg(e.regTmp, e.PacketEnd, ""),
+	)
+
+	direct, err := appendNtoh(e, dst, sizeToEBPF[size], asm.LoadMem(dst, base, int16(off), sizeToEBPF[size]))
+	if err != nil {
+		return nil, err
+	}
+
+	// Jumps of check skip the direct load, and the jump over slow, to slow
+	for i := range check {
+		if check[i].OpCode.Class() == asm.JumpClass {
+			check[i].Offset = int16(len(check) - 1 - i + len(direct) + 1)
+		}
+	}
+
+	done := asm.Ja.Label("")
+	done.Offset = int16(len(slow))
+
+	insns := append(check, direct...)
+	insns = append(insns, done)
+	return append(insns, slow...), nil
+}
+
+// skbPullData calls bpf_skb_pull_data to make n bytes of the packet linear, all of it if n is 0,
+// and reloads PacketStart and PacketEnd.
+func (e ebpfOpts) skbPullData(n uint64) asm.Instructions {
+	insns, restore := e.saveClobbered()
+
+	if n == 0 {
+		insns = append(insns, asm.Mov.Imm(asm.R2, 0))
+	} else {
+		// Pulling more than the packet fails, pull all of it if it's shorter
+		skip := asm.JGE.Reg(asm.R3, asm.R2, "")
+		skip.Offset = 1
+
+		insns = append(insns,
+			asm.LoadMem(asm.R2, e.SKBContext, skbLenOffset, asm.Word),
+			asm.Mov.Imm32(asm.R3, int32(n)),
+			skip,
+			asm.Mov.Reg(asm.R2, asm.R3),
+		)
+	}
+
+	// Loads past the linear part still fail the guards if the call fails, the result isn't checked
+	insns = append(insns,
+		asm.Mov.Reg(asm.R1, e.SKBContext),
+		skbPullData.Call(),
+	)
+	insns = append(insns, restore...)
+
+	// The call invalidates packet pointers, even the ones restored
+	return append(insns,
+		asm.LoadMem(e.PacketStart, e.SKBContext, skbDataOffset, asm.Word),
+		asm.LoadMem(e.PacketEnd, e.SKBContext, skbDataEndOffset, asm.Word),
+	)
+}
+
+// skbPullLen is the length of packet the loads of blocks need, 0 if it isn't known because of indirect loads.
+// ok is false if blocks don't load from the packet.
+func skbPullLen(blocks []*block, opts ebpfOpts) (uint64, bool) {
+	var n uint64
+	ok := false
+
+	for _, block := range blocks {
+		for _, insn := range block.insns {
+			switch i := insn.Instruction.(type) {
+			case packetGuardAbsolute:
+				if l := opts.guardLen(i.Len); l > n {
+					n = l
+				}
+				ok = true
+			case packetGuardIndirect:
+				return 0, true
+			}
+		}
+	}
+
+	return n, ok
+}
+
+// scratchMapPtr loads a reference to the map backing M[n] into R1.
+func (e ebpfOpts) scratchMapPtr(n int) asm.Instruction {
+	load := asm.LoadImm(asm.R1, 0, asm.DWord)
+	load.Reference = e.ScratchMaps[n]
+	return load
 }
 
 // ToEBF converts a cBPF filter to eBPF.
@@ -99,12 +647,138 @@ func (e ebpfOpts) stackOffset(n int) int16 {
 // The generated eBPF code always jumps to opts.ResultLabel, with register opts.Result containing the filter's return value:
 // 0 if the packet does not match the cBPF filter,
 // non 0 if the packet does match.
+//
+// The value is the one the filter returns unchanged, from RetConstant or from A with RetA, so it can be the number of bytes
+// of the packet to capture, like a socket filter's snap length. Packets too short for a load return GuardFailureValue,
+// 0 (drop) by default.
 func ToEBPF(filter []bpf.Instruction, opts EBPFOpts) (asm.Instructions, error) {
-	blocks, err := compile(filter)
+	prog, err := toEBPF(&buffers{}, filter, opts)
 	if err != nil {
 		return nil, err
 	}
 
+	return prog.insns, nil
+}
+
+// ToEBPFAsm converts a cBPF filter to eBPF like ToEBPF, rendered as human readable assembly.
+//
+// Every eBPF instruction is listed with its offset, under the labels of the blocks.
+// The first eBPF instruction each cBPF instruction compiles to is commented with it, its position in the filter,
+// and its entry in Comments, if any. Packet guards and other checks the compiler adds are commented without a position.
+func ToEBPFAsm(filter []bpf.Instruction, opts EBPFOpts) (string, error) {
+	prog, err := toEBPF(&buffers{}, filter, opts)
+	if err != nil {
+		return "", err
+	}
+
+	out := strings.Builder{}
+
+	offset := 0
+	for i, insn := range prog.insns {
+		if insn.Symbol != "" {
+			fmt.Fprintf(&out, "%s:\n", insn.Symbol)
+		}
+
+		fmt.Fprintf(&out, "\t%4d: %v", offset, insn)
+
+		// 64 bit immediate loads take two slots
+		offset++
+		if insn.OpCode == asm.LoadImmOp(asm.DWord) {
+			offset++
+		}
+
+		source := prog.sources[i]
+		if source.Instruction != nil && (i == 0 || prog.sources[i-1] != source) {
+			if isSynthetic(source.Instruction) {
+				fmt.Fprintf(&out, "\t; %v", source.Instruction)
+			} else {
+				fmt.Fprintf(&out, "\t; %v", source)
+			}
+
+			if comment, ok := opts.comment(source); ok {
+				fmt.Fprintf(&out, "; %s", comment)
+			}
+		}
+
+		out.WriteString("\n")
+	}
+
+	return out.String(), nil
+}
+
+// ebpfProgram is a cBPF filter compiled to eBPF
+type ebpfProgram struct {
+	// blocks are the compiled cBPF blocks
+	blocks []*block
+
+	insns asm.Instructions
+
+	// sources are the cBPF instructions each eBPF instruction was compiled from.
+	// The zero instruction for eBPF instructions that aren't from any, like jumps between blocks.
+	sources []instruction
+
+	// opts are the internal options used
+	opts ebpfOpts
+}
+
+// toEBPF converts a cBPF filter to eBPF using bufs.
+func toEBPF(bufs *buffers, filter []bpf.Instruction, opts EBPFOpts) (ebpfProgram, error) {
+	opts, err := compileOptsEBPF(opts)
+	if err != nil {
+		return ebpfProgram{}, err
+	}
+
+	blocks, err := bufs.compile(filter, opts.CompileOpts)
+	if err != nil {
+		return ebpfProgram{}, err
+	}
+
+	return blocksToEBPF(blocks, opts)
+}
+
+// compileOptsEBPF sets the CompileOpts of opts the eBPF backend depends on.
+func compileOptsEBPF(opts EBPFOpts) (EBPFOpts, error) {
+	// Don't modify the caller's InitializedRegs
+	if opts.PreserveX {
+		opts.InitializedRegs = append(opts.InitializedRegs[:len(opts.InitializedRegs):len(opts.InitializedRegs)], bpf.RegX)
+	}
+
+	// Scratch backed by maps is set by previous runs, and read by the next ones
+	if len(opts.ScratchMaps) != 0 {
+		// The single guard is checked before any instruction runs
+		if opts.SingleGuard {
+			return opts, errors.New("SingleGuard can't be used with ScratchMaps")
+		}
+
+		maps := make([]int, 0, len(opts.ScratchMaps))
+		for n, symbol := range opts.ScratchMaps {
+			if n < 0 || n >= 16 {
+				return opts, errors.Errorf("invalid ScratchMaps position %d", n)
+			}
+			if symbol == "" {
+				return opts, errors.Errorf("ScratchMaps position %d has no map symbol", n)
+			}
+
+			maps = append(maps, n)
+		}
+		sort.Ints(maps)
+
+		opts.InitializedScratch = append(opts.InitializedScratch[:len(opts.InitializedScratch):len(opts.InitializedScratch)], maps...)
+		opts.liveScratch = maps
+	}
+
+	// Packet loads that call helpers check the packet is long enough themselves
+	opts.checkedLoads = ebpfOpts{EBPFOpts: opts}.helperLoads()
+
+	return opts, nil
+}
+
+// blocksToEBPF lays compiled blocks out as eBPF, opts are the options from compileOptsEBPF.
+func blocksToEBPF(blocks []*block, opts EBPFOpts) (ebpfProgram, error) {
+	if opts.LabelPrefix == "" {
+		opts.LabelPrefix = opts.Name
+	}
+
 	eOpts := ebpfOpts{
 		EBPFOpts:    opts,
 		regA:        opts.Working[0],
@@ -114,47 +788,263 @@ func ToEBPF(filter []bpf.Instruction, opts EBPFOpts) (asm.Instructions, error) {
 	}
 
 	// opts.Result does not have to be unique
-	err = registersUnique(eOpts.PacketStart, eOpts.PacketEnd, eOpts.regA, eOpts.regX, eOpts.regTmp, eOpts.regIndirect)
+	err := registersUnique(eOpts.PacketStart, eOpts.PacketEnd, eOpts.regA, eOpts.regX, eOpts.regTmp, eOpts.regIndirect)
 	if err != nil {
-		return nil, err
+		return ebpfProgram{}, err
 	}
 
 	err = registerValid(eOpts.Result)
 	if err != nil {
-		return nil, err
+		return ebpfProgram{}, err
+	}
+
+	if eOpts.PreserveX && eOpts.Result == eOpts.regX {
+		return ebpfProgram{}, errors.Errorf("Result %v can't be X with PreserveX", eOpts.Result)
+	}
+
+	if eOpts.MatchOffset {
+		err = registersUnique(eOpts.PacketStart, eOpts.PacketEnd, eOpts.regA, eOpts.regX, eOpts.regTmp, eOpts.regIndirect, eOpts.MatchOffsetReg)
+		if err != nil {
+			return ebpfProgram{}, errors.Wrap(err, "MatchOffsetReg")
+		}
+
+		if eOpts.MatchOffsetReg == eOpts.Result {
+			return ebpfProgram{}, errors.Errorf("MatchOffsetReg %v can't be Result", eOpts.MatchOffsetReg)
+		}
+
+		if eOpts.calls() && eOpts.MatchOffsetReg <= asm.R5 {
+			return ebpfProgram{}, errors.Errorf("MatchOffsetReg %v is clobbered by calls", eOpts.MatchOffsetReg)
+		}
+	}
+
+	if eOpts.Metadata.Len != 0 {
+		err = registersUnique(eOpts.PacketStart, eOpts.PacketEnd, eOpts.regA, eOpts.regX, eOpts.regTmp, eOpts.regIndirect, eOpts.MetadataStart, eOpts.MetadataEnd)
+		if err != nil {
+			return ebpfProgram{}, errors.Wrap(err, "MetadataStart and MetadataEnd")
+		}
+
+		for _, reg := range []asm.Register{eOpts.MetadataStart, eOpts.MetadataEnd} {
+			if reg == eOpts.Result || (eOpts.MatchOffset && reg == eOpts.MatchOffsetReg) {
+				return ebpfProgram{}, errors.Errorf("metadata register %v can't be Result or MatchOffsetReg", reg)
+			}
+
+			if eOpts.calls() && reg <= asm.R5 {
+				return ebpfProgram{}, errors.Errorf("metadata register %v is clobbered by calls", reg)
+			}
+		}
+	}
+
+	if eOpts.XDPLoadBytes {
+		err = registersUnique(eOpts.PacketStart, eOpts.PacketEnd, eOpts.regA, eOpts.regX, eOpts.regTmp, eOpts.regIndirect, eOpts.XDPContext)
+		if err != nil {
+			return ebpfProgram{}, errors.Wrap(err, "XDPContext")
+		}
+
+		if eOpts.XDPContext <= asm.R5 {
+			return ebpfProgram{}, errors.Errorf("XDPContext %v is clobbered by calls", eOpts.XDPContext)
+		}
+
+		// The helper only checks the loads are in the packet
+		if eOpts.Trailer != 0 {
+			return ebpfProgram{}, errors.New("Trailer not supported with XDPLoadBytes")
+		}
+
+		if !eOpts.KernelVersion.supports(kernelXDPLoadBytes) {
+			return ebpfProgram{}, errors.Errorf("kernel %v does not support bpf_xdp_load_bytes, requires %v", eOpts.KernelVersion, kernelXDPLoadBytes)
+		}
+	}
+
+	switch eOpts.SKB {
+	case SKBLinear:
+	case SKBPullData, SKBLoadBytes:
+		err = registersUnique(eOpts.PacketStart, eOpts.PacketEnd, eOpts.regA, eOpts.regX, eOpts.regTmp, eOpts.regIndirect, eOpts.SKBContext)
+		if err != nil {
+			return ebpfProgram{}, errors.Wrap(err, "SKBContext")
+		}
+
+		if eOpts.SKBContext <= asm.R5 {
+			return ebpfProgram{}, errors.Errorf("SKBContext %v is clobbered by calls", eOpts.SKBContext)
+		}
+
+		if eOpts.XDPLoadBytes {
+			return ebpfProgram{}, errors.New("SKB not supported with XDPLoadBytes")
+		}
+
+		// The helper only checks the loads are in the packet
+		if eOpts.SKB == SKBLoadBytes && eOpts.Trailer != 0 {
+			return ebpfProgram{}, errors.New("Trailer not supported with SKBLoadBytes")
+		}
+
+		if eOpts.SKB == SKBPullData && !eOpts.KernelVersion.supports(kernelSKBPullData) {
+			return ebpfProgram{}, errors.Errorf("kernel %v does not support bpf_skb_pull_data, requires %v", eOpts.KernelVersion, kernelSKBPullData)
+		}
+	default:
+		return ebpfProgram{}, errors.Errorf("invalid SKB mode %d", eOpts.SKB)
 	}
 
 	if eOpts.StackOffset&1 == 1 {
-		return nil, errors.Errorf("unaligned stack offset")
+		return ebpfProgram{}, errors.Errorf("unaligned stack offset")
+	}
+
+	if eOpts.ScratchAlign < 0 || eOpts.ScratchAlign&(eOpts.ScratchAlign-1) != 0 {
+		return ebpfProgram{}, errors.Errorf("ScratchAlign %d not a power of 2", eOpts.ScratchAlign)
+	}
+
+	if eOpts.ScratchPadding < 0 {
+		return ebpfProgram{}, errors.Errorf("negative ScratchPadding %d", eOpts.ScratchPadding)
+	}
+
+	if depth := eOpts.stackDepth(); depth > maxStackDepth {
+		return ebpfProgram{}, errors.Errorf("filter uses %d bytes of stack, more than %d", depth, maxStackDepth)
+	}
+
+	if !eOpts.KernelVersion.supports(kernelPacketAccess) {
+		return ebpfProgram{}, errors.Errorf("kernel %v does not support direct packet access, requires %v", eOpts.KernelVersion, kernelPacketAccess)
 	}
 
 	eInsns := asm.Instructions{}
+	sources := []instruction{}
+
+	// add appends eInsns compiled from source
+	add := func(source instruction, insns ...asm.Instruction) {
+		eInsns = append(eInsns, insns...)
+		for range insns {
+			sources = append(sources, source)
+		}
+	}
+
+	if len(eOpts.Prologue) != 0 {
+		add(instruction{}, eOpts.splice(prologueLabel, eOpts.Prologue)...)
+	}
+
+	if eOpts.calls() {
+		add(instruction{}, traceInitEBPF(eOpts)...)
+	}
+
+	if eOpts.PreserveX {
+		add(instruction{}, asm.StoreMem(asm.R10, eOpts.preserveXStackOffset(), eOpts.regX, asm.DWord))
+	}
+
+	if eOpts.MatchOffset {
+		add(instruction{}, asm.Mov.Imm32(eOpts.MatchOffsetReg, -1))
+	}
+
+	if eOpts.SKB == SKBPullData {
+		if n, ok := skbPullLen(blocks, eOpts); ok {
+			add(instruction{}, eOpts.skbPullData(n)...)
+		}
+	}
+
+	for b, block := range blocks {
+		next := nextBlock(blocks, b)
 
-	for _, block := range blocks {
 		for i, insn := range block.insns {
-			eInsn, err := insnToEBPF(insn, block, eOpts)
+			eInsn, err := insnToEBPF(insn, block, next, eOpts)
 			if err != nil {
-				return nil, errors.Wrapf(err, "unable to compile %v", insn)
+				return ebpfProgram{}, errors.Wrapf(err, "unable to compile %v", insn)
+			}
+
+			// Tracing and assertions are inserted, they aren't compiled from insn
+			inserted := asm.Instructions{}
+			if eOpts.Trace && i == 0 {
+				inserted = eOpts.trace("blk %d\n", asm.Mov.Imm32(asm.R3, int32(block.id)))
+			}
+
+			if eOpts.Assertions {
+				inserted = append(inserted, assertionEBPF(insn, eOpts)...)
 			}
 
+			inserted = append(inserted, traceRetEBPF(insn.Instruction, eOpts)...)
+
 			// First insn of the block, add symbol so it can be referenced in jumps
 			if block.IsTarget && i == 0 {
-				eInsn[0].Symbol = eOpts.label(block.Label())
+				if len(inserted) != 0 {
+					inserted[0].Symbol = eOpts.label(block.Label())
+				} else {
+					eInsn[0].Symbol = eOpts.label(block.Label())
+				}
+			}
+
+			add(instruction{}, inserted...)
+			add(insn, eInsn...)
+
+			if eOpts.MatchOffset {
+				add(instruction{}, matchOffsetEBPF(insn, eOpts)...)
 			}
+		}
 
-			eInsns = append(eInsns, eInsn...)
+		// Block isn't laid out before the block it falls through to
+		if ft := block.fallthroughBlock(); ft != nil && ft != next {
+			add(instruction{}, asm.Ja.Label(eOpts.label(ft.jumpTarget().Label())))
 		}
 	}
 
-	// kernel verifier does not like dead code - only include no match block if we used it
-	if _, ok := eInsns.ReferenceOffsets()[eOpts.label(noMatchLabel)]; ok {
-		eInsns = append(eInsns,
-			asm.Mov.Imm(eOpts.Result, 0).Sym(eOpts.label(noMatchLabel)),
-			asm.Ja.Label(opts.ResultLabel),
-		)
+	// kernel verifier does not like dead code - only include no match and guard failure blocks if we used them
+	refs := eInsns.ReferenceOffsets()
+	for _, exit := range []struct {
+		label string
+		value uint32
+		set   asm.Instruction
+	}{
+		{noMatchLabel, 0, asm.Mov.Imm(eOpts.Result, 0)},
+		{guardFailureLabel, eOpts.GuardFailureValue, asm.Mov.Imm32(eOpts.Result, int32(eOpts.GuardFailureValue))},
+	} {
+		if _, ok := refs[eOpts.label(exit.label)]; !ok {
+			continue
+		}
+
+		insns := asm.Instructions{}
+		if eOpts.Trace {
+			insns = eOpts.trace("ret %d\n", asm.Mov.Imm32(asm.R3, int32(exit.value)))
+		}
+
+		insns = append(insns, exit.set)
+		insns = append(insns, eOpts.result()...)
+		insns[0].Symbol = eOpts.label(exit.label)
+
+		add(instruction{}, insns...)
 	}
 
-	return eInsns, nil
+	if len(eOpts.Epilogue) != 0 {
+		insns := eOpts.splice(epilogueLabel, eOpts.Epilogue)
+		if insns[0].Symbol != "" {
+			// Instructions only have one symbol, jump over the empty block instead
+			insns = append(asm.Instructions{asm.Ja.Label(insns[0].Symbol)}, insns...)
+		}
+		insns[0].Symbol = eOpts.label(epilogueLabel)
+
+		if fallsThrough(insns[len(insns)-1]) {
+			insns = append(insns, asm.Ja.Label(eOpts.ResultLabel))
+		}
+
+		add(instruction{}, insns...)
+	}
+
+	return ebpfProgram{
+		blocks:  blocks,
+		insns:   eInsns,
+		sources: sources,
+		opts:    eOpts,
+	}, nil
+}
+
+// matchOffsetEBPF sets MatchOffsetReg to the offset of insn if it is a packet load.
+// Indirect packet guards are inserted again when X is modified, X is the same as when regIndirect was set.
+func matchOffsetEBPF(insn instruction, opts ebpfOpts) []asm.Instruction {
+	switch i := insn.Instruction.(type) {
+	case bpf.LoadAbsolute:
+		return []asm.Instruction{asm.Mov.Imm32(opts.MatchOffsetReg, int32(i.Off))}
+	case bpf.LoadMemShift:
+		return []asm.Instruction{asm.Mov.Imm32(opts.MatchOffsetReg, int32(i.Off))}
+	// 64 bit add, x + off doesn't overflow
+	case bpf.LoadIndirect:
+		return []asm.Instruction{
+			asm.Mov.Reg32(opts.MatchOffsetReg, opts.regX),
+			asm.Add.Imm(opts.MatchOffsetReg, int32(i.Off)),
+		}
+	}
+
+	return nil
 }
 
 // registersUnique ensures the registers are valid and unique
@@ -185,31 +1075,95 @@ func registerValid(reg asm.Register) error {
 }
 
 // insnToEBPF compiles an instruction to a set of eBPF instructions
-func insnToEBPF(insn instruction, blk *block, opts ebpfOpts) (asm.Instructions, error) {
+// next is the block laid out after blk, nil if blk is the last block.
+func insnToEBPF(insn instruction, blk *block, next *block, opts ebpfOpts) (asm.Instructions, error) {
 	switch i := insn.Instruction.(type) {
 
 	case bpf.LoadConstant:
 		return ebpfInsn(asm.Mov.Imm32(opts.reg(i.Dst), int32(i.Val)))
 	case bpf.LoadScratch:
+		if _, ok := opts.ScratchMaps[i.N]; ok {
+			return opts.loadScratchMap(i.N, opts.reg(i.Dst)), nil
+		}
 		return ebpfInsn(asm.LoadMem(opts.reg(i.Dst), asm.R10, opts.stackOffset(i.N), asm.Word))
 	case bpf.LoadAbsolute:
+		if opts.helperLoads() {
+			load, err := opts.loadBytes(opts.regA, i.Size, nil, asm.Mov.Imm32(asm.R2, int32(i.Off)))
+			if err != nil {
+				return nil, err
+			}
+
+			return opts.linearLoad(opts.regA, i.Size, i.Off, false, load)
+		}
+
 		if i.Off > math.MaxInt16 {
 			return nil, errors.Errorf("LoadAbsolute offset %v too large", i.Off)
 		}
 
-		return appendNtoh(opts.regA, sizeToEBPF[i.Size],
+		return appendNtoh(opts, opts.regA, sizeToEBPF[i.Size],
 			asm.LoadMem(opts.regA, opts.PacketStart, int16(i.Off), sizeToEBPF[i.Size]),
 		)
+	case loadMetadata:
+		if i.Off > math.MaxInt16 {
+			return nil, errors.Errorf("metadata load offset %v too large", i.Off)
+		}
+
+		return appendNtoh(opts, opts.regA, sizeToEBPF[i.Size],
+			asm.LoadMem(opts.regA, opts.MetadataStart, int16(i.Off), sizeToEBPF[i.Size]),
+		)
 	case bpf.LoadIndirect:
+		if opts.helperLoads() {
+			// Offsets are 32 bits, x + off can't overflow them
+			overflow := asm.Instructions{
+				asm.Mov.Imm32(opts.regTmp, int32(math.MaxUint32-i.Off)),
+				asm.JGT.Reg(opts.regX, opts.regTmp, opts.label(opts.guardLabel())),
+			}
+
+			load, err := opts.loadBytes(opts.regA, i.Size, overflow, asm.Mov.Reg32(asm.R2, opts.regX), asm.Add.Imm32(asm.R2, int32(i.Off)))
+			if err != nil {
+				return nil, err
+			}
+
+			return opts.linearLoad(opts.regA, i.Size, i.Off, true, load)
+		}
+
 		if i.Off > math.MaxInt16 {
 			return nil, errors.Errorf("LoadIndirect offset %v too large", i.Off)
 		}
 
-		return appendNtoh(opts.regA, sizeToEBPF[i.Size],
+		return appendNtoh(opts, opts.regA, sizeToEBPF[i.Size],
 			// last packet guard set opts.regIndirect to packetstart + x
 			asm.LoadMem(opts.regA, opts.regIndirect, int16(i.Off), sizeToEBPF[i.Size]),
 		)
+	// Subtracting packet pointers requires a privileged program.
+	// The length is less than 2^32, the upper 32 bits of A stay 0.
+	case bpf.LoadExtension:
+		if opts.SKB != SKBLinear {
+			return ebpfInsn(asm.LoadMem(opts.regA, opts.SKBContext, skbLenOffset, asm.Word))
+		}
+
+		return ebpfInsn(
+			asm.Mov.Reg(opts.regA, opts.PacketEnd),
+			asm.Sub.Reg(opts.regA, opts.PacketStart),
+		)
 	case bpf.LoadMemShift:
+		if opts.helperLoads() {
+			load, err := opts.loadBytes(opts.regX, 1, nil, asm.Mov.Imm32(asm.R2, int32(i.Off)))
+			if err != nil {
+				return nil, err
+			}
+
+			load, err = opts.linearLoad(opts.regX, 1, i.Off, false, load)
+			if err != nil {
+				return nil, err
+			}
+
+			return append(load,
+				asm.And.Imm32(opts.regX, 0xF),
+				asm.LSh.Imm32(opts.regX, 2),
+			), nil
+		}
+
 		if i.Off > math.MaxInt16 {
 			return nil, errors.Errorf("LoadMemShift offset %v too large", i.Off)
 		}
@@ -221,19 +1175,48 @@ func insnToEBPF(insn instruction, blk *block, opts ebpfOpts) (asm.Instructions,
 		)
 
 	case bpf.StoreScratch:
+		if _, ok := opts.ScratchMaps[i.N]; ok {
+			return opts.storeScratchMap(i.N, opts.reg(i.Src)), nil
+		}
 		return ebpfInsn(asm.StoreMem(asm.R10, opts.stackOffset(i.N), opts.reg(i.Src), asm.Word))
 
+	// 32 bit ALU operations wrap like cBPF, and zero the upper 32 bits of the register, on every kernel.
+	// A and X are always zero extended, so 64 bit jumps compare them exactly without masking:
+	// 32 bit jumps (JMP32) would only save zero extending constants >= 0x80000000, and require kernel 5.1.
+	//
+	// cBPF shifts of 32 or more are 0, the verifier rejects them and JITs mask them.
 	case bpf.ALUOpConstant:
-		return ebpfInsn(aluToEBPF[i.Op].Imm32(opts.regA, int32(i.Val)))
+		op, ok := aluToEBPF[i.Op]
+		if !ok {
+			return nil, errors.Errorf("unsupported instruction %v", insn)
+		}
+		if isShift(i.Op) && i.Val >= 32 {
+			return ebpfInsn(asm.Mov.Imm32(opts.regA, 0))
+		}
+		return ebpfInsn(op.Imm32(opts.regA, int32(i.Val)))
 	case bpf.ALUOpX:
-		return ebpfInsn(aluToEBPF[i.Op].Reg32(opts.regA, opts.regX))
+		op, ok := aluToEBPF[i.Op]
+		if !ok {
+			return nil, errors.Errorf("unsupported instruction %v", insn)
+		}
+		if isShift(i.Op) {
+			return shiftXToEBPF(opts, op)
+		}
+		return ebpfInsn(op.Reg32(opts.regA, opts.regX))
 	case bpf.NegateA:
 		return ebpfInsn(asm.Neg.Imm32(opts.regA, 0))
 
 	case bpf.Jump:
-		return ebpfInsn(asm.Ja.Label(opts.label(blk.skipToBlock(skip(i.Skip)).Label())))
+		target := blk.skipToBlock(skip(i.Skip))
+
+		// Falls through to the next block, unless the jump is all a target block is made of: it needs an instruction to be labelled
+		if target == next && (len(blk.insns) > 1 || !blk.IsTarget) {
+			return nil, nil
+		}
+
+		return ebpfInsn(asm.Ja.Label(opts.label(target.jumpTarget().Label())))
 	case bpf.JumpIf:
-		return condToEBPF(opts, skip(i.SkipTrue), skip(i.SkipFalse), blk, i.Cond, func(jo asm.JumpOp, label string) asm.Instructions {
+		return condToEBPF(opts, skip(i.SkipTrue), skip(i.SkipFalse), blk, next, i.Cond, func(jo asm.JumpOp, label string) asm.Instructions {
 			// eBPF immediates are signed, zero extend into temp register
 			if int32(i.Val) < 0 {
 				return asm.Instructions{
@@ -245,46 +1228,69 @@ func insnToEBPF(insn instruction, blk *block, opts ebpfOpts) (asm.Instructions,
 			return asm.Instructions{jo.Imm(opts.regA, int32(i.Val), label)}
 		})
 	case bpf.JumpIfX:
-		return condToEBPF(opts, skip(i.SkipTrue), skip(i.SkipFalse), blk, i.Cond, func(jo asm.JumpOp, label string) asm.Instructions {
+		return condToEBPF(opts, skip(i.SkipTrue), skip(i.SkipFalse), blk, next, i.Cond, func(jo asm.JumpOp, label string) asm.Instructions {
 			return asm.Instructions{jo.Reg(opts.regA, opts.regX, label)}
 		})
 
 	case bpf.RetA:
-		return ebpfInsn(
-			asm.Mov.Reg32(opts.Result, opts.regA),
-			asm.Ja.Label(opts.ResultLabel),
-		)
+		return ebpfInsn(append([]asm.Instruction{asm.Mov.Reg32(opts.Result, opts.regA)}, opts.result()...)...)
 	case bpf.RetConstant:
-		return ebpfInsn(
-			asm.Mov.Imm32(opts.Result, int32(i.Val)),
-			asm.Ja.Label(opts.ResultLabel),
-		)
+		return ebpfInsn(append([]asm.Instruction{asm.Mov.Imm32(opts.Result, int32(i.Val))}, opts.result()...)...)
 
 	case bpf.TXA:
 		return ebpfInsn(asm.Mov.Reg32(opts.regA, opts.regX))
 	case bpf.TAX:
 		return ebpfInsn(asm.Mov.Reg32(opts.regX, opts.regA))
 
+	// The verifier only allows small packet offsets, but they must at least fit in the immediate.
+	// Pointers are 64 bits, so adding X (32 bits) and Len can't overflow.
+	//
+	// Guards compare a packet pointer to PacketEnd instead of comparing a length computed once to Len:
+	// the verifier only learns how much of the packet can be read from comparisons of packet pointers to the end of the packet.
 	case packetGuardAbsolute:
+		if opts.guardLen(i.Len) > math.MaxInt32 {
+			return nil, errors.Errorf("packet guard of %d bytes too big", opts.guardLen(i.Len))
+		}
+
 		return ebpfInsn(
 			asm.Mov.Reg(opts.regTmp, opts.PacketStart),
-			asm.Add.Imm(opts.regTmp, int32(i.Len)),
-			asm.JGT.Reg(opts.regTmp, opts.PacketEnd, opts.label(noMatchLabel)),
+			asm.Add.Imm(opts.regTmp, int32(opts.guardLen(i.Len))),
+			asm.JGT.Reg(opts.regTmp, opts.PacketEnd, opts.label(opts.guardLabel())),
 		)
 	case packetGuardIndirect:
+		if opts.guardLen(i.Len) > maxPacketOffset {
+			return nil, errors.Errorf("packet guard of x + %d bytes too big", opts.guardLen(i.Len))
+		}
+
 		return ebpfInsn(
+			// Bound x, so packet start + x + Len is a pointer the verifier learns the range of.
+			// Packets can't be longer, x + Len > maxPacketOffset always fails the guard.
+			asm.JGT.Imm(opts.regX, int32(maxPacketOffset-opts.guardLen(i.Len)), opts.label(opts.guardLabel())),
 			// packet start + x
 			asm.Mov.Reg(opts.regIndirect, opts.PacketStart),
 			asm.Add.Reg(opts.regIndirect, opts.regX),
 			// different reg (so actual load picks offset), but same verifier context id
 			asm.Mov.Reg(opts.regTmp, opts.regIndirect),
-			asm.Add.Imm(opts.regTmp, int32(i.Len)),
-			asm.JGT.Reg(opts.regTmp, opts.PacketEnd, opts.label(noMatchLabel)),
+			asm.Add.Imm(opts.regTmp, int32(opts.guardLen(i.Len))),
+			asm.JGT.Reg(opts.regTmp, opts.PacketEnd, opts.label(opts.guardLabel())),
 		)
 
+	case initializeRegister:
+		return ebpfInsn(asm.Mov.Imm32(opts.reg(i.Reg), 0))
 	case initializeScratch:
 		return ebpfInsn(asm.StoreImm(asm.R10, opts.stackOffset(i.N), 0, asm.Word))
 
+	case metadataGuard:
+		if i.Len > math.MaxInt32 {
+			return nil, errors.Errorf("metadata guard of %d bytes too big", i.Len)
+		}
+
+		return ebpfInsn(
+			asm.Mov.Reg(opts.regTmp, opts.MetadataStart),
+			asm.Add.Imm(opts.regTmp, int32(i.Len)),
+			asm.JGT.Reg(opts.regTmp, opts.MetadataEnd, opts.label(opts.guardLabel())),
+		)
+
 	case checkXNotZero:
 		return ebpfInsn(asm.JEq.Imm(opts.regX, 0, opts.label(noMatchLabel)))
 
@@ -293,8 +1299,110 @@ func insnToEBPF(insn instruction, blk *block, opts ebpfOpts) (asm.Instructions,
 	}
 }
 
-func appendNtoh(reg asm.Register, size asm.Size, insns ...asm.Instruction) (asm.Instructions, error) {
-	if size == asm.Byte {
+// assertionEBPF checks at runtime what the packet guards and divide by zero checks guarantee for insn.
+func assertionEBPF(insn instruction, opts ebpfOpts) asm.Instructions {
+	// checkBuffer checks the size bytes at off from base are before end
+	checkBuffer := func(base, end asm.Register, off uint32, size int) asm.Instructions {
+		return asm.Instructions{
+			asm.Mov.Reg(opts.regTmp, base),
+			asm.Add.Imm(opts.regTmp, int32(off)+int32(size)),
+			asm.JGT.Reg(opts.regTmp, end, opts.label(opts.guardLabel())),
+		}
+	}
+
+	// checkLoad checks the size bytes at off from base are in the packet
+	checkLoad := func(base asm.Register, off uint32, size int) asm.Instructions {
+		if opts.helperLoads() {
+			return nil
+		}
+
+		return checkBuffer(base, opts.PacketEnd, off, size)
+	}
+
+	switch i := insn.Instruction.(type) {
+	case loadMetadata:
+		return checkBuffer(opts.MetadataStart, opts.MetadataEnd, i.Off, i.Size)
+	case bpf.LoadAbsolute:
+		return checkLoad(opts.PacketStart, i.Off, i.Size)
+	case bpf.LoadMemShift:
+		return checkLoad(opts.PacketStart, i.Off, 1)
+	case bpf.LoadIndirect:
+		// last packet guard set opts.regIndirect to packetstart + x
+		return checkLoad(opts.regIndirect, i.Off, i.Size)
+	case bpf.ALUOpX:
+		if i.Op == bpf.ALUOpDiv || i.Op == bpf.ALUOpMod {
+			return asm.Instructions{asm.JEq.Imm(opts.regX, 0, opts.label(noMatchLabel))}
+		}
+	}
+
+	return nil
+}
+
+// traceInitEBPF zero initializes the registers saved around calls, so they can be saved before the filter initializes them.
+func traceInitEBPF(opts ebpfOpts) asm.Instructions {
+	initialized := map[asm.Register]bool{}
+	for _, reg := range opts.InitializedRegs {
+		initialized[opts.reg(reg)] = true
+	}
+
+	insns := asm.Instructions{}
+	for _, reg := range []asm.Register{opts.regA, opts.regX, opts.regIndirect} {
+		if reg <= asm.R5 && !initialized[reg] {
+			insns = append(insns, asm.Mov.Imm(reg, 0))
+		}
+	}
+
+	return insns
+}
+
+// shiftXToEBPF shifts A by X, A becoming 0 if X is 32 or more.
+// Jumps are relative, there is no block to jump to.
+func shiftXToEBPF(opts ebpfOpts, op asm.ALUOp) (asm.Instructions, error) {
+	// Skip zeroing A if X < 32, shifting 0 is always 0
+	if opts.KernelVersion.supports(kernelJumpLess) {
+		skip := asm.JLT.Imm(opts.regX, 32, "")
+		skip.Offset = 1
+
+		return ebpfInsn(
+			skip,
+			asm.Mov.Imm32(opts.regA, 0),
+			op.Reg32(opts.regA, opts.regX),
+		)
+	}
+
+	// Skip the shift if X >= 32
+	skip := asm.JGE.Imm(opts.regX, 32, "")
+	skip.Offset = 2
+
+	done := asm.Ja.Label("")
+	done.Offset = 1
+
+	return ebpfInsn(
+		skip,
+		op.Reg32(opts.regA, opts.regX),
+		done,
+		asm.Mov.Imm32(opts.regA, 0),
+	)
+}
+
+// traceRetEBPF traces the return value of insn, if it's a return and tracing is enabled.
+func traceRetEBPF(insn bpf.Instruction, opts ebpfOpts) asm.Instructions {
+	if !opts.Trace {
+		return nil
+	}
+
+	switch i := insn.(type) {
+	case bpf.RetA:
+		return opts.trace("ret %d\n", asm.Mov.Reg32(asm.R3, opts.regA))
+	case bpf.RetConstant:
+		return opts.trace("ret %d\n", asm.Mov.Imm32(asm.R3, int32(i.Val)))
+	}
+
+	return nil
+}
+
+func appendNtoh(opts ebpfOpts, reg asm.Register, size asm.Size, insns ...asm.Instruction) (asm.Instructions, error) {
+	if size == asm.Byte || opts.HostByteOrder {
 		return insns, nil
 	}
 
@@ -302,7 +1410,8 @@ func appendNtoh(reg asm.Register, size asm.Size, insns ...asm.Instruction) (asm.
 	return append(insns, asm.HostTo(asm.BE, reg, size)), nil
 }
 
-func condToEBPF(opts ebpfOpts, skipTrue, skipFalse skip, blk *block, cond bpf.JumpTest, insn func(jo asm.JumpOp, label string) asm.Instructions) (asm.Instructions, error) {
+func condToEBPF(opts ebpfOpts, skipTrue, skipFalse skip, blk *block, next *block, cond bpf.JumpTest, insn func(jo asm.JumpOp, label string) asm.Instructions) (asm.Instructions, error) {
+	// cBPF comparisons are unsigned, never use the signed jumps (JSGT, JSGE, JSLT, JSLE)
 	var condToJump = map[bpf.JumpTest]asm.JumpOp{
 		bpf.JumpEqual:          asm.JEq,
 		bpf.JumpNotEqual:       asm.JNE,
@@ -314,31 +1423,43 @@ func condToEBPF(opts ebpfOpts, skipTrue, skipFalse skip, blk *block, cond bpf.Ju
 		// BitsNotSet doesn't map to anything nicely
 	}
 
-	trueLabel := opts.label(blk.skipToBlock(skipTrue).Label())
-	falseLabel := opts.label(blk.skipToBlock(skipFalse).Label())
+	// No JLT or JLE on older kernels
+	supported := func(cond bpf.JumpTest) bool {
+		if cond == bpf.JumpLessThan || cond == bpf.JumpLessOrEqual {
+			return opts.KernelVersion.supports(kernelJumpLess)
+		}
+
+		_, ok := condToJump[cond]
+		return ok
+	}
 
-	// no skipFalse, we only have to explicitly jump to one block
-	trueOnly := skipFalse == 0
+	trueBlk := blk.skipToBlock(skipTrue)
+	falseBlk := blk.skipToBlock(skipFalse)
 
-	// No native BitsNotSet, convert to BitsSet
-	if cond == bpf.JumpBitsNotSet {
-		cond = bpf.JumpBitsSet
+	// Convert unsupported conditions to their inverse: BitsNotSet, and JLT or JLE on older kernels
+	if !supported(cond) {
+		cond = condToInverse[cond]
 
-		trueLabel, falseLabel = falseLabel, trueLabel
+		trueBlk, falseBlk = falseBlk, trueBlk
+	}
 
-		trueOnly = false
+	// true is the next block: invert the condition so it falls through to it instead, if we can
+	if trueBlk == next && falseBlk != next && supported(condToInverse[cond]) {
+		cond = condToInverse[cond]
 
-		// skipFalse could have fallen through before
-		blk.skipToBlock(skipFalse).IsTarget = true
+		trueBlk, falseBlk = falseBlk, trueBlk
 	}
 
-	if trueOnly {
+	trueLabel := opts.label(trueBlk.jumpTarget().Label())
+
+	// false falls through to the next block: we only have to explicitly jump to one block
+	if falseBlk == next {
 		return insn(condToJump[cond], trueLabel), nil
 	}
 
 	return append(
 		insn(condToJump[cond], trueLabel),
-		asm.Ja.Label(falseLabel),
+		asm.Ja.Label(opts.label(falseBlk.jumpTarget().Label())),
 	), nil
 }
 
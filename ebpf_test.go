@@ -1,9 +1,13 @@
 package cbpfc
 
 import (
+	"math"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/newtools/ebpf"
+	"github.com/newtools/ebpf/asm"
 	"golang.org/x/net/bpf"
 )
 
@@ -26,3 +30,2163 @@ func loadEBPF(tb testing.TB, insns []bpf.Instruction) *ebpf.ProgramSpec {
 		License:      "BSD",
 	}
 }
+
+// testOpts are the EBPFOpts used by tests that check the generated eBPF
+var testOpts = EBPFOpts{
+	PacketStart: asm.R2,
+	PacketEnd:   asm.R3,
+	Result:      asm.R4,
+	ResultLabel: "result",
+	Working:     [4]asm.Register{asm.R4, asm.R5, asm.R6, asm.R7},
+	LabelPrefix: "filter",
+}
+
+// checkEBPF checks a filter compiles to the expected eBPF
+func checkEBPF(tb testing.TB, filter []bpf.Instruction, opts EBPFOpts, expected asm.Instructions) {
+	tb.Helper()
+
+	insns, err := ToEBPF(filter, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(insns, expected) {
+		tb.Fatalf("expected:\n%v\ngot:\n%v", expected, insns)
+	}
+}
+
+func TestSingleInstructionEBPF(t *testing.T) {
+	checkEBPF(t, []bpf.Instruction{
+		bpf.RetConstant{Val: 1},
+	}, testOpts, asm.Instructions{
+		asm.Mov.Imm32(asm.R4, 1),
+		asm.Ja.Label("result"),
+	})
+
+	checkEBPF(t, []bpf.Instruction{
+		bpf.RetA{},
+	}, testOpts, asm.Instructions{
+		asm.Mov.Imm32(asm.R4, 0),
+		asm.Mov.Reg32(asm.R4, asm.R4),
+		asm.Ja.Label("result"),
+	})
+
+	_, err := ToEBPF([]bpf.Instruction{bpf.LoadAbsolute{Size: 1, Off: 0}}, testOpts)
+	if err == nil {
+		t.Fatal("single load compiled")
+	}
+}
+
+// Blocks laid out in any order return the same results
+func TestBlockOrderEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 0, SkipFalse: 6},
+		/* 2 */ bpf.LoadAbsolute{Size: 1, Off: 1},
+		/* 3 */ bpf.JumpIf{Cond: bpf.JumpBitsNotSet, Val: 0x10, SkipTrue: 1, SkipFalse: 0},
+		/* 4 */ bpf.RetConstant{Val: 0},
+		/* 5 */ bpf.LoadAbsolute{Size: 1, Off: 2},
+		/* 6 */ bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 3, SkipTrue: 2, SkipFalse: 0},
+		/* 7 */ bpf.LoadAbsolute{Size: 1, Off: 3}, // falls through to 8
+		/* 8 */ bpf.RetConstant{Val: 0},
+		/* 9 */ bpf.RetA{},
+	}
+
+	packets := [][]byte{
+		{},
+		{1},
+		{2},
+		{1, 0x10},
+		{1, 0x00, 2},
+		{1, 0x00, 2, 5},
+		{1, 0x00, 7},
+		{1, 0x00, 1, 9},
+	}
+
+	for _, order := range []BlockOrder{SourceOrder, FallthroughFirst} {
+		opts := testOpts
+		opts.BlockOrder = order
+
+		checkInterpreter(t, filter, opts, packets...)
+	}
+}
+
+// checksFilter checks the first checks bytes of the packet, returning no match as soon as one doesn't match
+func checksFilter(checks int) []bpf.Instruction {
+	filter := []bpf.Instruction{}
+	for i := 0; i < checks; i++ {
+		filter = append(filter,
+			bpf.LoadAbsolute{Size: 1, Off: uint32(i)},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(i), SkipTrue: 1},
+			bpf.RetConstant{Val: 0},
+		)
+	}
+
+	return append(filter, bpf.RetConstant{Val: 1})
+}
+
+// Size of the eBPF of every block order, and how far the block that returns a match is laid out from the start
+func BenchmarkBlockOrderEBPF(b *testing.B) {
+	filter := checksFilter(16)
+
+	for name, order := range map[string]BlockOrder{
+		"source":      SourceOrder,
+		"fallthrough": FallthroughFirst,
+	} {
+		opts := testOpts
+		opts.BlockOrder = order
+
+		b.Run(name, func(b *testing.B) {
+			var insns asm.Instructions
+
+			for i := 0; i < b.N; i++ {
+				var err error
+				if insns, err = ToEBPF(filter, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			// Instructions laid out before the block that returns a match, after the last check
+			match := 0
+			for match < len(insns) && insns[match].Symbol != "filter_block_48" {
+				match++
+			}
+
+			b.ReportMetric(float64(len(insns)), "insns")
+			b.ReportMetric(float64(match), "insns-before-match")
+		})
+	}
+}
+
+// IP options skipping filter, X is the IP header length
+func TestIPOptionsEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadMemShift{Off: 0},
+		bpf.LoadIndirect{Size: 1, Off: 1}, // first byte after the IP header
+		bpf.RetA{},
+	}
+
+	// x/net/bpf VM panics on out of bounds LoadMemShift, no empty packet
+	checkInterpreter(t, filter, testOpts,
+		[]byte{0x00, 0xAA},
+		[]byte{0x01},
+		[]byte{0x01, 1, 2, 3, 4},
+		[]byte{0x01, 1, 2, 3, 4, 0xBB},
+		[]byte{0x02, 1, 2, 3, 4, 5, 6, 7, 8, 0xCC},
+	)
+}
+
+// X is read from the packet, X + Off + Size overflows 32 bits
+func TestIndirectGuardOverflowEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 4, Off: 0},
+		bpf.TAX{},
+		bpf.LoadIndirect{Size: 4, Off: 4},
+		bpf.RetA{},
+	}
+
+	checkInterpreter(t, filter, testOpts,
+		// x + 8 wraps to 6
+		[]byte{0xff, 0xff, 0xff, 0xfe, 1, 2, 3, 4},
+		[]byte{0xff, 0xff, 0xff, 0xfc, 1, 2, 3, 4},
+		[]byte{0, 0, 0, 0, 1, 2, 3, 4},
+	)
+}
+
+func TestKernelVersionEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.JumpIf{Cond: bpf.JumpLessThan, Val: 3, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 1},
+	}
+
+	guard := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R2),
+		asm.Add.Imm(asm.R6, 1),
+		asm.JGT.Reg(asm.R6, asm.R3, "filter_nomatch"),
+		asm.LoadMem(asm.R4, asm.R2, 0, asm.Byte),
+	}
+
+	ret := func(val int32, label string) asm.Instructions {
+		return asm.Instructions{
+			asm.Mov.Imm32(asm.R4, val).Sym(label),
+			asm.Ja.Label("result"),
+		}
+	}
+
+	noMatch := asm.Instructions{
+		asm.Mov.Imm(asm.R4, 0).Sym("filter_nomatch"),
+		asm.Ja.Label("result"),
+	}
+
+	opts := testOpts
+	opts.KernelVersion = KernelVersion{4, 14}
+
+	checkEBPF(t, filter, opts, joinEBPF(
+		guard,
+		asm.Instructions{
+			asm.JLT.Imm(asm.R4, 3, "filter_block_3"),
+		},
+		ret(0, ""),
+		ret(1, "filter_block_3"),
+		noMatch,
+	))
+
+	opts.KernelVersion = KernelVersion{4, 13}
+
+	checkEBPF(t, filter, opts, joinEBPF(
+		guard,
+		asm.Instructions{
+			asm.JGE.Imm(asm.R4, 3, "filter_block_2"),
+			asm.Ja.Label("filter_block_3"),
+		},
+		ret(0, "filter_block_2"),
+		ret(1, "filter_block_3"),
+		noMatch,
+	))
+
+	checkInterpreter(t, filter, opts, []byte{}, []byte{2}, []byte{3}, []byte{4})
+
+	opts.KernelVersion = KernelVersion{4, 6}
+
+	_, err := ToEBPF(filter, opts)
+	if err == nil {
+		t.Fatal("kernel without direct packet access accepted")
+	}
+}
+
+func joinEBPF(insns ...asm.Instructions) asm.Instructions {
+	res := asm.Instructions{}
+
+	for _, insn := range insns {
+		res = append(res, insn...)
+	}
+
+	return res
+}
+
+func TestTraceEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+		/* 2 */ bpf.RetConstant{Val: 0},
+		/* 3 */ bpf.RetA{},
+	}
+
+	opts := testOpts
+	opts.Trace = true
+
+	checkInterpreter(t, filter, opts, []byte{}, []byte{0}, []byte{1})
+
+	insns, err := ToEBPF(filter, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, pkt []byte, expected []string) {
+		t.Helper()
+
+		interp, err := newInterpreter(insns, opts, pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := interp.run(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(interp.traces, expected) {
+			t.Fatalf("expected traces %q, got %q", expected, interp.traces)
+		}
+	}
+
+	check(t, []byte{}, []string{"blk 0\n", "ret 0\n"})
+	check(t, []byte{0}, []string{"blk 0\n", "blk 2\n", "ret 0\n"})
+	check(t, []byte{1}, []string{"blk 0\n", "blk 3\n", "ret 1\n"})
+}
+
+// Tracing is omitted entirely when disabled
+func TestTraceDisabledEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.RetA{},
+	}
+
+	opts := testOpts
+	if calls := mustCompileEBPF(t, filter, opts).Metrics().HelperCalls; calls != 0 {
+		t.Fatalf("expected no helper calls, got %d", calls)
+	}
+
+	// block 0, ret, nomatch ret
+	opts.Trace = true
+	if calls := mustCompileEBPF(t, filter, opts).Metrics().HelperCalls; calls != 3 {
+		t.Fatalf("expected 3 helper calls, got %d", calls)
+	}
+}
+
+func TestIndirectLoadInitializesXEBPF(t *testing.T) {
+	checkInterpreter(t, []bpf.Instruction{
+		bpf.LoadIndirect{Size: 1, Off: 5},
+		bpf.RetA{},
+	}, testOpts, []byte{}, []byte{0, 1, 2, 3, 4}, []byte{0, 1, 2, 3, 4, 5})
+}
+
+// Jumps to the block laid out next are elided, even if they use skipTrue and skipFalse
+func TestJumpElisionEBPF(t *testing.T) {
+	opts := testOpts
+	opts.BlockOrder = FallthroughFirst
+
+	check := func(t *testing.T, filter []bpf.Instruction, jumps asm.Instructions) {
+		t.Helper()
+
+		ret := func(val int32, label string) asm.Instructions {
+			return asm.Instructions{
+				asm.Mov.Imm32(asm.R4, val).Sym(label),
+				asm.Ja.Label("result"),
+			}
+		}
+
+		// block 3 returns no match, so is laid out last: block 4 is laid out after block 2
+		checkEBPF(t, filter, opts, joinEBPF(
+			asm.Instructions{
+				asm.Mov.Reg(asm.R6, asm.R2),
+				asm.Add.Imm(asm.R6, 1),
+				asm.JGT.Reg(asm.R6, asm.R3, "filter_nomatch"),
+				asm.LoadMem(asm.R4, asm.R2, 0, asm.Byte),
+				asm.JEq.Imm(asm.R4, 0, "filter_block_3"),
+			},
+			jumps,
+			ret(1, "filter_block_4"),
+			ret(2, "filter_block_5"),
+			ret(0, "filter_block_3"),
+			asm.Instructions{
+				asm.Mov.Imm(asm.R4, 0).Sym("filter_nomatch"),
+				asm.Ja.Label("result"),
+			},
+		))
+
+		checkInterpreter(t, filter, opts, []byte{}, []byte{0}, []byte{1}, []byte{2})
+	}
+
+	// false is the next block
+	check(t, []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 1, SkipFalse: 0},
+		/* 2 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 2, SkipFalse: 1},
+		/* 3 */ bpf.RetConstant{Val: 0},
+		/* 4 */ bpf.RetConstant{Val: 1},
+		/* 5 */ bpf.RetConstant{Val: 2},
+	}, asm.Instructions{
+		asm.JEq.Imm(asm.R4, 1, "filter_block_5"),
+	})
+
+	// true is the next block, condition is inverted
+	check(t, []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 1, SkipFalse: 0},
+		/* 2 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1, SkipFalse: 2},
+		/* 3 */ bpf.RetConstant{Val: 0},
+		/* 4 */ bpf.RetConstant{Val: 1},
+		/* 5 */ bpf.RetConstant{Val: 2},
+	}, asm.Instructions{
+		asm.JNE.Imm(asm.R4, 1, "filter_block_5"),
+	})
+
+	// BitsSet can't be inverted
+	check(t, []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 1, SkipFalse: 0},
+		/* 2 */ bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 1, SkipTrue: 1, SkipFalse: 2},
+		/* 3 */ bpf.RetConstant{Val: 0},
+		/* 4 */ bpf.RetConstant{Val: 1},
+		/* 5 */ bpf.RetConstant{Val: 2},
+	}, asm.Instructions{
+		asm.JSet.Imm(asm.R4, 1, "filter_block_4"),
+		asm.Ja.Label("filter_block_5"),
+	})
+
+	// Unconditional jump to the next block
+	jump := []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 2, SkipFalse: 0},
+		/* 2 */ bpf.LoadAbsolute{Size: 1, Off: 1},
+		/* 3 */ bpf.Jump{Skip: 1},
+		/* 4 */ bpf.RetConstant{Val: 0},
+		/* 5 */ bpf.RetA{},
+	}
+
+	insns, err := ToEBPF(jump, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, insn := range insns {
+		if insn.Reference == "filter_block_5" {
+			t.Fatalf("unexpected jump to next block:\n%v", insns)
+		}
+	}
+
+	checkInterpreter(t, jump, opts, []byte{}, []byte{0}, []byte{1}, []byte{1, 2})
+}
+
+// cBPF comparisons are unsigned, including of values with the top bit set
+func TestUnsignedJumpsEBPF(t *testing.T) {
+	values := []uint32{0, 1, 0x7FFFFFFF, 0x80000000, 0x80000001, 0xFFFFFFFE, 0xFFFFFFFF}
+
+	packets := make([][]byte, len(values))
+	for i, val := range values {
+		packets[i] = []byte{byte(val >> 24), byte(val >> 16), byte(val >> 8), byte(val)}
+	}
+
+	check := func(t *testing.T, filter []bpf.Instruction) {
+		t.Helper()
+
+		for _, kernel := range []KernelVersion{{}, {4, 13}} {
+			opts := testOpts
+			opts.KernelVersion = kernel
+
+			insns, err := ToEBPF(filter, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, insn := range insns {
+				if insn.OpCode.Class() != asm.JumpClass {
+					continue
+				}
+
+				switch insn.OpCode.JumpOp() {
+				case asm.JSGT, asm.JSGE, asm.JSLT, asm.JSLE:
+					t.Fatalf("signed jump %v:\n%v", insn, insns)
+				}
+			}
+
+			checkInterpreter(t, filter, opts, packets...)
+		}
+	}
+
+	for _, cond := range []bpf.JumpTest{
+		bpf.JumpEqual,
+		bpf.JumpNotEqual,
+		bpf.JumpGreaterThan,
+		bpf.JumpLessThan,
+		bpf.JumpGreaterOrEqual,
+		bpf.JumpLessOrEqual,
+		bpf.JumpBitsSet,
+		bpf.JumpBitsNotSet,
+	} {
+		for _, val := range values {
+			check(t, []bpf.Instruction{
+				bpf.LoadAbsolute{Size: 4, Off: 0},
+				bpf.JumpIf{Cond: cond, Val: val, SkipTrue: 1},
+				bpf.RetConstant{Val: 0},
+				bpf.RetConstant{Val: 1},
+			})
+
+			check(t, []bpf.Instruction{
+				bpf.LoadConstant{Dst: bpf.RegX, Val: val},
+				bpf.LoadAbsolute{Size: 4, Off: 0},
+				bpf.JumpIfX{Cond: cond, SkipTrue: 1},
+				bpf.RetConstant{Val: 0},
+				bpf.RetConstant{Val: 1},
+			})
+		}
+	}
+}
+
+func TestHostByteOrderEBPF(t *testing.T) {
+	check := func(t *testing.T, load bpf.Instruction, hostOrder bool, expected uint64) {
+		t.Helper()
+
+		opts := testOpts
+		opts.HostByteOrder = hostOrder
+
+		insns, err := ToEBPF([]bpf.Instruction{
+			bpf.LoadConstant{Dst: bpf.RegX, Val: 1},
+			load,
+			bpf.RetA{},
+		}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := interpretEBPF(insns, opts, []byte{0, 0x12, 0x34, 0x56, 0x78})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res != expected {
+			t.Fatalf("%v host order %v: expected %#x, got %#x", load, hostOrder, expected, res)
+		}
+	}
+
+	// Network order matches the VM, the interpreter's host is little endian
+	checkInterpreter(t, []bpf.Instruction{bpf.LoadAbsolute{Size: 4, Off: 1}, bpf.RetA{}}, testOpts, []byte{0, 0x12, 0x34, 0x56, 0x78})
+
+	check(t, bpf.LoadAbsolute{Size: 4, Off: 1}, false, 0x12345678)
+	check(t, bpf.LoadAbsolute{Size: 4, Off: 1}, true, 0x78563412)
+	check(t, bpf.LoadIndirect{Size: 4, Off: 0}, false, 0x12345678)
+	check(t, bpf.LoadIndirect{Size: 4, Off: 0}, true, 0x78563412)
+	check(t, bpf.LoadAbsolute{Size: 2, Off: 1}, false, 0x1234)
+	check(t, bpf.LoadAbsolute{Size: 2, Off: 1}, true, 0x3412)
+	check(t, bpf.LoadAbsolute{Size: 1, Off: 1}, true, 0x12)
+}
+
+// Scratch and registers zero initialized in a branch, after being written on another path
+func TestSunkInitializationEBPF(t *testing.T) {
+	checkInterpreter(t, []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 3, SkipTrue: 0, SkipFalse: 2},
+		/* 2 */ bpf.StoreScratch{Src: bpf.RegA, N: 1},
+		/* 3 */ bpf.RetA{},
+		/* 4 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 4, SkipTrue: 0, SkipFalse: 3},
+		/* 5 */ bpf.LoadScratch{Dst: bpf.RegA, N: 1},
+		/* 6 */ bpf.TXA{},
+		/* 7 */ bpf.RetA{},
+		/* 8 */ bpf.RetConstant{Val: 9},
+	}, testOpts, []byte{}, []byte{3}, []byte{4}, []byte{5})
+}
+
+func TestEBPFAsmGolden(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	}
+
+	checkGolden(t, "ebpf_asm", filter, testOpts)
+}
+
+func TestCommentsEBPFAsm(t *testing.T) {
+	opts := testOpts
+	opts.Comments = map[int]string{
+		0: "ethertype",
+		3: "no match",
+	}
+
+	ebpfAsm, err := ToEBPFAsm([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"LdXMemH dst: r4 src: r2 off: 12 imm: 0\t; 0: ldh [12]; ethertype\n",
+		"Mov32Imm dst: r4 imm: 1\t; 2: ret #1\n",
+		"Mov32Imm dst: r4 imm: 0\t; 3: ret #0; no match\n",
+	} {
+		if !strings.Contains(ebpfAsm, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, ebpfAsm)
+		}
+	}
+}
+
+// Check X the caller initializes isn't overwritten before the filter reads it
+func TestInitializedXEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.TXA{},
+		bpf.RetA{},
+	}
+
+	for _, preserve := range []bool{false, true} {
+		opts := testOpts
+		if preserve {
+			opts.PreserveX = true
+		} else {
+			opts.InitializedRegs = []bpf.Register{bpf.RegX}
+		}
+
+		insns, err := ToEBPF(filter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		interp, err := newInterpreter(insns, opts, []byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		interp.set(opts.Working[1], 42)
+
+		res, err := interp.run()
+		if err != nil {
+			t.Fatalf("%v\n%v", err, insns)
+		}
+
+		if res != 42 {
+			t.Fatalf("expected 42, got %d\n%v", res, insns)
+		}
+	}
+}
+
+// Check X is restored when the filter returns, including when a packet guard fails
+func TestPreserveXEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.TAX{},
+		bpf.LoadIndirect{Size: 1, Off: 0},
+		bpf.RetA{},
+	}
+
+	for _, trace := range []bool{false, true} {
+		opts := testOpts
+		opts.PreserveX = true
+		opts.Trace = trace
+
+		insns, err := ToEBPF(filter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, pkt := range [][]byte{{1, 2}, {2, 2}, {}} {
+			interp, err := newInterpreter(insns, opts, pkt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const x = 0x1122334455667788
+			interp.set(opts.Working[1], x)
+
+			if _, err := interp.run(); err != nil {
+				t.Fatalf("packet %x: %v\n%v", pkt, err, insns)
+			}
+
+			if interp.regs[opts.Working[1]] != x {
+				t.Fatalf("packet %x: X not preserved, got %#x\n%v", pkt, interp.regs[opts.Working[1]], insns)
+			}
+		}
+	}
+}
+
+func TestPreserveXResultEBPF(t *testing.T) {
+	opts := testOpts
+	opts.PreserveX = true
+	opts.Result = opts.Working[1]
+
+	_, err := ToEBPF([]bpf.Instruction{bpf.RetConstant{Val: 1}}, opts)
+	if err == nil {
+		t.Fatal("PreserveX with X as Result accepted")
+	}
+}
+
+// multiVerdictFilter classifies packets by their first byte, returning a distinct value for each class
+var multiVerdictFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Size: 1, Off: 0},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipFalse: 1},
+	bpf.RetConstant{Val: 10},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 2, SkipFalse: 1},
+	bpf.RetConstant{Val: 20},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 3, SkipFalse: 1},
+	bpf.RetConstant{Val: 0xfffffff0},
+	bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 100},
+	bpf.RetA{},
+}
+
+// multiVerdictPackets are packets taking every return path of multiVerdictFilter, and the value returned
+var multiVerdictPackets = []struct {
+	pkt []byte
+	res uint32
+}{
+	{[]byte{1}, 10},
+	{[]byte{2}, 20},
+	{[]byte{3}, 0xfffffff0},
+	{[]byte{7}, 107},
+	// packet guard
+	{[]byte{}, 0},
+}
+
+func TestMultiVerdictEBPF(t *testing.T) {
+	insns, err := ToEBPF(multiVerdictFilter, testOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range multiVerdictPackets {
+		res, err := interpretEBPF(insns, testOpts, test.pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res != uint64(test.res) {
+			t.Fatalf("packet %x: expected %d, got %d\n%v", test.pkt, test.res, res, insns)
+		}
+	}
+}
+
+// Check A and X are only modified by 32 bit operations, so they wrap like cBPF,
+// on kernels with and without JLT / JLE, without any masking.
+func TestALU32EBPF(t *testing.T) {
+	values := []uint32{0, 1, 0x7FFFFFFF, 0x80000000, 0x80000001, 0xFFFFFFFE, 0xFFFFFFFF}
+
+	packets := make([][]byte, len(values))
+	for i, val := range values {
+		packets[i] = []byte{byte(val >> 24), byte(val >> 16), byte(val >> 8), byte(val)}
+	}
+
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 4, Off: 0},
+		bpf.TAX{},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 2},
+		bpf.ALUOpX{Op: bpf.ALUOpMul},
+		bpf.ALUOpConstant{Op: bpf.ALUOpSub, Val: 0xFFFFFFF0},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 1},
+		bpf.ALUOpX{Op: bpf.ALUOpXor},
+		bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 0xFFFFFFF0, SkipTrue: 7},
+		bpf.ALUOpX{Op: bpf.ALUOpAdd},
+		bpf.JumpIfX{Cond: bpf.JumpLessThan, SkipTrue: 5},
+		bpf.ALUOpConstant{Op: bpf.ALUOpXor, Val: 0xFFFFFFFF},
+		bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 0x80000000, SkipTrue: 3},
+		bpf.ALUOpX{Op: bpf.ALUOpSub},
+		bpf.JumpIfX{Cond: bpf.JumpGreaterOrEqual, SkipTrue: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetA{},
+		bpf.RetConstant{Val: 0xFFFFFFFF},
+	}
+
+	for _, kernel := range []KernelVersion{{}, {4, 13}} {
+		opts := testOpts
+		opts.KernelVersion = kernel
+
+		insns, err := ToEBPF(filter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, insn := range insns {
+			// Sets the result, not A
+			if insn.Symbol == "filter_nomatch" {
+				break
+			}
+
+			if insn.OpCode.Class() == asm.ALU64Class && (insn.Dst == opts.Working[0] || insn.Dst == opts.Working[1]) {
+				t.Fatalf("64 bit operation on A or X %v:\n%v", insn, insns)
+			}
+		}
+
+		checkInterpreter(t, filter, opts, packets...)
+	}
+}
+
+// cBPF shifts of 32 or more are 0
+func TestShiftEBPF(t *testing.T) {
+	for _, op := range []bpf.ALUOp{bpf.ALUOpShiftLeft, bpf.ALUOpShiftRight} {
+		for _, kernel := range []KernelVersion{{}, {4, 13}} {
+			opts := testOpts
+			opts.KernelVersion = kernel
+
+			checkInterpreter(t, []bpf.Instruction{
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 0xF0F0F0F0},
+				bpf.ALUOpConstant{Op: op, Val: 40},
+				bpf.RetA{},
+			}, opts, []byte{})
+
+			// Shift by the first byte of the packet
+			checkInterpreter(t, []bpf.Instruction{
+				bpf.LoadAbsolute{Size: 1, Off: 0},
+				bpf.TAX{},
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 0xF0F0F0F0},
+				bpf.ALUOpX{Op: op},
+				bpf.RetA{},
+			}, opts, []byte{0}, []byte{4}, []byte{31}, []byte{32}, []byte{33}, []byte{40}, []byte{255})
+		}
+	}
+}
+
+func TestTrailerEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.RetA{},
+	}
+
+	opts := testOpts
+	opts.Trailer = 4
+
+	checkEBPF(t, filter, opts, asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R2),
+		asm.Add.Imm(asm.R6, 5),
+		asm.JGT.Reg(asm.R6, asm.R3, "filter_nomatch"),
+		asm.LoadMem(asm.R4, asm.R2, 0, asm.Byte),
+		asm.Mov.Reg32(asm.R4, asm.R4),
+		asm.Ja.Label("result"),
+		asm.Mov.Imm(asm.R4, 0).Sym("filter_nomatch"),
+		asm.Ja.Label("result"),
+	})
+
+	// Guard can't overflow with the trailer
+	opts.Trailer = math.MaxInt32
+
+	_, err := ToEBPF(filter, opts)
+	if err == nil {
+		t.Fatal("guard bigger than MaxInt32 accepted")
+	}
+}
+
+// ipv6Packet builds an IPv6 packet, with extension headers of 8 bytes each, followed by TCP to port.
+// nextHeaders are the next header fields: the IPv6 header's, and each extension header's.
+func ipv6Packet(port uint16, nextHeaders ...byte) []byte {
+	pkt := make([]byte, 14+40)
+	pkt[12], pkt[13] = 0x86, 0xdd
+	pkt[14+6] = nextHeaders[0]
+
+	for _, nh := range nextHeaders[1:] {
+		pkt = append(pkt, nh, 0, 0, 0, 0, 0, 0, 0)
+	}
+
+	return append(pkt, 0x12, 0x34, byte(port>>8), byte(port))
+}
+
+func TestIPv6ExtensionsEBPF(t *testing.T) {
+	opts := testOpts
+	opts.StackOffset = 4
+
+	// hop by hop, routing, destination options
+	exts := ipv6Packet(80, 0, 43, 60, 6)
+
+	checkInterpreter(t, ipv6ExtensionFilter(3), opts,
+		ipv6Packet(80, 6),
+		ipv6Packet(443, 6),
+		ipv6Packet(80, 0, 6),
+		ipv6Packet(80, 43, 60, 6),
+		exts,
+		ipv6Packet(443, 0, 43, 60, 6),
+		// more extensions than stages
+		ipv6Packet(80, 0, 43, 60, 60, 6),
+		// unknown extension
+		ipv6Packet(80, 17, 6),
+		// truncated in the IPv6 header, in each extension header, and in the port
+		exts[:14+20],
+		exts[:14+40+1],
+		exts[:14+40+8+1],
+		exts[:14+40+16+1],
+		exts[:len(exts)-1],
+	)
+}
+
+func TestScratchAlignEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.StoreScratch{Src: bpf.RegA, N: 15},
+		bpf.LoadConstant{Dst: bpf.RegA, Val: 3},
+		bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		bpf.LoadScratch{Dst: bpf.RegX, N: 15},
+		bpf.LoadScratch{Dst: bpf.RegA, N: 0},
+		bpf.ALUOpX{Op: bpf.ALUOpAdd},
+		bpf.RetA{},
+	}
+
+	for _, align := range []int{0, 8, 16, 64} {
+		for _, offset := range []int{4, 12, 28} {
+			opts := testOpts
+			opts.StackOffset = offset
+			opts.ScratchAlign = align
+			opts.ScratchPadding = 8
+
+			eOpts := ebpfOpts{EBPFOpts: opts}
+
+			// Stack offsets are negative
+			if align != 0 && -int(eOpts.stackOffset(15))%align != 0 {
+				t.Fatalf("align %d offset %d: M[15] at %d not aligned", align, offset, eOpts.stackOffset(15))
+			}
+
+			if -int(eOpts.stackOffset(0)) < offset {
+				t.Fatalf("align %d offset %d: M[0] at %d before StackOffset", align, offset, eOpts.stackOffset(0))
+			}
+
+			// Padding follows the scratch memory
+			if gap := int(eOpts.stackOffset(15) - eOpts.traceStackOffset(0)); gap < 8+8 {
+				t.Fatalf("align %d offset %d: trace %d bytes after M[15]", align, offset, gap)
+			}
+
+			checkInterpreter(t, filter, opts, []byte{1}, []byte{7})
+
+			opts.Trace = true
+			checkInterpreter(t, filter, opts, []byte{1}, []byte{7})
+		}
+	}
+}
+
+func TestStackLimitEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.RetConstant{Val: 1},
+	}
+
+	opts := testOpts
+	opts.StackOffset = 512 - 60
+	if _, err := ToEBPF(filter, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, change := range map[string]func(*EBPFOpts){
+		"align":   func(o *EBPFOpts) { o.ScratchAlign = 1024 },
+		"padding": func(o *EBPFOpts) { o.ScratchPadding = 1 },
+		"trace":   func(o *EBPFOpts) { o.Trace = true },
+		"offset":  func(o *EBPFOpts) { o.StackOffset = 40000 },
+	} {
+		opts := opts
+		change(&opts)
+
+		if _, err := ToEBPF(filter, opts); err == nil {
+			t.Fatalf("%s: stack bigger than 512 bytes accepted", name)
+		}
+	}
+
+	opts.ScratchAlign = 3
+	if _, err := ToEBPF(filter, opts); err == nil {
+		t.Fatal("ScratchAlign 3 accepted")
+	}
+}
+
+func TestHoistGuardsEBPF(t *testing.T) {
+	opts := testOpts
+	opts.HoistGuards = true
+
+	packets := [][]byte{}
+	for _, first := range []byte{0, 1, 2, 3} {
+		for l := 0; l <= 25; l++ {
+			pkt := make([]byte, l)
+			for i := range pkt {
+				pkt[i] = byte(i)
+			}
+			if l > 0 {
+				pkt[0] = first
+			}
+
+			packets = append(packets, pkt)
+		}
+	}
+
+	checkInterpreter(t, fanOutFilter(3), opts, packets...)
+}
+
+// lenFilter returns the length of the packet, plus its first byte if it's at least 4 bytes
+var lenFilter = []bpf.Instruction{
+	bpf.LoadExtension{Num: bpf.ExtLen},
+	bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 4, SkipFalse: 4},
+	bpf.TAX{},
+	bpf.LoadAbsolute{Size: 1, Off: 0},
+	bpf.ALUOpX{Op: bpf.ALUOpAdd},
+	bpf.RetA{},
+	bpf.RetA{},
+}
+
+var lenPackets = [][]byte{{}, {1}, {1, 2, 3}, {1, 2, 3, 4}, {7, 2, 3, 4, 5, 6, 7, 8, 9}}
+
+func TestLoadLenEBPF(t *testing.T) {
+	checkInterpreter(t, lenFilter, testOpts, lenPackets...)
+}
+
+func TestMatchOffsetEBPF(t *testing.T) {
+	// IPv4 TCP to port 80
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+		bpf.LoadAbsolute{Size: 1, Off: 23},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 3},
+		bpf.LoadMemShift{Off: 14},
+		bpf.LoadIndirect{Size: 2, Off: 16},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 1},
+	}
+
+	ipv4 := func(proto byte, ihl byte) []byte {
+		pkt := make([]byte, 14+int(ihl)*4+4)
+		pkt[12], pkt[13] = 0x08, 0x00
+		pkt[14] = 0x40 | ihl
+		pkt[23] = proto
+		pkt[14+int(ihl)*4+3] = 80
+		return pkt
+	}
+
+	opts := testOpts
+	opts.MatchOffset = true
+	opts.MatchOffsetReg = asm.R8
+
+	insns, err := ToEBPF(filter, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		pkt    []byte
+		offset uint64
+	}{
+		{[]byte{}, 0xFFFFFFFF},
+		{make([]byte, 14), 12},
+		{ipv4(17, 5), 23},
+		{ipv4(6, 5), 36},
+		{ipv4(6, 6), 40},
+	} {
+		interp, err := newInterpreter(insns, opts, test.pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := interp.run(); err != nil {
+			t.Fatalf("packet %x: %v\n%v", test.pkt, err, insns)
+		}
+
+		if offset := interp.regs[opts.MatchOffsetReg]; offset != test.offset {
+			t.Fatalf("packet %x: expected offset %d, got %d\n%v", test.pkt, test.offset, offset, insns)
+		}
+	}
+
+	checkInterpreter(t, filter, opts, ipv4(6, 5), ipv4(17, 5), ipv4(6, 15))
+}
+
+func TestMatchOffsetRegisterEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.RetConstant{Val: 1},
+	}
+
+	for _, reg := range []asm.Register{testOpts.PacketStart, testOpts.Working[1], asm.R10} {
+		opts := testOpts
+		opts.MatchOffset = true
+		opts.MatchOffsetReg = reg
+
+		if _, err := ToEBPF(filter, opts); err == nil {
+			t.Fatalf("MatchOffsetReg %v allowed", reg)
+		}
+	}
+
+	opts := testOpts
+	opts.Result = asm.R0
+	opts.MatchOffset = true
+	opts.MatchOffsetReg = asm.R0
+
+	if _, err := ToEBPF(filter, opts); err == nil {
+		t.Fatal("MatchOffsetReg same as Result allowed")
+	}
+
+	opts = testOpts
+	opts.MatchOffset = true
+	opts.MatchOffsetReg = asm.R1
+	opts.Trace = true
+
+	if _, err := ToEBPF(filter, opts); err == nil {
+		t.Fatal("MatchOffsetReg clobbered by Trace allowed")
+	}
+
+	opts.MatchOffsetReg = asm.R8
+
+	if _, err := ToEBPF(filter, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// narrowFilter checks byte and half word loads are zero extended:
+// it returns 1 if they're all equal to 0xFF and 0xFFFF, otherwise the first value that isn't.
+var narrowFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Size: 1, Off: 0},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xFF, SkipFalse: 8},
+	bpf.LoadAbsolute{Size: 2, Off: 0},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xFFFF, SkipFalse: 6},
+	bpf.LoadConstant{Dst: bpf.RegX, Val: 1},
+	bpf.LoadIndirect{Size: 1, Off: 0},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xFF, SkipFalse: 3},
+	bpf.LoadIndirect{Size: 2, Off: 0},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0xFFFF, SkipFalse: 1},
+	bpf.RetConstant{Val: 1},
+	bpf.RetA{},
+}
+
+var narrowPackets = [][]byte{
+	{0xFF, 0xFF, 0xFF},
+	{0x80},
+	{0xFF, 0x80},
+	{0xFF, 0xFF, 0x80},
+	{0xFF, 0x7F, 0xFF},
+}
+
+func TestNarrowLoadsEBPF(t *testing.T) {
+	checkInterpreter(t, narrowFilter, testOpts, narrowPackets...)
+}
+
+// counterFilter increments M[3], and returns it added to the first two bytes of the packet, stored in M[4]
+var counterFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Size: 1, Off: 0},
+	bpf.TAX{},
+	bpf.LoadScratch{Dst: bpf.RegA, N: 3},
+	bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+	bpf.StoreScratch{Src: bpf.RegA, N: 3},
+	bpf.StoreScratch{Src: bpf.RegA, N: 4},
+	bpf.LoadAbsolute{Size: 1, Off: 1},
+	bpf.ALUOpX{Op: bpf.ALUOpAdd},
+	bpf.TAX{},
+	bpf.LoadScratch{Dst: bpf.RegA, N: 4},
+	bpf.ALUOpX{Op: bpf.ALUOpAdd},
+	bpf.RetA{},
+}
+
+func TestScratchMapsEBPF(t *testing.T) {
+	opts := testOpts
+	opts.StackOffset = 4
+	opts.ScratchMaps = map[int]string{3: "counter"}
+
+	insns, err := ToEBPF(counterFilter, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// M[3] is only accessed through the map, M[4] only on the stack
+	calls := map[asm.BuiltinFunc]int{}
+	stack := map[int16]int{}
+	for _, insn := range insns {
+		switch {
+		case insn.OpCode.Class() == asm.JumpClass && insn.OpCode.JumpOp() == asm.Call:
+			calls[asm.BuiltinFunc(insn.Constant)]++
+		case insn.OpCode.Size() == asm.Word && (insn.Dst == asm.R10 || insn.Src == asm.R10):
+			stack[insn.Offset]++
+		}
+	}
+
+	eOpts := ebpfOpts{EBPFOpts: opts}
+	if !reflect.DeepEqual(calls, map[asm.BuiltinFunc]int{asm.MapLookupElement: 1, asm.MapUpdateElement: 1}) {
+		t.Fatalf("unexpected helper calls %v\n%v", calls, insns)
+	}
+	if stack[eOpts.stackOffset(3)] != 0 {
+		t.Fatalf("M[3] accessed on the stack\n%v", insns)
+	}
+	if stack[eOpts.stackOffset(4)] != 2 {
+		t.Fatalf("M[4] not accessed on the stack\n%v", insns)
+	}
+
+	if refs := insns.ReferenceOffsets()["counter"]; len(refs) != 2 {
+		t.Fatalf("expected 2 references to the map, got %d\n%v", len(refs), insns)
+	}
+
+	// The value of the map persists across runs
+	interp, err := newInterpreter(insns, opts, []byte{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	interp.setMapValue("counter", 41)
+
+	res, err := interp.run()
+	if err != nil {
+		t.Fatalf("%v\n%v", err, insns)
+	}
+
+	if res != 42+1+2 {
+		t.Fatalf("expected %d, got %d\n%v", 42+1+2, res, insns)
+	}
+
+	if val := interp.mapValue("counter"); val != 42 {
+		t.Fatalf("expected map value 42, got %d", val)
+	}
+
+	// Maps start at 0, like scratch memory is zero initialized
+	checkInterpreter(t, counterFilter, opts, []byte{}, []byte{1}, []byte{1, 2}, []byte{0xFF, 0xFF})
+
+	opts.Trace = true
+	checkInterpreter(t, counterFilter, opts, []byte{1, 2})
+}
+
+// Stores to scratch backed by a map are read by the next run, they aren't dead
+func TestScratchMapsStoreEBPF(t *testing.T) {
+	opts := testOpts
+	opts.ScratchMaps = map[int]string{0: "state"}
+
+	insns, err := ToEBPF([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		bpf.RetConstant{Val: 1},
+	}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	interp, err := newInterpreter(insns, opts, []byte{7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := interp.run(); err != nil {
+		t.Fatalf("%v\n%v", err, insns)
+	}
+
+	if val := interp.mapValue("state"); val != 7 {
+		t.Fatalf("expected map value 7, got %d\n%v", val, insns)
+	}
+}
+
+func TestScratchMapsInvalidEBPF(t *testing.T) {
+	for _, maps := range []map[int]string{
+		{-1: "state"},
+		{16: "state"},
+		{2: ""},
+	} {
+		opts := testOpts
+		opts.ScratchMaps = maps
+
+		if _, err := ToEBPF(counterFilter, opts); err == nil {
+			t.Fatalf("ScratchMaps %v accepted", maps)
+		}
+	}
+
+	// MatchOffsetReg would be clobbered by the calls
+	opts := testOpts
+	opts.ScratchMaps = map[int]string{3: "counter"}
+	opts.MatchOffset = true
+	opts.MatchOffsetReg = asm.R1
+
+	if _, err := ToEBPF(counterFilter, opts); err == nil {
+		t.Fatal("MatchOffsetReg clobbered by calls accepted")
+	}
+
+	// The single guard would skip stores to the map
+	opts = testOpts
+	opts.ScratchMaps = map[int]string{3: "counter"}
+	opts.SingleGuard = true
+
+	if _, err := ToEBPF(counterFilter, opts); err == nil {
+		t.Fatal("SingleGuard with ScratchMaps accepted")
+	}
+}
+
+// Stores to the map happen before the packet is too short, like in cBPF
+func TestScratchMapsShortPacketEBPF(t *testing.T) {
+	for _, hoist := range []bool{false, true} {
+		opts := testOpts
+		opts.ScratchMaps = map[int]string{3: "counter"}
+		opts.HoistGuards = hoist
+
+		insns, err := ToEBPF(counterFilter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		interp, err := newInterpreter(insns, opts, []byte{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		interp.setMapValue("counter", 41)
+
+		res, err := interp.run()
+		if err != nil {
+			t.Fatalf("%v\n%v", err, insns)
+		}
+
+		if res != 0 {
+			t.Fatalf("HoistGuards %v: expected 0, got %d\n%v", hoist, res, insns)
+		}
+
+		if val := interp.mapValue("counter"); val != 42 {
+			t.Fatalf("HoistGuards %v: expected map value 42, got %d\n%v", hoist, val, insns)
+		}
+	}
+}
+
+// ipv4TCPFilter matches IPv4 TCP packets
+var ipv4TCPFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Size: 2, Off: 12},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 3},
+	bpf.LoadAbsolute{Size: 1, Off: 23},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 1},
+	bpf.RetConstant{Val: 1},
+	bpf.RetConstant{Val: 0},
+}
+
+func TestGuardFailureValueEBPF(t *testing.T) {
+	tcp := make([]byte, 24)
+	tcp[12], tcp[13], tcp[23] = 0x08, 0x00, 6
+
+	udp := append([]byte{}, tcp...)
+	udp[23] = 17
+
+	for _, trace := range []bool{false, true} {
+		opts := testOpts
+		opts.GuardFailureValue = math.MaxUint32
+		opts.Trace = trace
+
+		insns, err := ToEBPF(ipv4TCPFilter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			pkt      []byte
+			expected uint64
+		}{
+			{nil, math.MaxUint32},
+			{tcp[:14], math.MaxUint32},
+			{tcp, 1},
+			{udp, 0},
+			// not IPv4, doesn't need the protocol
+			{make([]byte, 14), 0},
+		} {
+			res, err := interpretEBPF(insns, opts, test.pkt)
+			if err != nil {
+				t.Fatalf("packet %x: %v\n%v", test.pkt, err, insns)
+			}
+
+			if res != test.expected {
+				t.Fatalf("packet %x: expected %d, got %d\n%v", test.pkt, test.expected, res, insns)
+			}
+		}
+	}
+
+	// Guards share the no match exit by default
+	symbols, err := mustCompileEBPF(t, ipv4TCPFilter, testOpts).Instructions.SymbolOffsets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := symbols[ebpfOpts{EBPFOpts: testOpts}.label(guardFailureLabel)]; ok {
+		t.Fatal("unused guard failure exit")
+	}
+}
+
+// Division by zero returns 0 before later packet guards can fail
+func TestGuardFailureValueDivisionEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.TAX{},
+		bpf.LoadConstant{Dst: bpf.RegA, Val: 10},
+		bpf.ALUOpX{Op: bpf.ALUOpDiv},
+		bpf.LoadAbsolute{Size: 1, Off: 5},
+		bpf.RetA{},
+	}
+
+	for _, hoist := range []bool{false, true} {
+		opts := testOpts
+		opts.GuardFailureValue = 7
+		opts.HoistGuards = hoist
+
+		insns, err := ToEBPF(filter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			pkt      []byte
+			expected uint64
+		}{
+			{nil, 7},
+			{[]byte{0}, 0},
+			{[]byte{2}, 7},
+			{[]byte{2, 0, 0, 0, 0, 9}, 9},
+		} {
+			res, err := interpretEBPF(insns, opts, test.pkt)
+			if err != nil {
+				t.Fatalf("packet %x: %v\n%v", test.pkt, err, insns)
+			}
+
+			if res != test.expected {
+				t.Fatalf("HoistGuards %v, packet %x: expected %d, got %d\n%v", hoist, test.pkt, test.expected, res, insns)
+			}
+		}
+	}
+}
+
+func TestXDPLoadBytesEBPF(t *testing.T) {
+	opts := testOpts
+	opts.XDPLoadBytes = true
+	opts.XDPContext = asm.R8
+
+	// No guard, bpf_xdp_load_bytes(ctx, 14, buf, 1)
+	checkEBPF(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 14},
+		bpf.RetA{},
+	}, opts, asm.Instructions{
+		// A and X are saved around the call
+		asm.Mov.Imm(asm.R4, 0),
+		asm.Mov.Imm(asm.R5, 0),
+
+		asm.StoreMem(asm.R10, -80, asm.R2, asm.DWord),
+		asm.StoreMem(asm.R10, -88, asm.R3, asm.DWord),
+		asm.StoreMem(asm.R10, -96, asm.R4, asm.DWord),
+		asm.StoreMem(asm.R10, -104, asm.R5, asm.DWord),
+		asm.Mov.Imm32(asm.R2, 14),
+		asm.Mov.Reg(asm.R1, asm.R8),
+		asm.Mov.Reg(asm.R3, asm.R10),
+		asm.Add.Imm(asm.R3, -72),
+		asm.Mov.Imm(asm.R4, 1),
+		xdpLoadBytes.Call(),
+		asm.StoreMem(asm.R10, -68, asm.R0, asm.Word),
+		asm.LoadMem(asm.R2, asm.R10, -80, asm.DWord),
+		asm.LoadMem(asm.R3, asm.R10, -88, asm.DWord),
+		asm.LoadMem(asm.R4, asm.R10, -96, asm.DWord),
+		asm.LoadMem(asm.R5, asm.R10, -104, asm.DWord),
+		asm.LoadMem(asm.R6, asm.R10, -68, asm.Word),
+		asm.JNE.Imm(asm.R6, 0, "filter_nomatch"),
+		asm.LoadMem(asm.R4, asm.R10, -72, asm.Byte),
+
+		asm.Mov.Reg32(asm.R4, asm.R4),
+		asm.Ja.Label("result"),
+		asm.Mov.Imm(asm.R4, 0).Sym("filter_nomatch"),
+		asm.Ja.Label("result"),
+	})
+
+	tcp := make([]byte, 14+20+4)
+	tcp[12], tcp[13] = 0x08, 0x00
+	tcp[14] = 0x45
+	tcp[14+20+3] = 80
+
+	checkInterpreter(t, cPortFilter, opts, tcp[:13], tcp[:15], tcp[:37], tcp)
+	checkInterpreter(t, narrowFilter, opts, narrowPackets...)
+	checkInterpreter(t, lenFilter, opts, lenPackets...)
+
+	// x + 4 wraps to 2
+	checkInterpreter(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 4, Off: 0},
+		bpf.TAX{},
+		bpf.LoadIndirect{Size: 4, Off: 4},
+		bpf.RetA{},
+	}, opts,
+		[]byte{0xff, 0xff, 0xff, 0xfe, 1, 2, 3, 4},
+		[]byte{0xff, 0xff, 0xff, 0xfc, 1, 2, 3, 4},
+		[]byte{0, 0, 0, 0, 1, 2, 3, 4},
+	)
+
+	opts.Trace = true
+	checkInterpreter(t, cPortFilter, opts, tcp[:15], tcp)
+}
+
+// ipv4ProtoFilter returns the IP protocol of IPv4 packets, the block it jumps to starts with a packet load
+var ipv4ProtoFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Size: 2, Off: 12},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 1},
+	bpf.RetConstant{Val: 0},
+	bpf.LoadAbsolute{Size: 1, Off: 23},
+	bpf.RetA{},
+}
+
+// Loads that check themselves aren't guarded, in any block
+func checkHelperLoads(tb testing.TB, opts EBPFOpts) {
+	tb.Helper()
+
+	prog := mustCompileEBPF(tb, ipv4ProtoFilter, opts)
+
+	for _, ins := range prog.Insertions() {
+		if ins.Kind == InsertionPacketGuard || ins.Kind == InsertionIndirectPacketGuard {
+			tb.Fatalf("unexpected packet guard %+v", ins)
+		}
+	}
+
+	for _, pre := range prog.Preconditions() {
+		if pre.PacketLen != 0 {
+			tb.Fatalf("block %s expects %d bytes of packet", pre.Block, pre.PacketLen)
+		}
+	}
+
+	// One path for each result, and one for each load that fails
+	if states := prog.Metrics().States; states != 4 {
+		tb.Fatalf("expected 4 states, got %d", states)
+	}
+}
+
+func TestXDPLoadBytesBlocksEBPF(t *testing.T) {
+	opts := testOpts
+	opts.XDPLoadBytes = true
+	opts.XDPContext = asm.R8
+
+	checkHelperLoads(t, opts)
+
+	ipv4 := make([]byte, 24)
+	ipv4[12], ipv4[13], ipv4[23] = 0x08, 0x00, 6
+	checkInterpreter(t, ipv4ProtoFilter, opts, nil, ipv4[:14], ipv4[:23], ipv4, make([]byte, 24))
+}
+
+func TestXDPLoadBytesInvalidEBPF(t *testing.T) {
+	for name, modify := range map[string]func(*EBPFOpts){
+		"old kernel":  func(opts *EBPFOpts) { opts.KernelVersion = KernelVersion{5, 17} },
+		"clobbered":   func(opts *EBPFOpts) { opts.XDPContext = asm.R1 },
+		"packet":      func(opts *EBPFOpts) { opts.XDPContext = opts.PacketStart },
+		"working":     func(opts *EBPFOpts) { opts.XDPContext = opts.Working[3] },
+		"trailer":     func(opts *EBPFOpts) { opts.Trailer = 4 },
+		"match reg":   func(opts *EBPFOpts) { opts.MatchOffset, opts.MatchOffsetReg = true, asm.R1 },
+		"invalid reg": func(opts *EBPFOpts) { opts.XDPContext = asm.R10 },
+	} {
+		opts := testOpts
+		opts.XDPLoadBytes = true
+		opts.XDPContext = asm.R8
+		modify(&opts)
+
+		if _, err := ToEBPF(cPortFilter, opts); err == nil {
+			t.Fatalf("%s: accepted", name)
+		}
+	}
+
+	opts := testOpts
+	opts.XDPLoadBytes = true
+	opts.XDPContext = asm.R8
+	opts.KernelVersion = KernelVersion{5, 18}
+
+	if _, err := ToEBPF(cPortFilter, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkSKB checks eBPF generated with opts returns the same as cBPF for packets,
+// whatever length of them is in the linear part of the socket buffer.
+func checkSKB(tb testing.TB, filter []bpf.Instruction, opts EBPFOpts, packets ...[]byte) {
+	tb.Helper()
+
+	vm, err := bpf.NewVM(filter)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	insns, err := ToEBPF(filter, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	for _, pkt := range packets {
+		expected, err := vm.Run(pkt)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		for linear := 0; linear <= len(pkt); linear++ {
+			res, err := interpretEBPFSKB(insns, opts, pkt, linear)
+			if err != nil {
+				tb.Fatalf("packet %x linear %d: %v\n%v", pkt, linear, err, insns)
+			}
+
+			if res != uint64(uint32(expected)) {
+				tb.Fatalf("packet %x linear %d: expected %d, got %d\n%v", pkt, linear, uint32(expected), res, insns)
+			}
+		}
+	}
+}
+
+// skbFilters are filters with every kind of packet load for checkSKB, and packets for them
+var skbFilters = []struct {
+	filter  []bpf.Instruction
+	packets [][]byte
+}{
+	{cPortFilter, [][]byte{skbTCP[:13], skbTCP[:15], skbTCP[:37], skbTCP}},
+	{lenFilter, lenPackets},
+	{narrowFilter, narrowPackets},
+	{ipv4ProtoFilter, [][]byte{skbTCP[:14], skbTCP[:23], skbTCP[:24], skbTCP}},
+	// x + 4 wraps to 2
+	{[]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 4, Off: 0},
+		bpf.TAX{},
+		bpf.LoadIndirect{Size: 4, Off: 4},
+		bpf.RetA{},
+	}, [][]byte{
+		{0xff, 0xff, 0xff, 0xfe, 1, 2, 3, 4},
+		{0, 0, 0, 0, 1, 2, 3, 4},
+		{0, 0, 0, 1, 1, 2, 3, 4},
+	}},
+}
+
+// skbTCP is an IPv4 TCP packet to port 80
+var skbTCP = func() []byte {
+	tcp := make([]byte, 14+20+4)
+	tcp[12], tcp[13] = 0x08, 0x00
+	tcp[14] = 0x45
+	tcp[14+20+3] = 80
+	return tcp
+}()
+
+func skbOpts(mode SKBMode) EBPFOpts {
+	opts := testOpts
+	opts.SKB = mode
+	opts.SKBContext = asm.R8
+	return opts
+}
+
+func TestSKBPullDataEBPF(t *testing.T) {
+	opts := skbOpts(SKBPullData)
+
+	// Pulls the 15 bytes the filter needs, or the whole packet if it's shorter
+	checkEBPF(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 14},
+		bpf.RetA{},
+	}, opts, asm.Instructions{
+		// A and X are saved around the call
+		asm.Mov.Imm(asm.R4, 0),
+		asm.Mov.Imm(asm.R5, 0),
+
+		asm.StoreMem(asm.R10, -80, asm.R2, asm.DWord),
+		asm.StoreMem(asm.R10, -88, asm.R3, asm.DWord),
+		asm.StoreMem(asm.R10, -96, asm.R4, asm.DWord),
+		asm.StoreMem(asm.R10, -104, asm.R5, asm.DWord),
+		asm.LoadMem(asm.R2, asm.R8, 0, asm.Word),
+		asm.Mov.Imm32(asm.R3, 15),
+		asm.Instruction{OpCode: asm.JGE.Op(asm.RegSource), Dst: asm.R3, Src: asm.R2, Offset: 1},
+		asm.Mov.Reg(asm.R2, asm.R3),
+		asm.Mov.Reg(asm.R1, asm.R8),
+		skbPullData.Call(),
+		asm.LoadMem(asm.R2, asm.R10, -80, asm.DWord),
+		asm.LoadMem(asm.R3, asm.R10, -88, asm.DWord),
+		asm.LoadMem(asm.R4, asm.R10, -96, asm.DWord),
+		asm.LoadMem(asm.R5, asm.R10, -104, asm.DWord),
+		// Packet pointers are reloaded
+		asm.LoadMem(asm.R2, asm.R8, 76, asm.Word),
+		asm.LoadMem(asm.R3, asm.R8, 80, asm.Word),
+
+		// Guarded against the linear part of the packet
+		asm.Mov.Reg(asm.R6, asm.R2),
+		asm.Add.Imm(asm.R6, 15),
+		asm.JGT.Reg(asm.R6, asm.R3, "filter_nomatch"),
+		asm.LoadMem(asm.R4, asm.R2, 14, asm.Byte),
+		asm.Mov.Reg32(asm.R4, asm.R4),
+		asm.Ja.Label("result"),
+		asm.Mov.Imm(asm.R4, 0).Sym("filter_nomatch"),
+		asm.Ja.Label("result"),
+	})
+
+	// The whole packet is pulled for indirect loads
+	insns, err := ToEBPF(cPortFilter, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pulls := 0
+	for i, insn := range insns {
+		if insn.OpCode.JumpOp() == asm.Call && insn.OpCode.Class() == asm.JumpClass && insn.Constant == int64(skbPullData) {
+			pulls++
+
+			if insns[i-2] != asm.Mov.Imm(asm.R2, 0) {
+				t.Fatalf("pulled %v", insns[i-2])
+			}
+		}
+	}
+
+	if pulls != 1 {
+		t.Fatalf("expected 1 pull, got %d", pulls)
+	}
+
+	// Nothing to pull without packet loads
+	if helpers := mustCompileEBPF(t, lenFilter[len(lenFilter)-1:], opts).Requirements().Helpers; len(helpers) != 0 {
+		t.Fatalf("filter without loads calls %v", helpers)
+	}
+
+	for _, test := range skbFilters {
+		checkSKB(t, test.filter, opts, test.packets...)
+	}
+
+}
+
+func TestSKBLoadBytesEBPF(t *testing.T) {
+	opts := skbOpts(SKBLoadBytes)
+
+	// No guard, the load is checked against the linear part of the packet, with bpf_skb_load_bytes(ctx, 14, buf, 1) past it
+	checkEBPF(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 14},
+		bpf.RetA{},
+	}, opts, asm.Instructions{
+		asm.Mov.Imm(asm.R4, 0),
+		asm.Mov.Imm(asm.R5, 0),
+
+		asm.Mov.Reg(asm.R6, asm.R2),
+		asm.Add.Imm(asm.R6, 15),
+		asm.Instruction{OpCode: asm.JGT.Op(asm.RegSource), Dst: asm.R6, Src: asm.R3, Offset: 2},
+		asm.LoadMem(asm.R4, asm.R2, 14, asm.Byte),
+		asm.Instruction{OpCode: asm.Ja.Op(asm.ImmSource), Offset: 18},
+
+		asm.StoreMem(asm.R10, -80, asm.R2, asm.DWord),
+		asm.StoreMem(asm.R10, -88, asm.R3, asm.DWord),
+		asm.StoreMem(asm.R10, -96, asm.R4, asm.DWord),
+		asm.StoreMem(asm.R10, -104, asm.R5, asm.DWord),
+		asm.Mov.Imm32(asm.R2, 14),
+		asm.Mov.Reg(asm.R1, asm.R8),
+		asm.Mov.Reg(asm.R3, asm.R10),
+		asm.Add.Imm(asm.R3, -72),
+		asm.Mov.Imm(asm.R4, 1),
+		skbLoadBytes.Call(),
+		asm.StoreMem(asm.R10, -68, asm.R0, asm.Word),
+		asm.LoadMem(asm.R2, asm.R10, -80, asm.DWord),
+		asm.LoadMem(asm.R3, asm.R10, -88, asm.DWord),
+		asm.LoadMem(asm.R4, asm.R10, -96, asm.DWord),
+		asm.LoadMem(asm.R5, asm.R10, -104, asm.DWord),
+		asm.LoadMem(asm.R6, asm.R10, -68, asm.Word),
+		asm.JNE.Imm(asm.R6, 0, "filter_nomatch"),
+		asm.LoadMem(asm.R4, asm.R10, -72, asm.Byte),
+
+		asm.Mov.Reg32(asm.R4, asm.R4),
+		asm.Ja.Label("result"),
+		asm.Mov.Imm(asm.R4, 0).Sym("filter_nomatch"),
+		asm.Ja.Label("result"),
+	})
+
+	// Offsets direct loads can't reach only use the helper
+	insns, err := ToEBPF([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 4, Off: 40000},
+		bpf.RetA{},
+	}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, insn := range insns {
+		if insn.OpCode.Class() == asm.LdXClass && insn.Src == opts.PacketStart {
+			t.Fatalf("direct load %v", insn)
+		}
+	}
+
+	for _, test := range skbFilters {
+		checkSKB(t, test.filter, opts, test.packets...)
+	}
+
+	checkHelperLoads(t, opts)
+
+	// Loads past the end of the whole packet fail like guards
+	opts.GuardFailureValue = 7
+
+	insns, err = ToEBPF(cPortFilter, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, linear := range []int{0, 13} {
+		res, err := interpretEBPFSKB(insns, opts, skbTCP[:13], linear)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res != 7 {
+			t.Fatalf("linear %d: expected guard failure 7, got %d", linear, res)
+		}
+	}
+}
+
+func TestSKBInvalidEBPF(t *testing.T) {
+	for name, modify := range map[string]func(*EBPFOpts){
+		"mode":        func(opts *EBPFOpts) { opts.SKB = SKBLoadBytes + 1 },
+		"clobbered":   func(opts *EBPFOpts) { opts.SKBContext = asm.R1 },
+		"packet":      func(opts *EBPFOpts) { opts.SKBContext = opts.PacketStart },
+		"working":     func(opts *EBPFOpts) { opts.SKBContext = opts.Working[3] },
+		"invalid reg": func(opts *EBPFOpts) { opts.SKBContext = asm.R10 },
+		"trailer":     func(opts *EBPFOpts) { opts.Trailer = 4 },
+		"xdp":         func(opts *EBPFOpts) { opts.XDPLoadBytes, opts.XDPContext = true, asm.R9 },
+		"match reg":   func(opts *EBPFOpts) { opts.MatchOffset, opts.MatchOffsetReg = true, asm.R1 },
+	} {
+		opts := skbOpts(SKBLoadBytes)
+		modify(&opts)
+
+		if _, err := ToEBPF(cPortFilter, opts); err == nil {
+			t.Fatalf("%s: accepted", name)
+		}
+	}
+
+	opts := skbOpts(SKBPullData)
+	opts.KernelVersion = KernelVersion{4, 8}
+
+	if _, err := ToEBPF(cPortFilter, opts); err == nil {
+		t.Fatal("pull data accepted on kernel 4.8")
+	}
+
+	opts.KernelVersion = KernelVersion{4, 9}
+	opts.Trailer = 4
+
+	if _, err := ToEBPF(cPortFilter, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// snippetFilter returns through every kind of exit: RetA, RetConstant, a failed packet guard and a division by zero.
+// It returns 7 if packet guards fail, with GuardFailureValue set to 7.
+var snippetFilter = []bpf.Instruction{
+	/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 12},
+	/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+	/* 2 */ bpf.LoadAbsolute{Size: 1, Off: 14},
+	/* 3 */ bpf.TAX{},
+	/* 4 */ bpf.LoadConstant{Dst: bpf.RegA, Val: 100},
+	/* 5 */ bpf.ALUOpX{Op: bpf.ALUOpDiv},
+	/* 6 */ bpf.RetA{},
+	/* 7 */ bpf.RetConstant{Val: 1},
+}
+
+// snippetPackets are packets for snippetFilter, with the result of the filter
+var snippetPackets = []struct {
+	pkt    []byte
+	result uint32
+}{
+	{[]byte{0, 1}, 7},
+	{[]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x08, 0x00, 0}, 0},
+	{[]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x08, 0x00, 5}, 20},
+	{[]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x86, 0xdd, 5}, 1},
+}
+
+func TestPrologueEpilogueEBPF(t *testing.T) {
+	opts := testOpts
+	opts.GuardFailureValue = 7
+
+	// Prologue and Epilogue both define done, Epilogue a label on its first instruction
+	opts.Prologue = asm.Instructions{
+		asm.Mov.Imm(asm.R8, 1000),
+		asm.JNE.Imm(opts.PacketStart, 0, "done"), // never 0
+		asm.Mov.Imm(asm.R8, 0),
+		asm.Mov.Imm(asm.R9, 0).Sym("done"),
+	}
+	opts.Epilogue = asm.Instructions{
+		asm.JNE.Imm(asm.R9, 0, "done").Sym("start"),
+		asm.Add.Reg(opts.Result, asm.R8),
+		asm.Mov.Imm(asm.R9, 0).Sym("done"),
+	}
+
+	insns, err := ToEBPF(snippetFilter, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Prologue runs before the first guard
+	prologue := append(asm.Instructions{}, opts.Prologue...)
+	prologue[1].Reference = "filter_prologue_done"
+	prologue[3].Symbol = "filter_prologue_done"
+	if !reflect.DeepEqual(insns[:len(prologue)], prologue) {
+		t.Fatalf("expected prologue:\n%v\ngot:\n%v", prologue, insns)
+	}
+
+	symbols, err := insns.SymbolOffsets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, label := range []string{"filter_epilogue", "filter_epilogue_start", "filter_epilogue_done"} {
+		if _, ok := symbols[label]; !ok {
+			t.Fatalf("missing label %s:\n%v", label, insns)
+		}
+	}
+
+	// Epilogue runs after every return
+	for _, p := range snippetPackets {
+		res, err := interpretEBPF(insns, opts, p.pkt)
+		if err != nil {
+			t.Fatalf("packet %x: %v\n%v", p.pkt, err, insns)
+		}
+
+		if res != uint64(p.result)+1000 {
+			t.Fatalf("packet %x: expected %d, got %d\n%v", p.pkt, p.result+1000, res, insns)
+		}
+	}
+}
+
+// Epilogues that exit or jump don't fall through to ResultLabel
+func TestEpilogueExitEBPF(t *testing.T) {
+	opts := testOpts
+	opts.Epilogue = asm.Instructions{
+		asm.Mov.Reg(asm.R0, opts.Result),
+		asm.Return(),
+	}
+
+	checkEBPF(t, []bpf.Instruction{bpf.RetConstant{Val: 1}}, opts, asm.Instructions{
+		asm.Mov.Imm32(opts.Result, 1),
+		asm.Ja.Label("filter_epilogue"),
+		asm.Mov.Reg(asm.R0, opts.Result).Sym("filter_epilogue"),
+		asm.Return(),
+	})
+
+	// Caller's Epilogue isn't modified
+	if opts.Epilogue[0].Symbol != "" {
+		t.Fatalf("Epilogue modified: %v", opts.Epilogue)
+	}
+}
+
+func TestAssertionsEBPF(t *testing.T) {
+	opts := testOpts
+	opts.Assertions = true
+
+	checkEBPF(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 3},
+		bpf.TAX{},
+		bpf.LoadConstant{Dst: bpf.RegA, Val: 8},
+		bpf.ALUOpX{Op: bpf.ALUOpMod},
+		bpf.RetA{},
+	}, opts, asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R2),
+		asm.Add.Imm(asm.R6, 4),
+		asm.JGT.Reg(asm.R6, asm.R3, "filter_nomatch"),
+
+		// assertion
+		asm.Mov.Reg(asm.R6, asm.R2),
+		asm.Add.Imm(asm.R6, 4),
+		asm.JGT.Reg(asm.R6, asm.R3, "filter_nomatch"),
+		asm.LoadMem(asm.R4, asm.R2, 3, asm.Byte),
+
+		asm.Mov.Reg32(asm.R5, asm.R4),
+		asm.Mov.Imm32(asm.R4, 8),
+		asm.JEq.Imm(asm.R5, 0, "filter_nomatch"),
+
+		// assertion
+		asm.JEq.Imm(asm.R5, 0, "filter_nomatch"),
+		asm.Mod.Reg32(asm.R4, asm.R5),
+		asm.Mov.Reg32(asm.R4, asm.R4),
+		asm.Ja.Label("result"),
+
+		asm.Mov.Imm(asm.R4, 0).Sym("filter_nomatch"),
+		asm.Ja.Label("result"),
+	})
+}
+
+// Assertions add a branch to every packet load and division by X, without changing the results
+func TestAssertionsResultsEBPF(t *testing.T) {
+	opts := testOpts
+	opts.Assertions = true
+
+	for _, filter := range [][]bpf.Instruction{snippetFilter, cPortFilter} {
+		without, with := mustCompileEBPF(t, filter, testOpts).Metrics(), mustCompileEBPF(t, filter, opts).Metrics()
+
+		expected := without.Branches + without.PacketLoads
+		for _, insn := range filter {
+			if alu, ok := insn.(bpf.ALUOpX); ok && (alu.Op == bpf.ALUOpDiv || alu.Op == bpf.ALUOpMod) {
+				expected++
+			}
+		}
+
+		if with.Branches != expected {
+			t.Fatalf("expected %d branches, got %d", expected, with.Branches)
+		}
+	}
+
+	tcp := make([]byte, 14+20+4)
+	tcp[12], tcp[13] = 0x08, 0x00
+	tcp[14] = 0x45
+	tcp[14+20+3] = 80
+
+	checkInterpreter(t, cPortFilter, opts, tcp[:15], tcp[:len(tcp)-1], tcp)
+
+	for _, p := range snippetPackets {
+		// The VM doesn't have GuardFailureValue
+		if p.result == 7 {
+			continue
+		}
+
+		checkInterpreter(t, snippetFilter, opts, p.pkt)
+	}
+}
+
+func TestMetadataEBPF(t *testing.T) {
+	opts := testOpts
+	opts.Metadata = metadataRegion
+	opts.GuardFailureValue = 7
+	opts.MetadataStart, opts.MetadataEnd = asm.R8, asm.R9
+
+	insns := mustCompileEBPF(t, metadataFilter, opts).Instructions
+
+	ipv4 := make([]byte, 14)
+	ipv4[12] = 0x08
+
+	for _, test := range []struct {
+		pkt, meta []byte
+		result    uint64
+	}{
+		{ipv4, []byte{0, 0, 0, 3}, 1},
+		{ipv4, []byte{0, 0, 0, 3, 0xFF}, 1},
+		{ipv4, []byte{0, 0, 0, 4}, 0},
+		{make([]byte, 14), []byte{0, 0, 0, 3}, 0},
+		// Metadata guard fails, the packet is long enough
+		{ipv4, []byte{0, 0, 3}, 7},
+		{ipv4, []byte{}, 7},
+		// Packet guard fails, the metadata is long enough
+		{ipv4[:13], []byte{0, 0, 0, 3}, 7},
+		{[]byte{}, []byte{0, 0, 0, 4}, 0},
+	} {
+		result, err := interpretEBPFMetadata(insns, opts, test.pkt, test.meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result != test.result {
+			t.Fatalf("packet %v, metadata %v: expected %d, got %d", test.pkt, test.meta, test.result, result)
+		}
+	}
+}
+
+func TestMetadataInvalidEBPF(t *testing.T) {
+	for name, modify := range map[string]func(*EBPFOpts){
+		"same":      func(opts *EBPFOpts) { opts.MetadataEnd = opts.MetadataStart },
+		"packet":    func(opts *EBPFOpts) { opts.MetadataStart = opts.PacketStart },
+		"working":   func(opts *EBPFOpts) { opts.MetadataEnd = opts.Working[3] },
+		"result":    func(opts *EBPFOpts) { opts.Result = opts.MetadataStart },
+		"match reg": func(opts *EBPFOpts) { opts.MatchOffset, opts.MatchOffsetReg = true, opts.MetadataEnd },
+		"clobbered": func(opts *EBPFOpts) {
+			opts.XDPLoadBytes, opts.XDPContext, opts.KernelVersion = true, asm.R8, KernelVersion{5, 18}
+			opts.MetadataStart = asm.R1
+		},
+		"partial": func(opts *EBPFOpts) { opts.Metadata.Base = 0x1002 },
+	} {
+		opts := testOpts
+		opts.Metadata = metadataRegion
+		opts.MetadataStart, opts.MetadataEnd = asm.R8, asm.R9
+		modify(&opts)
+
+		if _, err := ToEBPF(metadataFilter, opts); err == nil {
+			t.Fatalf("%s: accepted", name)
+		}
+	}
+
+	// R1 is only clobbered by calls
+	opts := testOpts
+	opts.Metadata = metadataRegion
+	opts.MetadataStart, opts.MetadataEnd = asm.R1, asm.R9
+
+	if _, err := ToEBPF(metadataFilter, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// X can be as big as the packet, loads at x + k are guarded like any other value of X
+func TestIndirectLenEBPF(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.TAX{},
+		bpf.LoadIndirect{Size: 1, Off: 0},
+		bpf.RetConstant{Val: 1},
+	}
+
+	opts := testOpts
+	opts.GuardFailureValue = 7
+
+	insns := mustCompileEBPF(t, filter, opts).Instructions
+
+	// x == len, the load is always past the end of the packet
+	for _, pkt := range [][]byte{{}, {1}, make([]byte, 64)} {
+		res, err := interpretEBPF(insns, opts, pkt)
+		if err != nil {
+			t.Fatalf("packet %x: %v", pkt, err)
+		}
+
+		if res != 7 {
+			t.Fatalf("packet %x: expected guard failure, got %d", pkt, res)
+		}
+	}
+
+	// The last byte of the packet
+	last := []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.ALUOpConstant{Op: bpf.ALUOpSub, Val: 1},
+		bpf.TAX{},
+		bpf.LoadIndirect{Size: 1, Off: 0},
+		bpf.RetA{},
+	}
+
+	checkInterpreter(t, last, testOpts, []byte{1}, []byte{1, 2}, []byte{1, 2, 3, 0xFF})
+
+	// Empty packet, x wraps to 0xFFFFFFFF
+	res, err := interpretEBPF(mustCompileEBPF(t, last, opts).Instructions, opts, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res != 7 {
+		t.Fatalf("empty packet: expected guard failure, got %d", res)
+	}
+}
+
+// reuseportHashFilter hashes the first 8 bytes of the packet, to pick a socket like SO_ATTACH_REUSEPORT_CBPF
+var reuseportHashFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Size: 4, Off: 0},
+	bpf.TAX{},
+	bpf.LoadAbsolute{Size: 4, Off: 4},
+	bpf.ALUOpX{Op: bpf.ALUOpXor},
+	bpf.ALUOpConstant{Op: bpf.ALUOpMul, Val: 0x9E3779B1},
+	bpf.TAX{},
+	bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 16},
+	bpf.ALUOpX{Op: bpf.ALUOpXor},
+	bpf.RetA{},
+}
+
+// reuseportHashPackets have hashes with the top bit set, and without
+var reuseportHashPackets = [][]byte{
+	{0, 0, 0, 0, 0, 0, 0, 0},
+	{0, 0, 0, 1, 0, 0, 0, 0},
+	{0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0},
+	{0x12, 0x34, 0x56, 0x78, 0x9A, 0xBC, 0xDE, 0xF0},
+	{0xDE, 0xAD, 0xBE, 0xEF, 0xCA, 0xFE, 0xBA, 0xBE, 0xFF},
+}
+
+// The full 32 bits of A are returned
+func TestReuseportHashEBPF(t *testing.T) {
+	vm, err := bpf.NewVM(reuseportHashFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	top := false
+	for _, pkt := range reuseportHashPackets {
+		res, err := vm.Run(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		top = top || uint32(res)&0x80000000 != 0
+	}
+
+	if !top {
+		t.Fatal("no hash with the top bit set")
+	}
+
+	checkInterpreter(t, reuseportHashFilter, testOpts, reuseportHashPackets...)
+
+	ret := []bpf.Instruction{bpf.RetConstant{Val: 0xFFFFFFFF}}
+	checkInterpreter(t, ret, testOpts, []byte{})
+}
+
+// snapLenFilter returns the number of bytes of packets to capture, like a snap length:
+// 96 for IPv4 TCP, 64 for other IPv4, all of IPv6 packets, and nothing of other packets.
+var snapLenFilter = []bpf.Instruction{
+	/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 12},
+	/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 4},
+	/* 2 */ bpf.LoadAbsolute{Size: 1, Off: 23},
+	/* 3 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 1},
+	/* 4 */ bpf.RetConstant{Val: 96},
+	/* 5 */ bpf.RetConstant{Val: 64},
+	/* 6 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 2},
+	/* 7 */ bpf.LoadExtension{Num: bpf.ExtLen},
+	/* 8 */ bpf.RetA{},
+	/* 9 */ bpf.RetConstant{Val: 0},
+}
+
+// snapLenPackets are packets for snapLenFilter, with the length it returns.
+// short packets fail a packet guard.
+var snapLenPackets = []struct {
+	pkt   []byte
+	len   uint32
+	short bool
+}{
+	{[]byte{12: 0x08, 13: 0x00, 23: 6}, 96, false},
+	{[]byte{12: 0x08, 13: 0x00, 23: 17, 59: 0}, 64, false},
+	{[]byte{12: 0x86, 13: 0xdd, 39: 0}, 40, false},
+	{[]byte{12: 0x86, 13: 0xdd, 199: 0}, 200, false},
+	{[]byte{12: 0x08, 13: 0x06, 41: 0}, 0, false},
+	{[]byte{12: 0x08, 13: 0x00, 22: 0}, 0, true},
+	{[]byte{11: 0}, 0, true},
+}
+
+// Every path returns its own length unchanged, and packets too short for a load GuardFailureValue
+func TestSnapLenEBPF(t *testing.T) {
+	for _, guardFailure := range []uint32{0, 1500} {
+		opts := testOpts
+		opts.GuardFailureValue = guardFailure
+
+		insns, err := ToEBPF(snapLenFilter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range snapLenPackets {
+			expected := test.len
+			if test.short {
+				expected = guardFailure
+			}
+
+			res, err := interpretEBPF(insns, opts, test.pkt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res != uint64(expected) {
+				t.Fatalf("guard failure %d, packet %x: expected %d, got %d", guardFailure, test.pkt, expected, res)
+			}
+		}
+	}
+
+	packets := [][]byte{}
+	for _, test := range snapLenPackets {
+		packets = append(packets, test.pkt)
+	}
+
+	checkInterpreter(t, snapLenFilter, testOpts, packets...)
+}
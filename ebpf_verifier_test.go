@@ -0,0 +1,121 @@
+//go:build linux && cbpfc_verifier
+
+package cbpfc
+
+import (
+	"testing"
+
+	"github.com/newtools/ebpf"
+	"github.com/newtools/ebpf/asm"
+	"golang.org/x/net/bpf"
+)
+
+// The verifier only learns the range of packet pointers it knows are within maxPacketOffset of the packet start.
+// Loading from an offset straight from the packet requires the guard to bound x first.
+func TestVerifierIndirectUnbounded(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 4, Off: 0},
+		bpf.TAX{},
+		bpf.LoadIndirect{Size: 1, Off: 0},
+		bpf.RetA{},
+	}
+
+	packet := func(x uint32, val byte) []byte {
+		pkt := make([]byte, 20)
+		pkt[0], pkt[1], pkt[2], pkt[3] = byte(x>>24), byte(x>>16), byte(x>>8), byte(x)
+		pkt[len(pkt)-1] = val
+		return pkt
+	}
+
+	checkBackends(t, filter, packet(19, 1), XDPDrop)
+	checkBackends(t, filter, packet(19, 0), XDPPass)
+
+	// Guard fails
+	checkBackends(t, filter, packet(20, 1), XDPPass)
+	checkBackends(t, filter, packet(maxPacketOffset, 1), XDPPass)
+	checkBackends(t, filter, packet(0xFFFFFFFF, 1), XDPPass)
+}
+
+// Unbounded x was rejected before, but bounded x always worked, check it still does.
+func TestVerifierIndirectBounded(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadMemShift{Off: 0},
+		bpf.LoadIndirect{Size: 2, Off: 0},
+		bpf.RetA{},
+	}
+
+	checkBackends(t, filter, []byte{0x41, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, XDPPass)
+	checkBackends(t, filter, []byte{0x41, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0}, XDPDrop)
+}
+
+// X from the length of the packet is unbounded to the verifier too
+func TestVerifierIndirectLen(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.ALUOpConstant{Op: bpf.ALUOpSub, Val: 1},
+		bpf.TAX{},
+		bpf.LoadIndirect{Size: 1, Off: 0},
+		bpf.RetA{},
+	}
+
+	pkt := make([]byte, 14)
+	checkBackends(t, filter, pkt, XDPPass)
+
+	pkt[13] = 1
+	checkBackends(t, filter, pkt, XDPDrop)
+}
+
+// Every SKB mode is accepted in tc programs, which have a socket buffer context
+func TestVerifierSKB(t *testing.T) {
+	other := append([]byte(nil), skbTCP...)
+	other[len(other)-1] = 81
+
+	for _, mode := range []SKBMode{SKBLinear, SKBPullData, SKBLoadBytes} {
+		opts := skbOpts(mode)
+
+		filter, err := ToEBPF(cPortFilter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		insns := asm.Instructions{
+			asm.Mov.Reg(opts.SKBContext, asm.R1),
+			asm.LoadMem(opts.PacketStart, asm.R1, skbDataOffset, asm.Word),
+			asm.LoadMem(opts.PacketEnd, asm.R1, skbDataEndOffset, asm.Word),
+		}
+		insns = append(insns, filter...)
+		insns = append(insns,
+			asm.Mov.Reg(asm.R0, opts.Result).Sym(opts.ResultLabel),
+			asm.Return(),
+		)
+
+		prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+			Name:         "skb_filter",
+			Type:         ebpf.SchedCLS,
+			Instructions: insns,
+			License:      "BSD",
+		})
+		if err != nil {
+			t.Fatalf("mode %d: %v", mode, err)
+		}
+
+		for _, test := range []struct {
+			pkt      []byte
+			expected uint32
+		}{
+			{skbTCP, 1},
+			{other, 0},
+		} {
+			ret, _, err := prog.Test(test.pkt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ret != test.expected {
+				t.Fatalf("mode %d: expected %d, got %d", mode, test.expected, ret)
+			}
+		}
+
+		prog.Close()
+	}
+}
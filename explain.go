@@ -0,0 +1,171 @@
+package cbpfc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// alu operation to an explanation fmt string, with the operand as argument
+var aluToExplainFmt = map[bpf.ALUOp]string{
+	bpf.ALUOpAdd:        "add %s to a",
+	bpf.ALUOpSub:        "subtract %s from a",
+	bpf.ALUOpMul:        "multiply a by %s",
+	bpf.ALUOpDiv:        "divide a by %s",
+	bpf.ALUOpOr:         "bitwise or a with %s",
+	bpf.ALUOpAnd:        "bitwise and a with %s",
+	bpf.ALUOpShiftLeft:  "shift a left by %s",
+	bpf.ALUOpShiftRight: "shift a right by %s",
+	bpf.ALUOpMod:        "set a to a modulo %s",
+	bpf.ALUOpXor:        "xor a with %s",
+}
+
+// jump test to an explanation of the condition
+var condToExplain = map[bpf.JumpTest]string{
+	bpf.JumpEqual:          "equal to",
+	bpf.JumpNotEqual:       "not equal to",
+	bpf.JumpGreaterThan:    "greater than",
+	bpf.JumpLessThan:       "less than",
+	bpf.JumpGreaterOrEqual: "greater than or equal to",
+	bpf.JumpLessOrEqual:    "less than or equal to",
+	bpf.JumpBitsSet:        "any of the bits set in",
+	bpf.JumpBitsNotSet:     "none of the bits set in",
+}
+
+// Explain describes what a cBPF filter does in plain English, one line per block, eg:
+//
+//	Block 0: require at least 14 bytes; load 2 bytes at offset 12; if a is equal to 0x800 goto block 3, else return no match.
+//
+// Blocks are named after the position of the instruction that starts them.
+// The instructions cbpfc inserts to make the filter safe, such as packet guards, are included.
+func Explain(insns []bpf.Instruction) (string, error) {
+	blocks, err := compile(insns, CompileOpts{})
+	if err != nil {
+		return "", err
+	}
+
+	explanation := strings.Builder{}
+
+	for _, block := range blocks {
+		steps := make([]string, 0, len(block.insns))
+
+		for _, insn := range block.insns {
+			step, err := explainInsn(insn, block)
+			if err != nil {
+				return "", errors.Wrapf(err, "unable to explain %v", insn)
+			}
+
+			steps = append(steps, step)
+		}
+
+		if ft := block.fallthroughBlock(); ft != nil {
+			steps = append(steps, explainTarget(ft))
+		}
+
+		fmt.Fprintf(&explanation, "Block %d: %s.\n", block.id, strings.Join(steps, "; "))
+	}
+
+	return explanation.String(), nil
+}
+
+// explainInsn describes a single instruction.
+func explainInsn(insn instruction, blk *block) (string, error) {
+	switch i := insn.Instruction.(type) {
+
+	case bpf.LoadConstant:
+		return stat("set %s to %s", regName(i.Dst), explainConst(i.Val))
+	case bpf.LoadScratch:
+		return stat("load M[%d] into %s", i.N, regName(i.Dst))
+	case bpf.LoadAbsolute:
+		return stat("load %s at offset %d", explainSize(i.Size), i.Off)
+	case bpf.LoadIndirect:
+		return stat("load %s at offset x + %d", explainSize(i.Size), i.Off)
+	case loadMetadata:
+		return stat("load %s at offset %d of the metadata", explainSize(i.Size), i.Off)
+	case bpf.LoadExtension:
+		return stat("load the length of the packet into a")
+	case bpf.LoadMemShift:
+		return stat("set x to 4 times the low 4 bits of the byte at offset %d", i.Off)
+
+	case bpf.StoreScratch:
+		return stat("store %s in M[%d]", regName(i.Src), i.N)
+
+	case bpf.ALUOpConstant:
+		return stat(aluToExplainFmt[i.Op], explainConst(i.Val))
+	case bpf.ALUOpX:
+		return stat(aluToExplainFmt[i.Op], "x")
+	case bpf.NegateA:
+		return stat("negate a")
+
+	case bpf.Jump:
+		return explainTarget(blk.skipToBlock(skip(i.Skip))), nil
+	case bpf.JumpIf:
+		return explainCond(i.Cond, explainConst(i.Val), skip(i.SkipTrue), skip(i.SkipFalse), blk), nil
+	case bpf.JumpIfX:
+		return explainCond(i.Cond, "x", skip(i.SkipTrue), skip(i.SkipFalse), blk), nil
+
+	case bpf.RetA:
+		return stat("return a")
+	case bpf.RetConstant:
+		if i.Val == 0 {
+			return stat("return no match")
+		}
+		return stat("return %s", explainConst(i.Val))
+
+	case bpf.TXA:
+		return stat("copy x to a")
+	case bpf.TAX:
+		return stat("copy a to x")
+
+	case packetGuardAbsolute:
+		return stat("require at least %d bytes", i.Len)
+	case packetGuardIndirect:
+		return stat("require at least x + %d bytes", i.Len)
+	case metadataGuard:
+		return stat("require at least %d bytes of metadata", i.Len)
+
+	case initializeRegister:
+		return stat("set %s to 0", regName(i.Reg))
+	case initializeScratch:
+		return stat("set M[%d] to 0", i.N)
+
+	case checkXNotZero:
+		return stat("return no match if x is 0")
+
+	default:
+		return "", errors.Errorf("unsupported instruction %v", insn)
+	}
+}
+
+func explainCond(cond bpf.JumpTest, val string, skipTrue, skipFalse skip, blk *block) string {
+	return fmt.Sprintf("if a is %s %s %s, else %s", condToExplain[cond], val, explainTarget(blk.skipToBlock(skipTrue)), explainTarget(blk.skipToBlock(skipFalse)))
+}
+
+// explainTarget describes going to a block.
+// Blocks that only return no match are inlined, as that's what most conditions lead to.
+func explainTarget(target *block) string {
+	if target.isNoMatch() && len(target.insns) == 1 {
+		return "return no match"
+	}
+
+	return fmt.Sprintf("goto block %d", target.id)
+}
+
+func explainSize(size int) string {
+	if size == 1 {
+		return "1 byte"
+	}
+
+	return fmt.Sprintf("%d bytes", size)
+}
+
+// explainConst formats small constants in decimal, others in hex
+func explainConst(val uint32) string {
+	if val < 256 {
+		return fmt.Sprintf("%d", val)
+	}
+
+	return fmt.Sprintf("%#x", val)
+}
@@ -0,0 +1,67 @@
+package cbpfc
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestExplainIPv4(t *testing.T) {
+	explanation, err := Explain([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 3},
+		bpf.LoadAbsolute{Size: 1, Off: 23},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Conditions are normalized so the false branch falls through
+	expected := "Block 0: require at least 14 bytes; load 2 bytes at offset 12; if a is not equal to 0x800 return no match, else goto block 2.\n" +
+		"Block 2: require at least 24 bytes; load 1 byte at offset 23; if a is not equal to 6 return no match, else goto block 4.\n" +
+		"Block 4: return 1.\n" +
+		"Block 5: return no match.\n"
+
+	if explanation != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, explanation)
+	}
+}
+
+func TestExplainIndirect(t *testing.T) {
+	explanation, err := Explain([]bpf.Instruction{
+		bpf.LoadMemShift{Off: 14},
+		bpf.LoadIndirect{Size: 2, Off: 16},
+		bpf.ALUOpX{Op: bpf.ALUOpDiv},
+		bpf.RetA{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []string{
+		"require at least 15 bytes",
+		"set x to 4 times the low 4 bits of the byte at offset 14",
+		"require at least x + 18 bytes",
+		"load 2 bytes at offset x + 16",
+		"return no match if x is 0",
+		"divide a by x",
+		"return a",
+	} {
+		if !strings.Contains(explanation, step) {
+			t.Fatalf("expected %q in:\n%s", step, explanation)
+		}
+	}
+}
+
+func TestExplainInvalid(t *testing.T) {
+	_, err := Explain([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+	})
+	if err == nil {
+		t.Fatal("invalid filter explained")
+	}
+}
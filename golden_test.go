@@ -0,0 +1,95 @@
+package cbpfc
+
+import (
+	"testing"
+
+	"github.com/cloudflare/cbpfc/internal/golden"
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// goldenOutput compiles filter with the backend opts are the options of (COpts, EBPFOpts, RustOpts or WATOpts).
+// Blocks are laid out in SourceOrder whatever the BlockOrder of opts, so the golden files of a filter
+// only change if the code generated for its blocks does, not if their layout does.
+func goldenOutput(filter []bpf.Instruction, opts interface{}) (string, error) {
+	switch o := opts.(type) {
+	case COpts:
+		o.BlockOrder = SourceOrder
+		return ToC(filter, o)
+	case EBPFOpts:
+		o.BlockOrder = SourceOrder
+		return ToEBPFAsm(filter, o)
+	case RustOpts:
+		o.BlockOrder = SourceOrder
+		return ToRust(filter, o)
+	case WATOpts:
+		o.BlockOrder = SourceOrder
+		return ToWAT(filter, o)
+	}
+
+	return "", errors.Errorf("no golden output for %T", opts)
+}
+
+// goldenRuns is the number of times checkGolden compiles a filter.
+// Blocks jump to targets in a map, iterating over it can't change the output.
+const goldenRuns = 5
+
+// checkGolden compiles filter with the backend of opts, see goldenOutput,
+// and compares the output to the golden file testdata/name.golden.
+// Run with -update to regenerate the golden file.
+func checkGolden(tb testing.TB, name string, filter []bpf.Instruction, opts interface{}) {
+	tb.Helper()
+
+	var out string
+
+	for i := 0; i < goldenRuns; i++ {
+		res, err := goldenOutput(filter, opts)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if i != 0 && res != out {
+			tb.Fatalf("%s: output isn't deterministic:\n%s", name, golden.Diff(out, res))
+		}
+
+		out = res
+	}
+
+	golden.Check(tb, "testdata/"+name+".golden", out)
+}
+
+// The layout of blocks doesn't change golden output
+func TestGoldenBlockOrder(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 1},
+	}
+
+	opts := testOpts
+	opts.BlockOrder = FallthroughFirst
+
+	source, err := ToEBPFAsm(filter, testOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fallthroughFirst, err := ToEBPFAsm(filter, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if source == fallthroughFirst {
+		t.Fatal("block order doesn't change the output")
+	}
+
+	out, err := goldenOutput(filter, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := golden.Diff(source, out); diff != "" {
+		t.Fatalf("golden output isn't in source order:\n%s", diff)
+	}
+}
@@ -0,0 +1,108 @@
+// Package golden compares the output of tests to golden files.
+//
+// Run tests with -update to write the golden files from the output instead:
+//
+//	go test -run TestName -update
+package golden
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files instead of comparing to them")
+
+// Check compares got to the golden file at path, after normalizing both.
+// With -update, the golden file is written with got instead.
+func Check(tb testing.TB, path string, got string) {
+	tb.Helper()
+
+	got = Normalize(got)
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			tb.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			tb.Fatal(err)
+		}
+
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		tb.Fatalf("%v, run with -update to create it", err)
+	}
+
+	if diff := Diff(Normalize(string(want)), got); diff != "" {
+		tb.Fatalf("%s differs, run with -update to regenerate it:\n%s", path, diff)
+	}
+}
+
+// Normalize removes the differences between outputs that don't matter:
+// carriage returns, and trailing whitespace on lines.
+func Normalize(s string) string {
+	lines := strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n")
+
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Diff describes the first line want and got differ on, with the lines around it. Empty if they're the same.
+func Diff(want, got string) string {
+	if want == got {
+		return ""
+	}
+
+	wantLines, gotLines := strings.Split(want, "\n"), strings.Split(got, "\n")
+
+	line := 0
+	for line < len(wantLines) && line < len(gotLines) && wantLines[line] == gotLines[line] {
+		line++
+	}
+
+	start := line - diffContext
+	if start < 0 {
+		start = 0
+	}
+
+	diff := strings.Builder{}
+	fmt.Fprintf(&diff, "line %d:\n", line+1)
+
+	for _, l := range wantLines[start:line] {
+		fmt.Fprintf(&diff, "  %s\n", l)
+	}
+
+	for _, l := range around(wantLines, line) {
+		fmt.Fprintf(&diff, "- %s\n", l)
+	}
+
+	for _, l := range around(gotLines, line) {
+		fmt.Fprintf(&diff, "+ %s\n", l)
+	}
+
+	return diff.String()
+}
+
+// diffContext is the number of lines around a difference Diff shows.
+const diffContext = 3
+
+// around is the lines from line, up to diffContext lines after it.
+func around(lines []string, line int) []string {
+	end := line + diffContext + 1
+	if end > len(lines) {
+		end = len(lines)
+	}
+
+	return lines[line:end]
+}
@@ -0,0 +1,82 @@
+package golden
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	if n := Normalize("a \r\nb\t\n\nc"); n != "a\nb\n\nc" {
+		t.Fatalf("unexpected %q", n)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	if diff := Diff("a\nb\nc", "a\nb\nc"); diff != "" {
+		t.Fatalf("unexpected diff %q", diff)
+	}
+
+	diff := Diff("a\nb\nc\nd", "a\nb\nx\nd")
+	if !strings.HasPrefix(diff, "line 3:\n") {
+		t.Fatalf("wrong line in %q", diff)
+	}
+
+	for _, line := range []string{"  a", "  b", "- c", "+ x", "- d", "+ d"} {
+		if !strings.Contains(diff, line+"\n") {
+			t.Fatalf("expected %q in %q", line, diff)
+		}
+	}
+
+	// got is longer
+	if diff := Diff("a", "a\nb"); !strings.Contains(diff, "+ b\n") {
+		t.Fatalf("missing extra line in %q", diff)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.golden")
+	if err := ioutil.WriteFile(path, []byte("a\r\nb \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	Check(t, path, "a\nb\n")
+}
+
+func TestCheckUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	*update = true
+	defer func() { *update = false }()
+
+	// Missing directories are created
+	path := filepath.Join(dir, "testdata", "test.golden")
+	Check(t, path, "a \r\nb\n")
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "a\nb\n" {
+		t.Fatalf("expected normalized output, got %q", got)
+	}
+
+	// Existing files are overwritten
+	Check(t, path, "c\n")
+
+	*update = false
+	Check(t, path, "c\n")
+}
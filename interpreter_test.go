@@ -0,0 +1,844 @@
+package cbpfc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"testing"
+
+	"github.com/newtools/ebpf/asm"
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// Simple eBPF interpreter, for checking the eBPF we generate without a kernel.
+// Only supports the subset of eBPF ToEBPF generates.
+//
+// Stricter than the kernel at runtime where it's cheap to be:
+// reading uninitialized registers or stack, and out of bounds memory accesses are errors.
+
+const (
+	// Fake addresses of the packet, the stack, and map values
+	interpPacket = 0x10000000
+	interpStack  = 0x20000000
+	interpMaps   = 0x30000000
+
+	// Fake value of map pointers, the map's number is added
+	interpMapPtr = 0x40000000
+
+	// Fake value of the XDP context
+	interpXDPContext = 0x50000000
+
+	// Fake address of the metadata buffer
+	interpMetadata = 0x60000000
+
+	// Fake address of the socket buffer context
+	interpSKBContext = 0x70000000
+
+	interpStackSize = 512
+
+	// Maximum number of instructions executed, guards against loops
+	interpMaxSteps = 1 << 16
+)
+
+// The interpreter runs on a (pretend) little endian host
+var interpEndian = binary.LittleEndian
+
+type interpreter struct {
+	insns   asm.Instructions
+	symbols map[string]int
+
+	regs        [asm.R10 + 1]uint64
+	initialized [asm.R10 + 1]bool
+
+	pkt []byte
+
+	// Length of the linear part of the packet, that can be accessed directly
+	linear int
+
+	// Socket buffer context (struct __sk_buff), with EBPFOpts.SKB
+	skb []byte
+
+	// Metadata buffer, with CompileOpts.Metadata
+	meta []byte
+
+	// Output of bpf_trace_printk calls
+	traces []string
+
+	// Maps referenced by the program, with a single 4 byte value each.
+	// Values are in mapValues, at the position of the map in maps.
+	maps      []string
+	mapValues []byte
+
+	stack            [interpStackSize]byte
+	stackInitialized [interpStackSize]bool
+}
+
+// interpretEBPF runs eBPF generated by ToEBPF with opts against a packet, and returns the result of the filter.
+func interpretEBPF(insns asm.Instructions, opts EBPFOpts, pkt []byte) (uint64, error) {
+	interp, err := newInterpreter(insns, opts, pkt)
+	if err != nil {
+		return 0, err
+	}
+
+	return interp.run()
+}
+
+// interpretEBPFMetadata runs eBPF generated by ToEBPF with opts against a packet and a metadata buffer,
+// and returns the result of the filter.
+func interpretEBPFMetadata(insns asm.Instructions, opts EBPFOpts, pkt, meta []byte) (uint64, error) {
+	interp, err := newInterpreter(insns, opts, pkt)
+	if err != nil {
+		return 0, err
+	}
+
+	interp.meta = meta
+	interp.set(opts.MetadataEnd, interpMetadata+uint64(len(meta)))
+
+	return interp.run()
+}
+
+// interpretEBPFSKB runs eBPF generated by ToEBPF with opts against a socket buffer packet,
+// with only the first linear bytes in the linear part, and returns the result of the filter.
+func interpretEBPFSKB(insns asm.Instructions, opts EBPFOpts, pkt []byte, linear int) (uint64, error) {
+	interp, err := newInterpreter(insns, opts, pkt)
+	if err != nil {
+		return 0, err
+	}
+
+	interp.setLinear(linear)
+	interp.set(opts.PacketEnd, interpPacket+uint64(linear))
+
+	return interp.run()
+}
+
+// newInterpreter prepares eBPF generated by ToEBPF with opts to run against a packet.
+func newInterpreter(insns asm.Instructions, opts EBPFOpts, pkt []byte) (*interpreter, error) {
+	// Return the result
+	prog := append(append(asm.Instructions{}, insns...),
+		asm.Mov.Reg(asm.R0, opts.Result).Sym(opts.ResultLabel),
+		asm.Return(),
+	)
+
+	symbols, err := prog.SymbolOffsets()
+	if err != nil {
+		return nil, err
+	}
+
+	interp := &interpreter{
+		insns:   prog,
+		symbols: symbols,
+		pkt:     pkt,
+		linear:  len(pkt),
+	}
+
+	interp.set(opts.PacketStart, interpPacket)
+	interp.set(opts.PacketEnd, interpPacket+uint64(len(pkt)))
+	interp.set(asm.R10, interpStack+interpStackSize)
+
+	if opts.XDPLoadBytes {
+		interp.set(opts.XDPContext, interpXDPContext)
+	}
+
+	if opts.SKB != SKBLinear {
+		interp.set(opts.SKBContext, interpSKBContext)
+		interp.skb = make([]byte, skbDataEndOffset+4)
+		interpEndian.PutUint32(interp.skb[skbLenOffset:], uint32(len(pkt)))
+		interpEndian.PutUint32(interp.skb[skbDataOffset:], interpPacket)
+		interp.setLinear(len(pkt))
+	}
+
+	if opts.Metadata.Len != 0 {
+		interp.set(opts.MetadataStart, interpMetadata)
+		interp.set(opts.MetadataEnd, interpMetadata)
+	}
+
+	return interp, nil
+}
+
+// setLinear sets the length of the linear part of the packet, in the socket buffer context if there is one.
+func (p *interpreter) setLinear(linear int) {
+	p.linear = linear
+
+	if p.skb != nil {
+		interpEndian.PutUint32(p.skb[skbDataEndOffset:], interpPacket+uint32(linear))
+	}
+}
+
+func (p *interpreter) set(reg asm.Register, val uint64) {
+	p.regs[reg] = val
+	p.initialized[reg] = true
+}
+
+func (p *interpreter) get(reg asm.Register) (uint64, error) {
+	if reg > asm.R10 {
+		return 0, errors.Errorf("invalid register %v", reg)
+	}
+
+	if !p.initialized[reg] {
+		return 0, errors.Errorf("read of uninitialized register %v", reg)
+	}
+
+	return p.regs[reg], nil
+}
+
+func (p *interpreter) run() (uint64, error) {
+	pc := 0
+
+	for steps := 0; steps < interpMaxSteps; steps++ {
+		if pc < 0 || pc >= len(p.insns) {
+			return 0, errors.Errorf("pc %d out of bounds", pc)
+		}
+
+		insn := p.insns[pc]
+
+		if insn.OpCode.Class() == asm.JumpClass && insn.OpCode.JumpOp() == asm.Exit {
+			return p.get(asm.R0)
+		}
+
+		next, err := p.step(pc, insn)
+		if err != nil {
+			return 0, errors.Wrapf(err, "insn %d: %v", pc, insn)
+		}
+
+		pc = next
+	}
+
+	return 0, errors.New("too many instructions executed")
+}
+
+// step executes an instruction, and returns the next pc.
+func (p *interpreter) step(pc int, insn asm.Instruction) (int, error) {
+	switch insn.OpCode.Class() {
+	case asm.ALUClass, asm.ALU64Class:
+		return pc + 1, p.alu(insn)
+
+	case asm.JumpClass:
+		if insn.OpCode.JumpOp() == asm.Call {
+			return pc + 1, p.call(insn)
+		}
+
+		taken, err := p.jump(insn)
+		if err != nil {
+			return 0, err
+		}
+
+		if !taken {
+			return pc + 1, nil
+		}
+
+		if insn.Reference == "" {
+			return pc + 1 + int(insn.Offset), nil
+		}
+
+		target, ok := p.symbols[insn.Reference]
+		if !ok {
+			return 0, errors.Errorf("unknown label %s", insn.Reference)
+		}
+
+		if target <= pc {
+			return 0, errors.Errorf("backwards jump to %s", insn.Reference)
+		}
+
+		return target, nil
+
+	case asm.LdXClass:
+		if insn.OpCode.Mode() != asm.MemMode {
+			return 0, errors.New("unsupported load mode")
+		}
+
+		addr, err := p.get(insn.Src)
+		if err != nil {
+			return 0, err
+		}
+
+		val, err := p.load(addr+uint64(int64(insn.Offset)), insn.OpCode.Size().Sizeof())
+		if err != nil {
+			return 0, err
+		}
+
+		p.set(insn.Dst, val)
+		return pc + 1, nil
+
+	case asm.StClass, asm.StXClass:
+		if insn.OpCode.Mode() != asm.MemMode {
+			return 0, errors.New("unsupported store mode")
+		}
+
+		addr, err := p.get(insn.Dst)
+		if err != nil {
+			return 0, err
+		}
+
+		val := uint64(insn.Constant)
+		if insn.OpCode.Class() == asm.StXClass {
+			val, err = p.get(insn.Src)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		return pc + 1, p.store(addr+uint64(int64(insn.Offset)), insn.OpCode.Size().Sizeof(), val)
+
+	case asm.LdClass:
+		if insn.OpCode.Mode() != asm.ImmMode || insn.OpCode.Size() != asm.DWord {
+			return 0, errors.New("unsupported load mode")
+		}
+
+		if insn.Reference != "" {
+			p.set(insn.Dst, interpMapPtr+uint64(p.mapIndex(insn.Reference)))
+			return pc + 1, nil
+		}
+
+		p.set(insn.Dst, uint64(insn.Constant))
+		return pc + 1, nil
+
+	default:
+		return 0, errors.Errorf("unsupported class %v", insn.OpCode.Class())
+	}
+}
+
+func (p *interpreter) alu(insn asm.Instruction) error {
+	is64 := insn.OpCode.Class() == asm.ALU64Class
+	op := insn.OpCode.ALUOp()
+
+	var src uint64
+	if op == asm.Swap {
+		src = uint64(insn.Constant)
+	} else if op != asm.Neg && insn.OpCode.Source() == asm.RegSource {
+		var err error
+		src, err = p.get(insn.Src)
+		if err != nil {
+			return err
+		}
+	} else {
+		// immediates are sign extended
+		src = uint64(insn.Constant)
+
+		// the verifier rejects constant shifts larger than the operand
+		if (op == asm.LSh || op == asm.RSh || op == asm.ArSh) && (src >= 64 || (!is64 && src >= 32)) {
+			return errors.Errorf("invalid shift %d", insn.Constant)
+		}
+	}
+
+	// Mov is the only op that doesn't read dst
+	var dst uint64
+	if op != asm.Mov {
+		var err error
+		dst, err = p.get(insn.Dst)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !is64 {
+		src = uint64(uint32(src))
+		dst = uint64(uint32(dst))
+	}
+
+	// shifts are masked, like most JITs do
+	shiftMask := uint64(63)
+	if !is64 {
+		shiftMask = 31
+	}
+
+	var res uint64
+	switch op {
+	case asm.Add:
+		res = dst + src
+	case asm.Sub:
+		res = dst - src
+	case asm.Mul:
+		res = dst * src
+	case asm.Div:
+		if src == 0 {
+			res = 0
+		} else {
+			res = dst / src
+		}
+	case asm.Mod:
+		if src == 0 {
+			res = dst
+		} else {
+			res = dst % src
+		}
+	case asm.Or:
+		res = dst | src
+	case asm.And:
+		res = dst & src
+	case asm.Xor:
+		res = dst ^ src
+	case asm.LSh:
+		res = dst << (src & shiftMask)
+	case asm.RSh:
+		res = dst >> (src & shiftMask)
+	case asm.ArSh:
+		if is64 {
+			res = uint64(int64(dst) >> (src & shiftMask))
+		} else {
+			res = uint64(int32(dst) >> (src & shiftMask))
+		}
+	case asm.Neg:
+		res = -dst
+	case asm.Mov:
+		res = src
+	case asm.Swap:
+		res = swap(dst, int(src), insn.OpCode.Endianness())
+	default:
+		return errors.Errorf("unsupported alu op %v", op)
+	}
+
+	// 32bit ops zero the upper 32 bits of dst
+	if !is64 {
+		res = uint64(uint32(res))
+	}
+
+	p.set(insn.Dst, res)
+	return nil
+}
+
+// swap converts the lower size bits of val to endian, from the host endianness.
+func swap(val uint64, size int, endian asm.Endianness) uint64 {
+	// Host is little endian, swapping to LE only truncates
+	switch size {
+	case 16:
+		if endian == asm.BE {
+			return uint64(bits.ReverseBytes16(uint16(val)))
+		}
+		return uint64(uint16(val))
+	case 32:
+		if endian == asm.BE {
+			return uint64(bits.ReverseBytes32(uint32(val)))
+		}
+		return uint64(uint32(val))
+	default:
+		if endian == asm.BE {
+			return bits.ReverseBytes64(val)
+		}
+		return val
+	}
+}
+
+func (p *interpreter) jump(insn asm.Instruction) (bool, error) {
+	op := insn.OpCode.JumpOp()
+
+	if op == asm.Ja {
+		return true, nil
+	}
+
+	dst, err := p.get(insn.Dst)
+	if err != nil {
+		return false, err
+	}
+
+	src := uint64(insn.Constant)
+	if insn.OpCode.Source() == asm.RegSource {
+		src, err = p.get(insn.Src)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	switch op {
+	case asm.JEq:
+		return dst == src, nil
+	case asm.JNE:
+		return dst != src, nil
+	case asm.JGT:
+		return dst > src, nil
+	case asm.JGE:
+		return dst >= src, nil
+	case asm.JLT:
+		return dst < src, nil
+	case asm.JLE:
+		return dst <= src, nil
+	case asm.JSet:
+		return dst&src != 0, nil
+	case asm.JSGT:
+		return int64(dst) > int64(src), nil
+	case asm.JSGE:
+		return int64(dst) >= int64(src), nil
+	case asm.JSLT:
+		return int64(dst) < int64(src), nil
+	case asm.JSLE:
+		return int64(dst) <= int64(src), nil
+	default:
+		return false, errors.Errorf("unsupported jump op %v", op)
+	}
+}
+
+// mapIndex is the position of a map in maps, adding it if it's new.
+func (p *interpreter) mapIndex(name string) int {
+	for i, m := range p.maps {
+		if m == name {
+			return i
+		}
+	}
+
+	p.maps = append(p.maps, name)
+	p.mapValues = append(p.mapValues, 0, 0, 0, 0)
+	return len(p.maps) - 1
+}
+
+// mapValue is the value of key 0 of a map, 0 if the filter doesn't reference it.
+func (p *interpreter) mapValue(name string) uint32 {
+	for i, m := range p.maps {
+		if m == name {
+			return interpEndian.Uint32(p.mapValues[i*4:])
+		}
+	}
+
+	return 0
+}
+
+// setMapValue sets the value of key 0 of a map.
+func (p *interpreter) setMapValue(name string, val uint32) {
+	interpEndian.PutUint32(p.mapValues[p.mapIndex(name)*4:], val)
+}
+
+// call calls a helper.
+// Only bpf_trace_printk with a single argument, map_lookup_elem / map_update_elem of key 0,
+// bpf_xdp_load_bytes, bpf_skb_load_bytes and bpf_skb_pull_data are supported.
+func (p *interpreter) call(insn asm.Instruction) error {
+	switch asm.BuiltinFunc(insn.Constant) {
+	case asm.TracePrintk:
+		return p.tracePrintk()
+	case asm.MapLookupElement, asm.MapUpdateElement:
+		return p.mapElement(asm.BuiltinFunc(insn.Constant))
+	case xdpLoadBytes:
+		return p.loadBytes(interpXDPContext)
+	case skbLoadBytes:
+		return p.loadBytes(interpSKBContext)
+	case skbPullData:
+		return p.skbPullData()
+	default:
+		return errors.Errorf("unsupported helper %v", asm.BuiltinFunc(insn.Constant))
+	}
+}
+
+// clobber clobbers the registers calls clobber, and sets the return value.
+func (p *interpreter) clobber(ret uint64) {
+	for reg := asm.R1; reg <= asm.R5; reg++ {
+		p.initialized[reg] = false
+	}
+
+	p.set(asm.R0, ret)
+}
+
+func (p *interpreter) mapElement(fn asm.BuiltinFunc) error {
+	ptr, err := p.get(asm.R1)
+	if err != nil {
+		return err
+	}
+
+	n := int(ptr - interpMapPtr)
+	if ptr < interpMapPtr || n >= len(p.maps) {
+		return errors.Errorf("invalid map pointer %#x", ptr)
+	}
+
+	keyAddr, err := p.get(asm.R2)
+	if err != nil {
+		return err
+	}
+
+	key, err := p.load(keyAddr, 4)
+	if err != nil {
+		return err
+	}
+
+	if key != 0 {
+		return errors.Errorf("unsupported map key %d", key)
+	}
+
+	if fn == asm.MapLookupElement {
+		p.clobber(interpMaps + uint64(n)*4)
+		return nil
+	}
+
+	valueAddr, err := p.get(asm.R3)
+	if err != nil {
+		return err
+	}
+
+	value, err := p.load(valueAddr, 4)
+	if err != nil {
+		return err
+	}
+
+	flags, err := p.get(asm.R4)
+	if err != nil {
+		return err
+	}
+
+	if flags != 0 {
+		return errors.Errorf("unsupported map update flags %d", flags)
+	}
+
+	interpEndian.PutUint32(p.mapValues[n*4:], uint32(value))
+
+	p.clobber(0)
+	return nil
+}
+
+// loadBytes copies bytes of the packet to memory, returning -EFAULT if they're not all in the packet.
+// The context passed has to be expected.
+func (p *interpreter) loadBytes(expected uint64) error {
+	args := make([]uint64, 4)
+	for i := range args {
+		var err error
+		if args[i], err = p.get(asm.R1 + asm.Register(i)); err != nil {
+			return err
+		}
+	}
+
+	ctx, offset, addr, size := args[0], args[1], args[2], args[3]
+
+	if ctx != expected {
+		return errors.Errorf("invalid context %#x", ctx)
+	}
+
+	if offset > 0xFFFFFFFF || size > 0xFFFFFFFF {
+		return errors.Errorf("offset %#x or size %#x don't fit in 32 bits", offset, size)
+	}
+
+	if offset+size > uint64(len(p.pkt)) {
+		efault := int64(14)
+		p.clobber(uint64(-efault))
+		return nil
+	}
+
+	for i := uint64(0); i < size; i++ {
+		if err := p.store(addr+i, 1, uint64(p.pkt[offset+i])); err != nil {
+			return err
+		}
+	}
+
+	p.clobber(0)
+	return nil
+}
+
+// skbPullData makes bytes of the packet linear, all of it if the length is 0,
+// returning -ENOMEM if the packet is shorter than the length.
+func (p *interpreter) skbPullData() error {
+	ctx, err := p.get(asm.R1)
+	if err != nil {
+		return err
+	}
+
+	if ctx != interpSKBContext {
+		return errors.Errorf("invalid context %#x", ctx)
+	}
+
+	n, err := p.get(asm.R2)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case n == 0:
+		p.setLinear(len(p.pkt))
+	case n > uint64(len(p.pkt)):
+		enomem := int64(12)
+		p.clobber(uint64(-enomem))
+		return nil
+	case n > uint64(p.linear):
+		p.setLinear(int(n))
+	}
+
+	p.clobber(0)
+	return nil
+}
+
+// tracePrintk calls bpf_trace_printk.
+func (p *interpreter) tracePrintk() error {
+
+	addr, err := p.get(asm.R1)
+	if err != nil {
+		return err
+	}
+
+	size, err := p.get(asm.R2)
+	if err != nil {
+		return err
+	}
+
+	arg, err := p.get(asm.R3)
+	if err != nil {
+		return err
+	}
+
+	format := []byte{}
+	for i := uint64(0); i < size; i++ {
+		c, err := p.load(addr+i, 1)
+		if err != nil {
+			return err
+		}
+
+		format = append(format, byte(c))
+	}
+
+	if len(format) == 0 || format[len(format)-1] != 0 {
+		return errors.New("format not NUL terminated")
+	}
+
+	p.traces = append(p.traces, fmt.Sprintf(string(format[:bytes.IndexByte(format, 0)]), int64(arg)))
+
+	p.clobber(uint64(len(p.traces[len(p.traces)-1])))
+	return nil
+}
+
+// region returns the memory an access falls in, and if it's the stack.
+func (p *interpreter) region(addr uint64, size int) ([]byte, int, bool, error) {
+	switch {
+	case addr >= interpPacket && addr+uint64(size) <= interpPacket+uint64(p.linear):
+		return p.pkt, int(addr - interpPacket), false, nil
+	case addr >= interpMetadata && addr+uint64(size) <= interpMetadata+uint64(len(p.meta)):
+		return p.meta, int(addr - interpMetadata), false, nil
+	case addr >= interpSKBContext && addr+uint64(size) <= interpSKBContext+uint64(len(p.skb)):
+		return p.skb, int(addr - interpSKBContext), false, nil
+	case addr >= interpMaps && addr+uint64(size) <= interpMaps+uint64(len(p.mapValues)):
+		return p.mapValues, int(addr - interpMaps), false, nil
+	case addr >= interpStack && addr+uint64(size) <= interpStack+interpStackSize:
+		if addr%uint64(size) != 0 {
+			return nil, 0, false, errors.Errorf("unaligned stack access %#x", addr)
+		}
+		return p.stack[:], int(addr - interpStack), true, nil
+	default:
+		return nil, 0, false, errors.Errorf("out of bounds access %#x size %d", addr, size)
+	}
+}
+
+func (p *interpreter) load(addr uint64, size int) (uint64, error) {
+	mem, off, isStack, err := p.region(addr, size)
+	if err != nil {
+		return 0, err
+	}
+
+	if isStack {
+		for i := off; i < off+size; i++ {
+			if !p.stackInitialized[i] {
+				return 0, errors.Errorf("read of uninitialized stack %#x", addr)
+			}
+		}
+	}
+
+	switch size {
+	case 1:
+		return uint64(mem[off]), nil
+	case 2:
+		return uint64(interpEndian.Uint16(mem[off:])), nil
+	case 4:
+		return uint64(interpEndian.Uint32(mem[off:])), nil
+	default:
+		return interpEndian.Uint64(mem[off:]), nil
+	}
+}
+
+func (p *interpreter) store(addr uint64, size int, val uint64) error {
+	mem, off, isStack, err := p.region(addr, size)
+	if err != nil {
+		return err
+	}
+
+	if !isStack {
+		return errors.Errorf("write to packet %#x", addr)
+	}
+
+	for i := off; i < off+size; i++ {
+		p.stackInitialized[i] = true
+	}
+
+	switch size {
+	case 1:
+		mem[off] = byte(val)
+	case 2:
+		interpEndian.PutUint16(mem[off:], uint16(val))
+	case 4:
+		interpEndian.PutUint32(mem[off:], uint32(val))
+	default:
+		interpEndian.PutUint64(mem[off:], val)
+	}
+
+	return nil
+}
+
+// checkInterpreter checks a filter compiled to eBPF with opts returns the same results as the x/net/bpf VM for each packet.
+// The filter must be supported by the x/net/bpf VM.
+func checkInterpreter(tb testing.TB, filter []bpf.Instruction, opts EBPFOpts, packets ...[]byte) {
+	tb.Helper()
+
+	vm, err := bpf.NewVM(filter)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	insns, err := ToEBPF(filter, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	blocks, err := compile(filter, opts.CompileOpts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if err := verifyGuards(blocks); err != nil {
+		tb.Fatal(err)
+	}
+
+	for _, pkt := range packets {
+		expected, err := vm.Run(pkt)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		res, err := interpretEBPF(insns, opts, pkt)
+		if err != nil {
+			tb.Fatalf("packet %x: %v\n%v", pkt, err, insns)
+		}
+
+		if res != uint64(uint32(expected)) {
+			tb.Fatalf("packet %x: expected %d, got %d\n%v", pkt, uint32(expected), res, insns)
+		}
+	}
+}
+
+func TestInterpreterSwap(t *testing.T) {
+	res, err := interpretEBPF(asm.Instructions{
+		asm.LoadMem(asm.R4, asm.R2, 0, asm.Half),
+		asm.HostTo(asm.BE, asm.R4, asm.Half),
+	}, testOpts, []byte{0x12, 0x34})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res != 0x1234 {
+		t.Fatalf("expected 0x1234, got %#x", res)
+	}
+}
+
+func TestInterpreterOutOfBounds(t *testing.T) {
+	_, err := interpretEBPF(asm.Instructions{
+		asm.LoadMem(asm.R4, asm.R2, 1, asm.Half),
+	}, testOpts, []byte{0x12, 0x34})
+	if err == nil {
+		t.Fatal("out of bounds load allowed")
+	}
+}
+
+func TestInterpreterUninitialized(t *testing.T) {
+	_, err := interpretEBPF(asm.Instructions{
+		asm.LoadMem(asm.R4, asm.R10, -4, asm.Word),
+	}, testOpts, []byte{})
+	if err == nil {
+		t.Fatal("uninitialized stack read allowed")
+	}
+
+	_, err = interpretEBPF(asm.Instructions{
+		asm.Mov.Reg(asm.R4, asm.R8),
+	}, testOpts, []byte{})
+	if err == nil {
+		t.Fatal("uninitialized register read allowed")
+	}
+}
@@ -0,0 +1,125 @@
+package cbpfc
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// jsonVersion is the version of the JSON representation generated by ToJSON.
+// Incremented on incompatible changes.
+const jsonVersion = 1
+
+// jsonProgram is the top level JSON representation of a compiled cBPF filter
+type jsonProgram struct {
+	Version int         `json:"version"`
+	Blocks  []jsonBlock `json:"blocks"`
+}
+
+// jsonBlock is the JSON representation of a block
+type jsonBlock struct {
+	// id of the block, unique.
+	// Absolute position of the cBPF instruction that started the block.
+	ID       pos               `json:"id"`
+	IsTarget bool              `json:"isTarget"`
+	Insns    []jsonInstruction `json:"instructions"`
+
+	// ids of the blocks this block can jump or fall through to, lowest first
+	Jumps []pos `json:"jumps"`
+}
+
+// jsonInstruction is the JSON representation of an instruction
+type jsonInstruction struct {
+	// Type of the instruction, ie the name of the golang.org/x/net/bpf type,
+	// or of the cbpfc type for synthetic instructions.
+	Type string `json:"type"`
+
+	// Synthetic instructions are inserted by cbpfc, and have no position.
+	Synthetic bool `json:"synthetic"`
+
+	// Absolute position of the cBPF instruction.
+	// Relative jumps (skips) are relative to this.
+	Pos *pos `json:"pos,omitempty"`
+
+	// Fields of the instruction, as named by the Go type
+	Fields bpf.Instruction `json:"fields"`
+
+	// Human readable representation of the instruction
+	Text string `json:"text"`
+}
+
+// ToJSON compiles a cBPF filter to a JSON representation of the blocks cbpfc generates from it.
+//
+// The top level object has a "version" that is incremented on incompatible changes.
+// Each block has an "id", the "instructions" it's made of (including synthetic instructions
+// added by cbpfc, such as packet guards), and the ids of the blocks it "jumps" to.
+//
+// Block ids are the absolute positions of the cBPF instructions that start them,
+// so the targets of the relative jumps of an instruction can be computed from its "pos".
+func ToJSON(insns []bpf.Instruction) ([]byte, error) {
+	blocks, err := compile(insns, CompileOpts{})
+	if err != nil {
+		return nil, err
+	}
+
+	prog := jsonProgram{
+		Version: jsonVersion,
+		Blocks:  make([]jsonBlock, len(blocks)),
+	}
+
+	for i, block := range blocks {
+		prog.Blocks[i] = blockToJSON(block)
+	}
+
+	j, err := json.Marshal(prog)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to marshal JSON")
+	}
+
+	return j, nil
+}
+
+// blockToJSON converts a block to it's JSON representation
+func blockToJSON(blk *block) jsonBlock {
+	jBlk := jsonBlock{
+		ID:       blk.id,
+		IsTarget: blk.IsTarget,
+		Insns:    make([]jsonInstruction, len(blk.insns)),
+		Jumps:    []pos{},
+	}
+
+	for i, insn := range blk.insns {
+		jBlk.Insns[i] = insnToJSON(insn)
+	}
+
+	for _, target := range blk.jumps {
+		jBlk.Jumps = append(jBlk.Jumps, target.id)
+	}
+
+	sort.Slice(jBlk.Jumps, func(i, j int) bool {
+		return jBlk.Jumps[i] < jBlk.Jumps[j]
+	})
+
+	return jBlk
+}
+
+// insnToJSON converts an instruction to it's JSON representation
+func insnToJSON(insn instruction) jsonInstruction {
+	jInsn := jsonInstruction{
+		Type:      reflect.TypeOf(insn.Instruction).Name(),
+		Synthetic: isSynthetic(insn.Instruction),
+		Fields:    insn.Instruction,
+		Text:      fmt.Sprint(insn.Instruction),
+	}
+
+	if !jInsn.Synthetic {
+		id := insn.id
+		jInsn.Pos = &id
+	}
+
+	return jInsn
+}
@@ -0,0 +1,77 @@
+package cbpfc
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestToJSON(t *testing.T) {
+	j, err := ToJSON([]bpf.Instruction{
+		// block 0
+		/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 12},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 1},
+
+		// block 1
+		/* 2 */ bpf.RetConstant{Val: 0},
+
+		// block 2
+		/* 3 */ bpf.RetA{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prog map[string]interface{}
+	if err := json.Unmarshal(j, &prog); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected map[string]interface{}
+	if err := json.Unmarshal([]byte(`{
+		"version": 1,
+		"blocks": [
+			{
+				"id": 0,
+				"isTarget": false,
+				"instructions": [
+					{"type": "packetGuardAbsolute", "synthetic": true, "fields": {"Len": 14}, "text": "guard len >= 14"},
+					{"type": "LoadAbsolute", "synthetic": false, "pos": 0, "fields": {"Off": 12, "Size": 2}, "text": "ldh [12]"},
+					{"type": "JumpIf", "synthetic": false, "pos": 1, "fields": {"Cond": 0, "Val": 2048, "SkipTrue": 1, "SkipFalse": 0}, "text": "jeq #2048,1"}
+				],
+				"jumps": [2, 3]
+			},
+			{
+				"id": 2,
+				"isTarget": false,
+				"instructions": [
+					{"type": "RetConstant", "synthetic": false, "pos": 2, "fields": {"Val": 0}, "text": "ret #0"}
+				],
+				"jumps": []
+			},
+			{
+				"id": 3,
+				"isTarget": true,
+				"instructions": [
+					{"type": "RetA", "synthetic": false, "pos": 3, "fields": {}, "text": "ret a"}
+				],
+				"jumps": []
+			}
+		]
+	}`), &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(prog, expected) {
+		t.Fatalf("expected:\n%v\ngot:\n%s", expected, j)
+	}
+}
+
+func TestToJSONInvalid(t *testing.T) {
+	_, err := ToJSON([]bpf.Instruction{})
+	if err == nil {
+		t.Fatal("invalid filter accepted")
+	}
+}
@@ -0,0 +1,162 @@
+package cbpfc
+
+import (
+	"fmt"
+)
+
+// OptEvent is a change a compile pass made to a filter.
+type OptEvent struct {
+	// Pass is the name of the pass that made the change, eg "dead stores".
+	Pass string
+
+	// Blocks are the ids of the blocks changed, the position of the instruction that starts them like in Explain.
+	// Empty if the change isn't to blocks, eg removing unreachable instructions.
+	Blocks []int
+
+	// Description of the change, eg "removed 2 dead stores".
+	Description string
+}
+
+// log reports an event to c.Log, if set.
+func (c CompileOpts) log(pass string, blocks []*block, format string, args ...interface{}) {
+	if c.Log == nil {
+		return
+	}
+
+	event := OptEvent{
+		Pass:        pass,
+		Description: fmt.Sprintf(format, args...),
+	}
+
+	for _, block := range blocks {
+		event.Blocks = append(event.Blocks, int(block.id))
+	}
+
+	c.Log(event)
+}
+
+// logUnreachable logs the instructions of a filter of length insns that aren't in any of the blocks.
+func (c CompileOpts) logUnreachable(blocks []*block, insns int) {
+	if c.Log == nil {
+		return
+	}
+
+	reachable := make([]bool, insns)
+	for _, block := range blocks {
+		for _, insn := range block.insns {
+			reachable[insn.id] = true
+		}
+	}
+
+	// Runs of unreachable instructions
+	for pc := 0; pc < insns; pc++ {
+		if reachable[pc] {
+			continue
+		}
+
+		start := pc
+		for pc+1 < insns && !reachable[pc+1] {
+			pc++
+		}
+
+		if start == pc {
+			c.log("unreachable code", nil, "removed unreachable instruction %d", pc)
+		} else {
+			c.log("unreachable code", nil, "removed unreachable instructions %d to %d", start, pc)
+		}
+	}
+}
+
+// logRemovals runs a pass that removes instructions from blocks, logging how many it removed from each block.
+// what is the singular name of the instructions removed.
+func (c CompileOpts) logRemovals(pass, what string, blocks []*block, run func()) {
+	if c.Log == nil {
+		run()
+		return
+	}
+
+	before := make([]int, len(blocks))
+	for i, blk := range blocks {
+		before[i] = len(blk.insns)
+	}
+
+	run()
+
+	for i, blk := range blocks {
+		removed := before[i] - len(blk.insns)
+
+		switch {
+		case removed == 1:
+			c.log(pass, []*block{blk}, "removed 1 %s", what)
+		case removed > 1:
+			c.log(pass, []*block{blk}, "removed %d %ss", removed, what)
+		}
+	}
+}
+
+// logInsertions runs a pass that inserts synthetic instructions in blocks, logging every instruction it added.
+func (c CompileOpts) logInsertions(pass string, blocks []*block, run func() error) error {
+	if c.Log == nil {
+		return run()
+	}
+
+	before := make([]map[string]int, len(blocks))
+	for i, blk := range blocks {
+		before[i] = syntheticInsns(blk)
+	}
+
+	if err := run(); err != nil {
+		return err
+	}
+
+	for i, blk := range blocks {
+		existing := before[i]
+
+		for _, insn := range blk.insns {
+			if !isSynthetic(insn.Instruction) {
+				continue
+			}
+
+			name := fmt.Sprint(insn.Instruction)
+			if existing[name] > 0 {
+				existing[name]--
+				continue
+			}
+
+			c.log(pass, []*block{blk}, "added %s", name)
+		}
+	}
+
+	return nil
+}
+
+// syntheticInsns counts the synthetic instructions of a block, by name.
+func syntheticInsns(blk *block) map[string]int {
+	insns := make(map[string]int)
+
+	for _, insn := range blk.insns {
+		if isSynthetic(insn.Instruction) {
+			insns[fmt.Sprint(insn.Instruction)]++
+		}
+	}
+
+	return insns
+}
+
+// logOrder logs the blocks that were moved later, from their position in before to their position in after.
+func (c CompileOpts) logOrder(before, after []*block) {
+	if c.Log == nil {
+		return
+	}
+
+	index := make(map[*block]int, len(before))
+	for i, blk := range before {
+		index[blk] = i
+	}
+
+	for i, blk := range after {
+		if i > index[blk] {
+			c.log("block order", []*block{blk}, "moved block %d from position %d to %d", blk.id, index[blk], i)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package cbpfc
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+// compileLog compiles filter with opts, returning the events logged.
+func compileLog(tb testing.TB, filter []bpf.Instruction, opts CompileOpts) []OptEvent {
+	tb.Helper()
+
+	events := []OptEvent{}
+	opts.Log = func(event OptEvent) {
+		events = append(events, event)
+	}
+
+	if _, err := compile(filter, opts); err != nil {
+		tb.Fatal(err)
+	}
+
+	return events
+}
+
+// eventsOf are the events of a pass.
+func eventsOf(events []OptEvent, pass string) []OptEvent {
+	res := []OptEvent{}
+
+	for _, event := range events {
+		if event.Pass == pass {
+			res = append(res, event)
+		}
+	}
+
+	return res
+}
+
+func TestLogNoOps(t *testing.T) {
+	events := compileLog(t, []bpf.Instruction{
+		/* 0 */ bpf.LoadConstant{Dst: bpf.RegA, Val: 1},
+		/* 1 */ bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 0},
+		/* 2 */ bpf.ALUOpConstant{Op: bpf.ALUOpMul, Val: 1},
+		/* 3 */ bpf.ALUOpConstant{Op: bpf.ALUOpOr, Val: 0},
+		/* 4 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 3},
+		/* 5 */ bpf.ALUOpConstant{Op: bpf.ALUOpXor, Val: 0},
+		/* 6 */ bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xFFFFFFFF},
+		/* 7 */ bpf.RetA{},
+		/* 8 */ bpf.RetConstant{Val: 1},
+	}, CompileOpts{})
+
+	expected := []OptEvent{
+		{Pass: "no ops", Blocks: []int{0}, Description: "removed 3 no op ALU operations"},
+		{Pass: "no ops", Blocks: []int{5}, Description: "removed 2 no op ALU operations"},
+	}
+
+	if got := eventsOf(events, "no ops"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("unexpected events %v", events)
+	}
+}
+
+func TestLogNarrowLoads(t *testing.T) {
+	events := compileLog(t, narrowFilterAnd, CompileOpts{})
+
+	expected := []OptEvent{
+		{Pass: "narrow loads", Blocks: []int{0}, Description: "narrowed ld [0] to ldh [2]"},
+		{Pass: "narrow loads", Blocks: []int{3}, Description: "narrowed ldh [4] to ldb [4]"},
+	}
+
+	if got := eventsOf(events, "narrow loads"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestLogDeadTransfers(t *testing.T) {
+	events := compileLog(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.TAX{},
+		bpf.TXA{},
+		bpf.LoadConstant{Dst: bpf.RegA, Val: 2},
+		bpf.RetA{},
+	}, CompileOpts{})
+
+	expected := []OptEvent{
+		{Pass: "dead transfers", Blocks: []int{0}, Description: "removed 2 dead register transfers"},
+	}
+
+	if got := eventsOf(events, "dead transfers"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestLogSelectivity(t *testing.T) {
+	events := compileLog(t, chainFilter, CompileOpts{Selectivity: chainHints})
+
+	expected := []OptEvent{
+		{Pass: "selectivity", Blocks: []int{0, 2, 4}, Description: "reordered comparisons to test instructions [5 3 1] in order"},
+	}
+
+	if got := eventsOf(events, "selectivity"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestLog(t *testing.T) {
+	events := compileLog(t, []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 12},
+		/* 1 */ bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		/* 2 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 1},
+		/* 3 */ bpf.RetConstant{Val: 0},
+		/* 4 */ bpf.ALUOpX{Op: bpf.ALUOpDiv},
+		/* 5 */ bpf.RetA{},
+		/* 6 */ bpf.RetConstant{Val: 2},
+		/* 7 */ bpf.RetConstant{Val: 3},
+	}, CompileOpts{BlockOrder: FallthroughFirst})
+
+	expected := []OptEvent{
+		{Pass: "unreachable code", Description: "removed unreachable instructions 6 to 7"},
+		{Pass: "dead stores", Blocks: []int{0}, Description: "removed 1 dead store"},
+		{Pass: "initialize memory", Blocks: []int{4}, Description: "added init x"},
+		{Pass: "divide by zero guards", Blocks: []int{4}, Description: "added check x != 0"},
+		{Pass: "packet guards", Blocks: []int{0}, Description: "added guard len >= 14"},
+		{Pass: "block order", Blocks: []int{3}, Description: "moved block 3 from position 1 to 2"},
+	}
+
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("expected %v, got %v", expected, events)
+	}
+}
+
+// Events are only for changes
+func TestLogNoChanges(t *testing.T) {
+	events := compileLog(t, []bpf.Instruction{
+		bpf.RetConstant{Val: 1},
+	}, CompileOpts{})
+
+	if len(events) != 0 {
+		t.Fatalf("unexpected events %v", events)
+	}
+}
@@ -0,0 +1,115 @@
+package cbpfc
+
+import (
+	"golang.org/x/net/bpf"
+)
+
+// narrowLoads narrows absolute packet loads immediately masked by an and to the bytes the mask keeps,
+// if that doesn't add instructions:
+//
+//	ld [12]; and #0xffff         ->  ldh [14]
+//	ld [12]; and #0xf0           ->  ldb [15]; and #0xf0
+//	ldh [12]; and #0xff00        ->  ldb [12]; lsh #8
+//
+// The mask has to keep a single byte, or two consecutive ones.
+// Packet guards are computed per block from the loads, so a load only gets shorter at the end
+// if another absolute load of its block needs as much packet: a short packet still fails the same guard.
+//
+// narrowed, if set, is called with every load narrowed.
+func narrowLoads(blocks []*block, narrowed func(blk *block, from, to bpf.LoadAbsolute)) {
+	for _, blk := range blocks {
+		for pc := 0; pc+1 < len(blk.insns); pc++ {
+			load, ok := blk.insns[pc].Instruction.(bpf.LoadAbsolute)
+			if !ok {
+				continue
+			}
+
+			and, ok := blk.insns[pc+1].Instruction.(bpf.ALUOpConstant)
+			if !ok || and.Op != bpf.ALUOpAnd {
+				continue
+			}
+
+			narrow, mask, ok := narrowLoad(load, and.Val)
+			if !ok {
+				continue
+			}
+
+			end, _ := absoluteLoadLen(load)
+			if narrowEnd, _ := absoluteLoadLen(narrow); narrowEnd < end && blockLoadLen(blk, pc) < end {
+				continue
+			}
+
+			blk.insns[pc].Instruction = narrow
+
+			// The and is replaced, or isn't needed anymore
+			if mask == nil {
+				blk.insns = append(blk.insns[:pc+1], blk.insns[pc+2:]...)
+			} else {
+				blk.insns[pc+1].Instruction = mask
+			}
+
+			if narrowed != nil {
+				narrowed(blk, load, narrow)
+			}
+		}
+	}
+}
+
+// narrowLoad narrows load, immediately followed by an and with val, to the bytes the and keeps.
+// mask is the instruction that replaces the and, nil if it isn't needed.
+func narrowLoad(load bpf.LoadAbsolute, val uint32) (bpf.LoadAbsolute, bpf.Instruction, bool) {
+	if load.Size != 2 && load.Size != 4 {
+		return load, nil, false
+	}
+
+	// Bits the load can't set don't matter
+	if load.Size == 2 {
+		val &= 0xFFFF
+	}
+
+	// First and last bytes, in network byte order, the mask keeps
+	first, last := -1, -1
+	for b := 0; b < load.Size; b++ {
+		if byte(val>>(8*(load.Size-1-b))) == 0 {
+			continue
+		}
+
+		if first == -1 {
+			first = b
+		}
+		last = b
+	}
+
+	size := last - first + 1
+	if first == -1 || (size != 1 && size != 2) || size >= load.Size {
+		return load, nil, false
+	}
+
+	narrow := bpf.LoadAbsolute{Off: load.Off + uint32(first), Size: size}
+	shift := uint32(8 * (load.Size - 1 - last))
+	full := val == (uint32(1)<<(8*uint(size))-1)<<shift
+
+	switch {
+	case shift == 0 && full:
+		return narrow, nil, true
+	case shift == 0:
+		return narrow, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: val}, true
+	case full:
+		return narrow, bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: shift}, true
+	default:
+		return load, nil, false
+	}
+}
+
+// blockLoadLen is the length of packet the absolute packet loads of blk need, other than the one at pc.
+func blockLoadLen(blk *block, pc int) uint32 {
+	max := uint32(0)
+
+	for i, insn := range blk.insns {
+		if l, ok := absoluteLoadLen(insn.Instruction); ok && i != pc && l > max {
+			max = l
+		}
+	}
+
+	return max
+}
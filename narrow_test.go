@@ -0,0 +1,198 @@
+package cbpfc
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestNarrowLoad(t *testing.T) {
+	for _, test := range []struct {
+		load bpf.LoadAbsolute
+		val  uint32
+
+		// expected instructions, nil if not narrowed
+		expected []bpf.Instruction
+	}{
+		// Bytes at the end
+		{bpf.LoadAbsolute{Size: 4, Off: 12}, 0xFFFF, []bpf.Instruction{bpf.LoadAbsolute{Size: 2, Off: 14}}},
+		{bpf.LoadAbsolute{Size: 4, Off: 12}, 0xFF, []bpf.Instruction{bpf.LoadAbsolute{Size: 1, Off: 15}}},
+		{bpf.LoadAbsolute{Size: 2, Off: 12}, 0xFF, []bpf.Instruction{bpf.LoadAbsolute{Size: 1, Off: 13}}},
+		{bpf.LoadAbsolute{Size: 4, Off: 12}, 0xF0, []bpf.Instruction{bpf.LoadAbsolute{Size: 1, Off: 15}, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xF0}}},
+		{bpf.LoadAbsolute{Size: 4, Off: 12}, 0x1FF, []bpf.Instruction{bpf.LoadAbsolute{Size: 2, Off: 14}, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x1FF}}},
+
+		// Bytes that need shifting
+		{bpf.LoadAbsolute{Size: 4, Off: 12}, 0xFFFF0000, []bpf.Instruction{bpf.LoadAbsolute{Size: 2, Off: 12}, bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 16}}},
+		{bpf.LoadAbsolute{Size: 4, Off: 12}, 0x00FFFF00, []bpf.Instruction{bpf.LoadAbsolute{Size: 2, Off: 13}, bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 8}}},
+		{bpf.LoadAbsolute{Size: 2, Off: 12}, 0xFF00, []bpf.Instruction{bpf.LoadAbsolute{Size: 1, Off: 12}, bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 8}}},
+
+		// Bits the load can't set are ignored
+		{bpf.LoadAbsolute{Size: 2, Off: 12}, 0xFFFF00FF, []bpf.Instruction{bpf.LoadAbsolute{Size: 1, Off: 13}}},
+
+		// Shift and and
+		{bpf.LoadAbsolute{Size: 4, Off: 12}, 0xF000, nil},
+		// 3 bytes
+		{bpf.LoadAbsolute{Size: 4, Off: 12}, 0xFFFFFF, nil},
+		{bpf.LoadAbsolute{Size: 4, Off: 12}, 0xFF0000FF, nil},
+		// Every byte
+		{bpf.LoadAbsolute{Size: 2, Off: 12}, 0x0FF0, nil},
+		{bpf.LoadAbsolute{Size: 4, Off: 12}, 0x0FFFFFF0, nil},
+		// Nothing
+		{bpf.LoadAbsolute{Size: 4, Off: 12}, 0, nil},
+		{bpf.LoadAbsolute{Size: 2, Off: 12}, 0xFFFF0000, nil},
+		// Already a byte
+		{bpf.LoadAbsolute{Size: 1, Off: 12}, 0xF, nil},
+	} {
+		narrow, mask, ok := narrowLoad(test.load, test.val)
+
+		if ok != (test.expected != nil) {
+			t.Fatalf("%v; and #%#x: expected narrowed %v, got %v", test.load, test.val, test.expected != nil, ok)
+		}
+
+		if !ok {
+			continue
+		}
+
+		insns := []bpf.Instruction{narrow}
+		if mask != nil {
+			insns = append(insns, mask)
+		}
+
+		if !reflect.DeepEqual(insns, test.expected) {
+			t.Fatalf("%v; and #%#x: expected %v, got %v", test.load, test.val, test.expected, insns)
+		}
+	}
+}
+
+// narrowFilterAnd has loads masked to fewer bytes
+var narrowFilterAnd = []bpf.Instruction{
+	/* 0 */ bpf.LoadAbsolute{Size: 4, Off: 0},
+	/* 1 */ bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xFFFF},
+	/* 2 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0102, SkipFalse: 6},
+	/* 3 */ bpf.LoadAbsolute{Size: 2, Off: 4},
+	/* 4 */ bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xFF00},
+	/* 5 */ bpf.TAX{},
+	/* 6 */ bpf.LoadAbsolute{Size: 4, Off: 4},
+	/* 7 */ bpf.ALUOpX{Op: bpf.ALUOpAdd},
+	/* 8 */ bpf.RetA{},
+	/* 9 */ bpf.LoadAbsolute{Size: 4, Off: 4},
+	/* 10 */ bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xFFFF0000},
+	/* 11 */ bpf.RetA{},
+}
+
+func TestNarrowLoads(t *testing.T) {
+	blocks, err := compile(narrowFilterAnd, CompileOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insns := []bpf.Instruction{}
+	for _, blk := range blocks {
+		for _, insn := range blk.insns {
+			switch insn.Instruction.(type) {
+			case bpf.LoadAbsolute, bpf.ALUOpConstant:
+				insns = append(insns, insn.Instruction)
+			}
+		}
+	}
+
+	expected := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 2},
+		// ld [4] needs as much packet
+		bpf.LoadAbsolute{Size: 1, Off: 4},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 8},
+		bpf.LoadAbsolute{Size: 4, Off: 4},
+		// Would need less packet
+		bpf.LoadAbsolute{Size: 4, Off: 4},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xFFFF0000},
+	}
+	if !reflect.DeepEqual(insns, expected) {
+		t.Fatalf("expected %v, got %v", expected, insns)
+	}
+
+	// Packet guards are unchanged
+	if guards := absoluteGuards(blocks); !reflect.DeepEqual(guards, []uint32{4, 8, 8}) {
+		t.Fatalf("expected guards [4 8 8], got %v", guards)
+	}
+}
+
+func TestNarrowLoadsVM(t *testing.T) {
+	checkInterpreter(t, narrowFilterAnd, testOpts,
+		[]byte{},
+		[]byte{0, 0, 1},
+		[]byte{0, 0, 1, 2},
+		[]byte{0, 0, 1, 2, 3, 4, 5},
+		[]byte{0, 0, 1, 2, 3, 4, 5, 6},
+		[]byte{0, 0, 1, 3, 3, 4, 5, 6},
+		[]byte{0, 0, 1, 3, 3, 4, 5},
+		[]byte{0xFF, 0xFF, 1, 2, 0xFF, 0xFE, 0xFD, 0xFC, 0xFB},
+	)
+}
+
+func TestNarrowLoadsCBPF(t *testing.T) {
+	optimized, err := OptimizeCBPF(narrowFilterAnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if optimized[0] != (bpf.LoadAbsolute{Size: 2, Off: 2}) {
+		t.Fatalf("load not narrowed: %v", optimized)
+	}
+}
+
+// Masks keep bytes in host order with HostByteOrder, loads aren't narrowed
+func TestNarrowLoadsHostByteOrder(t *testing.T) {
+	opts := testOpts
+	opts.HostByteOrder = true
+
+	for _, test := range []struct {
+		filter []bpf.Instruction
+		// expected result for pkt, in host order
+		expected func(pkt []byte) uint64
+	}{
+		{
+			[]bpf.Instruction{bpf.LoadAbsolute{Size: 4, Off: 0}, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xFFFF}, bpf.RetA{}},
+			func(pkt []byte) uint64 { return uint64(binary.LittleEndian.Uint32(pkt) & 0xFFFF) },
+		},
+		{
+			[]bpf.Instruction{bpf.LoadAbsolute{Size: 2, Off: 0}, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xFF00}, bpf.RetA{}},
+			func(pkt []byte) uint64 { return uint64(binary.LittleEndian.Uint16(pkt) & 0xFF00) },
+		},
+	} {
+		insns, err := ToEBPF(test.filter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The interpreter's host is little endian
+		pkt := []byte{0x12, 0x34, 0x56, 0x78}
+
+		res, err := interpretEBPF(insns, opts, pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := test.expected(pkt); res != expected {
+			t.Fatalf("%v: expected %#x, got %#x", test.filter, expected, res)
+		}
+	}
+
+	c, err := ToC([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 4, Off: 12},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xFFFF},
+		bpf.RetA{},
+	}, COpts{
+		CompileOpts:  CompileOpts{HostByteOrder: true},
+		FunctionName: "filter",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "a = (*((uint32_t *) (data + 12)));"; !strings.Contains(c, expected) {
+		t.Fatalf("expected %q in:\n%s", expected, c)
+	}
+}
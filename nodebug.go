@@ -0,0 +1,7 @@
+//go:build !cbpfc_debug
+
+package cbpfc
+
+// debug enables internal consistency checks of compiled filters, that are too slow to always run.
+// Enabled by the cbpfc_debug build tag.
+const debug = false
@@ -0,0 +1,211 @@
+package cbpfc
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+
+	"github.com/newtools/ebpf"
+	"github.com/newtools/ebpf/asm"
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// Object files are always little endian (bpfel)
+var objectByteOrder = binary.LittleEndian
+
+// Sizes of the ELF64 file header and section headers
+const (
+	elfHeaderSize        = 64
+	elfSectionHeaderSize = 64
+)
+
+// progTypeSections are the ELF sections of the program types objects can be generated for,
+// along with the offsets of the packet start and end pointers in the program's context.
+var progTypeSections = map[ebpf.ProgType]struct {
+	section     string
+	packetStart int16
+	packetEnd   int16
+}{
+	// struct xdp_md
+	ebpf.XDP: {"xdp", 0, 4},
+	// struct __sk_buff
+	ebpf.SchedCLS: {"classifier", 76, 80},
+}
+
+// ObjectOpts control how a cBPF filter is converted to an eBPF object file
+type ObjectOpts struct {
+	CompileOpts
+
+	// Type of the program. ebpf.XDP or ebpf.SchedCLS.
+	// Socket filters don't support direct packet access.
+	Type ebpf.ProgType
+
+	// ProgramName is the symbol of the program, Name if not set. Must match regex:
+	//     [A-Za-z_][0-9A-Za-z_]*
+	ProgramName string
+
+	// License of the program.
+	License string
+
+	// Match is returned by the program if a packet matches the filter, NoMatch otherwise.
+	// eg XDP_DROP and XDP_PASS.
+	Match   int32
+	NoMatch int32
+}
+
+// ToObject compiles a cBPF filter to a little endian ELF object file,
+// with a single eBPF program in the section of opts.Type ("xdp" or "classifier").
+//
+// The object can be loaded by ip, tc or other eBPF loaders.
+func ToObject(filter []bpf.Instruction, opts ObjectOpts) ([]byte, error) {
+	name, err := opts.symbol(opts.ProgramName, "ProgramName")
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.License == "" {
+		return nil, errors.New("missing License")
+	}
+
+	// The program only sets up the packet pointers, nothing initializes the filter's registers or stack
+	if len(opts.InitializedRegs) != 0 || len(opts.InitializedScratch) != 0 {
+		return nil, errors.New("InitializedRegs and InitializedScratch not supported")
+	}
+
+	progType, ok := progTypeSections[opts.Type]
+	if !ok {
+		return nil, errors.Errorf("unsupported program type %v", opts.Type)
+	}
+
+	ebpfFilter, err := ToEBPF(filter, EBPFOpts{
+		CompileOpts: opts.CompileOpts,
+		PacketStart: asm.R2,
+		PacketEnd:   asm.R3,
+		Result:      asm.R4,
+		ResultLabel: "result",
+		Working:     [4]asm.Register{asm.R4, asm.R5, asm.R6, asm.R7},
+		LabelPrefix: "filter",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// R1 holds the context
+	prog := asm.Instructions{
+		asm.LoadMem(asm.R2, asm.R1, progType.packetStart, asm.Word),
+		asm.LoadMem(asm.R3, asm.R1, progType.packetEnd, asm.Word),
+	}
+
+	prog = append(prog, ebpfFilter...)
+
+	prog = append(prog,
+		asm.Mov.Imm(asm.R0, opts.NoMatch).Sym("result"),
+		asm.JEq.Imm(asm.R4, 0, "return"),
+		asm.Mov.Imm(asm.R0, opts.Match),
+		asm.Return().Sym("return"),
+	)
+
+	code := bytes.Buffer{}
+	if err := prog.Marshal(&code, objectByteOrder); err != nil {
+		return nil, errors.Wrap(err, "unable to marshal program")
+	}
+
+	return elfObject(progType.section, name, code.Bytes(), opts.License)
+}
+
+// elfObject builds an ELF object file with a single program, in section, starting at symbol name.
+func elfObject(section, name string, code []byte, license string) ([]byte, error) {
+	// Single string table for section and symbol names
+	strtab := []byte{0}
+	str := func(s string) uint32 {
+		off := len(strtab)
+		strtab = append(append(strtab, s...), 0)
+		return uint32(off)
+	}
+
+	const (
+		strtabIdx = iota + 1
+		progIdx
+		licenseIdx
+		symtabIdx
+		sectionCount
+	)
+
+	symtab := bytes.Buffer{}
+	for _, sym := range []elf.Sym64{
+		{},
+		// Like clang, program symbols have no type
+		{
+			Name:  str(name),
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_NOTYPE),
+			Shndx: progIdx,
+			Size:  uint64(len(code)),
+		},
+	} {
+		if err := binary.Write(&symtab, objectByteOrder, sym); err != nil {
+			return nil, err
+		}
+	}
+
+	headers := make([]elf.Section64, sectionCount)
+	headers[strtabIdx] = elf.Section64{Name: str(".strtab"), Type: uint32(elf.SHT_STRTAB), Addralign: 1}
+	headers[progIdx] = elf.Section64{Name: str(section), Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR), Addralign: 8}
+	headers[licenseIdx] = elf.Section64{Name: str("license"), Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_WRITE), Addralign: 1}
+	// Info is the index of the first global symbol
+	headers[symtabIdx] = elf.Section64{Name: str(".symtab"), Type: uint32(elf.SHT_SYMTAB), Link: strtabIdx, Info: 1, Addralign: 8, Entsize: elf.Sym64Size}
+
+	data := [][]byte{
+		strtabIdx:  strtab,
+		progIdx:    code,
+		licenseIdx: append([]byte(license), 0),
+		symtabIdx:  symtab.Bytes(),
+	}
+
+	obj := bytes.Buffer{}
+	// header, written last
+	obj.Write(make([]byte, elfHeaderSize))
+
+	for i := strtabIdx; i < sectionCount; i++ {
+		// Align everything to 8 bytes
+		obj.Write(make([]byte, (8-obj.Len()%8)%8))
+
+		headers[i].Off = uint64(obj.Len())
+		headers[i].Size = uint64(len(data[i]))
+		obj.Write(data[i])
+	}
+
+	obj.Write(make([]byte, (8-obj.Len()%8)%8))
+	shoff := obj.Len()
+
+	for _, header := range headers {
+		if err := binary.Write(&obj, objectByteOrder, header); err != nil {
+			return nil, err
+		}
+	}
+
+	header := elf.Header64{
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(elf.EM_BPF),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     uint64(shoff),
+		Ehsize:    elfHeaderSize,
+		Shentsize: elfSectionHeaderSize,
+		Shnum:     sectionCount,
+		Shstrndx:  strtabIdx,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	headerBuf := bytes.Buffer{}
+	if err := binary.Write(&headerBuf, objectByteOrder, header); err != nil {
+		return nil, err
+	}
+
+	out := obj.Bytes()
+	copy(out, headerBuf.Bytes())
+
+	return out, nil
+}
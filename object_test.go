@@ -0,0 +1,110 @@
+package cbpfc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/newtools/ebpf"
+	"github.com/newtools/ebpf/asm"
+	"golang.org/x/net/bpf"
+)
+
+func TestToObject(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 1},
+	}
+
+	check := func(t *testing.T, progType ebpf.ProgType, packetStart, packetEnd int16) {
+		t.Helper()
+
+		obj, err := ToObject(filter, ObjectOpts{
+			Type:        progType,
+			ProgramName: "filter_prog",
+			License:     "BSD",
+			Match:       1,
+			NoMatch:     2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(obj))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		prog := spec.Programs["filter_prog"]
+		if prog == nil {
+			t.Fatalf("missing program, got %v", spec.Programs)
+		}
+
+		if prog.Type != progType {
+			t.Fatalf("expected type %v, got %v", progType, prog.Type)
+		}
+
+		if prog.License != "BSD" {
+			t.Fatalf("expected license BSD, got %s", prog.License)
+		}
+
+		// Context is loaded from R1
+		expected := asm.Instructions{
+			asm.LoadMem(asm.R2, asm.R1, packetStart, asm.Word).Sym("filter_prog"),
+			asm.LoadMem(asm.R3, asm.R1, packetEnd, asm.Word),
+		}
+		if !reflect.DeepEqual(prog.Instructions[:2], expected) {
+			t.Fatalf("expected:\n%v\ngot:\n%v", expected, prog.Instructions[:2])
+		}
+	}
+
+	check(t, ebpf.XDP, 0, 4)
+	check(t, ebpf.SchedCLS, 76, 80)
+}
+
+func TestToObjectInvalid(t *testing.T) {
+	filter := []bpf.Instruction{bpf.RetConstant{Val: 1}}
+
+	valid := ObjectOpts{
+		Type:        ebpf.XDP,
+		ProgramName: "filter_prog",
+		License:     "BSD",
+	}
+
+	_, err := ToObject(filter, valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := valid
+	opts.Type = ebpf.SocketFilter
+	if _, err := ToObject(filter, opts); err == nil {
+		t.Fatal("socket filter accepted")
+	}
+
+	opts = valid
+	opts.ProgramName = "0prog"
+	if _, err := ToObject(filter, opts); err == nil {
+		t.Fatal("invalid program name accepted")
+	}
+
+	opts = valid
+	opts.License = ""
+	if _, err := ToObject(filter, opts); err == nil {
+		t.Fatal("missing license accepted")
+	}
+
+	opts = valid
+	opts.InitializedRegs = []bpf.Register{bpf.RegA}
+	if _, err := ToObject(filter, opts); err == nil {
+		t.Fatal("initialized registers accepted")
+	}
+
+	opts = valid
+	opts.InitializedScratch = []int{0}
+	if _, err := ToObject(filter, opts); err == nil {
+		t.Fatal("initialized scratch accepted")
+	}
+}
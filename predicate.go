@@ -0,0 +1,347 @@
+package cbpfc
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// PacketField is a field of a fixed layout header, at a constant offset in the packet.
+type PacketField struct {
+	// Offset of the field from the start of the packet
+	Offset uint32
+
+	// Size of the field in bytes: 1, 2 or 4. Fields are big endian.
+	Size int
+}
+
+// predicateOps are the comparison operators predicates support, longest first.
+var predicateOps = []struct {
+	op   string
+	cond bpf.JumpTest
+}{
+	{"==", bpf.JumpEqual},
+	{"!=", bpf.JumpNotEqual},
+	{">=", bpf.JumpGreaterOrEqual},
+	{"<=", bpf.JumpLessOrEqual},
+	{">", bpf.JumpGreaterThan},
+	{"<", bpf.JumpLessThan},
+	{"&", bpf.JumpBitsSet},
+}
+
+// PredicateFilter lowers a predicate on named packet fields to a cBPF filter,
+// that can be compiled by any of the backends.
+//
+// Predicates are comparisons of a field and a constant, combined with and / or, eg:
+//
+//	proto == 6 and (dport == 80 or dport >= 8000)
+//
+// Comparisons are ==, !=, >, >=, <, <= and & (any of the bits are set).
+// Constants are unsigned, in decimal or 0x prefixed hexadecimal.
+// and binds tighter than or, both are short circuiting.
+//
+// The filter returns math.MaxUint32 if the packet matches, 0 otherwise.
+func PredicateFilter(fields map[string]PacketField, predicate string) ([]bpf.Instruction, error) {
+	tokens, err := predicateTokens(predicate)
+	if err != nil {
+		return nil, err
+	}
+
+	p := predicateParser{tokens: tokens, fields: fields}
+
+	node, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos != len(p.tokens) {
+		return nil, errors.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+
+	l := predicateLowering{}
+	match, noMatch := l.newLabel(), l.newLabel()
+
+	l.lower(node, match, noMatch)
+
+	l.place(match)
+	l.emit(bpf.RetConstant{Val: math.MaxUint32}, -1, -1)
+	l.place(noMatch)
+	l.emit(bpf.RetConstant{Val: 0}, -1, -1)
+
+	return l.resolve()
+}
+
+// predicateTokens splits a predicate into identifiers, constants, operators and parentheses.
+func predicateTokens(predicate string) ([]string, error) {
+	tokens := []string{}
+
+	for rest := predicate; rest != ""; {
+		r := rune(rest[0])
+
+		switch {
+		case unicode.IsSpace(r):
+			rest = rest[1:]
+			continue
+
+		case r == '(' || r == ')':
+			tokens = append(tokens, rest[:1])
+			rest = rest[1:]
+			continue
+
+		// identifiers and constants
+		case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			end := strings.IndexFunc(rest, func(r rune) bool {
+				return r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+			})
+			if end == -1 {
+				end = len(rest)
+			}
+
+			tokens = append(tokens, rest[:end])
+			rest = rest[end:]
+			continue
+		}
+
+		found := false
+		for _, op := range predicateOps {
+			if strings.HasPrefix(rest, op.op) {
+				tokens = append(tokens, op.op)
+				rest = rest[len(op.op):]
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, errors.Errorf("unexpected character %q", r)
+		}
+	}
+
+	return tokens, nil
+}
+
+// predicateCompare compares a field to a constant
+type predicateCompare struct {
+	field PacketField
+	cond  bpf.JumpTest
+	val   uint32
+}
+
+// predicateBinary combines two predicates with and / or
+type predicateBinary struct {
+	and         bool
+	left, right interface{}
+}
+
+// predicateParser is a recursive descent parser of predicate tokens:
+//
+//	or      = and { "or" and }
+//	and     = compare { "and" compare }
+//	compare = field op constant | "(" or ")"
+type predicateParser struct {
+	tokens []string
+	pos    int
+	fields map[string]PacketField
+}
+
+func (p *predicateParser) next() (string, error) {
+	if p.pos == len(p.tokens) {
+		return "", errors.New("unexpected end of predicate")
+	}
+
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+// accept consumes the next token if it is token
+func (p *predicateParser) accept(token string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos] == token {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *predicateParser) or() (interface{}, error) {
+	return p.binary(false, "or", p.and)
+}
+
+func (p *predicateParser) and() (interface{}, error) {
+	return p.binary(true, "and", p.compare)
+}
+
+// binary parses operands separated by op
+func (p *predicateParser) binary(and bool, op string, operand func() (interface{}, error)) (interface{}, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(op) {
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+
+		left = predicateBinary{and: and, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *predicateParser) compare() (interface{}, error) {
+	if p.accept("(") {
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.accept(")") {
+			return nil, errors.New("missing )")
+		}
+
+		return node, nil
+	}
+
+	name, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	field, ok := p.fields[name]
+	if !ok {
+		return nil, errors.Errorf("unknown field %q", name)
+	}
+
+	if field.Size != 1 && field.Size != 2 && field.Size != 4 {
+		return nil, errors.Errorf("field %q has invalid size %d", name, field.Size)
+	}
+
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	compare := predicateCompare{field: field}
+
+	found := false
+	for _, o := range predicateOps {
+		if o.op == op {
+			compare.cond = o.cond
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return nil, errors.Errorf("unknown operator %q", op)
+	}
+
+	constant, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := strconv.ParseUint(constant, 0, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid constant %q", constant)
+	}
+
+	compare.val = uint32(val)
+
+	return compare, nil
+}
+
+// predicateInsn is a cBPF instruction with symbolic jump targets, that are resolved once all instructions are known.
+type predicateInsn struct {
+	bpf.Instruction
+	trueLabel, falseLabel int
+}
+
+// predicateLowering lowers parsed predicates to cBPF instructions
+type predicateLowering struct {
+	insns []predicateInsn
+
+	// position of each label, -1 if not placed yet
+	labels []int
+}
+
+func (l *predicateLowering) newLabel() int {
+	l.labels = append(l.labels, -1)
+	return len(l.labels) - 1
+}
+
+// place places label at the next instruction
+func (l *predicateLowering) place(label int) {
+	l.labels[label] = len(l.insns)
+}
+
+func (l *predicateLowering) emit(insn bpf.Instruction, trueLabel, falseLabel int) {
+	l.insns = append(l.insns, predicateInsn{insn, trueLabel, falseLabel})
+}
+
+// lower lowers a predicate that jumps to trueLabel if it is true, falseLabel otherwise.
+func (l *predicateLowering) lower(node interface{}, trueLabel, falseLabel int) {
+	switch n := node.(type) {
+	case predicateCompare:
+		l.emit(bpf.LoadAbsolute{Off: n.field.Offset, Size: n.field.Size}, -1, -1)
+		l.emit(bpf.JumpIf{Cond: n.cond, Val: n.val}, trueLabel, falseLabel)
+
+	// Only evaluate the right hand side if the left hand side doesn't decide the result
+	case predicateBinary:
+		right := l.newLabel()
+
+		if n.and {
+			l.lower(n.left, right, falseLabel)
+		} else {
+			l.lower(n.left, trueLabel, right)
+		}
+
+		l.place(right)
+		l.lower(n.right, trueLabel, falseLabel)
+	}
+}
+
+// resolve converts the symbolic jump targets to skips
+func (l *predicateLowering) resolve() ([]bpf.Instruction, error) {
+	insns := make([]bpf.Instruction, len(l.insns))
+
+	for i, insn := range l.insns {
+		jump, ok := insn.Instruction.(bpf.JumpIf)
+		if !ok {
+			insns[i] = insn.Instruction
+			continue
+		}
+
+		var err error
+
+		jump.SkipTrue, err = l.skip(i, insn.trueLabel)
+		if err != nil {
+			return nil, err
+		}
+
+		jump.SkipFalse, err = l.skip(i, insn.falseLabel)
+		if err != nil {
+			return nil, err
+		}
+
+		insns[i] = jump
+	}
+
+	return insns, nil
+}
+
+// skip computes the skip from instruction i to label
+func (l *predicateLowering) skip(i int, label int) (uint8, error) {
+	skip := l.labels[label] - i - 1
+	if skip > math.MaxUint8 {
+		return 0, errors.Errorf("predicate too long, jump of %d instructions", skip)
+	}
+
+	return uint8(skip), nil
+}
@@ -0,0 +1,101 @@
+package cbpfc
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+var testFields = map[string]PacketField{
+	"ethertype": {Offset: 12, Size: 2},
+	"proto":     {Offset: 23, Size: 1},
+	"dst":       {Offset: 30, Size: 4},
+}
+
+func TestPredicateAnd(t *testing.T) {
+	filter, err := PredicateFilter(testFields, "ethertype == 0x0800 and proto == 17")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipTrue: 0, SkipFalse: 3},
+		bpf.LoadAbsolute{Off: 23, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 17, SkipTrue: 0, SkipFalse: 1},
+		bpf.RetConstant{Val: math.MaxUint32},
+		bpf.RetConstant{Val: 0},
+	}
+
+	if !reflect.DeepEqual(filter, expected) {
+		t.Fatalf("expected %v, got %v", expected, filter)
+	}
+
+	packet := func(ethertype uint16, proto byte) []byte {
+		pkt := make([]byte, 24)
+		pkt[12], pkt[13] = byte(ethertype>>8), byte(ethertype)
+		pkt[23] = proto
+		return pkt
+	}
+
+	checkInterpreter(t, filter, testOpts,
+		[]byte{},
+		packet(0x0800, 17),
+		packet(0x0800, 6),
+		packet(0x86DD, 17),
+		packet(0x86DD, 6),
+		packet(0x0800, 17)[:23],
+	)
+}
+
+// and binds tighter than or
+func TestPredicatePrecedence(t *testing.T) {
+	filter, err := PredicateFilter(testFields, "proto == 6 or proto == 17 and (dst & 0xFF000000 or dst < 10)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := func(proto byte, dst uint32) []byte {
+		pkt := make([]byte, 34)
+		pkt[23] = proto
+		pkt[30], pkt[31], pkt[32], pkt[33] = byte(dst>>24), byte(dst>>16), byte(dst>>8), byte(dst)
+		return pkt
+	}
+
+	checkInterpreter(t, filter, testOpts,
+		packet(6, 0),
+		packet(17, 0),
+		packet(17, 0x01000000),
+		packet(17, 0x00FFFFFF),
+		packet(17, 9),
+		packet(1, 0x01000000),
+	)
+}
+
+func TestPredicateInvalid(t *testing.T) {
+	for _, predicate := range []string{
+		"",
+		"foo == 1",
+		"proto",
+		"proto ==",
+		"proto = 1",
+		"proto == foo",
+		"proto == 0x100000000",
+		"proto == 1 and",
+		"(proto == 1",
+		"proto == 1)",
+		"proto == 1 $",
+	} {
+		_, err := PredicateFilter(testFields, predicate)
+		if err == nil {
+			t.Fatalf("invalid predicate %q accepted", predicate)
+		}
+	}
+
+	_, err := PredicateFilter(map[string]PacketField{"foo": {Offset: 0, Size: 3}}, "foo == 1")
+	if err == nil {
+		t.Fatal("invalid field size accepted")
+	}
+}
@@ -0,0 +1,80 @@
+package cbpfc
+
+import (
+	"runtime"
+	"time"
+)
+
+// Phase is a phase of compiling a filter, independent of the backend.
+type Phase int
+
+const (
+	// PhaseValidate rewrites the instructions with CompileOpts.Rewrite, and checks the filter and options are valid.
+	PhaseValidate Phase = iota
+	// PhaseSplitBlocks normalizes the instructions, and splits them into blocks.
+	PhaseSplitBlocks
+	// PhaseInitializeMemory zero initializes the registers and scratch memory read before they're written.
+	PhaseInitializeMemory
+	// PhaseDivideByZeroGuards adds checks X isn't zero before divisions by X.
+	PhaseDivideByZeroGuards
+	// PhasePacketGuards adds guards before packet loads.
+	PhasePacketGuards
+	// PhaseBlockOrder orders the blocks according to CompileOpts.BlockOrder.
+	PhaseBlockOrder
+)
+
+var phaseNames = map[Phase]string{
+	PhaseValidate:           "validate",
+	PhaseSplitBlocks:        "split blocks",
+	PhaseInitializeMemory:   "initialize memory",
+	PhaseDivideByZeroGuards: "divide by zero guards",
+	PhasePacketGuards:       "packet guards",
+	PhaseBlockOrder:         "block order",
+}
+
+func (p Phase) String() string {
+	if name, ok := phaseNames[p]; ok {
+		return name
+	}
+
+	return "unknown phase"
+}
+
+// PhaseStats is the time and memory spent in a compile phase.
+type PhaseStats struct {
+	Phase Phase
+
+	// Duration is the wall clock time spent in the phase.
+	Duration time.Duration
+
+	// Allocs and Bytes are the number of heap allocations, and bytes allocated, during the phase.
+	// They include allocations by other goroutines.
+	Allocs uint64
+	Bytes  uint64
+}
+
+// phase runs the compile phase p, reporting its stats to c.Profile if set.
+func (c CompileOpts) phase(p Phase, run func() error) error {
+	if c.Profile == nil {
+		return run()
+	}
+
+	var before, after runtime.MemStats
+
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	err := run()
+
+	duration := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	c.Profile(PhaseStats{
+		Phase:    p,
+		Duration: duration,
+		Allocs:   after.Mallocs - before.Mallocs,
+		Bytes:    after.TotalAlloc - before.TotalAlloc,
+	})
+
+	return err
+}
@@ -0,0 +1,65 @@
+package cbpfc
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+// Check every phase is profiled exactly once, in order
+func TestProfile(t *testing.T) {
+	phases := []Phase{}
+
+	_, err := compile([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.ALUOpX{Op: bpf.ALUOpDiv},
+		bpf.RetA{},
+	}, CompileOpts{
+		Profile: func(stats PhaseStats) {
+			if stats.Duration < 0 {
+				t.Fatalf("phase %v has negative duration", stats.Phase)
+			}
+
+			phases = append(phases, stats.Phase)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Phase{
+		PhaseValidate,
+		PhaseSplitBlocks,
+		PhaseInitializeMemory,
+		PhaseDivideByZeroGuards,
+		PhasePacketGuards,
+		PhaseBlockOrder,
+	}
+
+	if !reflect.DeepEqual(phases, expected) {
+		t.Fatalf("expected phases %v, got %v", expected, phases)
+	}
+}
+
+// Check compilation stops at the phase that fails
+func TestProfileError(t *testing.T) {
+	phases := []Phase{}
+
+	_, err := compile([]bpf.Instruction{
+		bpf.RetA{},
+	}, CompileOpts{
+		StrictUninitialized: true,
+		Profile: func(stats PhaseStats) {
+			phases = append(phases, stats.Phase)
+		},
+	})
+	if err == nil {
+		t.Fatal("uninitialized read accepted")
+	}
+
+	expected := []Phase{PhaseValidate, PhaseSplitBlocks, PhaseInitializeMemory}
+	if !reflect.DeepEqual(phases, expected) {
+		t.Fatalf("expected phases %v, got %v", expected, phases)
+	}
+}
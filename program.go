@@ -0,0 +1,622 @@
+package cbpfc
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/newtools/ebpf"
+	"github.com/newtools/ebpf/asm"
+	"golang.org/x/net/bpf"
+)
+
+// Program is a cBPF filter compiled to eBPF, along with information about it.
+type Program struct {
+	// Instructions are the eBPF instructions, as returned by ToEBPF.
+	Instructions asm.Instructions
+
+	// Warnings are likely mistakes in the filter, that don't prevent it from being compiled.
+	Warnings []string
+
+	metrics       Metrics
+	insertions    []Insertion
+	requirements  Requirements
+	preconditions []Precondition
+	sourceMap     []SourceMapEntry
+
+	// Compiled blocks, the length of the filter and the options the program was compiled from, for CompileAppended.
+	// The blocks are never modified.
+	blocks []*block
+	length int
+	opts   EBPFOpts
+}
+
+// Metrics are instruction counts of a compiled Program, to budget against the verifier's limits.
+type Metrics struct {
+	// Instructions is the total number of eBPF instructions.
+	Instructions int
+
+	// Branches is the number of conditional jumps, including packet guards and division by zero checks.
+	// Each branch can double the number of paths the verifier has to explore.
+	Branches int
+
+	// PacketLoads is the number of loads from the packet: direct loads, and calls to bpf_xdp_load_bytes or bpf_skb_load_bytes.
+	// With SKBLoadBytes, loads that can be direct are counted twice, once for each way they can load.
+	PacketLoads int
+
+	// HelperCalls is the number of calls to eBPF helpers, made by Trace, ScratchMaps, XDPLoadBytes, SKB,
+	// and the Prologue and Epilogue. Packet loads that call a helper are counted in PacketLoads too.
+	HelperCalls int
+
+	// States estimates the worst case number of states the verifier explores:
+	// the number of paths through the filter, including the paths that fail a guard or check.
+	// Branches that join again, like a chain of if / else, multiply the number of paths.
+	// It saturates at math.MaxUint64.
+	States uint64
+}
+
+// CompileEBPF compiles a cBPF filter to eBPF like ToEBPF, returning a Program.
+func CompileEBPF(filter []bpf.Instruction, opts EBPFOpts) (*Program, error) {
+	return NewCompiler().Compile(filter, opts)
+}
+
+// Compiler compiles cBPF filters to eBPF, reusing internal buffers across compilations.
+// Compiling many filters with a single Compiler reduces allocations.
+//
+// A Compiler is not safe for concurrent use, but Programs it returns are independent of it.
+type Compiler struct {
+	bufs buffers
+}
+
+// NewCompiler creates a Compiler.
+func NewCompiler() *Compiler {
+	return &Compiler{}
+}
+
+// Compile compiles a cBPF filter to eBPF like CompileEBPF.
+func (c *Compiler) Compile(filter []bpf.Instruction, opts EBPFOpts) (*Program, error) {
+	prog, err := toEBPF(&c.bufs, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return newProgram(prog, len(filter), opts)
+}
+
+// CompileAppended compiles the filter of prog extended with next, with the options prog was compiled with.
+// Returns of the filter of prog of a non 0 constant, that accept packets, jump to next instead:
+// next is a further predicate packets have to match, and what it returns is the result of the extended filter.
+// Returns of A are unchanged.
+//
+// Only next is compiled: the blocks of prog are reused as they are, with their guards and initialization.
+// next is compiled on its own, so it's guarded, zero initialized and limited (eg by MaxBlocks) like a filter on its own,
+// even memory the caller initializes (InitializedRegs, InitializedScratch and PreserveX) is zeroed if next reads it before writing to it.
+// Only scratch backed by ScratchMaps is shared with the filter of prog.
+// Rewrite is called with the positions of instructions in next, and Comments only apply to the filter of prog.
+// Positions in the Program returned, like its SourceMap, are positions in the filter of prog followed by next.
+//
+// Only the eBPF code is generated again for the whole filter. prog is not modified.
+func (c *Compiler) CompileAppended(prog *Program, next []bpf.Instruction) (*Program, error) {
+	opts, err := compileOptsEBPF(prog.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The filter of prog can change memory the caller initializes, only scratch backed by maps is shared
+	nextOpts := opts.CompileOpts
+	nextOpts.InitializedRegs = nil
+	nextOpts.InitializedScratch = opts.liveScratch
+	nextOpts.Comments = nil
+
+	nextBlocks, err := c.bufs.compile(next, nextOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := appendBlocks(prog.blocks, nextBlocks, pos(prog.length))
+	if opts.BlockOrder == FallthroughFirst {
+		blocks = orderFallthroughFirst(blocks)
+	}
+
+	appended, err := blocksToEBPF(blocks, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return newProgram(appended, prog.length+len(next), prog.opts)
+}
+
+// appendBlocks returns copies of blocks, followed by next: returns of blocks of a non 0 constant jump to the first block of next instead.
+// next are the blocks of a filter laid out at offset, their positions are moved there.
+// next is left out if no block jumps to it.
+func appendBlocks(blocks, next []*block, offset pos) []*block {
+	for _, blk := range next {
+		blk.id += offset
+		for i := range blk.insns {
+			blk.insns[i].id += offset
+		}
+
+		jumps := make(map[pos]*block, len(blk.jumps))
+		for id, target := range blk.jumps {
+			jumps[id+offset] = target
+		}
+		blk.jumps = jumps
+	}
+
+	entry := next[0]
+
+	copies := make(map[*block]*block, len(blocks))
+	for _, blk := range blocks {
+		copies[blk] = &block{
+			insns:    append([]instruction(nil), blk.insns...),
+			id:       blk.id,
+			IsTarget: blk.IsTarget,
+		}
+	}
+
+	reached := false
+	res := make([]*block, 0, len(blocks)+len(next))
+	for _, blk := range blocks {
+		cp := copies[blk]
+
+		cp.jumps = make(map[pos]*block, len(blk.jumps))
+		for id, target := range blk.jumps {
+			cp.jumps[id] = copies[target]
+		}
+
+		if ret, ok := cp.last().Instruction.(bpf.RetConstant); ok && ret.Val != 0 {
+			last := &cp.insns[len(cp.insns)-1]
+			last.Instruction = bpf.Jump{Skip: uint32(entry.id - last.id - 1)}
+			cp.jumps[entry.id] = entry
+			entry.IsTarget = true
+			reached = true
+		}
+
+		res = append(res, cp)
+	}
+
+	// Unreachable code is rejected by the verifier
+	if !reached {
+		return res
+	}
+
+	return append(res, next...)
+}
+
+// newProgram returns the Program of a compiled filter of length instructions, compiled with opts.
+func newProgram(prog ebpfProgram, length int, opts EBPFOpts) (*Program, error) {
+	metrics := ebpfMetrics(prog.insns, prog.opts)
+	metrics.States = paths(prog.blocks, prog.opts.checkedLoads)
+
+	initialized, err := prog.opts.initialized()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Program{
+		Instructions:  prog.insns,
+		Warnings:      warnings(prog.blocks, prog.opts.GuardFailureValue),
+		metrics:       metrics,
+		insertions:    insertions(prog.blocks),
+		requirements:  ebpfRequirements(prog.insns, prog.opts),
+		preconditions: preconditions(prog.blocks, initialized),
+		sourceMap:     sourceMap(prog.sources),
+		blocks:        prog.blocks,
+		length:        length,
+		opts:          opts,
+	}, nil
+}
+
+// Metrics returns the instruction counts of the program.
+func (p *Program) Metrics() Metrics {
+	return p.metrics
+}
+
+// Requirements returns what the program needs to be loaded.
+func (p *Program) Requirements() Requirements {
+	return p.requirements
+}
+
+// Insertions returns the instructions cbpfc inserted in the filter, in the order they are laid out.
+func (p *Program) Insertions() []Insertion {
+	return p.insertions
+}
+
+// Preconditions returns what holds at the start of every block of the filter, in the order they are laid out.
+func (p *Program) Preconditions() []Precondition {
+	return p.preconditions
+}
+
+// SourceMap returns the position in the filter every instruction of the program was compiled from, in order.
+// Only eBPF programs have a source map: the C, Rust and WebAssembly backends return text,
+// that can be annotated with CompileOpts.Comments instead.
+func (p *Program) SourceMap() []SourceMapEntry {
+	return p.sourceMap
+}
+
+// NoSourcePC is the SourcePC of instructions that aren't compiled from an instruction of the filter,
+// like the instructions cbpfc inserts (including Trace, Assertions and MatchOffset), jumps between blocks,
+// and the Prologue and Epilogue.
+const NoSourcePC = -1
+
+// SourceMapEntry maps an eBPF instruction to the cBPF instruction it was compiled from.
+type SourceMapEntry struct {
+	// OutputIndex is the index of the eBPF instruction in Program.Instructions.
+	// 64 bit immediate loads are a single instruction, even though they take two slots when encoded.
+	OutputIndex int
+
+	// SourcePC is the position in the filter of the cBPF instruction, NoSourcePC if there isn't one.
+	SourcePC int
+}
+
+// sourceMap maps eBPF instructions to the position of the cBPF instructions they were compiled from.
+func sourceMap(sources []instruction) []SourceMapEntry {
+	res := make([]SourceMapEntry, len(sources))
+
+	for i, source := range sources {
+		res[i] = SourceMapEntry{OutputIndex: i, SourcePC: NoSourcePC}
+
+		if source.Instruction != nil && !isSynthetic(source.Instruction) {
+			res[i].SourcePC = int(source.id)
+		}
+	}
+
+	return res
+}
+
+// InsertionKind is the kind of instruction cbpfc inserts.
+type InsertionKind int
+
+const (
+	// InsertionPacketGuard checks the packet is long enough for loads at constant offsets.
+	InsertionPacketGuard InsertionKind = iota
+	// InsertionIndirectPacketGuard checks the packet is long enough for loads relative to X.
+	InsertionIndirectPacketGuard
+	// InsertionDivideByZeroCheck fails the filter if X is 0, before a division by X.
+	InsertionDivideByZeroCheck
+	// InsertionInitializeRegister zeroes a register that is read before being set.
+	InsertionInitializeRegister
+	// InsertionInitializeScratch zeroes a scratch slot that is read before being set.
+	InsertionInitializeScratch
+	// InsertionMetadataGuard checks the metadata buffer is long enough for loads from it.
+	InsertionMetadataGuard
+)
+
+func (k InsertionKind) String() string {
+	switch k {
+	case InsertionPacketGuard:
+		return "packet guard"
+	case InsertionIndirectPacketGuard:
+		return "indirect packet guard"
+	case InsertionDivideByZeroCheck:
+		return "divide by zero check"
+	case InsertionInitializeRegister:
+		return "initialize register"
+	case InsertionInitializeScratch:
+		return "initialize scratch"
+	case InsertionMetadataGuard:
+		return "metadata guard"
+	default:
+		return fmt.Sprintf("InsertionKind(%d)", int(k))
+	}
+}
+
+// Insertion is an instruction cbpfc inserted in a filter to make it safe.
+type Insertion struct {
+	Kind InsertionKind
+
+	// Instruction is the inserted instruction, eg "guard len >= 14".
+	Instruction string
+
+	// Reason the instruction was inserted.
+	Reason string
+
+	// Block is the label of the block the instruction was inserted in.
+	Block string
+
+	// PC is the position in the filter of the instruction the insertion is before.
+	// For divide by zero checks, this is the division.
+	PC int
+}
+
+// insertions lists the synthetic instructions of blocks.
+func insertions(blocks []*block) []Insertion {
+	var res []Insertion
+
+	for _, block := range blocks {
+		for i, insn := range block.insns {
+			if !isSynthetic(insn.Instruction) {
+				continue
+			}
+
+			ins := Insertion{
+				Instruction: fmt.Sprint(insn.Instruction),
+				Block:       block.Label(),
+			}
+
+			// Blocks end with a jump or return, there's always a filter instruction after a synthetic one
+			for _, next := range block.insns[i:] {
+				if !isSynthetic(next.Instruction) {
+					ins.PC = int(next.id)
+					break
+				}
+			}
+
+			switch s := insn.Instruction.(type) {
+			case packetGuardAbsolute:
+				ins.Kind = InsertionPacketGuard
+				ins.Reason = fmt.Sprintf("packet loads need %d bytes", s.Len)
+			case packetGuardIndirect:
+				ins.Kind = InsertionIndirectPacketGuard
+				ins.Reason = fmt.Sprintf("packet loads need x + %d bytes", s.Len)
+			case metadataGuard:
+				ins.Kind = InsertionMetadataGuard
+				ins.Reason = fmt.Sprintf("metadata loads need %d bytes", s.Len)
+			case checkXNotZero:
+				ins.Kind = InsertionDivideByZeroCheck
+				ins.Reason = fmt.Sprintf("instruction %d divides by x", ins.PC)
+			case initializeRegister:
+				ins.Kind = InsertionInitializeRegister
+				ins.Reason = fmt.Sprintf("%s can be read before being set", regName(s.Reg))
+			case initializeScratch:
+				ins.Kind = InsertionInitializeScratch
+				ins.Reason = fmt.Sprintf("M[%d] can be read before being set", s.N)
+			}
+
+			res = append(res, ins)
+		}
+	}
+
+	return res
+}
+
+// Precondition is what holds at the start of a block, on every path to it,
+// so callers can assert against the guards and initialization cbpfc inserts.
+type Precondition struct {
+	// Block is the label of the block.
+	Block string
+
+	// PacketLen is the length the packet is known to be at least, checked by the packet guards before the block.
+	// Like the Len of guards, it doesn't include the Trailer.
+	PacketLen uint32
+
+	// InitializedRegs and InitializedScratch are the registers and scratch positions set on every path to the block,
+	// by the filter, by inserted initializations, or by the caller (CompileOpts.InitializedRegs and InitializedScratch).
+	InitializedRegs    []bpf.Register
+	InitializedScratch []int
+}
+
+// preconditions computes the precondition of every block, from the least state of its predecessors.
+// initialized is the memory initialized before the filter runs.
+// The blocks must be topologically sorted.
+func preconditions(blocks []*block, initialized memStatus) []Precondition {
+	type state struct {
+		packetLen uint32
+		mem       memStatus
+	}
+
+	entry := make(map[*block]state, len(blocks))
+	if len(blocks) != 0 {
+		entry[blocks[0]] = state{mem: initialized}
+	}
+
+	res := make([]Precondition, 0, len(blocks))
+
+	for _, block := range blocks {
+		in := entry[block]
+
+		pre := Precondition{
+			Block:     block.Label(),
+			PacketLen: in.packetLen,
+		}
+		for reg, ok := range in.mem.regs {
+			if ok {
+				pre.InitializedRegs = append(pre.InitializedRegs, bpf.Register(reg))
+			}
+		}
+		for n, ok := range in.mem.scratch {
+			if ok {
+				pre.InitializedScratch = append(pre.InitializedScratch, n)
+			}
+		}
+		res = append(res, pre)
+
+		out := in
+		for _, insn := range block.insns {
+			if guard, ok := insn.Instruction.(packetGuardAbsolute); ok && guard.Len > out.packetLen {
+				out.packetLen = guard.Len
+			}
+
+			out.mem = out.mem.or(memWrites(insn.Instruction))
+		}
+
+		for _, target := range block.jumps {
+			least, ok := entry[target]
+			if !ok {
+				entry[target] = out
+				continue
+			}
+
+			if out.packetLen < least.packetLen {
+				least.packetLen = out.packetLen
+			}
+			least.mem = least.mem.and(out.mem)
+
+			entry[target] = least
+		}
+	}
+
+	return res
+}
+
+// Requirements are what a Program needs to be loaded, to pick where to attach it and check the kernel supports it.
+type Requirements struct {
+	// ProgramTypes are the eBPF program types the Program can be used in, in ascending order.
+	// Packets are accessed directly, so only types with direct packet access are compatible, not SocketFilter.
+	// With XDPLoadBytes, only XDP. With an SKB mode other than SKBLinear, only SchedCLS and SchedACT.
+	ProgramTypes []ebpf.ProgType
+
+	// Helpers are the eBPF helpers the Program calls, in ascending order.
+	// Calls made by the Prologue and Epilogue are included.
+	Helpers []asm.BuiltinFunc
+}
+
+// ebpfRequirements lists the requirements of eBPF generated with opts.
+func ebpfRequirements(insns asm.Instructions, opts ebpfOpts) Requirements {
+	reqs := Requirements{
+		ProgramTypes: []ebpf.ProgType{ebpf.SchedCLS, ebpf.SchedACT, ebpf.XDP},
+		Helpers:      []asm.BuiltinFunc{},
+	}
+
+	if opts.XDPLoadBytes {
+		reqs.ProgramTypes = []ebpf.ProgType{ebpf.XDP}
+	}
+
+	if opts.SKB != SKBLinear {
+		reqs.ProgramTypes = []ebpf.ProgType{ebpf.SchedCLS, ebpf.SchedACT}
+	}
+
+	seen := make(map[asm.BuiltinFunc]bool)
+	for _, insn := range insns {
+		if insn.OpCode.Class() != asm.JumpClass || insn.OpCode.JumpOp() != asm.Call {
+			continue
+		}
+
+		fn := asm.BuiltinFunc(insn.Constant)
+		if !seen[fn] {
+			seen[fn] = true
+			reqs.Helpers = append(reqs.Helpers, fn)
+		}
+	}
+
+	sort.Slice(reqs.Helpers, func(i, j int) bool {
+		return reqs.Helpers[i] < reqs.Helpers[j]
+	})
+
+	return reqs
+}
+
+// ebpfMetrics counts the instructions of eBPF generated with opts.
+func ebpfMetrics(insns asm.Instructions, opts ebpfOpts) Metrics {
+	metrics := Metrics{
+		Instructions: len(insns),
+	}
+
+	// Packet loads are from PacketStart, or the indirect register
+	packetRegs := map[asm.Register]bool{
+		opts.PacketStart: true,
+		opts.regIndirect: true,
+	}
+
+	for _, insn := range insns {
+		switch insn.OpCode.Class() {
+		case asm.JumpClass:
+			switch insn.OpCode.JumpOp() {
+			case asm.Ja, asm.Exit:
+			case asm.Call:
+				metrics.HelperCalls++
+
+				// Loads with XDPLoadBytes and SKBLoadBytes
+				if fn := asm.BuiltinFunc(insn.Constant); fn == xdpLoadBytes || fn == skbLoadBytes {
+					metrics.PacketLoads++
+				}
+			default:
+				metrics.Branches++
+			}
+
+		case asm.LdXClass:
+			if packetRegs[insn.Src] {
+				metrics.PacketLoads++
+			}
+		}
+	}
+
+	return metrics
+}
+
+// paths counts the paths from the first block to a return or a failed runtime check.
+// With checkedLoads, packet loads check themselves and can fail like guards.
+func paths(blocks []*block, checkedLoads bool) uint64 {
+	counts := make(map[*block]uint64, len(blocks))
+
+	// Blocks only jump forwards, the targets of a block are always visited before it
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+
+		var count uint64
+		for _, insn := range block.insns {
+			switch insn.Instruction.(type) {
+			case packetGuardAbsolute, packetGuardIndirect, metadataGuard, checkXNotZero:
+				count++
+			case bpf.LoadAbsolute, bpf.LoadIndirect, bpf.LoadMemShift:
+				if checkedLoads {
+					count++
+				}
+			}
+		}
+
+		if len(block.jumps) == 0 {
+			count++
+		}
+
+		for _, target := range block.jumps {
+			count = saturatingAdd(count, counts[target])
+		}
+
+		counts[block] = count
+	}
+
+	if len(blocks) == 0 {
+		return 0
+	}
+
+	return counts[blocks[0]]
+}
+
+func saturatingAdd(a, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+
+	return a + b
+}
+
+// warnings checks for filters that never or always match.
+// Only reachable blocks are compiled, so only reachable returns are considered.
+// Failed packet guards return guardFailure.
+func warnings(blocks []*block, guardFailure uint32) []string {
+	var match, noMatch, unknown bool
+
+	for _, block := range blocks {
+		for _, insn := range block.insns {
+			switch i := insn.Instruction.(type) {
+			case bpf.RetConstant:
+				if i.Val == 0 {
+					noMatch = true
+				} else {
+					match = true
+				}
+			case bpf.RetA:
+				unknown = true
+			// Fail (return no match) at runtime
+			case checkXNotZero:
+				noMatch = true
+			case packetGuardAbsolute, packetGuardIndirect, metadataGuard:
+				if guardFailure == 0 {
+					noMatch = true
+				} else {
+					match = true
+				}
+			}
+		}
+	}
+
+	switch {
+	case !match && !unknown:
+		return []string{"filter never matches"}
+	case !noMatch && !unknown:
+		return []string{"filter always matches"}
+	}
+
+	return nil
+}
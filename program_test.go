@@ -0,0 +1,781 @@
+package cbpfc
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/newtools/ebpf"
+	"github.com/newtools/ebpf/asm"
+	"golang.org/x/net/bpf"
+)
+
+func mustCompileEBPF(tb testing.TB, filter []bpf.Instruction, opts EBPFOpts) *Program {
+	tb.Helper()
+
+	prog, err := CompileEBPF(filter, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return prog
+}
+
+func TestMetrics(t *testing.T) {
+	prog := mustCompileEBPF(t, []bpf.Instruction{
+		bpf.RetConstant{Val: 1},
+	}, testOpts)
+
+	expected := Metrics{
+		Instructions: 2,
+		States:       1,
+	}
+	if prog.Metrics() != expected {
+		t.Fatalf("expected %+v, got %+v", expected, prog.Metrics())
+	}
+}
+
+// Guards are branches
+func TestMetricsGuard(t *testing.T) {
+	prog := mustCompileEBPF(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.RetA{},
+	}, testOpts)
+
+	// guard: 3, load: 1, ret: 2, nomatch: 2
+	expected := Metrics{
+		Instructions: 8,
+		Branches:     1,
+		PacketLoads:  1,
+		States:       2,
+	}
+	if prog.Metrics() != expected {
+		t.Fatalf("expected %+v, got %+v", expected, prog.Metrics())
+	}
+}
+
+func TestMetricsIndirect(t *testing.T) {
+	prog := mustCompileEBPF(t, []bpf.Instruction{
+		bpf.LoadMemShift{Off: 0},
+		bpf.LoadIndirect{Size: 2, Off: 0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 1},
+	}, testOpts)
+
+	metrics := prog.Metrics()
+
+	if metrics.Instructions != len(prog.Instructions) {
+		t.Fatalf("expected %d instructions, got %d", len(prog.Instructions), metrics.Instructions)
+	}
+
+	// absolute guard, indirect guard bound on x and packet end, JumpIf
+	if metrics.Branches != 4 {
+		t.Fatalf("expected 4 branches, got %d", metrics.Branches)
+	}
+
+	if metrics.PacketLoads != 2 {
+		t.Fatalf("expected 2 packet loads, got %d", metrics.PacketLoads)
+	}
+}
+
+// Loads that call a helper are packet loads
+func TestMetricsHelperLoads(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 14},
+		bpf.RetA{},
+	}
+
+	xdp := testOpts
+	xdp.XDPLoadBytes = true
+	xdp.XDPContext = asm.R8
+
+	for _, test := range []struct {
+		name    string
+		opts    EBPFOpts
+		loads   int
+		helpers int
+	}{
+		{"xdp", xdp, 1, 1},
+		// direct load, and bpf_skb_load_bytes if it isn't linear
+		{"skb", skbOpts(SKBLoadBytes), 2, 1},
+	} {
+		metrics := mustCompileEBPF(t, filter, test.opts).Metrics()
+
+		if metrics.PacketLoads != test.loads {
+			t.Fatalf("%s: expected %d packet loads, got %d", test.name, test.loads, metrics.PacketLoads)
+		}
+
+		if metrics.HelperCalls != test.helpers {
+			t.Fatalf("%s: expected %d helper calls, got %d", test.name, test.helpers, metrics.HelperCalls)
+		}
+	}
+}
+
+// Branches that join again multiply the paths the verifier explores, branches that return don't
+func TestMetricsStates(t *testing.T) {
+	const stages = 10
+
+	check := func(t *testing.T, name string, filter []bpf.Instruction, expected uint64) {
+		t.Helper()
+
+		if states := mustCompileEBPF(t, filter, testOpts).Metrics().States; states != expected {
+			t.Fatalf("%s: expected %d states, got %d", name, expected, states)
+		}
+	}
+
+	// Each stage optionally sets X, then joins the next stage
+	joined := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+	}
+	for i := 0; i < stages; i++ {
+		joined = append(joined,
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(i), SkipFalse: 1},
+			bpf.LoadConstant{Dst: bpf.RegX, Val: uint32(i)},
+		)
+	}
+	joined = append(joined, bpf.RetA{})
+
+	// guard, and every combination of stages
+	check(t, "joined", joined, 1+1<<stages)
+
+	// Each stage returns, or continues to the next stage
+	chain := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+	}
+	for i := 0; i < stages; i++ {
+		chain = append(chain, bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(i), SkipTrue: uint8(stages - i)})
+	}
+	chain = append(chain, bpf.RetConstant{Val: 0}, bpf.RetA{})
+
+	// guard, every stage returning, and the last stage not returning
+	check(t, "chain", chain, 1+stages+1)
+}
+
+func TestMetricsStatesSaturate(t *testing.T) {
+	joined := []bpf.Instruction{}
+	for i := 0; i < 70; i++ {
+		joined = append(joined,
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(i), SkipFalse: 1},
+			bpf.LoadConstant{Dst: bpf.RegX, Val: uint32(i)},
+		)
+	}
+	joined = append(joined, bpf.RetA{})
+
+	if states := mustCompileEBPF(t, joined, testOpts).Metrics().States; states != math.MaxUint64 {
+		t.Fatalf("expected %d states, got %d", uint64(math.MaxUint64), states)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	check := func(t *testing.T, filter []bpf.Instruction, expected []string) {
+		t.Helper()
+
+		prog := mustCompileEBPF(t, filter, testOpts)
+
+		if !reflect.DeepEqual(prog.Warnings, expected) {
+			t.Fatalf("expected warnings %q, got %q", expected, prog.Warnings)
+		}
+	}
+
+	// always reject
+	check(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 0},
+	}, []string{"filter never matches"})
+
+	// unreachable match
+	check(t, []bpf.Instruction{
+		bpf.Jump{Skip: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	}, []string{"filter never matches"})
+
+	// always accept
+	check(t, []bpf.Instruction{
+		bpf.LoadConstant{Dst: bpf.RegA, Val: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0xFFFF},
+	}, []string{"filter always matches"})
+
+	// packet guard can fail
+	check(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.RetConstant{Val: 1},
+	}, nil)
+
+	check(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.RetA{},
+	}, nil)
+
+	// packet guard can fail, but doesn't return no match
+	opts := testOpts
+	opts.GuardFailureValue = 2
+
+	prog := mustCompileEBPF(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.RetConstant{Val: 1},
+	}, opts)
+	if expected := []string{"filter always matches"}; !reflect.DeepEqual(prog.Warnings, expected) {
+		t.Fatalf("expected warnings %q, got %q", expected, prog.Warnings)
+	}
+}
+
+// Filters compiled by a Compiler are independent of each other
+func TestCompilerReuse(t *testing.T) {
+	filters := [][]bpf.Instruction{
+		{
+			bpf.LoadAbsolute{Size: 2, Off: 12},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 1},
+			bpf.RetConstant{Val: 0},
+			bpf.LoadMemShift{Off: 14},
+			bpf.LoadIndirect{Size: 1, Off: 23},
+			bpf.RetA{},
+		},
+		{
+			bpf.RetConstant{Val: 1},
+		},
+		// invalid, fails after splitBlocks has started
+		{
+			bpf.LoadAbsolute{Size: 1, Off: 0},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+			bpf.LoadAbsolute{Size: 1, Off: 1},
+		},
+		{
+			bpf.LoadAbsolute{Size: 1, Off: 0},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+			bpf.RetConstant{Val: 0},
+			bpf.RetConstant{Val: 1},
+		},
+	}
+
+	compiler := NewCompiler()
+
+	for i := 0; i < 2; i++ {
+		for _, filter := range filters {
+			expected, expectedErr := ToEBPF(filter, testOpts)
+
+			prog, err := compiler.Compile(filter, testOpts)
+			if (err == nil) != (expectedErr == nil) {
+				t.Fatalf("expected error %v, got %v", expectedErr, err)
+			}
+
+			if err != nil {
+				continue
+			}
+
+			if !reflect.DeepEqual(prog.Instructions, expected) {
+				t.Fatalf("expected:\n%v\ngot:\n%v", expected, prog.Instructions)
+			}
+		}
+	}
+}
+
+// appendFilter replaces the returns of filter of a non 0 constant with jumps to next, laid out after it.
+func appendFilter(filter, next []bpf.Instruction) []bpf.Instruction {
+	res := make([]bpf.Instruction, 0, len(filter)+len(next))
+
+	for pc, insn := range filter {
+		if ret, ok := insn.(bpf.RetConstant); ok && ret.Val != 0 {
+			insn = bpf.Jump{Skip: uint32(len(filter) - pc - 1)}
+		}
+
+		res = append(res, insn)
+	}
+
+	return append(res, next...)
+}
+
+// checkSameResults checks two programs return the same results for every packet.
+func checkSameResults(tb testing.TB, expected, got *Program, opts EBPFOpts, packets ...[]byte) {
+	tb.Helper()
+
+	for _, pkt := range packets {
+		want, err := interpretEBPF(expected.Instructions, opts, pkt)
+		if err != nil {
+			tb.Fatalf("packet %x: %v\n%v", pkt, err, expected.Instructions)
+		}
+
+		res, err := interpretEBPF(got.Instructions, opts, pkt)
+		if err != nil {
+			tb.Fatalf("packet %x: %v\n%v", pkt, err, got.Instructions)
+		}
+
+		if res != want {
+			tb.Fatalf("packet %x: expected %d, got %d\n%v", pkt, want, res, got.Instructions)
+		}
+	}
+}
+
+func TestCompileAppended(t *testing.T) {
+	ipv4 := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 1},
+		bpf.RetConstant{Val: math.MaxUint32},
+		bpf.RetConstant{Val: 0},
+	}
+
+	tcp := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 23},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	}
+
+	port := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 36},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.LoadAbsolute{Size: 1, Off: 14},
+		bpf.RetA{},
+	}
+
+	packets := [][]byte{
+		{},
+		make([]byte, 38),
+		{12: 0x08, 13: 0x00, 23: 6, 37: 0},
+		{12: 0x08, 13: 0x00, 14: 0x45, 23: 6, 37: 80},
+		{12: 0x08, 13: 0x00, 14: 0x45, 23: 17, 37: 80},
+		{12: 0x08, 13: 0x00, 14: 0x45, 23: 6},
+	}
+
+	// guards counts the packet guards cbpfc inserted in prog
+	guards := func(prog *Program) int {
+		n := 0
+		for _, ins := range prog.Insertions() {
+			if ins.Kind == InsertionPacketGuard {
+				n++
+			}
+		}
+		return n
+	}
+
+	fallthroughFirst := testOpts
+	fallthroughFirst.BlockOrder = FallthroughFirst
+
+	hoist := testOpts
+	hoist.HoistGuards = true
+
+	for _, opts := range []EBPFOpts{testOpts, fallthroughFirst, hoist} {
+		compiler := NewCompiler()
+
+		prog, err := compiler.Compile(ipv4, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		original := prog.Instructions
+
+		for _, next := range [][]bpf.Instruction{tcp, port} {
+			appended, err := compiler.CompileAppended(prog, next)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkSameResults(t, mustCompileEBPF(t, appendFilter(ipv4, next), opts), appended, opts, packets...)
+
+			// The guards of ipv4 are reused, next is guarded on its own
+			if g := guards(appended); g != guards(prog)+guards(mustCompileEBPF(t, next, opts)) {
+				t.Fatalf("unexpected %d guards\n%v", g, appended.Instructions)
+			}
+
+			// Positions of next follow ipv4
+			pcs := map[int]bool{}
+			for _, entry := range appended.SourceMap() {
+				pcs[entry.SourcePC] = true
+			}
+			if !pcs[len(ipv4)] || pcs[len(ipv4)+len(next)] {
+				t.Fatalf("wrong positions %v", pcs)
+			}
+		}
+
+		// Appending doesn't change the program appended to
+		if !reflect.DeepEqual(prog.Instructions, original) {
+			t.Fatalf("program appended to changed:\n%v", prog.Instructions)
+		}
+
+		// Appended programs can be appended to
+		appended, err := compiler.CompileAppended(prog, tcp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		twice, err := compiler.CompileAppended(appended, port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkSameResults(t, mustCompileEBPF(t, appendFilter(appendFilter(ipv4, tcp), port), opts), twice, opts, packets...)
+	}
+}
+
+// next runs with zeroed memory, not the memory the filter appended to left
+func TestCompileAppendedInitialized(t *testing.T) {
+	// Sets A, X and M[1] from the IP header length, and accepts everything
+	ihl := []bpf.Instruction{
+		bpf.LoadMemShift{Off: 14},
+		bpf.TXA{},
+		bpf.StoreScratch{Src: bpf.RegA, N: 1},
+		bpf.RetConstant{Val: 1},
+	}
+
+	next := []bpf.Instruction{
+		bpf.LoadIndirect{Size: 1, Off: 0},
+		bpf.TAX{},
+		bpf.LoadScratch{Dst: bpf.RegA, N: 1},
+		bpf.ALUOpX{Op: bpf.ALUOpAdd},
+		bpf.RetA{},
+	}
+
+	pkt := []byte{0: 3, 14: 0x45, 20: 9}
+
+	for _, test := range []struct {
+		name     string
+		opts     func(*EBPFOpts)
+		expected uint64
+	}{
+		// x and M[1] are 0, like next on its own
+		{"zeroed", func(*EBPFOpts) {}, 3},
+		{"initialized", func(opts *EBPFOpts) {
+			opts.InitializedRegs = []bpf.Register{bpf.RegX}
+			opts.InitializedScratch = []int{1}
+		}, 3},
+		// M[1] is 20, set by ihl
+		{"map", func(opts *EBPFOpts) { opts.ScratchMaps = map[int]string{1: "ihl"} }, 23},
+	} {
+		opts := testOpts
+		test.opts(&opts)
+
+		compiler := NewCompiler()
+
+		prog, err := compiler.Compile(ihl, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		appended, err := compiler.CompileAppended(prog, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := interpretEBPF(appended.Instructions, opts, pkt)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if res != test.expected {
+			t.Fatalf("%s: expected %d, got %d\n%v", test.name, test.expected, res, appended.Instructions)
+		}
+	}
+}
+
+// next isn't included if it can't be reached
+func TestCompileAppendedUnreachable(t *testing.T) {
+	compiler := NewCompiler()
+
+	prog, err := compiler.Compile([]bpf.Instruction{bpf.RetConstant{Val: 0}}, testOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appended, err := compiler.CompileAppended(prog, []bpf.Instruction{bpf.RetConstant{Val: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(appended.Instructions, prog.Instructions) {
+		t.Fatalf("expected:\n%v\ngot:\n%v", prog.Instructions, appended.Instructions)
+	}
+}
+
+func benchmarkFilter() []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 8},
+		bpf.LoadAbsolute{Size: 1, Off: 23},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 6},
+		bpf.LoadAbsolute{Size: 2, Off: 20},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+		bpf.LoadMemShift{Off: 14},
+		bpf.LoadIndirect{Size: 2, Off: 16},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	}
+}
+
+func BenchmarkCompileEBPF(b *testing.B) {
+	filter := benchmarkFilter()
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := CompileEBPF(filter, testOpts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompiler(b *testing.B) {
+	filter := benchmarkFilter()
+	compiler := NewCompiler()
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := compiler.Compile(filter, testOpts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Appending a predicate to a filter, compiling only the predicate or the whole filter again
+func BenchmarkCompileAppended(b *testing.B) {
+	filter := benchmarkFilter()
+	next := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 14},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x45, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	}
+
+	compiler := NewCompiler()
+
+	prog, err := compiler.Compile(filter, testOpts)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("appended", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := compiler.CompileAppended(prog, next); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("full", func(b *testing.B) {
+		full := appendFilter(filter, next)
+
+		b.ReportAllocs()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := compiler.Compile(full, testOpts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestInsertionsDivideByX(t *testing.T) {
+	prog := mustCompileEBPF(t, []bpf.Instruction{
+		bpf.LoadConstant{Dst: bpf.RegA, Val: 10},
+		bpf.LoadConstant{Dst: bpf.RegX, Val: 0},
+		bpf.ALUOpX{Op: bpf.ALUOpDiv},
+		bpf.RetA{},
+	}, testOpts)
+
+	expected := []Insertion{
+		{
+			Kind:        InsertionDivideByZeroCheck,
+			Instruction: "check x != 0",
+			Reason:      "instruction 2 divides by x",
+			Block:       "block_0",
+			PC:          2,
+		},
+	}
+	if !reflect.DeepEqual(prog.Insertions(), expected) {
+		t.Fatalf("expected %+v, got %+v", expected, prog.Insertions())
+	}
+}
+
+func TestInsertions(t *testing.T) {
+	opts := testOpts
+	opts.StackOffset = 4
+
+	prog := mustCompileEBPF(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.TAX{},
+		bpf.LoadIndirect{Size: 1, Off: 3},
+		bpf.LoadScratch{Dst: bpf.RegA, N: 2},
+		bpf.RetA{},
+	}, opts)
+
+	kinds := []InsertionKind{}
+	for _, ins := range prog.Insertions() {
+		kinds = append(kinds, ins.Kind)
+	}
+
+	expected := []InsertionKind{InsertionPacketGuard, InsertionInitializeScratch, InsertionIndirectPacketGuard}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Fatalf("expected %v, got %+v", expected, prog.Insertions())
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	opts := testOpts
+	opts.Prologue = asm.Instructions{asm.Mov.Imm(asm.R8, 0)}
+
+	prog := mustCompileEBPF(t, []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 12},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 2},
+		/* 2 */ bpf.LoadConstant{Dst: bpf.RegA, Val: 1},
+		/* 3 */ bpf.RetA{},
+		/* 4 */ bpf.LoadConstant{Dst: bpf.RegA, Val: 2},
+		/* 5 */ bpf.RetA{},
+	}, opts)
+
+	sourceMap := prog.SourceMap()
+	if len(sourceMap) != len(prog.Instructions) {
+		t.Fatalf("%d instructions, %d entries", len(prog.Instructions), len(sourceMap))
+	}
+
+	pcs := []int{}
+	for i, entry := range sourceMap {
+		if entry.OutputIndex != i {
+			t.Fatalf("entry %d: output index %d", i, entry.OutputIndex)
+		}
+
+		if len(pcs) == 0 || pcs[len(pcs)-1] != entry.SourcePC {
+			pcs = append(pcs, entry.SourcePC)
+		}
+	}
+
+	// The Prologue, packet guard and the exit of failed guards have no source
+	expected := []int{NoSourcePC, 0, 1, 2, 3, 4, 5, NoSourcePC}
+	if !reflect.DeepEqual(pcs, expected) {
+		t.Fatalf("expected pcs %v, got %v", expected, pcs)
+	}
+
+	if insn := prog.Instructions[sourceMap[len(opts.Prologue)].OutputIndex]; insn != asm.Mov.Reg(asm.R6, asm.R2) {
+		t.Fatalf("first instruction of the guard is %v", insn)
+	}
+}
+
+// Trace, Assertions and MatchOffset aren't compiled from the filter
+func TestSourceMapInserted(t *testing.T) {
+	opts := testOpts
+	opts.Trace = true
+	opts.Assertions = true
+	opts.MatchOffset = true
+	opts.MatchOffsetReg = asm.R9
+
+	// Instructions compiled from each pc
+	compiled := func(opts EBPFOpts) map[int]asm.Instructions {
+		prog := mustCompileEBPF(t, cPortFilter, opts)
+
+		insns := map[int]asm.Instructions{}
+		for _, entry := range prog.SourceMap() {
+			if entry.SourcePC == NoSourcePC {
+				continue
+			}
+
+			insn := prog.Instructions[entry.OutputIndex]
+			insn.Symbol = ""
+			insns[entry.SourcePC] = append(insns[entry.SourcePC], insn)
+		}
+
+		return insns
+	}
+
+	if with, without := compiled(opts), compiled(testOpts); !reflect.DeepEqual(with, without) {
+		t.Fatalf("expected:\n%v\ngot:\n%v", without, with)
+	}
+}
+
+func TestRequirements(t *testing.T) {
+	check := func(t *testing.T, name string, filter []bpf.Instruction, opts EBPFOpts, expected Requirements) {
+		t.Helper()
+
+		if reqs := mustCompileEBPF(t, filter, opts).Requirements(); !reflect.DeepEqual(reqs, expected) {
+			t.Fatalf("%s: expected %+v, got %+v", name, expected, reqs)
+		}
+	}
+
+	direct := []ebpf.ProgType{ebpf.SchedCLS, ebpf.SchedACT, ebpf.XDP}
+
+	// Extensions are compiled to direct packet access
+	check(t, "len", []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtLen},
+		bpf.RetA{},
+	}, testOpts, Requirements{
+		ProgramTypes: direct,
+		Helpers:      []asm.BuiltinFunc{},
+	})
+
+	xdp := testOpts
+	xdp.XDPLoadBytes = true
+	xdp.XDPContext = asm.R8
+	check(t, "xdp load bytes", cPortFilter, xdp, Requirements{
+		ProgramTypes: []ebpf.ProgType{ebpf.XDP},
+		Helpers:      []asm.BuiltinFunc{xdpLoadBytes},
+	})
+
+	skb := testOpts
+	skb.SKB = SKBLoadBytes
+	skb.SKBContext = asm.R8
+	check(t, "skb load bytes", cPortFilter, skb, Requirements{
+		ProgramTypes: []ebpf.ProgType{ebpf.SchedCLS, ebpf.SchedACT},
+		Helpers:      []asm.BuiltinFunc{skbLoadBytes},
+	})
+
+	maps := testOpts
+	maps.ScratchMaps = map[int]string{0: "counter"}
+	check(t, "scratch maps", []bpf.Instruction{
+		bpf.LoadScratch{Dst: bpf.RegA, N: 0},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 1},
+		bpf.StoreScratch{Src: bpf.RegA, N: 0},
+		bpf.RetA{},
+	}, maps, Requirements{
+		ProgramTypes: direct,
+		Helpers:      []asm.BuiltinFunc{asm.MapLookupElement, asm.MapUpdateElement},
+	})
+
+	// Calls are only listed once, with the Prologue's
+	trace := testOpts
+	trace.Trace = true
+	trace.Prologue = asm.Instructions{asm.GetPRandomu32.Call()}
+	check(t, "trace", cPortFilter, trace, Requirements{
+		ProgramTypes: direct,
+		Helpers:      []asm.BuiltinFunc{asm.TracePrintk, asm.GetPRandomu32},
+	})
+}
+
+func TestPreconditions(t *testing.T) {
+	filter := []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 1, Off: 0},
+		/* 1 */ bpf.StoreScratch{Src: bpf.RegA, N: 3},
+		/* 2 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipFalse: 3},
+		// Needs more packet than the first block
+		/* 3 */ bpf.LoadAbsolute{Size: 4, Off: 20},
+		/* 4 */ bpf.ALUOpX{Op: bpf.ALUOpAdd},
+		/* 5 */ bpf.RetA{},
+		/* 6 */ bpf.LoadScratch{Dst: bpf.RegA, N: 3},
+		/* 7 */ bpf.RetA{},
+	}
+
+	opts := testOpts
+	opts.StackOffset = 4
+
+	expected := []Precondition{
+		{Block: "block_0"},
+		{Block: "block_3", PacketLen: 1, InitializedRegs: []bpf.Register{bpf.RegA}, InitializedScratch: []int{3}},
+		{Block: "block_6", PacketLen: 1, InitializedRegs: []bpf.Register{bpf.RegA}, InitializedScratch: []int{3}},
+	}
+	if pre := mustCompileEBPF(t, filter, opts).Preconditions(); !reflect.DeepEqual(pre, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, pre)
+	}
+
+	// X is initialized by the caller
+	opts.InitializedRegs = []bpf.Register{bpf.RegX}
+	for _, pre := range mustCompileEBPF(t, filter, opts).Preconditions() {
+		if len(pre.InitializedRegs) == 0 || pre.InitializedRegs[len(pre.InitializedRegs)-1] != bpf.RegX {
+			t.Fatalf("%s: expected x initialized, got %+v", pre.Block, pre)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package cbpfc
+
+import (
+	"golang.org/x/net/bpf"
+)
+
+// rangeCheck is a pair of conditional jumps that test A against a lower and an upper bound,
+// eg a >= 80 followed by a <= 443, that can be emitted as a single combined condition.
+//
+// The outer block ends with the first test, and jumps to the inner block which is only the second test.
+// Both tests go to falseBlk if they fail, so A is in the range IFF the second test jumps to trueBlk.
+type rangeCheck struct {
+	// lower and upper are the bound tests, inverted as required so they have to be true to be in range.
+	// Only Cond and Val are set.
+	lower, upper bpf.JumpIf
+
+	// inner is the block with the second test, only reachable from the outer block.
+	// It doesn't need to be emitted if the range is.
+	inner *block
+
+	trueBlk, falseBlk *block
+}
+
+// rangeChecks finds the blocks that end with the first test of a range check.
+// Blocks are the outer block of at most one range check, and the inner block of a range check is never an outer block.
+func rangeChecks(blocks []*block) map[*block]*rangeCheck {
+	predecessors := make(map[*block]int)
+	for _, block := range blocks {
+		for _, target := range block.jumps {
+			predecessors[target]++
+		}
+	}
+
+	ranges := make(map[*block]*rangeCheck)
+	inner := make(map[*block]bool)
+
+	for _, outer := range blocks {
+		if inner[outer] {
+			continue
+		}
+
+		rng, ok := rangeCheckFrom(outer, predecessors)
+		if !ok || ranges[rng.inner] != nil {
+			continue
+		}
+
+		ranges[outer] = rng
+		inner[rng.inner] = true
+	}
+
+	return ranges
+}
+
+// rangeCheckFrom checks if outer is the outer block of a range check.
+func rangeCheckFrom(outer *block, predecessors map[*block]int) (*rangeCheck, bool) {
+	first, ok := outer.last().Instruction.(bpf.JumpIf)
+	if !ok || first.SkipTrue == first.SkipFalse {
+		return nil, false
+	}
+
+	// The first test has to pass to reach the inner block
+	inner, other := outer.skipToBlock(skip(first.SkipTrue)), outer.skipToBlock(skip(first.SkipFalse))
+	if len(inner.insns) != 1 || predecessors[inner] != 1 {
+		inner, other = other, inner
+		first.Cond = condToInverse[first.Cond]
+	}
+
+	if len(inner.insns) != 1 || predecessors[inner] != 1 {
+		return nil, false
+	}
+
+	second, ok := inner.last().Instruction.(bpf.JumpIf)
+	if !ok {
+		return nil, false
+	}
+
+	// Failing the second test has to go to the same block as failing the first
+	trueBlk, falseBlk := inner.skipToBlock(skip(second.SkipTrue)), inner.skipToBlock(skip(second.SkipFalse))
+	if trueBlk == other {
+		trueBlk, falseBlk = falseBlk, trueBlk
+		second.Cond = condToInverse[second.Cond]
+	}
+
+	if falseBlk != other || trueBlk == other {
+		return nil, false
+	}
+
+	rng := &rangeCheck{
+		inner:    inner,
+		trueBlk:  trueBlk,
+		falseBlk: falseBlk,
+	}
+
+	switch {
+	case isLowerBound(first.Cond) && isUpperBound(second.Cond):
+		rng.lower, rng.upper = first, second
+	case isUpperBound(first.Cond) && isLowerBound(second.Cond):
+		rng.lower, rng.upper = second, first
+	default:
+		return nil, false
+	}
+
+	rng.lower.SkipTrue, rng.lower.SkipFalse = 0, 0
+	rng.upper.SkipTrue, rng.upper.SkipFalse = 0, 0
+
+	return rng, true
+}
+
+func isLowerBound(cond bpf.JumpTest) bool {
+	return cond == bpf.JumpGreaterThan || cond == bpf.JumpGreaterOrEqual
+}
+
+func isUpperBound(cond bpf.JumpTest) bool {
+	return cond == bpf.JumpLessThan || cond == bpf.JumpLessOrEqual
+}
+
+// isInnerBlock checks if blk is the inner block of any of the range checks.
+func isInnerBlock(ranges map[*block]*rangeCheck, blk *block) bool {
+	for _, rng := range ranges {
+		if rng.inner == blk {
+			return true
+		}
+	}
+
+	return false
+}
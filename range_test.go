@@ -0,0 +1,94 @@
+package cbpfc
+
+import (
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestRangeChecks(t *testing.T) {
+	blocks := mustSplitBlocks(t, 4, toInstructions([]bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 2},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpLessThan, Val: 80, SkipTrue: 2, SkipFalse: 0},
+		/* 2 */ bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 443, SkipTrue: 0, SkipFalse: 1},
+		/* 3 */ bpf.RetConstant{Val: 1},
+		/* 4 */ bpf.RetConstant{Val: 0},
+	}))
+
+	ranges := rangeChecks(blocks)
+	if len(ranges) != 1 {
+		t.Fatalf("expected 1 range, got %d", len(ranges))
+	}
+
+	rng := ranges[blocks[0]]
+	if rng == nil {
+		t.Fatal("first block not outer block of range")
+	}
+
+	if rng.lower != (bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 80}) {
+		t.Fatalf("unexpected lower bound %v", rng.lower)
+	}
+
+	if rng.upper != (bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 443}) {
+		t.Fatalf("unexpected upper bound %v", rng.upper)
+	}
+
+	if rng.inner != blocks[1] || rng.trueBlk != blocks[2] || rng.falseBlk != blocks[3] {
+		t.Fatal("wrong range blocks")
+	}
+}
+
+func TestRangeChecksNotRange(t *testing.T) {
+	check := func(t *testing.T, filter []bpf.Instruction) {
+		t.Helper()
+
+		blocks := mustSplitBlocks(t, 4, toInstructions(filter))
+
+		if ranges := rangeChecks(blocks); len(ranges) != 0 {
+			t.Fatalf("unexpected ranges %v", ranges)
+		}
+	}
+
+	// Not bounds
+	check(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipTrue: 0, SkipFalse: 2},
+		bpf.JumpIf{Cond: bpf.JumpLessThan, Val: 443, SkipTrue: 0, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	})
+
+	// Two lower bounds
+	check(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 2},
+		bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 80, SkipTrue: 0, SkipFalse: 2},
+		bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 443, SkipTrue: 0, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	})
+
+	// Tests fail to different blocks
+	check(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 2},
+		bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 80, SkipTrue: 0, SkipFalse: 1},
+		bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 443, SkipTrue: 0, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	})
+}
+
+// The inner block of a range can't be reached from other blocks
+func TestRangeChecksInnerTarget(t *testing.T) {
+	blocks := mustSplitBlocks(t, 5, toInstructions([]bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 2},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 22, SkipTrue: 1, SkipFalse: 0},
+		/* 2 */ bpf.JumpIf{Cond: bpf.JumpGreaterOrEqual, Val: 80, SkipTrue: 0, SkipFalse: 2},
+		/* 3 */ bpf.JumpIf{Cond: bpf.JumpLessOrEqual, Val: 443, SkipTrue: 0, SkipFalse: 1},
+		/* 4 */ bpf.RetConstant{Val: 1},
+		/* 5 */ bpf.RetConstant{Val: 0},
+	}))
+
+	if ranges := rangeChecks(blocks); len(ranges) != 0 {
+		t.Fatalf("unexpected ranges %v", ranges)
+	}
+}
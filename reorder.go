@@ -0,0 +1,241 @@
+package cbpfc
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// validateSelectivity checks every hint is for a conditional jump with a constant of a filter insns, and is a fraction.
+func validateSelectivity(insns []bpf.Instruction, selectivity map[int]float64) error {
+	for pc, hint := range selectivity {
+		if pc < 0 || pc >= len(insns) {
+			return errors.Errorf("Selectivity hint for instruction %d, filter has %d instructions", pc, len(insns))
+		}
+
+		if _, ok := insns[pc].(bpf.JumpIf); !ok {
+			return errors.Errorf("Selectivity hint for instruction %d: %v, not a conditional jump with a constant", pc, insns[pc])
+		}
+
+		if !(hint >= 0 && hint <= 1) {
+			return errors.Errorf("Selectivity hint %v for instruction %d not between 0 and 1", hint, pc)
+		}
+	}
+
+	return nil
+}
+
+// comparison is a block of a chain of comparisons
+type comparison struct {
+	insns []instruction
+
+	// positions the last instruction jumps to, to continue the chain and to fail it
+	pass, fail pos
+
+	hint float64
+}
+
+// reorderComparisons reorders chains of independent comparisons to test the comparisons least likely to pass first,
+// according to the selectivity hints of their jumps:
+//
+//	ldh [12]; jne #0x800, fail      ldh [36]; jne #80, fail
+//	ldb [23]; jne #6, fail      ->  ldb [23]; jne #6, fail
+//	ldh [36]; jne #80, fail         ldh [12]; jne #0x800, fail
+//	...                             ...
+//
+// Comparisons are blocks that only load A from the packet or a constant, compute on it with constants, and jump
+// on it to continue the chain or to the block every comparison of the chain fails to.
+// Blocks continued to after the first one can only be reached from the chain.
+// Every comparison of a chain needs a hint, chains are only reordered if:
+//   - The failure block returns guardFailure, so a packet too short for a load reordered first still fails the same
+//   - A isn't read after the chain, it's set by a different comparison once reordered
+//
+// Blocks keep their position and labels, their instructions are swapped.
+// reordered, if set, is called with every chain reordered, and the positions of its jumps in the new order.
+func reorderComparisons(blocks []*block, selectivity map[int]float64, guardFailure uint32, reordered func(chain []*block, pcs []int)) {
+	if len(selectivity) == 0 {
+		return
+	}
+
+	preds := make(map[*block]int, len(blocks))
+	for _, blk := range blocks {
+		for _, target := range blk.jumps {
+			preds[target]++
+		}
+	}
+
+	liveA := liveInA(blocks)
+	chained := make(map[*block]bool)
+
+	for _, start := range blocks {
+		if chained[start] {
+			continue
+		}
+
+		chain, comparisons, next := comparisonChain(start, preds, selectivity)
+		if len(chain) < 2 || liveA[next] || !returns(comparisons[0].fail, chain[0], guardFailure) {
+			continue
+		}
+
+		for _, blk := range chain {
+			chained[blk] = true
+		}
+
+		fail := chain[0].jumps[comparisons[0].fail]
+
+		// Stable, comparisons hinted the same keep their order
+		sort.SliceStable(comparisons, func(i, j int) bool {
+			return comparisons[i].hint < comparisons[j].hint
+		})
+
+		pcs := make([]int, len(chain))
+
+		for i, blk := range chain {
+			cmp := comparisons[i]
+
+			target := next
+			if i+1 < len(chain) {
+				target = chain[i+1]
+			}
+
+			blk.insns = cmp.insns
+			blk.jumps = map[pos]*block{
+				cmp.pass: target,
+				cmp.fail: fail,
+			}
+
+			pcs[i] = int(blk.last().id)
+		}
+
+		if reordered != nil {
+			reordered(chain, pcs)
+		}
+	}
+}
+
+// comparisonChain finds the longest chain of comparisons starting with start, failing to the same block.
+// next is the block the chain continues to once every comparison passes.
+func comparisonChain(start *block, preds map[*block]int, selectivity map[int]float64) ([]*block, []comparison, *block) {
+	var chain []*block
+	var comparisons []comparison
+	var next *block
+
+	first, ok := comparisonOf(start, selectivity)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	flipped := first
+	flipped.pass, flipped.fail = first.fail, first.pass
+
+	// Either jump of the first comparison can be the failure
+	for _, cmp := range []comparison{first, flipped} {
+		fail := start.jumps[cmp.fail]
+
+		blks, cmps := []*block{start}, []comparison{cmp}
+		blk := start.jumps[cmp.pass]
+
+		for preds[blk] == 1 {
+			c, ok := comparisonOf(blk, selectivity)
+			if !ok {
+				break
+			}
+
+			// Orient the comparison so it fails to the same block
+			if blk.jumps[c.pass] == fail {
+				c.pass, c.fail = c.fail, c.pass
+			}
+
+			if blk.jumps[c.fail] != fail {
+				break
+			}
+
+			blks, cmps = append(blks, blk), append(cmps, c)
+			blk = blk.jumps[c.pass]
+		}
+
+		if len(blks) > len(chain) {
+			chain, comparisons, next = blks, cmps, blk
+		}
+	}
+
+	return chain, comparisons, next
+}
+
+// comparisonOf returns blk as a comparison, if it is one with a hint.
+// pass and fail are the true and false targets of its jump, in that order.
+func comparisonOf(blk *block, selectivity map[int]float64) (comparison, bool) {
+	if len(blk.jumps) != 2 {
+		return comparison{}, false
+	}
+
+	jump, ok := blk.last().Instruction.(bpf.JumpIf)
+	if !ok {
+		return comparison{}, false
+	}
+
+	hint, ok := selectivity[int(blk.last().id)]
+	if !ok {
+		return comparison{}, false
+	}
+
+	// A is set before it's read, and nothing else is
+	if len(blk.insns) == 1 {
+		return comparison{}, false
+	}
+
+	for i, insn := range blk.insns[:len(blk.insns)-1] {
+		switch in := insn.Instruction.(type) {
+		case bpf.LoadAbsolute:
+		case bpf.LoadConstant:
+			if in.Dst != bpf.RegA {
+				return comparison{}, false
+			}
+		case bpf.ALUOpConstant:
+			if i == 0 {
+				return comparison{}, false
+			}
+		default:
+			return comparison{}, false
+		}
+	}
+
+	return comparison{
+		insns: blk.insns,
+		pass:  blk.skipToPos(skip(jump.SkipTrue)),
+		fail:  blk.skipToPos(skip(jump.SkipFalse)),
+		hint:  hint,
+	}, true
+}
+
+// returns checks if the block blk jumps to at p only returns val.
+func returns(p pos, blk *block, val uint32) bool {
+	target := blk.jumps[p]
+
+	ret, ok := target.last().Instruction.(bpf.RetConstant)
+	return ok && len(target.insns) == 1 && ret.Val == val
+}
+
+// liveInA computes if A is live at the start of every block: it can be read before being written.
+func liveInA(blocks []*block) map[*block]bool {
+	live := make(map[*block]bool, len(blocks))
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		blk := blocks[i]
+
+		a := false
+		for _, target := range blk.jumps {
+			a = a || live[target]
+		}
+
+		for pc := len(blk.insns) - 1; pc >= 0; pc-- {
+			insn := blk.insns[pc].Instruction
+			a = (a && !memWrites(insn).regs[bpf.RegA]) || memReads(insn).regs[bpf.RegA]
+		}
+
+		live[blk] = a
+	}
+
+	return live
+}
@@ -0,0 +1,189 @@
+package cbpfc
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+// chainFilter matches IPv4 TCP packets to port 80, with a chain of comparisons failing to the same block
+var chainFilter = []bpf.Instruction{
+	/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 12},
+	/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipFalse: 5},
+	/* 2 */ bpf.LoadAbsolute{Size: 1, Off: 23},
+	/* 3 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 3},
+	/* 4 */ bpf.LoadAbsolute{Size: 2, Off: 36},
+	/* 5 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipFalse: 1},
+	/* 6 */ bpf.RetConstant{Val: 1},
+	/* 7 */ bpf.RetConstant{Val: 0},
+}
+
+// chainHints make the port the least likely to match
+var chainHints = map[int]float64{1: 0.9, 3: 0.5, 5: 0.01}
+
+// chainLoads are the offsets of the loads of the comparisons, in the order they're tested
+func chainLoads(tb testing.TB, filter []bpf.Instruction, opts CompileOpts) []uint32 {
+	tb.Helper()
+
+	blocks, err := compile(filter, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	offs := []uint32{}
+	for _, blk := range blocks {
+		for _, insn := range blk.insns {
+			switch i := insn.Instruction.(type) {
+			case bpf.LoadAbsolute:
+				offs = append(offs, i.Off)
+			case bpf.LoadIndirect:
+				offs = append(offs, i.Off)
+			}
+		}
+	}
+
+	return offs
+}
+
+func TestReorderComparisons(t *testing.T) {
+	if offs := chainLoads(t, chainFilter, CompileOpts{}); !reflect.DeepEqual(offs, []uint32{12, 23, 36}) {
+		t.Fatalf("reordered without hints: %v", offs)
+	}
+
+	if offs := chainLoads(t, chainFilter, CompileOpts{Selectivity: chainHints}); !reflect.DeepEqual(offs, []uint32{36, 23, 12}) {
+		t.Fatalf("expected loads [36 23 12], got %v", offs)
+	}
+
+	// Comparisons hinted the same keep their order
+	same := map[int]float64{1: 0.5, 3: 0.5, 5: 0.1}
+	if offs := chainLoads(t, chainFilter, CompileOpts{Selectivity: same}); !reflect.DeepEqual(offs, []uint32{36, 12, 23}) {
+		t.Fatalf("expected loads [36 12 23], got %v", offs)
+	}
+
+	// Chains start after comparisons without a hint
+	partial := map[int]float64{3: 0.5, 5: 0.01}
+	if offs := chainLoads(t, chainFilter, CompileOpts{Selectivity: partial}); !reflect.DeepEqual(offs, []uint32{12, 36, 23}) {
+		t.Fatalf("expected loads [12 36 23], got %v", offs)
+	}
+}
+
+func TestReorderComparisonsVM(t *testing.T) {
+	tcp := make([]byte, 38)
+	tcp[12], tcp[13] = 0x08, 0x00
+	tcp[23] = 6
+	tcp[37] = 80
+
+	udp := append([]byte{}, tcp...)
+	udp[23] = 17
+
+	port := append([]byte{}, tcp...)
+	port[37] = 81
+
+	arp := append([]byte{}, tcp...)
+	arp[13] = 0x06
+
+	packets := [][]byte{tcp, udp, port, arp, tcp[:37], tcp[:24], arp[:20], tcp[:13]}
+
+	// Short packets fail the guard of the port first, packets that don't match return the same
+	opts := testOpts
+	opts.Selectivity = chainHints
+	checkInterpreter(t, chainFilter, opts, packets...)
+
+	// Failing a guard and a comparison return the same, like with the original order
+	filter := append([]bpf.Instruction{}, chainFilter...)
+	filter[7] = bpf.RetConstant{Val: 7}
+
+	opts.GuardFailureValue = 7
+	reordered := mustCompileEBPF(t, filter, opts)
+
+	opts.Selectivity = nil
+	original := mustCompileEBPF(t, filter, opts)
+
+	for _, pkt := range packets {
+		expected, err := interpretEBPF(original.Instructions, opts, pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := interpretEBPF(reordered.Instructions, opts, pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res != expected {
+			t.Fatalf("packet %x: expected %d, got %d", pkt, expected, res)
+		}
+	}
+}
+
+func TestReorderComparisonsUnchanged(t *testing.T) {
+	for name, test := range map[string]struct {
+		modify func(filter []bpf.Instruction)
+		opts   CompileOpts
+	}{
+		// A from the last comparison is returned
+		"A read": {
+			func(filter []bpf.Instruction) { filter[6] = bpf.RetA{} },
+			CompileOpts{},
+		},
+		// Packets too short for a load reordered first wouldn't return the same
+		"failure value": {
+			func(filter []bpf.Instruction) {},
+			CompileOpts{GuardFailureValue: 1},
+		},
+		"failure block": {
+			func(filter []bpf.Instruction) { filter[7] = bpf.RetConstant{Val: 2} },
+			CompileOpts{},
+		},
+		// Comparisons read X
+		"indirect": {
+			func(filter []bpf.Instruction) { filter[2] = bpf.LoadIndirect{Size: 1, Off: 23} },
+			CompileOpts{},
+		},
+		"jump x": {
+			func(filter []bpf.Instruction) { filter[3] = bpf.JumpIfX{Cond: bpf.JumpEqual, SkipFalse: 3} },
+			CompileOpts{},
+		},
+	} {
+		filter := append([]bpf.Instruction{}, chainFilter...)
+		test.modify(filter)
+
+		opts := test.opts
+		opts.Selectivity = make(map[int]float64)
+		for pc, hint := range chainHints {
+			if _, ok := filter[pc].(bpf.JumpIf); ok {
+				opts.Selectivity[pc] = hint
+			}
+		}
+
+		// Only the port and proto comparisons can be a chain
+		if offs := chainLoads(t, filter, opts); offs[0] != 12 {
+			t.Fatalf("%s: reordered to %v", name, offs)
+		}
+	}
+}
+
+func TestSelectivityInvalid(t *testing.T) {
+	for _, test := range []struct {
+		hints map[int]float64
+		error string
+	}{
+		{map[int]float64{8: 0.5}, "filter has 8 instructions"},
+		{map[int]float64{-1: 0.5}, "filter has 8 instructions"},
+		{map[int]float64{0: 0.5}, "not a conditional jump"},
+		{map[int]float64{1: 1.5}, "not between 0 and 1"},
+		{map[int]float64{1: math.NaN()}, "not between 0 and 1"},
+	} {
+		_, err := compile(chainFilter, CompileOpts{Selectivity: test.hints})
+		if err == nil {
+			t.Fatalf("%v accepted", test.hints)
+		}
+
+		if !strings.Contains(err.Error(), test.error) {
+			t.Fatalf("%v: expected error %q, got %q", test.hints, test.error, err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package cbpfc
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// Rust has no goto, blocks are the states of a state machine.
+// Blocks can only jump forwards, so this always terminates.
+const rustFuncTemplate = `{{if .NoStd}}#![no_std]
+{{end}}
+// Returns the filter's return value: 0 if packet doesn't match, non 0 if it does
+#[inline]
+#[allow(unused_mut, unused_variables, unused_assignments, unreachable_code)]
+pub fn {{.Name}}(packet: &[u8]) -> u32 {
+    let mut a: u32 = 0;
+    let mut x: u32 = 0;
+    let mut m: [u32; 16] = [0; 16];
+
+    let mut block: usize = 0;
+
+    loop {
+        match block {
+{{- range $i, $b := .Blocks}}
+            {{$b.ID}} => {
+{{- range $i, $s := $b.Statements}}
+                {{$s}}
+{{- end}}
+            }
+{{- end}}
+            _ => return 0,
+        }
+    }
+}
+`
+
+type rustFunction struct {
+	Name   string
+	NoStd  bool
+	Blocks []rustBlock
+}
+
+// rustBlock is a block of compiled Rust
+type rustBlock struct {
+	ID         pos
+	Statements []string
+}
+
+// alu operation to Rust expression, with the value as argument
+var aluToRustFmt = map[bpf.ALUOp]string{
+	bpf.ALUOpAdd:        "a = a.wrapping_add(%v);",
+	bpf.ALUOpSub:        "a = a.wrapping_sub(%v);",
+	bpf.ALUOpMul:        "a = a.wrapping_mul(%v);",
+	bpf.ALUOpDiv:        "a /= %v;",
+	bpf.ALUOpOr:         "a |= %v;",
+	bpf.ALUOpAnd:        "a &= %v;",
+	bpf.ALUOpShiftLeft:  "a = a.checked_shl(%v).unwrap_or(0);",
+	bpf.ALUOpShiftRight: "a = a.checked_shr(%v).unwrap_or(0);",
+	bpf.ALUOpMod:        "a %%= %v;",
+	bpf.ALUOpXor:        "a ^= %v;",
+}
+
+// jump test to a Rust fmt string for condition
+var condToRustFmt = map[bpf.JumpTest]string{
+	bpf.JumpEqual:          "a == %v",
+	bpf.JumpNotEqual:       "a != %v",
+	bpf.JumpGreaterThan:    "a > %v",
+	bpf.JumpLessThan:       "a < %v",
+	bpf.JumpGreaterOrEqual: "a >= %v",
+	bpf.JumpLessOrEqual:    "a <= %v",
+	bpf.JumpBitsSet:        "a & %v != 0",
+	bpf.JumpBitsNotSet:     "a & %v == 0",
+}
+
+// RustOpts control how a cBPF filter is converted to Rust
+type RustOpts struct {
+	CompileOpts
+
+	// FunctionName is the symbol to use as the generated Rust function, Name if not set. Must match regex:
+	//     [A-Za-z_][0-9A-Za-z_]*
+	FunctionName string
+
+	// NoStd prepends a #![no_std] attribute, so the output can be used as the root of a no_std crate.
+	// The function itself only uses core.
+	NoStd bool
+}
+
+// ToRust compiles a cBPF filter to a Rust function with a signature of:
+//
+//     pub fn opts.FunctionName(packet: &[u8]) -> u32
+//
+// The function returns the filter's return value:
+// 0 if the packet does not match the cBPF filter,
+// non 0 if the packet does match.
+//
+// Packet loads are guarded by length checks, so the bounds checks of slice indexing never panic.
+func ToRust(filter []bpf.Instruction, opts RustOpts) (string, error) {
+	name, err := opts.symbol(opts.FunctionName, "FunctionName")
+	if err != nil {
+		return "", err
+	}
+
+	// a, x and m[] are local to the generated function, callers can't initialize them
+	if len(opts.InitializedRegs) != 0 || len(opts.InitializedScratch) != 0 {
+		return "", errors.New("InitializedRegs and InitializedScratch not supported")
+	}
+
+	// The generated function only has the packet
+	if opts.Metadata.Len != 0 {
+		return "", errors.New("Metadata not supported")
+	}
+
+	blocks, err := compile(filter, opts.CompileOpts)
+	if err != nil {
+		return "", err
+	}
+
+	fun := rustFunction{
+		Name:   name,
+		NoStd:  opts.NoStd,
+		Blocks: make([]rustBlock, len(blocks)),
+	}
+
+	for i, block := range blocks {
+		fun.Blocks[i], err = blockToRust(block, opts)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	tmpl, err := template.New("cbpf_rust_func").Parse(rustFuncTemplate)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to parse func template")
+	}
+
+	rust := strings.Builder{}
+
+	if err := tmpl.Execute(&rust, fun); err != nil {
+		return "", errors.Wrapf(err, "unable to execute func template")
+	}
+
+	return rust.String(), nil
+}
+
+// blockToRust compiles a block to Rust.
+func blockToRust(blk *block, opts RustOpts) (rustBlock, error) {
+	rBlk := rustBlock{
+		ID:         blk.id,
+		Statements: make([]string, len(blk.insns)),
+	}
+
+	for i, insn := range blk.insns {
+		stat, err := insnToRust(insn, blk, opts)
+		if err != nil {
+			return rBlk, errors.Wrapf(err, "unable to compile %v", insn)
+		}
+
+		if comment, ok := opts.comment(insn); ok {
+			stat += " // " + comment
+		}
+
+		rBlk.Statements[i] = stat
+	}
+
+	// Every block is a separate state, even if it falls through
+	if ft := blk.fallthroughBlock(); ft != nil {
+		rBlk.Statements = append(rBlk.Statements, fmt.Sprintf("block = %d;", ft.id))
+	}
+
+	return rBlk, nil
+}
+
+// insnToRust compiles an instruction to a single Rust line / statement.
+func insnToRust(insn instruction, blk *block, opts RustOpts) (string, error) {
+	switch i := insn.Instruction.(type) {
+
+	case bpf.LoadConstant:
+		return stat("%s = %d;", regToCSym[i.Dst], i.Val)
+	case bpf.LoadScratch:
+		return stat("%s = m[%d];", regToCSym[i.Dst], i.N)
+	case bpf.LoadAbsolute:
+		return packetLoadToRust(opts, i.Size, fmt.Sprintf("%d", i.Off))
+	case bpf.LoadIndirect:
+		return packetLoadToRust(opts, i.Size, fmt.Sprintf("x as usize + %d", i.Off))
+	case bpf.LoadExtension:
+		return stat("a = packet.len() as u32;")
+	case bpf.LoadMemShift:
+		return stat("x = 4 * (packet[%d] as u32 & 0xf);", i.Off)
+
+	case bpf.StoreScratch:
+		return stat("m[%d] = %s;", i.N, regToCSym[i.Src])
+
+	case bpf.ALUOpConstant:
+		return stat(aluToRustFmt[i.Op], i.Val)
+	case bpf.ALUOpX:
+		return stat(aluToRustFmt[i.Op], "x")
+	case bpf.NegateA:
+		return stat("a = a.wrapping_neg();")
+
+	case bpf.Jump:
+		return stat("block = %d;", blk.skipToBlock(skip(i.Skip)).id)
+	case bpf.JumpIf:
+		return condToRust(skip(i.SkipTrue), skip(i.SkipFalse), blk, condToRustFmt[i.Cond], i.Val)
+	case bpf.JumpIfX:
+		return condToRust(skip(i.SkipTrue), skip(i.SkipFalse), blk, condToRustFmt[i.Cond], "x")
+
+	case bpf.RetA:
+		return stat("return a;")
+	case bpf.RetConstant:
+		return stat("return %d;", i.Val)
+
+	case bpf.TXA:
+		return stat("a = x;")
+	case bpf.TAX:
+		return stat("x = a;")
+
+	// u64 can't overflow
+	case packetGuardAbsolute:
+		return stat("if (packet.len() as u64) < %d { return %d; }", opts.guardLen(i.Len), opts.GuardFailureValue)
+	case packetGuardIndirect:
+		return stat("if (packet.len() as u64) < x as u64 + %d { return %d; }", opts.guardLen(i.Len), opts.GuardFailureValue)
+
+	case initializeRegister:
+		return stat("%s = 0;", regToCSym[i.Reg])
+	case initializeScratch:
+		return stat("m[%d] = 0;", i.N)
+
+	case checkXNotZero:
+		return stat("if x == 0 { return 0; }")
+
+	default:
+		return "", errors.Errorf("unsupported instruction %v", insn)
+	}
+}
+
+func packetLoadToRust(opts RustOpts, size int, offset string) (string, error) {
+	order := "be"
+	if opts.HostByteOrder {
+		order = "ne"
+	}
+
+	switch size {
+	case 1:
+		return stat("a = packet[%s] as u32;", offset)
+	case 2:
+		return stat("a = u16::from_%[2]s_bytes([packet[%[1]s], packet[%[1]s + 1]]) as u32;", offset, order)
+	case 4:
+		return stat("a = u32::from_%[2]s_bytes([packet[%[1]s], packet[%[1]s + 1], packet[%[1]s + 2], packet[%[1]s + 3]]);", offset, order)
+	}
+
+	return "", errors.Errorf("unsupported load size %d", size)
+}
+
+func condToRust(skipTrue, skipFalse skip, blk *block, condFmt string, condArgs ...interface{}) (string, error) {
+	cond := fmt.Sprintf(condFmt, condArgs...)
+
+	return stat("if %s { block = %d; } else { block = %d; }", cond, blk.skipToBlock(skipTrue).id, blk.skipToBlock(skipFalse).id)
+}
@@ -0,0 +1,259 @@
+package cbpfc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestRustFunctionName(t *testing.T) {
+	_, err := ToRust([]bpf.Instruction{bpf.RetA{}}, RustOpts{FunctionName: "0foo"})
+	if err == nil {
+		t.Fatal("invalid function name accepted")
+	}
+
+	_, err = ToRust([]bpf.Instruction{bpf.RetA{}}, RustOpts{FunctionName: "foo_bar2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRustNoStd(t *testing.T) {
+	check := func(t *testing.T, noStd bool) {
+		t.Helper()
+
+		rust, err := ToRust([]bpf.Instruction{bpf.RetA{}}, RustOpts{FunctionName: "filter", NoStd: noStd})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.HasPrefix(rust, "#![no_std]\n") != noStd {
+			t.Fatalf("NoStd %v, got:\n%s", noStd, rust)
+		}
+	}
+
+	check(t, true)
+	check(t, false)
+}
+
+func TestRustGolden(t *testing.T) {
+	checkGolden(t, "rust", cPortFilter, RustOpts{FunctionName: "filter"})
+}
+
+func TestRustGuards(t *testing.T) {
+	rust, err := ToRust([]bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 12},
+		bpf.LoadMemShift{Off: 14},
+		bpf.LoadIndirect{Size: 4, Off: 14},
+		bpf.RetA{},
+	}, RustOpts{FunctionName: "filter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"if (packet.len() as u64) < 15 { return 0; }",
+		"if (packet.len() as u64) < x as u64 + 18 { return 0; }",
+	} {
+		if !strings.Contains(rust, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, rust)
+		}
+	}
+}
+
+// checkRust compiles a filter to Rust with rustc, and checks it returns the same results
+// as the x/net/bpf VM for each packet.
+func checkRust(tb testing.TB, filter []bpf.Instruction, packets ...[]byte) {
+	tb.Helper()
+
+	rustc, err := exec.LookPath("rustc")
+	if err != nil {
+		tb.Skip("rustc not available")
+	}
+
+	rust, err := ToRust(filter, RustOpts{FunctionName: "filter"})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	// Print the result of the filter for every packet
+	main := strings.Builder{}
+	main.WriteString("fn main() {\n")
+	for _, pkt := range packets {
+		bytes := make([]string, len(pkt))
+		for i, b := range pkt {
+			bytes[i] = strconv.Itoa(int(b))
+		}
+
+		fmt.Fprintf(&main, "\tprintln!(\"{}\", filter(&[%s]));\n", strings.Join(bytes, ", "))
+	}
+	main.WriteString("}\n")
+
+	dir, err := ioutil.TempDir("", "cbpfc-rust")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "filter.rs")
+	if err := ioutil.WriteFile(src, []byte(rust+main.String()), 0644); err != nil {
+		tb.Fatal(err)
+	}
+
+	bin := filepath.Join(dir, "filter")
+	if out, err := exec.Command(rustc, "-D", "warnings", "-o", bin, src).CombinedOutput(); err != nil {
+		tb.Fatalf("rustc failed: %v\n%s\n%s", err, out, rust)
+	}
+
+	out, err := exec.Command(bin).Output()
+	if err != nil {
+		tb.Fatalf("filter failed: %v\n%s", err, rust)
+	}
+
+	results := strings.Fields(string(out))
+	if len(results) != len(packets) {
+		tb.Fatalf("expected %d results, got %d", len(packets), len(results))
+	}
+
+	vm, err := bpf.NewVM(filter)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	for i, pkt := range packets {
+		expected, err := vm.Run(pkt)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if results[i] != strconv.Itoa(int(uint32(expected))) {
+			tb.Fatalf("packet %x: expected %d, got %s\n%s", pkt, uint32(expected), results[i], rust)
+		}
+	}
+}
+
+func TestRustFilter(t *testing.T) {
+	checkRust(t, []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipTrue: 0, SkipFalse: 8},
+		/* 2 */ bpf.LoadMemShift{Off: 2},
+		/* 3 */ bpf.LoadIndirect{Size: 4, Off: 2},
+		/* 4 */ bpf.JumpIf{Cond: bpf.JumpBitsNotSet, Val: 0x80000000, SkipTrue: 5, SkipFalse: 0},
+		/* 5 */ bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 16},
+		/* 6 */ bpf.ALUOpX{Op: bpf.ALUOpMod},
+		/* 7 */ bpf.StoreScratch{Src: bpf.RegA, N: 3},
+		/* 8 */ bpf.LoadScratch{Dst: bpf.RegX, N: 3},
+		/* 9 */ bpf.TXA{},
+		/* 10 */ bpf.RetA{},
+	},
+		[]byte{},
+		[]byte{0x08, 0x00, 0x01},
+		[]byte{0x08, 0x00, 0x01, 0x00, 0x00, 0x00},
+		[]byte{0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x12, 0x34},
+		[]byte{0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0x12, 0x34, 0x56, 0x78},
+		[]byte{0x86, 0xDD, 0x01, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x12, 0x34},
+	)
+}
+
+func TestRustHostByteOrder(t *testing.T) {
+	check := func(t *testing.T, hostOrder bool, expected string) {
+		t.Helper()
+
+		rust, err := ToRust([]bpf.Instruction{
+			bpf.LoadAbsolute{Size: 2, Off: 0},
+			bpf.RetA{},
+		}, RustOpts{
+			CompileOpts:  CompileOpts{HostByteOrder: hostOrder},
+			FunctionName: "filter",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(rust, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, rust)
+		}
+	}
+
+	check(t, false, "a = u16::from_be_bytes([packet[0], packet[0 + 1]]) as u32;")
+	check(t, true, "a = u16::from_ne_bytes([packet[0], packet[0 + 1]]) as u32;")
+}
+
+func TestRustIndirectGuardOverflow(t *testing.T) {
+	checkRust(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 4, Off: 0},
+		bpf.TAX{},
+		bpf.LoadIndirect{Size: 4, Off: 4},
+		bpf.RetA{},
+	},
+		// x + 8 wraps to 6
+		[]byte{0xff, 0xff, 0xff, 0xfe, 1, 2, 3, 4},
+		[]byte{0, 0, 0, 0, 1, 2, 3, 4},
+	)
+}
+
+func TestRustMultiVerdict(t *testing.T) {
+	packets := [][]byte{}
+	for _, test := range multiVerdictPackets {
+		packets = append(packets, test.pkt)
+	}
+
+	checkRust(t, multiVerdictFilter, packets...)
+}
+
+func TestRustShift(t *testing.T) {
+	checkRust(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.TAX{},
+		bpf.LoadConstant{Dst: bpf.RegA, Val: 0xF0F0F0F0},
+		bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 40},
+		bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: 0xF0F0F0F0},
+		bpf.ALUOpX{Op: bpf.ALUOpShiftLeft},
+		bpf.RetA{},
+	}, []byte{0}, []byte{4}, []byte{32}, []byte{40})
+}
+
+func TestRustLoadLen(t *testing.T) {
+	checkRust(t, lenFilter, lenPackets...)
+}
+
+func TestRustNarrowLoads(t *testing.T) {
+	checkRust(t, narrowFilter, narrowPackets...)
+}
+
+func TestRustGuardFailureValue(t *testing.T) {
+	rust, err := ToRust(cPortFilter, RustOpts{
+		CompileOpts:  CompileOpts{GuardFailureValue: 7},
+		FunctionName: "filter",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"if (packet.len() as u64) < 14 { return 7; }",
+		"if (packet.len() as u64) < x as u64 + 18 { return 7; }",
+	} {
+		if !strings.Contains(rust, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, rust)
+		}
+	}
+}
+
+func TestRustMetadata(t *testing.T) {
+	_, err := ToRust(metadataFilter, RustOpts{CompileOpts: CompileOpts{Metadata: metadataRegion}, FunctionName: "filter"})
+	if err == nil {
+		t.Fatal("Metadata accepted")
+	}
+}
+
+func TestRustReuseportHash(t *testing.T) {
+	checkRust(t, reuseportHashFilter, reuseportHashPackets...)
+}
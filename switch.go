@@ -0,0 +1,136 @@
+package cbpfc
+
+import (
+	"golang.org/x/net/bpf"
+)
+
+// minSwitchCases is the fewest tests a chain needs to be a switch, shorter chains are as readable as ifs.
+const minSwitchCases = 3
+
+// switchChain is a chain of conditional jumps that test A for equality with different constants,
+// eg a == 80, then a == 443, then a == 8080, that can be emitted as a single switch.
+//
+// The head block ends with the first test, every test that fails jumps to an inner block which is only the next test.
+// A failed last test goes to defaultBlk.
+type switchChain struct {
+	cases []switchCase
+
+	// inner are the blocks with the tests after the first, only reachable from the previous test.
+	// They don't need to be emitted if the switch is.
+	inner []*block
+
+	defaultBlk *block
+}
+
+// switchCase is a single test of a switchChain.
+type switchCase struct {
+	// test is the original jump, for comments.
+	test instruction
+
+	val    uint32
+	target *block
+}
+
+// switchChains finds the blocks that end with the first test of a switch chain.
+// Blocks are the head of at most one switch chain, and the inner blocks of a chain are never heads.
+func switchChains(blocks []*block) map[*block]*switchChain {
+	predecessors := make(map[*block]int)
+	for _, block := range blocks {
+		for _, target := range block.jumps {
+			predecessors[target]++
+		}
+	}
+
+	chains := make(map[*block]*switchChain)
+	inner := make(map[*block]bool)
+
+	for _, head := range blocks {
+		if inner[head] {
+			continue
+		}
+
+		chain, ok := switchChainFrom(head, predecessors)
+		if !ok {
+			continue
+		}
+
+		chains[head] = chain
+		for _, blk := range chain.inner {
+			inner[blk] = true
+		}
+	}
+
+	return chains
+}
+
+// switchChainFrom checks if head is the head of a switch chain.
+func switchChainFrom(head *block, predecessors map[*block]int) (*switchChain, bool) {
+	chain := &switchChain{}
+	seen := make(map[uint32]bool)
+
+	blk := head
+	for {
+		test, target, other, ok := equalityTest(blk)
+		if !ok || seen[test.Val] {
+			break
+		}
+
+		if blk != head {
+			chain.inner = append(chain.inner, blk)
+		}
+
+		seen[test.Val] = true
+		chain.cases = append(chain.cases, switchCase{
+			test:   blk.last(),
+			val:    test.Val,
+			target: target,
+		})
+		chain.defaultBlk = other
+
+		// The next test has to be the only thing in its block, and only reachable from this test
+		if len(other.insns) != 1 || predecessors[other] != 1 {
+			break
+		}
+
+		blk = other
+	}
+
+	if len(chain.cases) < minSwitchCases {
+		return nil, false
+	}
+
+	return chain, true
+}
+
+// equalityTest checks if blk ends with a test of A for equality with a constant,
+// returning the test, the block it goes to if A is equal, and the block it goes to otherwise.
+func equalityTest(blk *block) (bpf.JumpIf, *block, *block, bool) {
+	test, ok := blk.last().Instruction.(bpf.JumpIf)
+	if !ok || test.SkipTrue == test.SkipFalse {
+		return test, nil, nil, false
+	}
+
+	trueBlk, falseBlk := blk.skipToBlock(skip(test.SkipTrue)), blk.skipToBlock(skip(test.SkipFalse))
+
+	switch test.Cond {
+	case bpf.JumpEqual:
+		return test, trueBlk, falseBlk, true
+	case bpf.JumpNotEqual:
+		return test, falseBlk, trueBlk, true
+	default:
+		return test, nil, nil, false
+	}
+}
+
+// isSwitchInnerBlock checks if blk is an inner block of any of the switch chains.
+func isSwitchInnerBlock(chains map[*block]*switchChain, blk *block) bool {
+	for _, chain := range chains {
+		for _, inner := range chain.inner {
+			if inner == blk {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,133 @@
+package cbpfc
+
+import (
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestSwitchChains(t *testing.T) {
+	blocks := mustSplitBlocks(t, 6, toInstructions([]bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 2},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 22, SkipTrue: 3},
+		/* 2 */ bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 80, SkipFalse: 1},
+		/* 3 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 443, SkipFalse: 2},
+		/* 4 */ bpf.RetConstant{Val: 1},
+		/* 5 */ bpf.RetConstant{Val: 2},
+		/* 6 */ bpf.RetConstant{Val: 0},
+	}))
+
+	chains := switchChains(blocks)
+	if len(chains) != 1 {
+		t.Fatalf("expected 1 chain, got %d", len(chains))
+	}
+
+	chain := chains[blocks[0]]
+	if chain == nil {
+		t.Fatal("first block not head of chain")
+	}
+
+	expected := []struct {
+		val    uint32
+		target *block
+	}{
+		{22, blocks[4]},
+		{80, blocks[3]},
+		{443, blocks[3]},
+	}
+
+	if len(chain.cases) != len(expected) {
+		t.Fatalf("expected %d cases, got %d", len(expected), len(chain.cases))
+	}
+
+	for i, c := range chain.cases {
+		if c.val != expected[i].val || c.target != expected[i].target {
+			t.Fatalf("case %d: expected %d to %s, got %d to %s", i, expected[i].val, expected[i].target.Label(), c.val, c.target.Label())
+		}
+	}
+
+	if len(chain.inner) != 2 || chain.inner[0] != blocks[1] || chain.inner[1] != blocks[2] {
+		t.Fatal("wrong inner blocks")
+	}
+
+	if chain.defaultBlk != blocks[5] {
+		t.Fatalf("expected default %s, got %s", blocks[5].Label(), chain.defaultBlk.Label())
+	}
+}
+
+func TestSwitchChainsNotChain(t *testing.T) {
+	check := func(t *testing.T, filter []bpf.Instruction) {
+		t.Helper()
+
+		blocks, err := splitBlocks(toInstructions(filter))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if chains := switchChains(blocks); len(chains) != 0 {
+			t.Fatalf("unexpected chains %v", chains)
+		}
+	}
+
+	// Too short
+	check(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipTrue: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 443, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	})
+
+	// Not equality
+	check(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipTrue: 2},
+		bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 443, SkipTrue: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 22, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	})
+
+	// Not A, the second test loads
+	check(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipTrue: 3},
+		bpf.LoadAbsolute{Size: 2, Off: 0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 443, SkipTrue: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 22, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	})
+
+	// Same value tested twice
+	check(t, []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 2, Off: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipTrue: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipTrue: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 22, SkipFalse: 1},
+		bpf.RetConstant{Val: 1},
+		bpf.RetConstant{Val: 0},
+	})
+}
+
+// The inner blocks of a chain can't be reached from other blocks
+func TestSwitchChainsInnerTarget(t *testing.T) {
+	blocks, err := splitBlocks(toInstructions([]bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 2},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipTrue: 1},
+		/* 2 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 443, SkipTrue: 2},
+		/* 3 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 22, SkipTrue: 1},
+		/* 4 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 53, SkipFalse: 1},
+		/* 5 */ bpf.RetConstant{Val: 1},
+		/* 6 */ bpf.RetConstant{Val: 0},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Instruction 3 is reached from 1 and 2, splitting the chain in two that are too short
+	chains := switchChains(blocks)
+	if len(chains) != 0 {
+		t.Fatalf("unexpected chains %v", chains)
+	}
+}
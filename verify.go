@@ -0,0 +1,94 @@
+package cbpfc
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// guardState is the length the packet is known to be at least, absolutely and relative to X,
+// and the length the metadata buffer is known to be at least.
+type guardState struct {
+	absolute, indirect, metadata uint32
+}
+
+// verifyGuards checks every packet load of the blocks is covered by a packet guard,
+// on every path to it, independently of how the guards were added.
+// The blocks must be topologically sorted.
+func verifyGuards(blocks []*block) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	// Least state of the predecessors of each block
+	entry := map[*block]guardState{
+		blocks[0]: {},
+	}
+
+	for _, block := range blocks {
+		state, ok := entry[block]
+		if !ok {
+			return errors.Errorf("block %d has no predecessor", block.id)
+		}
+
+		for _, insn := range block.insns {
+			switch i := insn.Instruction.(type) {
+			case packetGuardAbsolute:
+				if i.Len > state.absolute {
+					state.absolute = i.Len
+				}
+			case packetGuardIndirect:
+				if i.Len > state.indirect {
+					state.indirect = i.Len
+				}
+			case metadataGuard:
+				if i.Len > state.metadata {
+					state.metadata = i.Len
+				}
+
+			case bpf.LoadAbsolute:
+				if i.Off+uint32(i.Size) > state.absolute {
+					return errors.Errorf("instruction %v not guarded, packet only %d bytes", insn, state.absolute)
+				}
+			case bpf.LoadMemShift:
+				if i.Off+1 > state.absolute {
+					return errors.Errorf("instruction %v not guarded, packet only %d bytes", insn, state.absolute)
+				}
+			case bpf.LoadIndirect:
+				if i.Off+uint32(i.Size) > state.indirect {
+					return errors.Errorf("instruction %v not guarded, packet only x + %d bytes", insn, state.indirect)
+				}
+			case loadMetadata:
+				if i.Off+uint32(i.Size) > state.metadata {
+					return errors.Errorf("instruction %v not guarded, metadata only %d bytes", insn, state.metadata)
+				}
+			}
+
+			// Indirect guards are relative to the value of X they checked
+			if memWrites(insn.Instruction).regs[bpf.RegX] {
+				state.indirect = 0
+			}
+		}
+
+		for _, target := range block.jumps {
+			least, ok := entry[target]
+			if !ok {
+				entry[target] = state
+				continue
+			}
+
+			if state.absolute < least.absolute {
+				least.absolute = state.absolute
+			}
+			if state.indirect < least.indirect {
+				least.indirect = state.indirect
+			}
+			if state.metadata < least.metadata {
+				least.metadata = state.metadata
+			}
+
+			entry[target] = least
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package cbpfc
+
+import (
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+var verifyFilter = []bpf.Instruction{
+	/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 12},
+	/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x800, SkipTrue: 0, SkipFalse: 4},
+	/* 2 */ bpf.LoadMemShift{Off: 14},
+	/* 3 */ bpf.LoadIndirect{Size: 2, Off: 16},
+	/* 4 */ bpf.TAX{},
+	/* 5 */ bpf.LoadIndirect{Size: 1, Off: 0},
+	/* 6 */ bpf.LoadAbsolute{Size: 4, Off: 20},
+	/* 7 */ bpf.RetA{},
+}
+
+func TestVerifyGuards(t *testing.T) {
+	for _, opts := range []CompileOpts{
+		{},
+		{SingleGuard: true},
+		{BlockOrder: FallthroughFirst},
+	} {
+		blocks, err := compile(verifyFilter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := verifyGuards(blocks); err != nil {
+			t.Fatalf("opts %+v: %v", opts, err)
+		}
+	}
+}
+
+func TestVerifyGuardsBroken(t *testing.T) {
+	check := func(t *testing.T, name string, breakGuards func(blocks []*block)) {
+		t.Helper()
+
+		blocks, err := compile(verifyFilter, CompileOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		breakGuards(blocks)
+
+		if err := verifyGuards(blocks); err == nil {
+			t.Fatalf("%s: broken guards not detected", name)
+		}
+	}
+
+	// Guard of the last block, covering the LoadAbsolute
+	check(t, "removed", func(blocks []*block) {
+		blocks[2].insns = blocks[2].insns[1:]
+	})
+
+	check(t, "too short", func(blocks []*block) {
+		blocks[2].insns[0] = instruction{Instruction: packetGuardAbsolute{Len: 23}}
+	})
+
+	// Indirect guard after the TAX, X changed
+	check(t, "clobbered", func(blocks []*block) {
+		for i, insn := range blocks[1].insns {
+			if _, ok := insn.Instruction.(bpf.TAX); ok {
+				blocks[1].insns = append(blocks[1].insns[:i+1], blocks[1].insns[i+2:]...)
+				return
+			}
+		}
+
+		t.Fatal("no TAX")
+	})
+
+	// Guard inserted after the load it covers, in the same block: an off by one insert() index
+	check(t, "absolute after load", func(blocks []*block) {
+		insns := blocks[0].insns
+		insns[0], insns[1] = insns[1], insns[0]
+	})
+
+	check(t, "indirect after load", func(blocks []*block) {
+		insns := blocks[1].insns
+		for i, insn := range insns {
+			if _, ok := insn.Instruction.(packetGuardIndirect); ok {
+				insns[i], insns[i+1] = insns[i+1], insns[i]
+				return
+			}
+		}
+
+		t.Fatal("no indirect guard")
+	})
+
+	// Guard only on one path to the last block
+	check(t, "one path", func(blocks []*block) {
+		blocks[1].insns[0] = instruction{Instruction: packetGuardAbsolute{Len: 24}}
+		blocks[2].insns = blocks[2].insns[1:]
+	})
+}
@@ -0,0 +1,294 @@
+package cbpfc
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// Jumps are always forwards, so every block that is jumped to ends a wasm block:
+// the blocks are nested, the first target being the innermost, and br to a block's label continues after it.
+const watModuleTemplate = `(module
+  (memory (export "memory") 1)
+
+  ;; Returns the filter's return value: 0 if packet doesn't match, non 0 if it does
+  (func ${{.Name}} (export "{{.Name}}") (param $ptr i32) (param $len i32) (result i32)
+    (local $a i32) (local $x i32)
+    {{- range $i, $m := .Scratch}} (local $m{{$m}} i32){{end}}
+{{range $i, $t := .Targets}}
+    (block ${{$t}}
+{{- end}}
+{{- range $i, $b := .Blocks}}
+{{if $b.IsTarget}}
+    ) ;; {{$b.Label}}
+{{- end}}
+{{- range $i, $s := $b.Statements}}
+    {{$s}}
+{{- end}}
+{{- end}}
+  )
+)
+`
+
+type watModule struct {
+	Name    string
+	Scratch []int
+
+	// Labels of the blocks that are jumped to, outermost first
+	Targets []string
+
+	Blocks []watBlock
+}
+
+// watBlock is a block of compiled WebAssembly text
+type watBlock struct {
+	*block
+	Statements []string
+}
+
+// alu operation to wasm instruction
+var aluToWAT = map[bpf.ALUOp]string{
+	bpf.ALUOpAdd:        "i32.add",
+	bpf.ALUOpSub:        "i32.sub",
+	bpf.ALUOpMul:        "i32.mul",
+	bpf.ALUOpDiv:        "i32.div_u",
+	bpf.ALUOpOr:         "i32.or",
+	bpf.ALUOpAnd:        "i32.and",
+	bpf.ALUOpShiftLeft:  "i32.shl",
+	bpf.ALUOpShiftRight: "i32.shr_u",
+	bpf.ALUOpMod:        "i32.rem_u",
+	bpf.ALUOpXor:        "i32.xor",
+}
+
+// jump test to a wasm fmt string for condition, with the value as argument
+var condToWATFmt = map[bpf.JumpTest]string{
+	bpf.JumpEqual:          "(i32.eq (local.get $a) %s)",
+	bpf.JumpNotEqual:       "(i32.ne (local.get $a) %s)",
+	bpf.JumpGreaterThan:    "(i32.gt_u (local.get $a) %s)",
+	bpf.JumpLessThan:       "(i32.lt_u (local.get $a) %s)",
+	bpf.JumpGreaterOrEqual: "(i32.ge_u (local.get $a) %s)",
+	bpf.JumpLessOrEqual:    "(i32.le_u (local.get $a) %s)",
+	bpf.JumpBitsSet:        "(i32.and (local.get $a) %s)",
+	bpf.JumpBitsNotSet:     "(i32.eqz (i32.and (local.get $a) %s))",
+}
+
+// WATOpts control how a cBPF filter is converted to WebAssembly text
+type WATOpts struct {
+	CompileOpts
+
+	// FunctionName is the name the generated function is exported as, Name if not set. Must match regex:
+	//     [A-Za-z_][0-9A-Za-z_]*
+	FunctionName string
+}
+
+// ToWAT compiles a cBPF filter to a WebAssembly text module, exporting a function with a signature of:
+//
+//	(func (export "opts.FunctionName") (param $ptr i32) (param $len i32) (result i32))
+//
+// The function returns the filter's return value:
+// 0 if the packet does not match the cBPF filter,
+// non 0 if the packet does match.
+//
+// The packet is read from len bytes of the module's exported "memory", starting at ptr.
+// Packet loads are guarded by length checks, so the filter never reads outside of the packet.
+func ToWAT(filter []bpf.Instruction, opts WATOpts) (string, error) {
+	name, err := opts.symbol(opts.FunctionName, "FunctionName")
+	if err != nil {
+		return "", err
+	}
+
+	// a, x and m[] are locals of the generated function, callers can't initialize them
+	if len(opts.InitializedRegs) != 0 || len(opts.InitializedScratch) != 0 {
+		return "", errors.New("InitializedRegs and InitializedScratch not supported")
+	}
+
+	// The generated function only has the packet
+	if opts.Metadata.Len != 0 {
+		return "", errors.New("Metadata not supported")
+	}
+
+	blocks, err := compile(filter, opts.CompileOpts)
+	if err != nil {
+		return "", err
+	}
+
+	module := watModule{
+		Name:   name,
+		Blocks: make([]watBlock, len(blocks)),
+	}
+
+	for n := range (memStatus{}).scratch {
+		module.Scratch = append(module.Scratch, n)
+	}
+
+	for i, block := range blocks {
+		module.Blocks[i], err = blockToWAT(block, nextBlock(blocks, i), opts)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Blocks are only known to be targets once every block has been compiled
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if blocks[i].IsTarget {
+			module.Targets = append(module.Targets, blocks[i].Label())
+		}
+	}
+
+	tmpl, err := template.New("cbpf_wat_module").Parse(watModuleTemplate)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to parse module template")
+	}
+
+	wat := strings.Builder{}
+
+	if err := tmpl.Execute(&wat, module); err != nil {
+		return "", errors.Wrapf(err, "unable to execute module template")
+	}
+
+	return wat.String(), nil
+}
+
+// blockToWAT compiles a block to WebAssembly text.
+// next is the block laid out after blk, nil if blk is the last block.
+func blockToWAT(blk *block, next *block, opts WATOpts) (watBlock, error) {
+	wBlk := watBlock{
+		block:      blk,
+		Statements: make([]string, len(blk.insns)),
+	}
+
+	for i, insn := range blk.insns {
+		stat, err := insnToWAT(insn, blk, next, opts)
+		if err != nil {
+			return wBlk, errors.Wrapf(err, "unable to compile %v", insn)
+		}
+
+		if comment, ok := opts.comment(insn); ok {
+			stat += " ;; " + comment
+		}
+
+		wBlk.Statements[i] = stat
+	}
+
+	// Block isn't laid out before the block it falls through to
+	if ft := blk.fallthroughBlock(); ft != nil && ft != next {
+		wBlk.Statements = append(wBlk.Statements, fmt.Sprintf("(br $%s)", ft.jumpTarget().Label()))
+	}
+
+	return wBlk, nil
+}
+
+// insnToWAT compiles an instruction to a single WebAssembly text statement.
+func insnToWAT(insn instruction, blk *block, next *block, opts WATOpts) (string, error) {
+	switch i := insn.Instruction.(type) {
+
+	case bpf.LoadConstant:
+		return stat("(local.set $%s %s)", regToCSym[i.Dst], watConst(i.Val))
+	case bpf.LoadScratch:
+		return stat("(local.set $%s (local.get $m%d))", regToCSym[i.Dst], i.N)
+	case bpf.LoadAbsolute:
+		return packetLoadToWAT(opts, i.Size, "(local.get $ptr)", i.Off)
+	case bpf.LoadIndirect:
+		return packetLoadToWAT(opts, i.Size, "(i32.add (local.get $ptr) (local.get $x))", i.Off)
+	case bpf.LoadExtension:
+		return stat("(local.set $a (local.get $len))")
+	case bpf.LoadMemShift:
+		return stat("(local.set $x (i32.shl (i32.and (i32.load8_u offset=%d (local.get $ptr)) (i32.const 0xf)) (i32.const 2)))", i.Off)
+
+	case bpf.StoreScratch:
+		return stat("(local.set $m%d (local.get $%s))", i.N, regToCSym[i.Src])
+
+	// wasm shifts are modulo 32, cBPF shifts of 32 or more are 0
+	case bpf.ALUOpConstant:
+		if isShift(i.Op) && i.Val >= 32 {
+			return stat("(local.set $a (i32.const 0))")
+		}
+		return stat("(local.set $a (%s (local.get $a) %s))", aluToWAT[i.Op], watConst(i.Val))
+	case bpf.ALUOpX:
+		if isShift(i.Op) {
+			return stat("(local.set $a (select (i32.const 0) (%s (local.get $a) (local.get $x)) (i32.ge_u (local.get $x) (i32.const 32))))", aluToWAT[i.Op])
+		}
+		return stat("(local.set $a (%s (local.get $a) (local.get $x)))", aluToWAT[i.Op])
+	case bpf.NegateA:
+		return stat("(local.set $a (i32.sub (i32.const 0) (local.get $a)))")
+
+	case bpf.Jump:
+		return stat("(br $%s)", blk.skipToBlock(skip(i.Skip)).jumpTarget().Label())
+	case bpf.JumpIf:
+		return condToWAT(skip(i.SkipTrue), skip(i.SkipFalse), blk, next, fmt.Sprintf(condToWATFmt[i.Cond], watConst(i.Val)))
+	case bpf.JumpIfX:
+		return condToWAT(skip(i.SkipTrue), skip(i.SkipFalse), blk, next, fmt.Sprintf(condToWATFmt[i.Cond], "(local.get $x)"))
+
+	case bpf.RetA:
+		return stat("(return (local.get $a))")
+	case bpf.RetConstant:
+		return stat("(return %s)", watConst(i.Val))
+
+	case bpf.TXA:
+		return stat("(local.set $a (local.get $x))")
+	case bpf.TAX:
+		return stat("(local.set $x (local.get $a))")
+
+	// i64 can't overflow
+	case packetGuardAbsolute:
+		return stat("(if (i64.lt_u (i64.extend_i32_u (local.get $len)) (i64.const %d)) (then (return %s)))", opts.guardLen(i.Len), watConst(opts.GuardFailureValue))
+	case packetGuardIndirect:
+		return stat("(if (i64.lt_u (i64.extend_i32_u (local.get $len)) (i64.add (i64.extend_i32_u (local.get $x)) (i64.const %d))) (then (return %s)))", opts.guardLen(i.Len), watConst(opts.GuardFailureValue))
+
+	case initializeRegister:
+		return stat("(local.set $%s (i32.const 0))", regToCSym[i.Reg])
+	case initializeScratch:
+		return stat("(local.set $m%d (i32.const 0))", i.N)
+
+	case checkXNotZero:
+		return stat("(if (i32.eqz (local.get $x)) (then (return (i32.const 0))))")
+
+	default:
+		return "", errors.Errorf("unsupported instruction %v", insn)
+	}
+}
+
+// watConst is an i32 constant
+func watConst(val uint32) string {
+	return fmt.Sprintf("(i32.const %d)", int32(val))
+}
+
+// packetLoadToWAT loads size bytes from addr + offset into a.
+// wasm is little endian, loads are byte swapped to network order.
+func packetLoadToWAT(opts WATOpts, size int, addr string, offset uint32) (string, error) {
+	switch size {
+	case 1:
+		return stat("(local.set $a (i32.load8_u offset=%d %s))", offset, addr)
+	case 2:
+		load := fmt.Sprintf("(local.set $a (i32.load16_u offset=%d align=1 %s))", offset, addr)
+		if opts.HostByteOrder {
+			return load, nil
+		}
+
+		return stat("%s (local.set $a (i32.and (i32.or (i32.shl (local.get $a) (i32.const 8)) (i32.shr_u (local.get $a) (i32.const 8))) (i32.const 0xffff)))", load)
+	case 4:
+		load := fmt.Sprintf("(local.set $a (i32.load offset=%d align=1 %s))", offset, addr)
+		if opts.HostByteOrder {
+			return load, nil
+		}
+
+		return stat("%s (local.set $a (i32.or (i32.and (i32.rotl (local.get $a) (i32.const 8)) (i32.const 0x00ff00ff)) (i32.and (i32.rotr (local.get $a) (i32.const 8)) (i32.const 0xff00ff00))))", load)
+	}
+
+	return "", errors.Errorf("unsupported load size %d", size)
+}
+
+func condToWAT(skipTrue, skipFalse skip, blk *block, next *block, cond string) (string, error) {
+	trueBlk := blk.skipToBlock(skipTrue).jumpTarget()
+	falseBlk := blk.skipToBlock(skipFalse)
+
+	// false falls through to the next block
+	if falseBlk == next {
+		return stat("(br_if $%s %s)", trueBlk.Label(), cond)
+	}
+
+	return stat("(br_if $%s %s) (br $%s)", trueBlk.Label(), cond, falseBlk.jumpTarget().Label())
+}
@@ -0,0 +1,221 @@
+package cbpfc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestWATFunctionName(t *testing.T) {
+	_, err := ToWAT([]bpf.Instruction{bpf.RetA{}}, WATOpts{FunctionName: "0foo"})
+	if err == nil {
+		t.Fatal("invalid function name accepted")
+	}
+
+	_, err = ToWAT([]bpf.Instruction{bpf.RetA{}}, WATOpts{FunctionName: "foo_bar2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWATGolden(t *testing.T) {
+	filter := []bpf.Instruction{
+		bpf.LoadAbsolute{Size: 1, Off: 0},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 1, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 1},
+	}
+
+	checkGolden(t, "wat", filter, WATOpts{FunctionName: "filter"})
+
+	checkWAT(t, filter, []byte{}, []byte{0}, []byte{1}, []byte{2, 1})
+}
+
+func TestWATLoads(t *testing.T) {
+	wat, err := ToWAT([]bpf.Instruction{
+		bpf.LoadMemShift{Off: 0},
+		bpf.LoadIndirect{Size: 2, Off: 1},
+		bpf.LoadAbsolute{Size: 4, Off: 2},
+		bpf.RetA{},
+	}, WATOpts{FunctionName: "filter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"(local.set $x (i32.shl (i32.and (i32.load8_u offset=0 (local.get $ptr)) (i32.const 0xf)) (i32.const 2)))",
+		"(if (i64.lt_u (i64.extend_i32_u (local.get $len)) (i64.add (i64.extend_i32_u (local.get $x)) (i64.const 3))) (then (return (i32.const 0))))",
+		"(local.set $a (i32.load16_u offset=1 align=1 (i32.add (local.get $ptr) (local.get $x))))",
+		"(local.set $a (i32.load offset=2 align=1 (local.get $ptr)))",
+	} {
+		if !strings.Contains(wat, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, wat)
+		}
+	}
+}
+
+// checkWAT assembles a filter compiled to WebAssembly text with wat2wasm, runs it with node,
+// and checks it returns the same results as the x/net/bpf VM for each packet.
+func checkWAT(tb testing.TB, filter []bpf.Instruction, packets ...[]byte) {
+	tb.Helper()
+
+	wat2wasm, err := exec.LookPath("wat2wasm")
+	if err != nil {
+		tb.Skip("wat2wasm not available")
+	}
+
+	node, err := exec.LookPath("node")
+	if err != nil {
+		tb.Skip("node not available")
+	}
+
+	wat, err := ToWAT(filter, WATOpts{FunctionName: "filter"})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "cbpfc-wat")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "filter.wat")
+	if err := ioutil.WriteFile(src, []byte(wat), 0644); err != nil {
+		tb.Fatal(err)
+	}
+
+	wasm := filepath.Join(dir, "filter.wasm")
+	if out, err := exec.Command(wat2wasm, "-o", wasm, src).CombinedOutput(); err != nil {
+		tb.Fatalf("wat2wasm failed: %v\n%s\n%s", err, out, wat)
+	}
+
+	// []byte marshals to base64
+	pkts := make([][]int, len(packets))
+	for i, pkt := range packets {
+		pkts[i] = make([]int, len(pkt))
+		for j, b := range pkt {
+			pkts[i][j] = int(b)
+		}
+	}
+
+	pktsJSON, err := json.Marshal(pkts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	// Print the result of the filter for every packet
+	script := `
+		const wasm = require("fs").readFileSync(process.argv[1]);
+		WebAssembly.instantiate(wasm).then(({instance}) => {
+			const memory = new Uint8Array(instance.exports.memory.buffer);
+			for (const pkt of JSON.parse(process.argv[2])) {
+				memory.set(pkt, 0);
+				console.log(instance.exports.filter(0, pkt.length) >>> 0);
+			}
+		});
+	`
+
+	out, err := exec.Command(node, "-e", script, wasm, string(pktsJSON)).Output()
+	if err != nil {
+		tb.Fatalf("filter failed: %v\n%s", err, wat)
+	}
+
+	results := strings.Fields(string(out))
+	if len(results) != len(packets) {
+		tb.Fatalf("expected %d results, got %d", len(packets), len(results))
+	}
+
+	vm, err := bpf.NewVM(filter)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	for i, pkt := range packets {
+		expected, err := vm.Run(pkt)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		if results[i] != strconv.Itoa(int(uint32(expected))) {
+			tb.Fatalf("packet %x: expected %d, got %s\n%s", pkt, uint32(expected), results[i], wat)
+		}
+	}
+}
+
+func TestWATFilter(t *testing.T) {
+	checkWAT(t, []bpf.Instruction{
+		/* 0 */ bpf.LoadAbsolute{Size: 2, Off: 0},
+		/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipTrue: 0, SkipFalse: 8},
+		/* 2 */ bpf.LoadMemShift{Off: 2},
+		/* 3 */ bpf.LoadIndirect{Size: 4, Off: 2},
+		/* 4 */ bpf.JumpIf{Cond: bpf.JumpBitsNotSet, Val: 0x80000000, SkipTrue: 5, SkipFalse: 0},
+		/* 5 */ bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 16},
+		/* 6 */ bpf.ALUOpX{Op: bpf.ALUOpMod},
+		/* 7 */ bpf.StoreScratch{Src: bpf.RegA, N: 3},
+		/* 8 */ bpf.LoadScratch{Dst: bpf.RegX, N: 3},
+		/* 9 */ bpf.TXA{},
+		/* 10 */ bpf.RetA{},
+	},
+		[]byte{0x08, 0x00, 0x01},
+		[]byte{0x08, 0x00, 0x01, 0x00, 0x00, 0x00},
+		[]byte{0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x12, 0x34},
+		[]byte{0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0x12, 0x34, 0x56, 0x78},
+		[]byte{0x86, 0xDD, 0x01, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x12, 0x34},
+	)
+}
+
+func TestWATMultiVerdict(t *testing.T) {
+	packets := [][]byte{}
+	for _, test := range multiVerdictPackets {
+		packets = append(packets, test.pkt)
+	}
+
+	checkWAT(t, multiVerdictFilter, packets...)
+}
+
+func TestWATLoadLen(t *testing.T) {
+	checkWAT(t, lenFilter, lenPackets...)
+}
+
+func TestWATNarrowLoads(t *testing.T) {
+	checkWAT(t, narrowFilter, narrowPackets...)
+}
+
+func TestWATGuardFailureValue(t *testing.T) {
+	wat, err := ToWAT(cPortFilter, WATOpts{
+		CompileOpts:  CompileOpts{GuardFailureValue: math.MaxUint32},
+		FunctionName: "filter",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"(i64.const 14)) (then (return (i32.const -1))))",
+		"(i64.const 18))) (then (return (i32.const -1))))",
+	} {
+		if !strings.Contains(wat, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, wat)
+		}
+	}
+}
+
+func TestWATMetadata(t *testing.T) {
+	_, err := ToWAT(metadataFilter, WATOpts{CompileOpts: CompileOpts{Metadata: metadataRegion}, FunctionName: "filter"})
+	if err == nil {
+		t.Fatal("Metadata accepted")
+	}
+}
+
+func TestWATReuseportHash(t *testing.T) {
+	checkWAT(t, reuseportHashFilter, reuseportHashPackets...)
+}